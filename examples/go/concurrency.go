@@ -0,0 +1,228 @@
+// Concurrency helpers for Camoufox Connector.
+//
+// These integrate the connector with golang.org/x/sync, so bounded,
+// cancellable fan-out is the easy way to use it:
+//
+//   - AcquireN leases several browsers at once, all or nothing.
+//   - BrowserLimiter caps the browsers a process uses at the same time.
+//   - ScrapeAll loads URLs in parallel and stops at the first error.
+//
+// Playwright calls don't take a context, so cancellation closes the
+// browser connection, which makes the pending call return an error.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/playwright-community/playwright-go"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// ErrPoolExhausted is returned when every browser is already leased
+var ErrPoolExhausted = errors.New("no idle browser to lease")
+
+// Lease represents the /sessions API response
+type Lease struct {
+	ID       string `json:"id"`
+	Instance int    `json:"instance"`
+	Endpoint string `json:"endpoint"`
+}
+
+// LeaseOptions are the options accepted by POST /sessions, e.g. "proxy" or "holder"
+type LeaseOptions map[string]any
+
+// APIError is a non-2xx response of the connector's HTTP API
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("server error on %s %s (HTTP %d): %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+// apiRequest calls the connector's HTTP API and decodes a JSON response into out
+func apiRequest(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, apiURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return &APIError{Method: method, Path: path, StatusCode: resp.StatusCode, Body: string(data)}
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// AcquireLease leases a browser for exclusive use
+func AcquireLease(ctx context.Context, options LeaseOptions) (*Lease, error) {
+	if options == nil {
+		options = LeaseOptions{}
+	}
+	var lease Lease
+	if err := apiRequest(ctx, http.MethodPost, "/sessions", options, &lease); err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusServiceUnavailable {
+			return nil, ErrPoolExhausted
+		}
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// Release returns the leased browser to the pool
+func (l *Lease) Release(ctx context.Context) error {
+	return apiRequest(ctx, http.MethodDelete, "/sessions/"+l.ID, nil, nil)
+}
+
+// AcquireN leases n browsers concurrently. Either all n leases are returned,
+// or none: if any acquisition fails, the leases already taken are released
+// and the first error is returned.
+func AcquireN(ctx context.Context, n int, options LeaseOptions) ([]*Lease, error) {
+	leases := make([]*Lease, n)
+	// Not errgroup.WithContext: cancelling the others on the first failure
+	// could drop a lease the connector has already granted
+	var g errgroup.Group
+
+	for i := 0; i < n; i++ {
+		i := i
+		g.Go(func() error {
+			lease, err := AcquireLease(ctx, options)
+			if err != nil {
+				return err
+			}
+			// Each goroutine writes its own slot, so no lock is needed
+			leases[i] = lease
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		// Released with a fresh context, as ctx may be the one cancelled
+		for _, lease := range leases {
+			if lease != nil {
+				lease.Release(context.WithoutCancel(ctx))
+			}
+		}
+		return nil, err
+	}
+	return leases, nil
+}
+
+// BrowserLimiter bounds the number of browsers used at once. Share one
+// limiter between everything in a process that talks to the same connector.
+type BrowserLimiter struct {
+	pw  *playwright.Playwright
+	sem *semaphore.Weighted
+}
+
+// NewBrowserLimiter creates a limiter allowing at most n browsers at once
+func NewBrowserLimiter(pw *playwright.Playwright, n int64) *BrowserLimiter {
+	return &BrowserLimiter{pw: pw, sem: semaphore.NewWeighted(n)}
+}
+
+// WithBrowser waits for a free slot, connects to the next browser and runs
+// fn with it. The browser is closed when fn returns or ctx is cancelled.
+func (l *BrowserLimiter) WithBrowser(ctx context.Context, fn func(context.Context, playwright.Browser) error) error {
+	if err := l.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer l.sem.Release(1)
+
+	var endpoint EndpointResponse
+	if err := apiRequest(ctx, http.MethodGet, "/next", nil, &endpoint); err != nil {
+		return err
+	}
+
+	browser, err := l.pw.Firefox.Connect(endpoint.Endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer browser.Close()
+
+	// Closing the connection aborts whatever fn is waiting on
+	stop := context.AfterFunc(ctx, func() { browser.Close() })
+	defer stop()
+
+	if err := fn(ctx, browser); err != nil {
+		// Report the cancellation rather than the error it caused
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// ScrapeAll loads every URL, on as many browsers at once as the limiter
+// allows, and returns what scrape extracted from each page in the order of
+// urls. The first error cancels the remaining work and is returned.
+func ScrapeAll(
+	ctx context.Context,
+	limiter *BrowserLimiter,
+	urls []string,
+	scrape func(playwright.Page) (string, error),
+) ([]string, error) {
+	results := make([]string, len(urls))
+	g, gctx := errgroup.WithContext(ctx)
+
+	for i, url := range urls {
+		i, url := i, url
+		g.Go(func() error {
+			return limiter.WithBrowser(gctx, func(ctx context.Context, browser playwright.Browser) error {
+				page, err := browser.NewPage()
+				if err != nil {
+					return fmt.Errorf("failed to create page: %w", err)
+				}
+				if _, err := page.Goto(url); err != nil {
+					return fmt.Errorf("failed to load %s: %w", url, err)
+				}
+				content, err := scrape(page)
+				if err != nil {
+					return fmt.Errorf("failed to scrape %s: %w", url, err)
+				}
+				results[i] = content
+				return nil
+			})
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
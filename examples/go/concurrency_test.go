@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withServer points the helpers at a test server for the duration of a test
+func withServer(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	previous := apiURL
+	apiURL = server.URL
+	t.Cleanup(func() {
+		apiURL = previous
+		server.Close()
+	})
+}
+
+func TestAcquireLease(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantID  string
+		wantErr error
+		wantAPI int
+	}{
+		{name: "leased", status: http.StatusCreated, body: `{"id": "abc", "instance": 2, "endpoint": "ws://x"}`, wantID: "abc"},
+		{name: "pool exhausted", status: http.StatusServiceUnavailable, body: `{"error": "busy"}`, wantErr: ErrPoolExhausted},
+		{name: "lease limit", status: http.StatusTooManyRequests, body: `{"error": "limit"}`, wantAPI: http.StatusTooManyRequests},
+		{name: "invalid options", status: http.StatusBadRequest, body: `{"error": "bad"}`, wantAPI: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var options LeaseOptions
+			withServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/sessions" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				json.NewDecoder(r.Body).Decode(&options)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			lease, err := AcquireLease(context.Background(), LeaseOptions{"holder": "test"})
+
+			if options["holder"] != "test" {
+				t.Errorf("options sent = %v, want holder test", options)
+			}
+			var apiErr *APIError
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantAPI != 0:
+				if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.wantAPI {
+					t.Fatalf("err = %v, want APIError with status %d", err, tt.wantAPI)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if lease.ID != tt.wantID {
+					t.Errorf("lease ID = %q, want %q", lease.ID, tt.wantID)
+				}
+			}
+		})
+	}
+}
+
+func TestAcquireN(t *testing.T) {
+	tests := []struct {
+		name      string
+		n         int
+		available int
+		wantErr   error
+	}{
+		{name: "all leased", n: 3, available: 3},
+		{name: "none left over on failure", n: 3, available: 2, wantErr: ErrPoolExhausted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			leased := map[string]bool{}
+			next := 0
+			withServer(t, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if r.Method == http.MethodDelete {
+					delete(leased, r.URL.Path[len("/sessions/"):])
+					return
+				}
+				if len(leased) >= tt.available {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				next++
+				id := string(rune('a' + next))
+				leased[id] = true
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(Lease{ID: id, Instance: next})
+			})
+
+			leases, err := AcquireN(context.Background(), tt.n, nil)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				if leases != nil || len(leased) != 0 {
+					t.Errorf("got %d lease(s), %d still held; want all released", len(leases), len(leased))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(leases) != tt.n || len(leased) != tt.n {
+				t.Errorf("got %d lease(s), %d held; want %d", len(leases), len(leased), tt.n)
+			}
+		})
+	}
+}
+
+func TestBrowserLimiterBoundsConcurrency(t *testing.T) {
+	tests := []struct {
+		limit   int64
+		callers int
+	}{
+		{limit: 1, callers: 4},
+		{limit: 2, callers: 8},
+		{limit: 3, callers: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var inFlight, peak atomic.Int64
+			// /next is called while a slot is held; failing it ends WithBrowser before connecting
+			withServer(t, func(w http.ResponseWriter, r *http.Request) {
+				current := inFlight.Add(1)
+				defer inFlight.Add(-1)
+				for {
+					seen := peak.Load()
+					if current <= seen || peak.CompareAndSwap(seen, current) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			})
+
+			limiter := NewBrowserLimiter(nil, tt.limit)
+			var wg sync.WaitGroup
+			for i := 0; i < tt.callers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					limiter.WithBrowser(context.Background(), nil)
+				}()
+			}
+			wg.Wait()
+
+			if got := peak.Load(); got < 1 || got > tt.limit {
+				t.Errorf("peak concurrency = %d, want 1..%d", got, tt.limit)
+			}
+		})
+	}
+}
+
+func TestBrowserLimiterCancelledWait(t *testing.T) {
+	limiter := NewBrowserLimiter(nil, 1)
+	limiter.sem.Acquire(context.Background(), 1)
+	defer limiter.sem.Release(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.WithBrowser(ctx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -12,6 +12,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -103,7 +104,7 @@ func checkHealth() (bool, error) {
 
 // basicExample demonstrates basic connection and navigation
 func basicExample(pw *playwright.Playwright) error {
-	fmt.Println("\n=== Basic Example ===\n")
+	fmt.Print("\n=== Basic Example ===\n\n")
 
 	// Get a browser endpoint using round-robin
 	endpoint, err := getNextEndpoint()
@@ -152,7 +153,7 @@ func basicExample(pw *playwright.Playwright) error {
 
 // poolExample demonstrates distributing work across multiple browsers
 func poolExample(pw *playwright.Playwright) error {
-	fmt.Println("\n=== Pool Example ===\n")
+	fmt.Print("\n=== Pool Example ===\n\n")
 
 	urls := []string{
 		"https://httpbin.org/ip",
@@ -233,6 +234,48 @@ func poolExample(pw *playwright.Playwright) error {
 	return nil
 }
 
+// boundedExample demonstrates bounded parallel scraping with first-error cancellation
+func boundedExample(pw *playwright.Playwright) error {
+	fmt.Print("\n=== Bounded Example ===\n\n")
+
+	urls := []string{
+		"https://httpbin.org/ip",
+		"https://httpbin.org/user-agent",
+		"https://httpbin.org/headers",
+		"https://httpbin.org/get",
+		"https://httpbin.org/cookies",
+	}
+
+	// At most 2 browsers at once; the first failure cancels the rest
+	limiter := NewBrowserLimiter(pw, 2)
+	results, err := ScrapeAll(context.Background(), limiter, urls, func(page playwright.Page) (string, error) {
+		return page.TextContent("body")
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Results:")
+	for i, content := range results {
+		if len(content) > 100 {
+			content = content[:100] + "..."
+		}
+		fmt.Printf("  %s: %s\n", urls[i], content)
+	}
+
+	// Lease two browsers for exclusive use, or none if that's not possible
+	leases, err := AcquireN(context.Background(), 2, LeaseOptions{"holder": "go-example"})
+	if err != nil {
+		return err
+	}
+	for _, lease := range leases {
+		fmt.Printf("Leased browser %d at %s\n", lease.Instance, lease.Endpoint)
+		lease.Release(context.Background())
+	}
+
+	return nil
+}
+
 func main() {
 	// Check if server is healthy
 	healthy, err := checkHealth()
@@ -267,5 +310,9 @@ func main() {
 		log.Printf("Pool example error: %v", err)
 	}
 
-	fmt.Println("\n✓ All examples completed!\n")
+	if err := boundedExample(pw); err != nil {
+		log.Printf("Bounded example error: %v", err)
+	}
+
+	fmt.Print("\n✓ All examples completed!\n\n")
 }
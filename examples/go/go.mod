@@ -2,4 +2,14 @@ module camoufox-connector-example
 
 go 1.21
 
-require github.com/playwright-community/playwright-go v0.4201.1
+require (
+	github.com/playwright-community/playwright-go v0.4201.1
+	golang.org/x/sync v0.7.0
+)
+
+require (
+	github.com/deckarep/golang-set/v2 v2.6.0 // indirect
+	github.com/go-jose/go-jose/v3 v3.0.1 // indirect
+	github.com/go-stack/stack v1.8.1 // indirect
+	golang.org/x/exp v0.0.0-20240103183307-be819d1f06fc // indirect
+)
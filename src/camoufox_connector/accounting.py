@@ -0,0 +1,89 @@
+"""
+Per-lease accounting for Camoufox Connector.
+
+While a lease is active, the relay counts the pages its clients open, the
+main-frame navigations and the protocol traffic between the clients and the
+browser. When the lease is released, these are summed up with its duration
+and the artifacts it produced. The summary is returned by
+``DELETE /sessions/{id}`` and carried by the ``lease-released`` event, so
+clients can log what each task consumed without further queries.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING
+
+if TYPE_CHECKING:
+    from .artifacts import ArtifactStore
+    from .relay import Relay, RelayConnection
+    from .sessions import Session
+
+logger = logging.getLogger(__name__)
+
+
+@dataclass
+class LeaseCounters:
+    """What the relayed connections of one lease did."""
+
+    connections: dict[int, RelayConnection] = field(default_factory=dict)
+    pages: int = 0
+    navigations: int = 0
+
+
+@dataclass
+class LeaseAccounting:
+    """Counts per-lease activity and summarizes it on release."""
+
+    relay: Relay
+    store: ArtifactStore
+    counters: dict[str, LeaseCounters] = field(default_factory=dict)
+
+    def __post_init__(self) -> None:
+        self.relay.event_filters.append(self._on_event)
+
+    def _on_event(self, connection: RelayConnection, message: dict) -> bool:
+        """Count pages and navigations; never consumes the event."""
+        if connection.session is None:
+            return False
+        counters = self.counters.setdefault(connection.session.id, LeaseCounters())
+        # Kept until release, as the traffic counts live on the connection
+        counters.connections.setdefault(id(connection), connection)
+
+        method = message.get("method")
+        if method == "page" and message.get("guid") in connection.contexts:
+            counters.pages += 1
+        elif method == "navigated":
+            params = message.get("params") or {}
+            frame = connection.initializer(message.get("guid")) or {}
+            if params.get("url") and not params.get("error") and not frame.get("parentFrame"):
+                counters.navigations += 1
+        return False
+
+    def _artifacts(self, session_id: str) -> dict:
+        """Count and size a session's artifacts per kind."""
+        directory = self.store.root / session_id if self.store.root is not None else None
+        if directory is None or not directory.is_dir():
+            return {}
+        artifacts = {}
+        for kind in sorted(p for p in directory.iterdir() if p.is_dir()):
+            files = [p for p in kind.rglob("*") if p.is_file()]
+            if files:
+                artifacts[kind.name] = {"count": len(files), "bytes": sum(p.stat().st_size for p in files)}
+        return artifacts
+
+    async def release_session(self, session: Session) -> None:
+        """Summarize a lease as it is released."""
+        counters = self.counters.pop(session.id, LeaseCounters())
+        connections = list(counters.connections.values())
+        session.summary = {
+            "duration": round(session.duration, 2),
+            "connections": len(connections),
+            "pages": counters.pages,
+            "navigations": counters.navigations,
+            "bytes_sent": sum(c.bytes_from_client for c in connections),
+            "bytes_received": sum(c.bytes_from_browser for c in connections),
+            "artifacts": await asyncio.to_thread(self._artifacts, session.id),
+        }
@@ -0,0 +1,83 @@
+"""
+Admin API for Camoufox Connector.
+
+Lets operators re-apply the configuration file without restarting the
+connector, the HTTP counterpart of sending the process SIGHUP, and resize
+the pool on the fly.
+"""
+
+from __future__ import annotations
+
+import logging
+from typing import Awaitable, Callable
+
+from pydantic import BaseModel, ConfigDict, Field, ValidationError
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+logger = logging.getLogger(__name__)
+
+
+class ScaleRequest(BaseModel):
+    """A new size for the pool."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    pool_size: int = Field(ge=1, le=20, description="Number of browser instances")
+
+
+def create_admin_routes(
+    reload: Callable[[], Awaitable[list[str]]],
+    scale: Callable[[int], Awaitable[int]],
+) -> list[Route]:
+    """
+    Create admin routes.
+
+    Args:
+        reload: Re-applies the configuration, returning the changed settings
+        scale: Resizes the pool, returning its previous size
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def reload_config(request: Request) -> Response:
+        """
+        Reload the configuration file.
+
+        POST /admin/reload
+        """
+        try:
+            changed = await reload()
+        except Exception as e:
+            logger.error(f"Configuration reload failed: {e}")
+            return JSONResponse({"error": f"Configuration reload failed: {e}"}, status_code=400)
+
+        return JSONResponse({"status": "reloaded", "changed": changed})
+
+    async def scale_pool(request: Request) -> Response:
+        """
+        Grow or shrink the pool; leased browsers are removed once released.
+
+        POST /admin/scale
+        """
+        try:
+            body = ScaleRequest.model_validate_json(await request.body())
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid scale request", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+
+        try:
+            previous = await scale(body.pool_size)
+        except ValueError as e:
+            return JSONResponse({"error": str(e)}, status_code=400)
+
+        return JSONResponse({"status": "scaled", "previous": previous, "pool_size": body.pool_size})
+
+    return [
+        Route("/admin/reload", reload_config, methods=["POST"]),
+        Route("/admin/scale", scale_pool, methods=["POST"]),
+    ]
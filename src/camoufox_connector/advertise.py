@@ -0,0 +1,65 @@
+"""
+Advertised browser addresses for Camoufox Connector.
+
+Without the relay, clients connect straight to the browsers' WebSocket
+endpoints, which carry the address Camoufox was launched on: ``localhost``
+or an IP internal to a Docker network, unreachable from the client. With
+``advertise_host`` and ``advertise_port`` (``--advertise-host``,
+``--advertise-port``), the endpoints handed out by ``/next``,
+``/endpoints``, the CDP routes and leases carry the address clients reach
+the browsers at instead; browser N is advertised at ``advertise_port + N``,
+matching a published port range such as ``-p 19222-19231:9222-9231``.
+Clients on different networks, e.g. other containers and the host itself,
+can be given different addresses with ``advertise_networks``. Relayed
+endpoints already use the address the client reached the API at.
+"""
+
+from __future__ import annotations
+
+from typing import TYPE_CHECKING, Optional
+from urllib.parse import urlsplit, urlunsplit
+
+from starlette.requests import HTTPConnection
+
+from .netpolicy import address_allowed
+
+if TYPE_CHECKING:
+    from .config import Settings
+
+
+def advertised_address(settings: Settings, client: Optional[str]) -> tuple[Optional[str], Optional[int]]:
+    """Host and first port advertised to a client address; None keeps the launched one."""
+    for mapping in settings.advertise_networks:
+        if address_allowed(client, [mapping.network]):
+            return (
+                mapping.host or settings.advertise_host,
+                mapping.port if mapping.port is not None else settings.advertise_port,
+            )
+    return settings.advertise_host, settings.advertise_port
+
+
+def advertise_endpoint(settings: Settings, endpoint: Optional[str], client: Optional[str] = None) -> Optional[str]:
+    """Rewrite a browser's WebSocket endpoint to the address a client reaches it at."""
+    if not endpoint:
+        return endpoint
+    host, first_port = advertised_address(settings, client)
+    if host is None and first_port is None:
+        return endpoint
+
+    parts = urlsplit(endpoint)
+    port = parts.port
+    if first_port is not None and port is not None:
+        # Browsers keep their offset from the first WebSocket port
+        port = first_port + port - settings.ws_port_start
+    if host is None:
+        host = parts.hostname or "localhost"
+    if ":" in host and not host.startswith("["):
+        host = f"[{host}]"
+    netloc = f"{host}:{port}" if port is not None else host
+    return urlunsplit((parts.scheme, netloc, parts.path, parts.query, parts.fragment))
+
+
+def client_endpoint(request: HTTPConnection, settings: Settings, endpoint: Optional[str]) -> Optional[str]:
+    """Rewrite a browser's WebSocket endpoint for the client making a request."""
+    client = request.client.host if request.client else None
+    return advertise_endpoint(settings, endpoint, client)
@@ -0,0 +1,399 @@
+"""
+Session artifact storage for Camoufox Connector.
+
+Files produced for a lease (HAR captures, ...) are stored per session under
+the artifacts directory, so they can still be fetched after the lease has
+been released. Artifacts of released sessions are deleted once they are
+older than the configured TTL. With a storage driver, they are also stored
+by it as their lease is released, and restored from it when asked for after
+the local copies were deleted; each kind of artifact may have a driver of
+its own.
+
+``GET /sessions/{id}/artifacts`` lists a session's files with signed URLs
+that download them without an API key until they expire: the storage
+driver's own (S3 presigned URLs) for files it stores, else ``/artifacts/...``
+URLs on the connector carrying an HMAC signature.
+
+Each session directory records the API key of the lease that produced it,
+so only that key, or an admin key, may read or list its artifacts.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import hashlib
+import hmac
+import logging
+import re
+import secrets
+import shutil
+import time
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import TYPE_CHECKING, Optional
+from urllib.parse import quote, urlencode
+
+from starlette.requests import HTTPConnection, Request
+from starlette.responses import FileResponse, JSONResponse, Response
+from starlette.routing import Route
+
+from .auth import may_access
+from .janitor import scratch_directory
+from .proxyheaders import public_url
+from .storage import StorageDriver, download_directory, upload_directory
+
+if TYPE_CHECKING:
+    from .sessions import Session, SessionManager
+
+logger = logging.getLogger(__name__)
+
+# How often expired artifacts are looked for
+CLEANUP_INTERVAL = 60.0
+
+SAFE_NAME = re.compile(r"^[A-Za-z0-9_-]+$")
+
+# File in a session's directory naming the API key that owns its artifacts
+OWNER_FILE = ".owner"
+
+# Signs artifact URLs when no artifact_url_secret is configured; they stop working on restart
+URL_KEY = secrets.token_bytes(32)
+
+# Seconds signed artifact URLs work by default, and at most
+URL_EXPIRES = 3600
+MAX_URL_EXPIRES = 7 * 24 * 3600
+
+
+@dataclass
+class ArtifactStore:
+    """Per-session artifact directories with TTL-based cleanup."""
+
+    sessions: SessionManager
+    root: Optional[Path] = None
+    driver: Optional[StorageDriver] = None
+    # Drivers of kinds of artifacts stored elsewhere than the default; None keeps a kind local
+    kind_drivers: dict[str, Optional[StorageDriver]] = field(default_factory=dict)
+    _cleanup_task: Optional[asyncio.Task] = None
+
+    def __post_init__(self) -> None:
+        configured = self.sessions.pool.settings.artifacts_dir
+        if self.root is None:
+            self.root = Path(configured) if configured else scratch_directory("artifacts")
+        self.root.mkdir(parents=True, exist_ok=True)
+
+    def session_directory(self, session_id: str) -> Optional[Path]:
+        """
+        Get the directory holding all artifacts of a session.
+
+        Returns:
+            The directory, or None if the session ID is not a valid name.
+        """
+        if not SAFE_NAME.match(session_id):
+            return None
+        return self.root / session_id
+
+    def directory(self, session_id: str, kind: str, create: bool = False) -> Optional[Path]:
+        """
+        Get the directory holding one kind of artifact for a session.
+
+        Returns:
+            The directory, or None if the session ID is not a valid name.
+        """
+        session_dir = self.session_directory(session_id)
+        if session_dir is None or not SAFE_NAME.match(kind):
+            return None
+        path = session_dir / kind
+        if create:
+            path.mkdir(parents=True, exist_ok=True)
+            session = self.sessions.get(session_id)
+            if session is not None:
+                self._claim(session_dir, session.tenant)
+        return path
+
+    @staticmethod
+    def _claim(session_dir: Path, tenant: Optional[str]) -> None:
+        """Record the API key owning a session's artifacts, once."""
+        owner = session_dir / OWNER_FILE
+        if not owner.exists():
+            owner.write_text(tenant or "")
+
+    def owner(self, session_id: str) -> Optional[str]:
+        """API key owning a session's artifacts; None without keys, or if unknown."""
+        session = self.sessions.get(session_id)
+        if session is not None:
+            return session.tenant
+        directory = self.session_directory(session_id)
+        if directory is None:
+            return None
+        try:
+            return (directory / OWNER_FILE).read_text() or None
+        except OSError:
+            return None
+
+    async def accessible(self, conn: HTTPConnection, session_id: str) -> bool:
+        """
+        Whether a client may read a session's artifacts: its own leases', or any with an admin key.
+
+        The artifacts are restored from the storage drivers first, as their owner is stored with them.
+        """
+        await self.restore(session_id)
+        return may_access(conn, self.owner(session_id))
+
+    def files(self, session_id: str, kind: str) -> list[Path]:
+        """List a session's artifacts of one kind, oldest first."""
+        path = self.directory(session_id, kind)
+        if path is None or not path.is_dir():
+            return []
+        return sorted((p for p in path.iterdir() if p.is_file()), key=lambda p: p.stat().st_mtime)
+
+    def new_path(self, session_id: str, kind: str, suffix: str) -> Path:
+        """Reserve a path for a new artifact."""
+        path = self.directory(session_id, kind, create=True)
+        if path is None:
+            raise ValueError(f"Invalid session ID: {session_id}")
+        return path / f"{time.time_ns()}{suffix}"
+
+    def enforce_limit(self, session_id: str, kind: str, max_mb: Optional[int]) -> int:
+        """Delete a session's oldest artifacts of one kind beyond a size limit; returns the number removed."""
+        if max_mb is None:
+            return 0
+        files = self.files(session_id, kind)
+        total = sum(p.stat().st_size for p in files)
+        removed = 0
+        while files and total > max_mb * 1024 * 1024:
+            oldest = files.pop(0)
+            total -= oldest.stat().st_size
+            oldest.unlink(missing_ok=True)
+            removed += 1
+        if removed:
+            logger.warning(f"Removed {removed} {kind} artifact(s) of session {session_id} over the {max_mb} MB limit")
+        return removed
+
+    @staticmethod
+    def storage_prefix(session_id: str) -> str:
+        """Storage driver key prefix of a session's artifacts."""
+        return f"artifacts/{session_id}"
+
+    def driver_for(self, kind: str) -> Optional[StorageDriver]:
+        """Storage driver of a kind of artifact; files directly in the session directory use the default."""
+        return self.kind_drivers[kind] if kind in self.kind_drivers else self.driver
+
+    @property
+    def drivers(self) -> list[StorageDriver]:
+        """Every storage driver artifacts are kept with."""
+        drivers: list[StorageDriver] = []
+        for driver in (self.driver, *self.kind_drivers.values()):
+            if driver is not None and not any(driver is known for known in drivers):
+                drivers.append(driver)
+        return drivers
+
+    def _upload(self, directory: Path, session_id: str, metadata: dict[str, str]) -> None:
+        """Store a session's files not stored yet, each kind with its driver."""
+        groups: dict[int, tuple[StorageDriver, set[str]]] = {}
+        for entry in directory.iterdir():
+            driver = self.driver_for(entry.name if entry.is_dir() else "")
+            if driver is not None:
+                groups.setdefault(id(driver), (driver, set()))[1].add(entry.name)
+        for driver, names in groups.values():
+            upload_directory(driver, directory, self.storage_prefix(session_id), metadata, only=names)
+
+    async def persist(self, session_id: str, tenant: Optional[str] = None) -> None:
+        """Store a session's artifacts not stored yet with the storage drivers."""
+        directory = self.session_directory(session_id)
+        if not self.drivers or directory is None or not directory.is_dir():
+            return
+        metadata = {"session": session_id, "tenant": tenant or ""}
+        try:
+            await asyncio.to_thread(self._upload, directory, session_id, metadata)
+        except Exception as e:
+            logger.warning(f"Failed to store artifacts of session {session_id}: {e}")
+
+    async def release_session(self, session: Session) -> None:
+        """Store a released lease's artifacts with the storage driver."""
+        directory = self.session_directory(session.id)
+        if directory is not None and directory.is_dir():
+            self._claim(directory, session.tenant)
+        await self.persist(session.id, session.tenant)
+
+    async def restore(self, session_id: str) -> None:
+        """Download a session's artifacts from the storage drivers if the local copies are gone."""
+        directory = self.session_directory(session_id)
+        if not self.drivers or directory is None or directory.is_dir():
+            return
+        try:
+            count = 0
+            for driver in self.drivers:
+                count += await asyncio.to_thread(download_directory, driver, self.storage_prefix(session_id), directory)
+        except Exception as e:
+            logger.warning(f"Failed to restore artifacts of session {session_id}: {e}")
+            return
+        if count:
+            logger.info(f"Restored {count} artifact(s) of session {session_id} from storage")
+
+    def url_signature(self, session_id: str, path: str, expires: int) -> str:
+        """Signature of a connector URL downloading an artifact until a Unix time."""
+        secret = self.sessions.pool.settings.artifact_url_secret
+        key = secret.encode() if secret else URL_KEY
+        return hmac.new(key, f"{session_id}/{path}:{expires}".encode(), hashlib.sha256).hexdigest()
+
+    def file(self, session_id: str, path: str) -> Optional[Path]:
+        """Resolve an artifact by its path in the session, refusing paths outside it."""
+        directory = self.session_directory(session_id)
+        if directory is None:
+            return None
+        target = (directory / path).resolve()
+        if not target.is_relative_to(directory.resolve()):
+            return None
+        return target if target.is_file() else None
+
+    async def signed_urls(self, session_id: str, expires: int) -> list[dict]:
+        """List a session's artifacts with URLs downloading them without a key for some seconds."""
+        await self.restore(session_id)
+        directory = self.session_directory(session_id)
+        if directory is None or not directory.is_dir():
+            return []
+        prefix = self.storage_prefix(session_id)
+        stored: dict[int, set[str]] = {}
+        for driver in self.drivers:
+            try:
+                stored[id(driver)] = {info.key for info in await asyncio.to_thread(driver.list, f"{prefix}/")}
+            except Exception as e:
+                logger.warning(f"Failed to list stored artifacts of session {session_id}: {e}")
+                stored[id(driver)] = set()
+        expires_at = int(time.time()) + expires
+        artifacts = []
+        for path in sorted(directory.rglob("*")):
+            if not path.is_file() or path == directory / OWNER_FILE:
+                continue
+            relative = path.relative_to(directory)
+            kind = relative.parts[0] if len(relative.parts) > 1 else ""
+            driver = self.driver_for(kind)
+            key = f"{prefix}/{relative.as_posix()}"
+            url = None
+            if driver is not None and key in stored.get(id(driver), ()):
+                url = await asyncio.to_thread(driver.signed_url, key, expires)
+            if url is None:
+                query = urlencode({
+                    "expires": expires_at,
+                    "signature": self.url_signature(session_id, relative.as_posix(), expires_at),
+                })
+                url = f"/artifacts/{session_id}/{quote(relative.as_posix())}?{query}"
+            artifacts.append({
+                "path": relative.as_posix(),
+                "kind": kind or None,
+                "size": path.stat().st_size,
+                "url": url,
+                "expires_at": expires_at,
+            })
+        return artifacts
+
+    def start(self) -> None:
+        """Start deleting expired artifacts."""
+        if self._cleanup_task is None:
+            self._cleanup_task = asyncio.create_task(self._cleanup_loop())
+
+    def stop(self) -> None:
+        """Stop the cleanup task."""
+        if self._cleanup_task is not None:
+            self._cleanup_task.cancel()
+            self._cleanup_task = None
+
+    async def _cleanup_loop(self) -> None:
+        """Periodically delete expired artifacts."""
+        while True:
+            await asyncio.sleep(CLEANUP_INTERVAL)
+            try:
+                await asyncio.to_thread(self.purge_expired)
+            except Exception as e:
+                logger.error(f"Artifact cleanup failed: {e}")
+
+    def purge_expired(self) -> int:
+        """Delete artifacts of released sessions older than the TTL; returns the number removed."""
+        settings = self.sessions.pool.settings
+        cutoff = time.time() - settings.artifact_ttl
+        removed = 0
+        for session_dir in self.root.iterdir():
+            if not session_dir.is_dir():
+                continue
+            self.enforce_limit(session_dir.name, "video", settings.max_video_mb)
+            if session_dir.name in self.sessions.sessions:
+                continue
+            newest = max(
+                (p.stat().st_mtime for p in session_dir.rglob("*")),
+                default=session_dir.stat().st_mtime,
+            )
+            if newest < cutoff:
+                if self.drivers:
+                    # Whatever was written after the release must be stored before it goes
+                    try:
+                        self._upload(session_dir, session_dir.name, {"session": session_dir.name})
+                    except Exception as e:
+                        logger.warning(f"Keeping artifacts of session {session_dir.name} until they are stored: {e}")
+                        continue
+                shutil.rmtree(session_dir, ignore_errors=True)
+                removed += 1
+        if removed:
+            logger.info(f"Removed artifacts of {removed} expired session(s)")
+        return removed
+
+
+def create_artifact_routes(store: ArtifactStore) -> list[Route]:
+    """
+    Create routes handing out and serving signed artifact URLs.
+
+    Args:
+        store: Artifact store of the sessions
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def list_artifacts(request: Request) -> Response:
+        """
+        A session's artifacts with signed download URLs; ``?expires=`` sets their lifetime in seconds.
+
+        GET /sessions/{id}/artifacts
+        """
+        session_id = request.path_params["session_id"]
+        try:
+            expires = int(request.query_params.get("expires", URL_EXPIRES))
+        except ValueError:
+            return JSONResponse({"error": "Invalid expires"}, status_code=400)
+        if not 1 <= expires <= MAX_URL_EXPIRES:
+            return JSONResponse({"error": f"expires must be between 1 and {MAX_URL_EXPIRES} seconds"}, status_code=400)
+        if not await store.accessible(request, session_id):
+            return JSONResponse({"error": "No artifacts for this session"}, status_code=404)
+        artifacts = await store.signed_urls(session_id, expires)
+        if not artifacts:
+            return JSONResponse({"error": "No artifacts for this session"}, status_code=404)
+        for artifact in artifacts:
+            # The connector's own links; storage drivers' are absolute already
+            if artifact["url"].startswith("/"):
+                artifact["url"] = public_url(request, artifact["url"])
+        return JSONResponse({"session_id": session_id, "artifacts": artifacts})
+
+    async def get_artifact(request: Request) -> Response:
+        """
+        Download an artifact with a signed URL, without an API key.
+
+        GET /artifacts/{id}/{path}
+        """
+        session_id = request.path_params["session_id"]
+        path = request.path_params["path"]
+        try:
+            expires = int(request.query_params.get("expires", ""))
+        except ValueError:
+            expires = 0
+        signature = request.query_params.get("signature", "")
+        expected = store.url_signature(session_id, path, expires)
+        if expires < time.time() or not hmac.compare_digest(signature.encode(), expected.encode()):
+            return JSONResponse({"error": "Invalid or expired signature"}, status_code=403)
+        await store.restore(session_id)
+        target = store.file(session_id, path)
+        if target is None:
+            return JSONResponse({"error": "Artifact not found"}, status_code=404)
+        return FileResponse(target, filename=target.name)
+
+    return [
+        Route("/sessions/{session_id}/artifacts", list_artifacts, methods=["GET"]),
+        Route("/artifacts/{session_id}/{path:path}", get_artifact, methods=["GET"]),
+    ]
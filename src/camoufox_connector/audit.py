@@ -0,0 +1,179 @@
+"""
+Per-lease audit log for Camoufox Connector.
+
+Records when each lease starts and ends and every page and navigation its
+relayed connections see, so it can be shown later which browser touched
+which domains. Entries are appended to a JSON Lines artifact per session and
+served, with a per-domain summary, from ``GET /sessions/{id}/log``. They are
+recorded as the relay sees them and written to disk in a background thread.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import json
+import logging
+import time
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Optional
+from urllib.parse import urlsplit
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+if TYPE_CHECKING:
+    from .artifacts import ArtifactStore
+    from .events import Event, EventBus
+    from .relay import Relay, RelayConnection
+
+logger = logging.getLogger(__name__)
+
+LOG_KIND = "log"
+LOG_FILE = "actions.jsonl"
+
+
+@dataclass
+class AuditLog:
+    """Writes the audit trail of every lease."""
+
+    relay: Relay
+    store: ArtifactStore
+    # Entries not written yet, by session
+    _pending: dict[str, list[dict]] = field(default_factory=dict)
+    _flushing: Optional[asyncio.Task] = None
+
+    def __post_init__(self) -> None:
+        self.relay.event_filters.append(self._on_event)
+
+    def attach(self, bus: EventBus) -> None:
+        """Record lease lifecycle events from a bus."""
+        bus.listeners.append(self._on_bus_event)
+
+    @property
+    def enabled(self) -> bool:
+        """Whether audit logging is switched on."""
+        return self.store.sessions.pool.settings.audit_log
+
+    def append(self, session_id: str, entry: dict) -> None:
+        """Append an entry to a session's log; it is written in the background."""
+        self._pending.setdefault(session_id, []).append({"time": time.time(), **entry})
+        if self._flushing is None or self._flushing.done():
+            self._flushing = asyncio.get_running_loop().create_task(self._flush())
+
+    async def _flush(self) -> None:
+        """Write the pending entries in a thread until none are left."""
+        while self._pending:
+            batch, self._pending = self._pending, {}
+            await asyncio.to_thread(self._write, batch)
+
+    def _write(self, batch: dict[str, list[dict]]) -> None:
+        """Append entries to the logs of their sessions."""
+        for session_id, entries in batch.items():
+            directory = self.store.directory(session_id, LOG_KIND, create=True)
+            if directory is None:
+                continue
+            try:
+                with open(directory / LOG_FILE, "a") as f:
+                    f.writelines(json.dumps(entry) + "\n" for entry in entries)
+            except OSError as e:
+                logger.warning(f"Failed to write audit log of session {session_id}: {e}")
+
+    def read(self, session_id: str) -> list[dict]:
+        """Read a session's log, oldest entry first, including entries not written yet."""
+        entries = []
+        directory = self.store.directory(session_id, LOG_KIND)
+        if directory is not None and (directory / LOG_FILE).is_file():
+            with open(directory / LOG_FILE) as f:
+                for line in f:
+                    try:
+                        entries.append(json.loads(line))
+                    except ValueError:
+                        continue
+        return entries + self._pending.get(session_id, [])
+
+    async def _on_bus_event(self, event: Event) -> None:
+        """Log leases being acquired and released."""
+        if not self.enabled or event.type not in ("lease-acquired", "lease-released", "lease-expired"):
+            return
+        session_id = event.data.get("session_id")
+        if session_id:
+            self.append(session_id, {"event": event.type, **event.data})
+
+    def _on_event(self, connection: RelayConnection, message: dict) -> bool:
+        """Log pages opening and closing and frames navigating; never consumes the event."""
+        session = connection.session
+        if session is None or not self.enabled:
+            return False
+
+        method = message.get("method")
+        guid = message.get("guid")
+        params = message.get("params") or {}
+
+        if method == "page" and guid in connection.contexts:
+            page_guid = (params.get("page") or {}).get("guid")
+            page = connection.initializer(page_guid) or {}
+            self.append(session.id, {
+                "event": "page-opened",
+                "page": page_guid,
+                "popup": bool(page.get("opener")),
+            })
+        elif method == "close" and (connection.objects.get(guid) or {}).get("type") == "Page":
+            self.append(session.id, {"event": "page-closed", "page": guid})
+        elif method == "navigated":
+            frame = connection.initializer(guid) or {}
+            url = params.get("url")
+            if url and not params.get("error"):
+                self.append(session.id, {
+                    "event": "navigation",
+                    "url": url,
+                    "main_frame": not frame.get("parentFrame"),
+                    "frame": guid,
+                })
+        return False
+
+
+def summarize_domains(entries: list[dict]) -> dict[str, int]:
+    """Count navigations per domain."""
+    domains: dict[str, int] = {}
+    for entry in entries:
+        if entry.get("event") == "navigation":
+            host = urlsplit(entry["url"]).hostname
+            if host:
+                domains[host] = domains.get(host, 0) + 1
+    return dict(sorted(domains.items()))
+
+
+def create_audit_routes(audit: AuditLog) -> list[Route]:
+    """
+    Create the route serving lease audit logs.
+
+    Args:
+        audit: Audit log to read from
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_log(request: Request) -> Response:
+        """
+        Get the audit log of a session.
+
+        GET /sessions/{id}/log
+        """
+        session_id = request.path_params["session_id"]
+        if not await audit.store.accessible(request, session_id):
+            return JSONResponse({"error": "No audit log for this session"}, status_code=404)
+        entries = audit.read(session_id)
+        if not entries:
+            return JSONResponse({"error": "No audit log for this session"}, status_code=404)
+        return JSONResponse({
+            "session_id": session_id,
+            "active": session_id in audit.store.sessions.sessions,
+            "domains": summarize_domains(entries),
+            "entries": entries,
+        })
+
+    return [
+        Route("/sessions/{session_id}/log", get_log, methods=["GET"]),
+    ]
@@ -0,0 +1,154 @@
+"""
+API key authentication for Camoufox Connector.
+
+When ``api_keys`` is configured, every HTTP request and relayed WebSocket
+must present one of the keys, either as ``Authorization: Bearer <key>``,
+an ``X-API-Key`` header or an ``api_key`` query parameter (for clients such
+as ``connect()`` calls that cannot set headers). Keys are read from the
+current settings on every request, so they can be rotated by reloading the
+configuration.
+
+Admin endpoints only accept the keys named in ``admin_keys``. Sessions and
+their artifacts belong to the key that acquired them: other keys get 404 for
+them, while admin keys reach every client's.
+"""
+
+from __future__ import annotations
+
+import hmac
+import json
+import re
+import secrets
+from typing import TYPE_CHECKING, Optional
+from urllib.parse import parse_qs
+
+if TYPE_CHECKING:
+    from starlette.requests import HTTPConnection
+
+    from .pool import BrowserPool
+
+# Paths reachable without a key, e.g. for load balancer health probes
+PUBLIC_PATHS = {"/health", "/livez", "/readyz"}
+
+# Paths of admin endpoints; everything else is data plane
+ADMIN_PATHS = re.compile(
+    r"^/(admin|restart|dashboard|maintenance|templates|patches|extensions|discovery|janitor|events)(/|$)"
+    r"|^/browsers/\d+(/drain|/cookies)?$"
+)
+
+# Paths anyone may read, but whose changes apply to every client
+ADMIN_WRITE_PATHS = re.compile(r"^/(devices|mirror)(/|$)|^/tasks/cache$")
+
+# Methods that only read
+READ_METHODS = {"GET", "HEAD"}
+
+# Paths whose routes check a URL signature instead of a key
+SIGNED_PREFIXES = ("/artifacts/",)
+
+# WebSocket close code sent to unauthenticated relay clients
+WS_UNAUTHORIZED = 4401
+
+# WebSocket close code sent to clients not allowed to use an endpoint, by key or address
+WS_FORBIDDEN = 4403
+
+# Per-process key used by the connector's own server-side tasks
+INTERNAL_KEY_NAME = "internal"
+INTERNAL_KEY = secrets.token_urlsafe(32)
+
+
+def extract_api_key(scope: dict) -> Optional[str]:
+    """Get the API key presented by a request, if any."""
+    headers = {k.decode("latin-1").lower(): v.decode("latin-1") for k, v in scope.get("headers", [])}
+
+    authorization = headers.get("authorization", "")
+    if authorization.lower().startswith("bearer "):
+        return authorization[7:].strip()
+
+    if "x-api-key" in headers:
+        return headers["x-api-key"].strip()
+
+    query = parse_qs(scope.get("query_string", b"").decode("latin-1"))
+    if query.get("api_key"):
+        return query["api_key"][0]
+    return None
+
+
+def match_api_key(api_keys: dict[str, str], key: Optional[str]) -> Optional[str]:
+    """Get the name of the client owning a key, or None if it is unknown."""
+    if not key:
+        return None
+    # compare_digest only takes ASCII strings, so keys are compared as bytes
+    presented = key.encode()
+    if hmac.compare_digest(INTERNAL_KEY.encode(), presented):
+        return INTERNAL_KEY_NAME
+    for name, expected in api_keys.items():
+        if hmac.compare_digest(expected.encode(), presented):
+            return name
+    return None
+
+
+def is_admin_path(path: str, method: str = "GET") -> bool:
+    """Whether a request to a path with a method is for an admin endpoint."""
+    if ADMIN_PATHS.match(path) is not None:
+        return True
+    return method not in READ_METHODS and ADMIN_WRITE_PATHS.match(path) is not None
+
+
+def may_access(conn: HTTPConnection, tenant: Optional[str]) -> bool:
+    """Whether a client may use what the key ``tenant`` owns: its own, or anything with an admin key."""
+    return getattr(conn.state, "api_key_admin", False) or tenant == getattr(conn.state, "api_key_name", None)
+
+
+class ApiKeyMiddleware:
+    """
+    ASGI middleware rejecting requests without a valid API key.
+
+    The name of the authenticated client is stored as ``api_key_name`` in
+    the request state, so leases can be attributed and limited per key, and
+    whether it is an admin key as ``api_key_admin``.
+    """
+
+    def __init__(self, app, pool: BrowserPool):
+        self.app = app
+        self.pool = pool
+
+    async def __call__(self, scope, receive, send) -> None:
+        if scope["type"] not in ("http", "websocket"):
+            await self.app(scope, receive, send)
+            return
+
+        api_keys = self.pool.settings.api_keys
+        if not api_keys or scope["path"] in PUBLIC_PATHS or scope["path"].startswith(SIGNED_PREFIXES):
+            await self.app(scope, receive, send)
+            return
+
+        name = match_api_key(api_keys, extract_api_key(scope))
+        if name is None:
+            await self._reject(scope, send, 401, "Missing or invalid API key")
+            return
+
+        admin = name == INTERNAL_KEY_NAME or name in self.pool.settings.admin_keys
+        if not admin and is_admin_path(scope["path"], scope.get("method", "GET")):
+            await self._reject(scope, send, 403, f"API key '{name}' may not use admin endpoints")
+            return
+
+        state = scope.setdefault("state", {})
+        state["api_key_name"] = name
+        state["api_key_admin"] = admin
+        await self.app(scope, receive, send)
+
+    @staticmethod
+    async def _reject(scope, send, status: int, error: str) -> None:
+        """Answer an HTTP request with an error, or close a WebSocket."""
+        if scope["type"] == "websocket":
+            await send({"type": "websocket.close", "code": WS_UNAUTHORIZED if status == 401 else WS_FORBIDDEN})
+            return
+        body = json.dumps({"error": error}).encode()
+        headers = [
+            (b"content-type", b"application/json"),
+            (b"content-length", str(len(body)).encode()),
+        ]
+        if status == 401:
+            headers.append((b"www-authenticate", b"Bearer"))
+        await send({"type": "http.response.start", "status": status, "headers": headers})
+        await send({"type": "http.response.body", "body": body})
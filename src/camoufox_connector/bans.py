@@ -0,0 +1,217 @@
+"""
+Block reports for Camoufox Connector.
+
+Only the client knows for sure that a site blocked or banned it. Clients
+report this on ``POST /sessions/{id}/report``: the lease ends, and the
+browser's identity, its fingerprint and proxy, is retired. The browser is
+relaunched with a fresh fingerprint and, when several proxies are
+configured, the next proxy of the rotation, like a recycled poisoned
+browser. A browser shared by context leases is drained instead, and
+relaunched once the last of them is released.
+
+Camoufox generates a new fingerprint at every launch, so a fingerprint is
+identified by the browser instance and its launch time. Reports are counted
+against leases per fingerprint and per proxy, which gives their ban rates
+on ``GET /bans``.
+"""
+
+from __future__ import annotations
+
+import logging
+import time
+from collections import OrderedDict, deque
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Literal, Optional
+from urllib.parse import urlsplit
+
+from pydantic import BaseModel, ConfigDict, Field, ValidationError
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+if TYPE_CHECKING:
+    from .pool import BrowserInstance, BrowserPool
+    from .recycle import PoisonDetector
+    from .sessions import Session, SessionManager
+
+logger = logging.getLogger(__name__)
+
+# Fingerprints tracked; the least recently used are forgotten first
+MAX_FINGERPRINTS = 500
+
+# Retired identities listed
+MAX_RETIRED = 100
+
+
+class BanReport(BaseModel):
+    """A client's report that a site blocked or banned its browser."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    outcome: Literal["blocked", "banned"] = Field(description="What the site did")
+
+    url: Optional[str] = Field(
+        default=None,
+        description="Page that was blocked",
+    )
+
+    reason: Optional[str] = Field(
+        default=None,
+        max_length=500,
+        description="What gave it away, e.g. a challenge page",
+    )
+
+
+@dataclass
+class BanStats:
+    """Leases and reports of one fingerprint or proxy."""
+
+    leases: int = 0
+    blocked: int = 0
+    banned: int = 0
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        reports = self.blocked + self.banned
+        return {
+            "leases": self.leases,
+            "blocked": self.blocked,
+            "banned": self.banned,
+            "ban_rate": round(reports / self.leases, 4) if self.leases else None,
+        }
+
+
+def fingerprint_id(instance: BrowserInstance) -> str:
+    """Identify a browser's current fingerprint by its instance and launch."""
+    return f"{instance.index}@{int(instance.started_at or 0)}"
+
+
+def proxy_id(instance: BrowserInstance) -> str:
+    """Identify a browser's proxy by its server, without credentials."""
+    proxy = instance.launch_kwargs.get("proxy")
+    if isinstance(proxy, dict):
+        proxy = proxy.get("server")
+    if not proxy:
+        return "direct"
+    parts = urlsplit(proxy if "://" in proxy else f"http://{proxy}")
+    host = f"[{parts.hostname}]" if ":" in (parts.hostname or "") else parts.hostname
+    return f"{parts.scheme}://{host}:{parts.port}" if parts.port else f"{parts.scheme}://{host}"
+
+
+@dataclass
+class BanTracker:
+    """Retires reported identities and tracks ban rates."""
+
+    sessions: SessionManager
+    detector: PoisonDetector
+    fingerprints: OrderedDict[str, BanStats] = field(default_factory=OrderedDict)
+    proxies: dict[str, BanStats] = field(default_factory=dict)
+    retired: deque[dict] = field(default_factory=lambda: deque(maxlen=MAX_RETIRED))
+    _retiring: dict[int, tuple[str, str]] = field(default_factory=dict)
+
+    @property
+    def pool(self) -> BrowserPool:
+        """Browser pool the leases are on."""
+        return self.sessions.pool
+
+    def _stats(self, instance: BrowserInstance) -> tuple[BanStats, BanStats]:
+        """Get the stats of a browser's fingerprint and proxy."""
+        key = fingerprint_id(instance)
+        fingerprint = self.fingerprints.pop(key, None) or BanStats()
+        self.fingerprints[key] = fingerprint
+        while len(self.fingerprints) > MAX_FINGERPRINTS:
+            self.fingerprints.popitem(last=False)
+        return fingerprint, self.proxies.setdefault(proxy_id(instance), BanStats())
+
+    async def release_session(self, session: Session) -> None:
+        """Count a released lease against its browser's identity; recycle a retired browser once free."""
+        instance = session.instance
+        for stats in self._stats(instance):
+            stats.leases += 1
+
+        retiring = self._retiring.get(instance.index)
+        if retiring is not None and not instance.is_leased:
+            del self._retiring[instance.index]
+            # Nobody may lease the browser between the release and the relaunch
+            instance.is_healthy = False
+            instance.draining = False
+            self.detector.schedule_recycle(instance, *retiring)
+
+    async def report(self, session: Session, report: BanReport) -> dict:
+        """Record a report, end the lease and relaunch its browser with a new identity."""
+        instance = session.instance
+        entry = {
+            "time": time.time(),
+            "index": instance.index,
+            "fingerprint": fingerprint_id(instance),
+            "proxy": proxy_id(instance),
+            "outcome": report.outcome,
+            "url": report.url,
+            "reason": report.reason,
+        }
+        for stats in self._stats(instance):
+            setattr(stats, report.outcome, getattr(stats, report.outcome) + 1)
+        self.retired.append(entry)
+
+        domain = (urlsplit(report.url).hostname or "") if report.url else ""
+        reason = f"client reported it {report.outcome}" + (f": {report.reason}" if report.reason else "")
+        logger.warning(f"Retiring identity {entry['fingerprint']} via {entry['proxy']}: {reason}")
+        self.pool.events.publish("ban-reported", **entry)
+
+        # Context leases sharing the browser carry on; it is recycled after the last one
+        self._retiring[instance.index] = (domain, reason)
+        instance.draining = True
+        await self.sessions.release(session.id)
+        return entry
+
+    def report_stats(self) -> dict:
+        """Ban rates per proxy and fingerprint, and the identities retired last."""
+        return {
+            "proxies": {key: stats.to_dict() for key, stats in self.proxies.items()},
+            "fingerprints": {key: stats.to_dict() for key, stats in reversed(self.fingerprints.items())},
+            "retired": list(reversed(self.retired)),
+        }
+
+
+def create_ban_routes(tracker: BanTracker) -> list[Route]:
+    """
+    Create routes for block reports and ban rates.
+
+    Args:
+        tracker: Ban tracker retiring reported identities
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def report(request: Request) -> Response:
+        """
+        Report that a site blocked or banned a lease's browser.
+
+        POST /sessions/{id}/report
+        """
+        try:
+            body = BanReport.model_validate_json(await request.body())
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid report", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+        session = tracker.sessions.get_for(request, request.path_params["session_id"])
+        if session is None:
+            return JSONResponse({"error": "Session not found"}, status_code=404)
+        entry = await tracker.report(session, body)
+        return JSONResponse({"status": "retired", "id": session.id, **entry, "summary": session.summary})
+
+    async def get_bans(request: Request) -> Response:
+        """
+        Ban rates per proxy and fingerprint.
+
+        GET /bans
+        """
+        return JSONResponse(tracker.report_stats())
+
+    return [
+        Route("/sessions/{session_id}/report", report, methods=["POST"]),
+        Route("/bans", get_bans, methods=["GET"]),
+    ]
@@ -0,0 +1,54 @@
+"""
+Block detection for server-side tasks.
+
+Anti-bot systems rarely fail a request outright; they answer with a
+challenge page or an error status instead. Task results are classified as
+a success, a block or an error by their status code and by markers of
+common challenge and block pages in their HTML, extended by the
+``block_markers`` setting.
+"""
+
+from __future__ import annotations
+
+from typing import TYPE_CHECKING, Literal, Sequence
+
+if TYPE_CHECKING:
+    from .tasks import FetchResult
+
+Outcome = Literal["success", "blocked", "error"]
+
+BLOCK_STATUSES = frozenset({401, 403, 429, 503})
+
+# Lower-case fragments of challenge and block pages of common anti-bot vendors
+BLOCK_MARKERS = (
+    "cf-chl-",
+    "challenge-platform",
+    "cf-turnstile",
+    "g-recaptcha",
+    "h-captcha",
+    "px-captcha",
+    "_incapsula_resource",
+    "captcha-delivery.com",
+    "access denied",
+    "are you a robot",
+    "unusual traffic from your computer",
+)
+
+
+def is_block_page(html: str, extra_markers: Sequence[str] = ()) -> bool:
+    """Check whether a page looks like a challenge or block page."""
+    text = html.lower()
+    return any(marker in text for marker in BLOCK_MARKERS) or any(
+        marker.lower() in text for marker in extra_markers
+    )
+
+
+def classify(result: FetchResult, extra_markers: Sequence[str] = ()) -> Outcome:
+    """Classify a fetch result as a success, a block or an error."""
+    if result.error is not None:
+        return "error"
+    if result.status in BLOCK_STATUSES:
+        return "blocked"
+    if result.html and is_block_page(result.html, extra_markers):
+        return "blocked"
+    return "success"
@@ -0,0 +1,286 @@
+"""
+Export and import of a deployment's state for Camoufox Connector.
+
+``camoufox-connector export`` packs what a deployment is made of into one
+portable bundle: the configuration (including its proxies and their
+assignment to browsers, maintenance schedules, device presets and
+patches), captured profile templates, configured extensions, the batch jobs
+of a SQLite job store and usage records. ``camoufox-connector import``
+unpacks a bundle into a directory and points the configuration's paths into
+it, so the deployment can be moved to a new host or cloned for staging:
+
+    camoufox-connector export --config connector.yaml -o connector.tar.gz
+    camoufox-connector import connector.tar.gz /srv/camoufox
+    camoufox-connector --config /srv/camoufox/config.json
+
+With ``--url``, the export also takes what was changed at runtime on a
+running connector: its pool size, browser labels, device presets registered
+through the API and the active profile template. Bundles hold the
+configuration's secrets (API keys, proxy credentials, signing keys) and are
+written readable by their owner only.
+"""
+
+from __future__ import annotations
+
+import argparse
+import json
+import os
+import shutil
+import socket
+import sqlite3
+import sys
+import tarfile
+import tempfile
+from datetime import datetime, timezone
+from pathlib import Path, PurePosixPath
+
+from . import __version__
+from .config import Settings, load_config_data
+from .ctl import DEFAULT_URL, CtlError, call
+
+BUNDLE_FORMAT = 1
+MANIFEST = "manifest.json"
+CONFIG = "config.json"
+
+# Where path settings point inside a bundle; import makes them absolute
+TEMPLATES = "templates"
+EXTENSIONS = "extensions"
+JOBS = "jobs.db"
+USAGE = "usage.jsonl"
+
+
+class BundleError(Exception):
+    """Raised when a bundle can't be written or read."""
+
+
+def parse_args(argv: list[str]) -> argparse.Namespace:
+    """Parse ``export`` and ``import`` command line arguments."""
+    parser = argparse.ArgumentParser(
+        prog="camoufox-connector",
+        description="Move a Camoufox Connector deployment to another host",
+    )
+    commands = parser.add_subparsers(dest="command", required=True, metavar="COMMAND")
+
+    export = commands.add_parser("export", help="Pack the configuration and state into a bundle")
+    export.add_argument("--config", help="Configuration file of the deployment")
+    export.add_argument(
+        "-o", "--output",
+        default="camoufox-connector-bundle.tar.gz",
+        help="Bundle to write (default: camoufox-connector-bundle.tar.gz)",
+    )
+    export.add_argument(
+        "--url",
+        help=f"Also take runtime changes from the running connector at this URL, e.g. {DEFAULT_URL}",
+    )
+    export.add_argument(
+        "--api-key",
+        default=os.environ.get("CAMOUFOX_CONNECTOR_API_KEY"),
+        help="API key for --url (default: $CAMOUFOX_CONNECTOR_API_KEY)",
+    )
+
+    unpack = commands.add_parser("import", help="Unpack a bundle into a directory")
+    unpack.add_argument("bundle", help="Bundle written by export")
+    unpack.add_argument("directory", help="Directory to unpack into; it must be empty or missing")
+    unpack.add_argument("--force", action="store_true", help="Unpack into a directory that is not empty")
+
+    return parser.parse_args(argv)
+
+
+def _runtime_changes(args: argparse.Namespace, data: dict) -> list[str]:
+    """Fold what was changed on a running connector into the configuration; returns the changes."""
+    changes = []
+    stats = call(args, "GET", "/stats")
+    if stats.get("mode") == "pool" and stats.get("total_instances") != data.get("pool_size"):
+        data["pool_size"] = stats["total_instances"]
+        changes.append(f"pool_size {stats['total_instances']}")
+
+    labels = {inst["index"]: inst["labels"] for inst in stats.get("instances", []) if inst.get("labels")}
+    if labels:
+        data["browser_labels"] = labels
+        changes.append(f"labels of {len(labels)} browser(s)")
+
+    custom = [
+        {k: v for k, v in preset.items() if k != "source"}
+        for preset in call(args, "GET", "/devices").get("devices", [])
+        if preset.get("source") == "custom"
+    ]
+    if custom:
+        names = {preset["name"] for preset in custom}
+        data["devices"] = [d for d in data.get("devices", []) if d.get("name") not in names] + custom
+        changes.append(f"{len(custom)} device preset(s)")
+
+    active = call(args, "GET", "/templates").get("active")
+    if active != data.get("profile_template"):
+        data["profile_template"] = active
+        changes.append(f"active profile template {active or 'none'}")
+    return changes
+
+
+def export_bundle(args: argparse.Namespace) -> str:
+    """Write a bundle; returns a summary of what it holds."""
+    if not args.config and not args.url:
+        raise BundleError("Nothing to export: give --config, --url or both")
+
+    data = load_config_data(args.config) if args.config else {}
+    contents = ["configuration"]
+    warnings = []
+
+    with tempfile.TemporaryDirectory(prefix="camoufox-bundle-") as staging:
+        staging = Path(staging)
+        relative = []
+
+        if args.url:
+            contents += _runtime_changes(args, data)
+
+        templates_dir = data.get("templates_dir")
+        if templates_dir and Path(templates_dir).is_dir():
+            shutil.copytree(templates_dir, staging / TEMPLATES)
+            data["templates_dir"] = TEMPLATES
+            relative.append("templates_dir")
+            count = sum(1 for _ in (staging / TEMPLATES).glob("*/template.json"))
+            contents.append(f"{count} profile template(s)")
+        elif not templates_dir:
+            warnings.append("Profile templates are not included: templates_dir is not set, so they are not kept on disk")
+
+        extensions = []
+        for position, entry in enumerate(data.get("extensions", [])):
+            source = Path(entry)
+            if not source.exists():
+                warnings.append(f"Extension {entry} is missing and was left out")
+                continue
+            name = f"{EXTENSIONS}/{position}-{source.name}"
+            if source.is_dir():
+                shutil.copytree(source, staging / name)
+            else:
+                (staging / EXTENSIONS).mkdir(exist_ok=True)
+                shutil.copy2(source, staging / name)
+            extensions.append(name)
+        if data.get("extensions"):
+            data["extensions"] = extensions
+            relative.append("extensions")
+            contents.append(f"{len(extensions)} extension(s)")
+
+        job_store = data.get("job_store") or ""
+        if job_store.startswith("sqlite://") and Path(job_store[len("sqlite://"):]).is_file():
+            # The backup API copies a consistent snapshot, even while the connector writes
+            source = sqlite3.connect(job_store[len("sqlite://"):])
+            target = sqlite3.connect(staging / JOBS)
+            try:
+                source.backup(target)
+            finally:
+                source.close()
+                target.close()
+            data["job_store"] = f"sqlite://{JOBS}"
+            relative.append("job_store")
+            contents.append("batch jobs")
+        elif job_store and not job_store.startswith("sqlite://"):
+            warnings.append(f"Batch jobs in {job_store.split('://')[0]} are not included; the new host must reach the same store")
+
+        usage_file = data.get("usage_file")
+        if usage_file and Path(usage_file).is_file():
+            shutil.copy2(usage_file, staging / USAGE)
+            data["usage_file"] = USAGE
+            relative.append("usage_file")
+            contents.append("usage records")
+
+        if data.get("artifacts_dir"):
+            warnings.append("Session artifacts are not included; they stay in artifacts_dir or the storage driver")
+        for build in data.get("browser_builds", []):
+            if build.get("executable_path"):
+                warnings.append(f"Browser build {build.get('version')} runs {build['executable_path']}, which must exist on the new host")
+
+        (staging / CONFIG).write_text(json.dumps(data, indent=2))
+        manifest = {
+            "format": BUNDLE_FORMAT,
+            "connector_version": __version__,
+            "exported_at": datetime.now(timezone.utc).isoformat(),
+            "host": socket.gethostname(),
+            "relative_paths": relative,
+            "contents": contents,
+            "warnings": warnings,
+        }
+        (staging / MANIFEST).write_text(json.dumps(manifest, indent=2))
+
+        output = Path(args.output)
+        # Created private before anything is written to it
+        output.touch(mode=0o600, exist_ok=True)
+        os.chmod(output, 0o600)
+        with tarfile.open(output, "w:gz") as tar:
+            for path in sorted(staging.iterdir()):
+                tar.add(path, arcname=path.name)
+
+    lines = [f"Exported to {args.output}: {', '.join(contents)}"]
+    lines += [f"warning: {w}" for w in warnings]
+    return "\n".join(lines)
+
+
+def _safe_members(tar: tarfile.TarFile) -> list[tarfile.TarInfo]:
+    """Members of a bundle, refusing any that would land outside the target directory."""
+    members = tar.getmembers()
+    for member in members:
+        path = PurePosixPath(member.name)
+        if path.is_absolute() or ".." in path.parts or not (member.isfile() or member.isdir()):
+            raise BundleError(f"Refusing to unpack {member.name!r}: not a plain file inside the bundle")
+    return members
+
+
+def import_bundle(args: argparse.Namespace) -> str:
+    """Unpack a bundle; returns how to start the imported deployment."""
+    target = Path(args.directory).resolve()
+    if target.exists() and any(target.iterdir()) and not args.force:
+        raise BundleError(f"{target} is not empty; use --force to unpack into it anyway")
+
+    try:
+        tar = tarfile.open(args.bundle, "r:gz")
+    except (OSError, tarfile.TarError) as e:
+        raise BundleError(f"Could not open bundle {args.bundle}: {e}") from e
+
+    with tar:
+        try:
+            manifest = json.load(tar.extractfile(MANIFEST))
+        except (KeyError, ValueError) as e:
+            raise BundleError(f"{args.bundle} is not a connector bundle: {e}") from e
+        if manifest.get("format") != BUNDLE_FORMAT:
+            raise BundleError(f"Unsupported bundle format {manifest.get('format')}")
+
+        target.mkdir(parents=True, exist_ok=True)
+        os.chmod(target, 0o700)
+        tar.extractall(target, members=_safe_members(tar))
+
+    config_path = target / CONFIG
+    data = json.loads(config_path.read_text())
+    relative = set(manifest.get("relative_paths", []))
+    if "templates_dir" in relative:
+        data["templates_dir"] = str(target / data["templates_dir"])
+    if "extensions" in relative:
+        data["extensions"] = [str(target / entry) for entry in data["extensions"]]
+    if "job_store" in relative:
+        data["job_store"] = f"sqlite://{target / data['job_store'][len('sqlite://'):]}"
+    if "usage_file" in relative:
+        data["usage_file"] = str(target / data["usage_file"])
+    config_path.write_text(json.dumps(data, indent=2))
+    os.chmod(config_path, 0o600)
+
+    try:
+        Settings(**data)
+    except Exception as e:
+        raise BundleError(f"The imported configuration is not valid here: {e}") from e
+
+    lines = [
+        f"Imported a bundle of connector {manifest.get('connector_version')} from {manifest.get('host')}"
+        f" ({manifest.get('exported_at')}): {', '.join(manifest.get('contents', []))}",
+    ]
+    lines += [f"warning: {w}" for w in manifest.get("warnings", [])]
+    lines.append(f"Start it with: camoufox-connector --config {config_path}")
+    return "\n".join(lines)
+
+
+def main(argv: list[str]) -> int:
+    """Entry point of ``camoufox-connector export`` and ``import``; returns the exit status."""
+    args = parse_args(argv)
+    try:
+        print(export_bundle(args) if args.command == "export" else import_bundle(args))
+    except (BundleError, CtlError, OSError, ValueError) as e:
+        print(f"error: {e}", file=sys.stderr)
+        return 1
+    return 0
@@ -0,0 +1,290 @@
+"""
+CAPTCHA detection and solving for Camoufox Connector.
+
+Server-side fetch tasks look for Cloudflare Turnstile, reCAPTCHA v2 and
+hCaptcha widgets on the loaded page and report what they find. With
+``captcha_solver`` configured, the widget's site key is sent to an external
+solving service speaking the 2Captcha/CapSolver ``createTask`` API; the
+returned token is put into the page's response field and handed to the
+widget's callback (or the enclosing form is submitted), and the task waits
+for the page to load again before reading its content.
+
+Tasks choose with ``captcha``: ``solve``, ``detect`` or ``off``. Solve
+counts and times are reported per CAPTCHA type on ``GET /captcha``.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+import time
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Any, Optional
+
+import httpx
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .popups import wait_loaded
+
+if TYPE_CHECKING:
+    from .config import CaptchaSolverConfig
+    from .pool import BrowserPool
+    from .tasks import FetchResult, FetchTask, TaskRunner
+
+logger = logging.getLogger(__name__)
+
+CAPTCHA_TYPES = ("turnstile", "recaptcha", "hcaptcha")
+
+DEFAULT_URLS = {
+    "2captcha": "https://api.2captcha.com",
+    "capsolver": "https://api.capsolver.com",
+}
+
+# Proxyless task types; the service solves from its own IPs
+TASK_TYPES = {
+    "2captcha": {
+        "turnstile": "TurnstileTaskProxyless",
+        "recaptcha": "RecaptchaV2TaskProxyless",
+        "hcaptcha": "HCaptchaTaskProxyless",
+    },
+    "capsolver": {
+        "turnstile": "AntiTurnstileTaskProxyLess",
+        "recaptcha": "ReCaptchaV2TaskProxyLess",
+        "hcaptcha": "HCaptchaTaskProxyLess",
+    },
+}
+
+# hCaptcha widgets also carry the g-recaptcha class for compatibility, so
+# they are looked for first
+DETECT_JS = """() => {
+    const widgets = [
+        ["turnstile", ".cf-turnstile[data-sitekey]", "challenges.cloudflare.com", null],
+        ["hcaptcha", ".h-captcha[data-sitekey]", "hcaptcha.com", "sitekey"],
+        ["recaptcha", ".g-recaptcha[data-sitekey]", "/recaptcha/", "k"],
+    ];
+    const frames = [...document.querySelectorAll("iframe[src]")].map(frame => frame.src);
+    for (const [type, selector, host, param] of widgets) {
+        const widget = document.querySelector(selector);
+        if (widget) {
+            return {type, sitekey: widget.getAttribute("data-sitekey")};
+        }
+        for (const src of frames) {
+            if (!param || !src.includes(host)) continue;
+            try {
+                const sitekey = new URL(src).searchParams.get(param);
+                if (sitekey) return {type, sitekey};
+            } catch (e) {}
+        }
+    }
+    return null;
+}"""
+
+INJECT_JS = """([type, token]) => {
+    const fields = {
+        turnstile: ["cf-turnstile-response"],
+        recaptcha: ["g-recaptcha-response"],
+        hcaptcha: ["h-captcha-response", "g-recaptcha-response"],
+    }[type];
+    for (const name of fields) {
+        for (const field of document.querySelectorAll(`[name="${name}"]`)) {
+            field.value = token;
+            field.innerHTML = token;
+        }
+    }
+    const widget = document.querySelector({turnstile: ".cf-turnstile", recaptcha: ".g-recaptcha", hcaptcha: ".h-captcha"}[type]);
+    const callback = widget && widget.getAttribute("data-callback");
+    if (callback && typeof window[callback] === "function") {
+        window[callback](token);
+        return "callback";
+    }
+    const form = widget && widget.closest("form");
+    if (form) {
+        form.requestSubmit ? form.requestSubmit() : form.submit();
+        return "form";
+    }
+    return null;
+}"""
+
+
+class CaptchaSolveError(Exception):
+    """Raised when the solving service returns no token."""
+
+
+@dataclass
+class SolveStats:
+    """How often one CAPTCHA type was met and solved."""
+
+    detected: int = 0
+    solved: int = 0
+    failed: int = 0
+    solve_time: float = 0.0
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "detected": self.detected,
+            "solved": self.solved,
+            "failed": self.failed,
+            "average_solve_time": round(self.solve_time / self.solved, 2) if self.solved else None,
+        }
+
+
+@dataclass
+class CaptchaSolver:
+    """Detects CAPTCHAs on fetched pages and has them solved."""
+
+    runner: TaskRunner
+    stats: dict[str, SolveStats] = field(default_factory=lambda: {kind: SolveStats() for kind in CAPTCHA_TYPES})
+    _client: Optional[httpx.AsyncClient] = None
+
+    def __post_init__(self) -> None:
+        self.runner.page_hooks.append(self.handle)
+
+    @property
+    def pool(self) -> BrowserPool:
+        """Browser pool the tasks run on."""
+        return self.runner.sessions.pool
+
+    @property
+    def config(self) -> Optional[CaptchaSolverConfig]:
+        """Configured solving service, if any."""
+        return self.pool.settings.captcha_solver
+
+    async def _call(self, config: CaptchaSolverConfig, method: str, payload: dict) -> dict:
+        """Call a method of the solving service's API."""
+        if self._client is None:
+            self._client = httpx.AsyncClient(timeout=30.0)
+        base = (config.url or DEFAULT_URLS[config.provider]).rstrip("/")
+        try:
+            response = await self._client.post(f"{base}/{method}", json={"clientKey": config.api_key, **payload})
+            response.raise_for_status()
+            body = response.json()
+        except (httpx.HTTPError, ValueError) as e:
+            raise CaptchaSolveError(f"{method} failed: {e or type(e).__name__}") from e
+        if body.get("errorId"):
+            raise CaptchaSolveError(body.get("errorDescription") or body.get("errorCode") or f"{method} failed")
+        return body
+
+    async def solve(self, config: CaptchaSolverConfig, kind: str, sitekey: str, url: str) -> str:
+        """
+        Have the solving service solve a CAPTCHA.
+
+        Returns:
+            The response token to submit
+
+        Raises:
+            CaptchaSolveError: If the service fails or takes longer than its timeout
+        """
+        task = {"type": TASK_TYPES[config.provider][kind], "websiteURL": url, "websiteKey": sitekey}
+        created = await self._call(config, "createTask", {"task": task})
+        task_id = created.get("taskId")
+        if task_id is None:
+            raise CaptchaSolveError("createTask returned no task ID")
+
+        deadline = time.monotonic() + config.timeout
+        while time.monotonic() < deadline:
+            await asyncio.sleep(config.poll_interval)
+            body = await self._call(config, "getTaskResult", {"taskId": task_id})
+            if body.get("status") != "ready":
+                continue
+            solution = body.get("solution") or {}
+            token = solution.get("gRecaptchaResponse") or solution.get("token")
+            if not token:
+                raise CaptchaSolveError("The solution holds no token")
+            return token
+        raise CaptchaSolveError(f"No solution within {config.timeout:g}s")
+
+    async def handle(self, task: FetchTask, page: Any, result: FetchResult) -> None:
+        """Detect a CAPTCHA on a fetched page and solve it if asked to."""
+        config = self.config
+        mode = task.captcha or ("solve" if config is not None else "detect")
+        if mode == "off":
+            return
+
+        try:
+            found = await page.evaluate(DETECT_JS)
+        except Exception as e:
+            # Pages loaded with JavaScript disabled can't be inspected
+            logger.debug(f"CAPTCHA detection failed on {page.url}: {e}")
+            return
+        if not found:
+            return
+
+        kind, sitekey = found["type"], found["sitekey"]
+        stats = self.stats[kind]
+        stats.detected += 1
+        result.captcha = {"type": kind, "sitekey": sitekey, "solved": False, "error": None}
+        if mode != "solve":
+            return
+        if config is None:
+            result.captcha["error"] = "No CAPTCHA solver is configured"
+            return
+        if kind not in config.types:
+            result.captcha["error"] = f"Solving {kind} is not enabled"
+            return
+
+        url = page.url
+        began = time.monotonic()
+        try:
+            token = await self.solve(config, kind, sitekey, url)
+            result.captcha["submitted"] = await page.evaluate(INJECT_JS, [kind, token])
+            await wait_loaded(page, task.wait_until, task.timeout)
+        except Exception as e:
+            stats.failed += 1
+            result.captcha["error"] = str(e)
+            logger.warning(f"Solving {kind} on {url} failed: {e}")
+        else:
+            elapsed = time.monotonic() - began
+            stats.solved += 1
+            stats.solve_time += elapsed
+            result.captcha["solved"] = True
+            result.captcha["duration"] = round(elapsed, 2)
+            logger.info(f"Solved {kind} on {url} in {elapsed:.1f}s")
+
+        self.pool.events.publish(
+            "captcha-solved",
+            type=kind,
+            url=url,
+            success=result.captcha["solved"],
+            error=result.captcha["error"],
+        )
+
+    def report(self) -> dict:
+        """Describe the configured service and the solve counts per type."""
+        config = self.config
+        return {
+            "provider": config.provider if config is not None else None,
+            "types": {kind: stats.to_dict() for kind, stats in self.stats.items()},
+        }
+
+    async def close(self) -> None:
+        """Close the HTTP client."""
+        if self._client is not None:
+            await self._client.aclose()
+            self._client = None
+
+
+def create_captcha_routes(solver: CaptchaSolver) -> list[Route]:
+    """
+    Create routes reporting CAPTCHA solve metrics.
+
+    Args:
+        solver: CAPTCHA solver hooked into fetch tasks
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_captcha(request: Request) -> Response:
+        """
+        How often each CAPTCHA type was detected and solved, and how long solving took.
+
+        GET /captcha
+        """
+        return JSONResponse(solver.report())
+
+    return [
+        Route("/captcha", get_captcha, methods=["GET"]),
+    ]
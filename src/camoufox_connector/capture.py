@@ -0,0 +1,163 @@
+"""
+Response capture for server-side tasks.
+
+The JSON API behind a page is often worth more than its rendered HTML. A
+task's ``capture`` options collect the XHR/fetch responses and WebSocket
+messages whose URL matches one of the given patterns while the task runs,
+and return their bodies with the result.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import base64
+import fnmatch
+import json
+import logging
+from dataclasses import dataclass, field
+from typing import Any, Callable, Optional
+
+from pydantic import BaseModel, ConfigDict, Field
+
+logger = logging.getLogger(__name__)
+
+CAPTURED_RESOURCE_TYPES = ("xhr", "fetch")
+
+
+class CaptureOptions(BaseModel):
+    """Which network traffic a task captures."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    urls: list[str] = Field(
+        default_factory=lambda: ["*"],
+        min_length=1,
+        description="URL glob patterns of the responses and WebSockets to capture",
+    )
+
+    websockets: bool = Field(
+        default=True,
+        description="Also capture messages of matching WebSockets",
+    )
+
+    max_entries: int = Field(
+        default=100,
+        ge=1,
+        le=1000,
+        description="Maximum number of captured responses and messages",
+    )
+
+    max_body_kb: int = Field(
+        default=1024,
+        ge=1,
+        description="Bodies larger than this are left out, with only their size reported",
+    )
+
+    def matches(self, url: str) -> bool:
+        """Check whether a URL is to be captured."""
+        return any(fnmatch.fnmatchcase(url, pattern) for pattern in self.urls)
+
+
+def encode_body(body: bytes, parse_json: bool) -> dict:
+    """Describe a body as text, with its parsed JSON if asked, or as base64."""
+    try:
+        text = body.decode("utf-8")
+    except UnicodeDecodeError:
+        return {"body": base64.b64encode(body).decode(), "encoding": "base64"}
+
+    entry: dict = {"body": text}
+    if parse_json:
+        try:
+            entry["json"] = json.loads(text)
+        except ValueError:
+            pass
+    return entry
+
+
+@dataclass
+class ResponseCapture:
+    """Collects matching responses and WebSocket messages of a browser context."""
+
+    options: CaptureOptions
+    entries: list[dict] = field(default_factory=list)
+    dropped: int = 0
+    # Called with each entry once complete, instead of keeping it, for streams
+    listener: Optional[Callable[[dict], None]] = None
+    _pending: set[asyncio.Task] = field(default_factory=set)
+
+    def attach(self, context: Any) -> None:
+        """Start capturing on a context and every page opened in it."""
+        context.on("response", self._on_response)
+        if self.options.websockets:
+            context.on("page", lambda page: page.on("websocket", self._on_websocket))
+
+    def _add(self, entry: dict) -> bool:
+        """Keep an entry unless the limit has been reached."""
+        if self.listener is not None:
+            return True
+        if len(self.entries) >= self.options.max_entries:
+            self.dropped += 1
+            return False
+        self.entries.append(entry)
+        return True
+
+    def _on_response(self, response: Any) -> None:
+        """Capture a matching XHR or fetch response."""
+        request = response.request
+        if request.resource_type not in CAPTURED_RESOURCE_TYPES or not self.options.matches(response.url):
+            return
+        entry = {
+            "type": request.resource_type,
+            "url": response.url,
+            "method": request.method,
+            "status": response.status,
+            "content_type": response.headers.get("content-type", ""),
+        }
+        if self._add(entry):
+            task = asyncio.ensure_future(self._read_body(response, entry))
+            self._pending.add(task)
+            task.add_done_callback(self._pending.discard)
+
+    async def _read_body(self, response: Any, entry: dict) -> None:
+        """Fill in a captured response's body."""
+        try:
+            body = await response.body()
+        except Exception as e:
+            # Redirects and aborted requests have no body
+            entry["error"] = str(e)
+        else:
+            entry["size"] = len(body)
+            if len(body) <= self.options.max_body_kb * 1024:
+                entry.update(encode_body(body, "json" in entry["content_type"]))
+        if self.listener is not None:
+            self.listener(entry)
+
+    def _on_websocket(self, websocket: Any) -> None:
+        """Capture the messages of a matching WebSocket."""
+        if not self.options.matches(websocket.url):
+            return
+
+        def on_frame(direction: str, payload: Any) -> None:
+            entry: dict = {"type": "websocket", "url": websocket.url, "direction": direction}
+            if isinstance(payload, bytes):
+                entry["size"] = len(payload)
+                if len(payload) <= self.options.max_body_kb * 1024:
+                    entry.update(encode_body(payload, False))
+            else:
+                data = payload.encode()
+                entry["size"] = len(data)
+                if len(data) <= self.options.max_body_kb * 1024:
+                    entry.update(encode_body(data, True))
+            if self._add(entry) and self.listener is not None:
+                self.listener(entry)
+
+        websocket.on("framesent", lambda payload: on_frame("sent", payload))
+        websocket.on("framereceived", lambda payload: on_frame("received", payload))
+
+    async def finish(self, timeout: float = 10.0) -> list[dict]:
+        """Wait for outstanding body reads and get the captured entries."""
+        if self._pending:
+            _, pending = await asyncio.wait(set(self._pending), timeout=timeout)
+            for task in pending:
+                task.cancel()
+        return self.entries
@@ -0,0 +1,121 @@
+"""
+CDP-style discovery for Camoufox Connector.
+
+Tools built for Chrome find browsers through the DevTools HTTP endpoints
+(``/json/version`` and ``/json/list``) before connecting to the
+``webSocketDebuggerUrl`` they return. These routes answer the same
+discovery requests with pool browsers, so such tools can be pointed at the
+connector. Camoufox is Firefox and speaks the Playwright protocol rather than
+CDP: the discovered endpoints work with Playwright's ``firefox.connect()``,
+not with ``connectOverCDP`` or puppeteer's CDP transport. Endpoints that
+would create, activate or close targets are answered with 501.
+"""
+
+from __future__ import annotations
+
+import logging
+from typing import TYPE_CHECKING, Optional
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from . import __version__
+from .advertise import client_endpoint
+from .relay import websocket_url
+
+if TYPE_CHECKING:
+    from .pool import BrowserInstance, BrowserPool
+
+logger = logging.getLogger(__name__)
+
+# What the DevTools HTTP API of Chrome reports as its protocol version
+CDP_PROTOCOL_VERSION = "1.3"
+
+NOT_CDP = "Camoufox speaks the Playwright protocol, not CDP; connect with Playwright's firefox.connect()"
+
+
+def create_cdp_routes(pool: BrowserPool) -> list[Route]:
+    """
+    Create CDP-style discovery routes.
+
+    Args:
+        pool: Browser pool to hand out browsers from
+
+    Returns:
+        List of Starlette routes
+    """
+
+    def endpoint_of(request: Request, instance: BrowserInstance) -> Optional[str]:
+        """Get the endpoint clients connect to for an instance."""
+        if pool.settings.relay:
+            return websocket_url(request, f"/browsers/{instance.index}/ws")
+        return client_endpoint(request, pool.settings, instance.ws_endpoint)
+
+    def describe(request: Request, instance: BrowserInstance) -> dict:
+        """Describe an instance like a DevTools browser target."""
+        endpoint = endpoint_of(request, instance)
+        return {
+            "id": str(instance.index),
+            "type": "browser",
+            "title": f"Camoufox browser {instance.index}",
+            "description": f"Pool instance {instance.index}",
+            "url": "about:blank",
+            "webSocketDebuggerUrl": endpoint,
+            "devtoolsFrontendUrl": "",
+            "protocol": "playwright",
+        }
+
+    async def version(request: Request) -> Response:
+        """
+        Discover a browser, handed out round-robin like /next.
+
+        GET /json/version
+        """
+        instance = await pool.get_next_instance(request.query_params.get("version"))
+        if instance is None:
+            return JSONResponse({"error": "No healthy browser instances available"}, status_code=503)
+        return JSONResponse({
+            "Browser": f"Firefox/{instance.version}" if instance.version else "Firefox/Camoufox",
+            "Protocol-Version": CDP_PROTOCOL_VERSION,
+            "Protocol": "playwright",
+            "Connector-Version": __version__,
+            "webSocketDebuggerUrl": endpoint_of(request, instance),
+        })
+
+    async def targets(request: Request) -> Response:
+        """
+        List the available browsers as DevTools targets.
+
+        GET /json/list
+        """
+        return JSONResponse([
+            describe(request, instance)
+            for instance in pool.get_available_instances(request.query_params.get("version"))
+        ])
+
+    async def protocol(request: Request) -> Response:
+        """
+        There is no CDP protocol description to serve.
+
+        GET /json/protocol
+        """
+        return JSONResponse({"error": NOT_CDP}, status_code=404)
+
+    async def unsupported(request: Request) -> Response:
+        """
+        Targets are created and closed through the Playwright protocol only.
+
+        PUT /json/new, /json/activate/{id}, /json/close/{id}
+        """
+        return JSONResponse({"error": f"Not supported. {NOT_CDP}"}, status_code=501)
+
+    return [
+        Route("/json/version", version, methods=["GET"]),
+        Route("/json/list", targets, methods=["GET"]),
+        Route("/json", targets, methods=["GET"]),
+        Route("/json/protocol", protocol, methods=["GET"]),
+        Route("/json/new", unsupported, methods=["GET", "PUT"]),
+        Route("/json/activate/{target_id}", unsupported, methods=["GET"]),
+        Route("/json/close/{target_id}", unsupported, methods=["GET"]),
+    ]
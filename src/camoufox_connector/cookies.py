@@ -0,0 +1,287 @@
+"""
+Cookie import and export for Camoufox Connector.
+
+Cookie jars can be read from and injected into the browser contexts that
+clients create through the relay, in Playwright storage-state JSON or the
+Netscape cookie-file format used by curl, wget and most cookie exporters.
+"""
+
+from __future__ import annotations
+
+import json
+import logging
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Optional
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, PlainTextResponse, Response
+from starlette.routing import Route
+
+from .relay import RelayCallError
+
+if TYPE_CHECKING:
+    from .pool import BrowserInstance
+    from .relay import Relay, RelayConnection
+    from .sessions import Session, SessionManager
+
+logger = logging.getLogger(__name__)
+
+NETSCAPE_HEADER = "# Netscape HTTP Cookie File\n"
+HTTPONLY_PREFIX = "#HttpOnly_"
+
+
+def parse_netscape(text: str) -> list[dict]:
+    """Parse a Netscape cookie file into Playwright cookies."""
+    cookies = []
+    for raw_line in text.splitlines():
+        line = raw_line.strip()
+        http_only = False
+        if line.startswith(HTTPONLY_PREFIX):
+            http_only = True
+            line = line[len(HTTPONLY_PREFIX):]
+        if not line or line.startswith("#"):
+            continue
+
+        parts = line.split("\t")
+        if len(parts) != 7:
+            raise ValueError(f"Malformed cookie line: {raw_line!r}")
+
+        domain, _include_subdomains, path, secure, expires, name, value = parts
+        expires_at = int(expires) if expires.lstrip("-").isdigit() else 0
+        cookies.append({
+            "name": name,
+            "value": value,
+            "domain": domain,
+            "path": path or "/",
+            "expires": expires_at if expires_at > 0 else -1,
+            "httpOnly": http_only,
+            "secure": secure.upper() == "TRUE",
+            "sameSite": "Lax",
+        })
+    return cookies
+
+
+def to_netscape(cookies: list[dict]) -> str:
+    """Serialize Playwright cookies to the Netscape cookie file format."""
+    lines = [NETSCAPE_HEADER]
+    for cookie in cookies:
+        domain = cookie.get("domain", "")
+        if cookie.get("httpOnly"):
+            domain = HTTPONLY_PREFIX + domain
+        expires = cookie.get("expires", -1)
+        lines.append("\t".join([
+            domain,
+            "TRUE" if cookie.get("domain", "").startswith(".") else "FALSE",
+            cookie.get("path", "/"),
+            "TRUE" if cookie.get("secure") else "FALSE",
+            str(int(expires)) if expires and expires > 0 else "0",
+            cookie.get("name", ""),
+            cookie.get("value", ""),
+        ]) + "\n")
+    return "".join(lines)
+
+
+def parse_storage_state(data: object) -> list[dict]:
+    """Extract cookies from a storage-state document or a bare cookie list."""
+    if isinstance(data, list):
+        return data
+    if isinstance(data, dict) and isinstance(data.get("cookies"), list):
+        return data["cookies"]
+    raise ValueError("Expected a storage state object or a list of cookies")
+
+
+def dedupe_cookies(cookies: list[dict]) -> list[dict]:
+    """Drop duplicate cookies, keeping the last one seen per name/domain/path."""
+    unique: dict[tuple, dict] = {}
+    for cookie in cookies:
+        key = (cookie.get("name"), cookie.get("domain"), cookie.get("path", "/"))
+        unique[key] = cookie
+    return list(unique.values())
+
+
+@dataclass
+class CookieJars:
+    """
+    Cookie jars pending injection into relayed browser contexts.
+
+    Jars can be set for a whole browser instance or for a single session;
+    both are added to every context created afterwards and pushed into
+    contexts that are already open.
+    """
+
+    relay: Relay
+    instance_jars: dict[int, list[dict]] = field(default_factory=dict)
+    session_jars: dict[str, list[dict]] = field(default_factory=dict)
+
+    def __post_init__(self) -> None:
+        self.relay.context_params_providers.append(self._context_params)
+
+    def _context_params(self, connection: RelayConnection) -> dict:
+        """Inject pending jars as storage state into new contexts."""
+        cookies = list(self.instance_jars.get(connection.instance.index, []))
+        if connection.session is not None:
+            cookies += self.session_jars.get(connection.session.id, [])
+        if not cookies:
+            return {}
+        return {"storageState": {"cookies": dedupe_cookies(cookies), "origins": []}}
+
+    async def export(self, connections: list[RelayConnection]) -> list[dict]:
+        """Read the cookies of every context on the given connections."""
+        cookies = []
+        for conn in connections:
+            for guid in list(conn.contexts):
+                try:
+                    result = await conn.call(guid, "cookies", {"urls": []})
+                except RelayCallError as e:
+                    logger.debug(f"Failed to read cookies from {guid}: {e}")
+                    continue
+                cookies.extend(result.get("cookies", []))
+        return dedupe_cookies(cookies)
+
+    async def inject(self, connections: list[RelayConnection], cookies: list[dict]) -> int:
+        """Add cookies to every open context; returns the number of contexts updated."""
+        updated = 0
+        for conn in connections:
+            for guid in list(conn.contexts):
+                try:
+                    await conn.call(guid, "addCookies", {"cookies": cookies})
+                    updated += 1
+                except RelayCallError as e:
+                    logger.warning(f"Failed to add cookies to {guid}: {e}")
+        return updated
+
+    async def release_session(self, session: Session) -> None:
+        """Forget a released session's jar."""
+        self.session_jars.pop(session.id, None)
+
+
+async def _read_cookies(request: Request) -> list[dict]:
+    """Parse a cookie upload in either supported format."""
+    body = (await request.body()).decode("utf-8")
+    content_type = request.headers.get("content-type", "")
+    if request.query_params.get("format") == "netscape" or content_type.startswith("text/plain"):
+        return parse_netscape(body)
+    return parse_storage_state(json.loads(body) if body else [])
+
+
+def _cookies_response(request: Request, cookies: list[dict]) -> Response:
+    """Render cookies in the requested format."""
+    if request.query_params.get("format") == "netscape":
+        return PlainTextResponse(to_netscape(cookies))
+    return JSONResponse({"cookies": cookies, "origins": []})
+
+
+def create_cookie_routes(jars: CookieJars, sessions: SessionManager) -> list[Route]:
+    """
+    Create HTTP routes for cookie import and export.
+
+    Args:
+        jars: Cookie jars pending injection
+        sessions: Session manager used to resolve session IDs
+
+    Returns:
+        List of Starlette routes
+    """
+    relay = jars.relay
+
+    def _instance(request: Request) -> Optional[BrowserInstance]:
+        index = request.path_params["index"]
+        if index < 0 or index >= len(relay.pool.instances):
+            return None
+        return relay.pool.instances[index]
+
+    def _not_relayed() -> Optional[Response]:
+        """Refuse browser cookies while clients get direct endpoints, whose contexts the connector can't see."""
+        if relay.pool.settings.relay:
+            return None
+        return JSONResponse(
+            {"error": "Browser cookies only cover relayed connections; start the connector with --relay"},
+            status_code=409,
+        )
+
+    async def get_browser_cookies(request: Request) -> Response:
+        """
+        Export cookies from a browser's relayed contexts.
+
+        GET /browsers/{index}/cookies
+        """
+        instance = _instance(request)
+        if instance is None:
+            return JSONResponse({"error": "Instance not found"}, status_code=404)
+        refused = _not_relayed()
+        if refused is not None:
+            return refused
+
+        connections = relay.connections_for(instance)
+        if connections:
+            cookies = await jars.export(connections)
+        else:
+            cookies = jars.instance_jars.get(instance.index, [])
+        return _cookies_response(request, cookies)
+
+    async def put_browser_cookies(request: Request) -> Response:
+        """
+        Import a cookie jar into a browser.
+
+        PUT /browsers/{index}/cookies
+        """
+        instance = _instance(request)
+        if instance is None:
+            return JSONResponse({"error": "Instance not found"}, status_code=404)
+        refused = _not_relayed()
+        if refused is not None:
+            return refused
+
+        try:
+            cookies = await _read_cookies(request)
+        except ValueError as e:
+            return JSONResponse({"error": f"Invalid cookies: {e}"}, status_code=400)
+
+        jars.instance_jars[instance.index] = cookies
+        updated = await jars.inject(relay.connections_for(instance), cookies) if cookies else 0
+        return JSONResponse({"status": "imported", "cookies": len(cookies), "contexts": updated})
+
+    async def get_session_cookies(request: Request) -> Response:
+        """
+        Export cookies from a session's relayed contexts.
+
+        GET /sessions/{id}/cookies
+        """
+        session = sessions.get_for(request, request.path_params["session_id"])
+        if session is None:
+            return JSONResponse({"error": "Session not found"}, status_code=404)
+
+        connections = relay.connections_for_session(session.id)
+        if connections:
+            cookies = await jars.export(connections)
+        else:
+            cookies = jars.session_jars.get(session.id, [])
+        return _cookies_response(request, cookies)
+
+    async def put_session_cookies(request: Request) -> Response:
+        """
+        Import a cookie jar into a session.
+
+        PUT /sessions/{id}/cookies
+        """
+        session = sessions.get_for(request, request.path_params["session_id"])
+        if session is None:
+            return JSONResponse({"error": "Session not found"}, status_code=404)
+
+        try:
+            cookies = await _read_cookies(request)
+        except ValueError as e:
+            return JSONResponse({"error": f"Invalid cookies: {e}"}, status_code=400)
+
+        jars.session_jars[session.id] = cookies
+        updated = (
+            await jars.inject(relay.connections_for_session(session.id), cookies) if cookies else 0
+        )
+        return JSONResponse({"status": "imported", "cookies": len(cookies), "contexts": updated})
+
+    return [
+        Route("/browsers/{index:int}/cookies", get_browser_cookies, methods=["GET"]),
+        Route("/browsers/{index:int}/cookies", put_browser_cookies, methods=["PUT"]),
+        Route("/sessions/{session_id}/cookies", get_session_cookies, methods=["GET"]),
+        Route("/sessions/{session_id}/cookies", put_session_cookies, methods=["PUT"]),
+    ]
@@ -0,0 +1,202 @@
+"""
+Operator CLI for Camoufox Connector.
+
+``camoufox-connector ctl`` manages a running connector through its HTTP API,
+so the pool can be inspected and managed from terminals and scripts:
+
+    camoufox-connector ctl status
+    camoufox-connector ctl acquire --holder backfill --ttl 600
+    camoufox-connector ctl release 9f1c2e...
+    camoufox-connector ctl restart 2
+    camoufox-connector ctl drain 2
+    camoufox-connector ctl scale 5
+
+The connector is found at ``--url`` (``CAMOUFOX_CONNECTOR_URL``) and called
+with ``--api-key`` (``CAMOUFOX_CONNECTOR_API_KEY``) when it requires one.
+Failed calls print the connector's error and exit with status 1.
+"""
+
+from __future__ import annotations
+
+import argparse
+import json
+import os
+import sys
+from typing import Any, Optional
+
+import httpx
+
+DEFAULT_URL = "http://localhost:8080"
+
+
+class CtlError(Exception):
+    """Raised when the connector can't be reached or rejects a call."""
+
+
+def parse_args(argv: list[str]) -> argparse.Namespace:
+    """Parse ``ctl`` command line arguments."""
+    parser = argparse.ArgumentParser(
+        prog="camoufox-connector ctl",
+        description="Inspect and manage a running Camoufox Connector",
+    )
+    parser.add_argument(
+        "--url",
+        default=os.environ.get("CAMOUFOX_CONNECTOR_URL", DEFAULT_URL),
+        help=f"Connector API URL (default: $CAMOUFOX_CONNECTOR_URL or {DEFAULT_URL})",
+    )
+    parser.add_argument(
+        "--api-key",
+        default=os.environ.get("CAMOUFOX_CONNECTOR_API_KEY"),
+        help="API key (default: $CAMOUFOX_CONNECTOR_API_KEY)",
+    )
+    parser.add_argument(
+        "--json",
+        action="store_true",
+        help="Print the connector's JSON responses as they are",
+    )
+    commands = parser.add_subparsers(dest="command", required=True, metavar="COMMAND")
+
+    commands.add_parser("status", help="Show the pool's browsers and leases")
+
+    acquire = commands.add_parser("acquire", help="Lease a browser and print its endpoint")
+    acquire.add_argument("--holder", help="Name shown for the lease on the dashboard")
+    acquire.add_argument("--ttl", type=float, help="Seconds after which the lease expires")
+    acquire.add_argument("--proxy", help="Proxy URL for the lease")
+    acquire.add_argument("--version", help="Browser version to lease")
+    acquire.add_argument("--group", help="Pool group to lease from")
+    acquire.add_argument(
+        "--label",
+        action="append",
+        default=[],
+        metavar="KEY=VALUE",
+        help="Label the leased browser must have (repeatable)",
+    )
+    acquire.add_argument("--scope", choices=["browser", "context"], help="Lease a whole browser or a context")
+
+    release = commands.add_parser("release", help="Release a lease")
+    release.add_argument("session_id", help="Session ID of the lease")
+
+    restart = commands.add_parser("restart", help="Relaunch a browser")
+    restart.add_argument("index", type=int, help="Browser instance index")
+
+    drain = commands.add_parser("drain", help="Stop handing out a browser, or resume it")
+    drain.add_argument("index", type=int, help="Browser instance index")
+    drain.add_argument("--resume", action="store_true", help="Hand the browser out again")
+
+    scale = commands.add_parser("scale", help="Grow or shrink the pool")
+    scale.add_argument("size", type=int, help="Number of browser instances")
+
+    return parser.parse_args(argv)
+
+
+def call(args: argparse.Namespace, method: str, path: str, body: Optional[dict] = None) -> Any:
+    """
+    Call the connector's API.
+
+    Returns:
+        The decoded JSON response
+
+    Raises:
+        CtlError: If the connector couldn't be reached or returned an error
+    """
+    headers = {"Authorization": f"Bearer {args.api_key}"} if args.api_key else {}
+    try:
+        response = httpx.request(method, f"{args.url.rstrip('/')}{path}", json=body, headers=headers, timeout=60.0)
+    except httpx.HTTPError as e:
+        raise CtlError(f"Could not reach {args.url}: {e}") from e
+    try:
+        data = response.json()
+    except ValueError:
+        data = None
+    if response.is_error:
+        error = data.get("error") if isinstance(data, dict) else None
+        raise CtlError(f"{method} {path} failed with {response.status_code}: {error or response.text}")
+    return data
+
+
+def format_status(stats: dict) -> str:
+    """Render pool statistics as a table."""
+    lines = [
+        f"Mode: {stats['mode']}  Instances: {stats['healthy_instances']}/{stats['total_instances']} healthy"
+        f"  Connections: {stats['active_connections']}",
+        "",
+        f"{'#':>3}  {'STATE':<10} {'VERSION':<8} {'CONN':>4} {'UPTIME':>8}  LEASE",
+    ]
+    for inst in stats["instances"]:
+        if inst["retiring"]:
+            state = "retiring"
+        elif inst["draining"]:
+            state = "draining"
+        elif not inst["is_healthy"]:
+            state = "down"
+        else:
+            state = "leased" if inst["leased"] else "idle"
+        if inst["session_id"]:
+            lease = inst["session_id"]
+        elif inst["context_sessions"]:
+            lease = f"{len(inst['context_sessions'])} context lease(s)"
+        else:
+            lease = "-"
+        lines.append(
+            f"{inst['index']:>3}  {state:<10} {inst['version'] or '-':<8} {inst['connections']:>4}"
+            f" {round(inst['uptime']):>7}s  {lease}"
+        )
+    return "\n".join(lines)
+
+
+def run(args: argparse.Namespace) -> str:
+    """Run a ``ctl`` command and return what to print."""
+    if args.command == "status":
+        data = call(args, "GET", "/stats")
+        return json.dumps(data, indent=2) if args.json else format_status(data)
+
+    if args.command == "acquire":
+        labels = {}
+        for label in args.label:
+            key, sep, value = label.partition("=")
+            if not sep:
+                raise CtlError(f"Invalid label {label!r}, expected KEY=VALUE")
+            labels[key] = value
+        options = {
+            "holder": args.holder,
+            "ttl": args.ttl,
+            "proxy": args.proxy,
+            "version": args.version,
+            "group": args.group,
+            "labels": labels or None,
+            "scope": args.scope,
+        }
+        data = call(args, "POST", "/sessions", {k: v for k, v in options.items() if v is not None})
+        return json.dumps(data, indent=2) if args.json else f"{data['id']} {data['endpoint']}"
+
+    if args.command == "release":
+        data = call(args, "DELETE", f"/sessions/{args.session_id}")
+        if args.json:
+            return json.dumps(data, indent=2)
+        summary = data.get("summary") or {}
+        return f"Released {args.session_id} after {summary.get('duration', 0):g}s"
+
+    if args.command == "restart":
+        data = call(args, "POST", f"/restart/{args.index}")
+        return json.dumps(data, indent=2) if args.json else f"Restarted browser {args.index}"
+
+    if args.command == "drain":
+        data = call(args, "DELETE" if args.resume else "POST", f"/browsers/{args.index}/drain")
+        return json.dumps(data, indent=2) if args.json else f"Browser {args.index} {data['status']}"
+
+    if args.command == "scale":
+        data = call(args, "POST", "/admin/scale", {"pool_size": args.size})
+        return json.dumps(data, indent=2) if args.json else f"Scaled pool from {data['previous']} to {args.size}"
+
+    raise CtlError(f"Unknown command {args.command}")
+
+
+def main(argv: list[str]) -> int:
+    """Entry point of ``camoufox-connector ctl``; returns the exit status."""
+    args = parse_args(argv)
+    try:
+        print(run(args))
+    except CtlError as e:
+        print(f"error: {e}", file=sys.stderr)
+        return 1
+    return 0
@@ -0,0 +1,151 @@
+"""
+Embedded admin dashboard for Camoufox Connector.
+
+Serves a single self-contained HTML page that polls the JSON APIs and shows
+live pool status, with buttons to restart or drain individual instances.
+When API keys are configured, open it as ``/dashboard?api_key=<key>``.
+"""
+
+from __future__ import annotations
+
+from starlette.requests import Request
+from starlette.responses import HTMLResponse, Response
+from starlette.routing import Route
+
+DASHBOARD_HTML = """<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Camoufox Connector</title>
+<style>
+  body { font-family: system-ui, sans-serif; margin: 2rem; background: #fafafa; color: #222; }
+  h1 { font-size: 1.4rem; margin-bottom: 0.2rem; }
+  #summary { color: #555; margin-bottom: 1.5rem; }
+  table { border-collapse: collapse; width: 100%; background: #fff; }
+  th, td { padding: 0.5rem 0.75rem; border-bottom: 1px solid #e5e5e5; text-align: left; vertical-align: top; }
+  th { background: #f0f0f0; font-weight: 600; }
+  .state { font-weight: 600; }
+  .healthy { color: #1b7f3b; }
+  .unhealthy { color: #c62828; }
+  .leased { color: #1565c0; }
+  .draining { color: #ef6c00; }
+  .errors { font-size: 0.85rem; color: #c62828; max-width: 28rem; }
+  button { margin-right: 0.3rem; cursor: pointer; }
+  code { font-size: 0.85rem; }
+</style>
+</head>
+<body>
+<h1>Camoufox Connector</h1>
+<div id="summary">Loading&hellip;</div>
+<table>
+  <thead>
+    <tr>
+      <th>#</th><th>State</th><th>Lease holder</th><th>Memory</th><th>Uptime</th>
+      <th>Connections</th><th>Recent errors</th><th>Actions</th>
+    </tr>
+  </thead>
+  <tbody id="instances"></tbody>
+</table>
+<script>
+const base = window.location.pathname.replace(/\\/dashboard\\/?$/, "");
+const apiKey = new URLSearchParams(window.location.search).get("api_key");
+
+function api(path) {
+  return base + path + (apiKey ? "?api_key=" + encodeURIComponent(apiKey) : "");
+}
+
+function fmtBytes(n) {
+  if (n === null || n === undefined) return "n/a";
+  const units = ["B", "KB", "MB", "GB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function fmtDuration(s) {
+  s = Math.floor(s);
+  const h = Math.floor(s / 3600), m = Math.floor((s % 3600) / 60);
+  return (h ? h + "h " : "") + (h || m ? m + "m " : "") + (s % 60) + "s";
+}
+
+function escapeHtml(s) {
+  return String(s).replace(/[&<>"']/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c]));
+}
+
+function stateOf(inst) {
+  if (!inst.is_healthy) return ["unhealthy", "unhealthy"];
+  if (inst.draining) return ["draining", "draining"];
+  if (inst.leased) return ["leased", "leased"];
+  return ["healthy", "idle"];
+}
+
+async function action(method, path) {
+  await fetch(api(path), {method});
+  refresh();
+}
+
+async function refresh() {
+  try {
+    const [stats, sessions] = await Promise.all([
+      fetch(api("/stats")).then(r => r.json()),
+      fetch(api("/sessions")).then(r => r.ok ? r.json() : {sessions: []}),
+    ]);
+    const holders = {};
+    for (const s of sessions.sessions) holders[s.id] = s.options.holder || s.id.slice(0, 8);
+
+    document.getElementById("summary").textContent =
+      `${stats.mode} mode · ${stats.healthy_instances}/${stats.total_instances} healthy · ` +
+      `${sessions.sessions.length} active lease(s) · ${stats.total_connections} total connections`;
+
+    const rows = stats.instances.map(inst => {
+      const [cls, label] = stateOf(inst);
+      const errors = inst.errors.slice(-3).map(e =>
+        new Date(e.time * 1000).toLocaleTimeString() + " " + escapeHtml(e.message)).join("<br>");
+      const drain = inst.draining
+        ? `<button onclick="action('DELETE', '/browsers/${inst.index}/drain')">Resume</button>`
+        : `<button onclick="action('POST', '/browsers/${inst.index}/drain')">Drain</button>`;
+      return `<tr>
+        <td>${inst.index}</td>
+        <td class="state ${cls}">${label}</td>
+        <td>${inst.session_id ? escapeHtml(holders[inst.session_id] || inst.session_id)
+          : inst.context_sessions.length ? `${inst.context_sessions.length} context lease(s)` : "&mdash;"}</td>
+        <td>${fmtBytes(inst.memory)}</td>
+        <td>${fmtDuration(inst.uptime)}</td>
+        <td>${inst.connections} / ${inst.total_connections}</td>
+        <td class="errors">${errors || "&mdash;"}</td>
+        <td><button onclick="action('POST', '/restart/${inst.index}')">Restart</button>${drain}</td>
+      </tr>`;
+    });
+    document.getElementById("instances").innerHTML = rows.join("");
+  } catch (e) {
+    document.getElementById("summary").textContent = "Failed to load status: " + e;
+  }
+}
+
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+"""
+
+
+def create_dashboard_routes() -> list[Route]:
+    """
+    Create the route serving the admin dashboard.
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def dashboard(request: Request) -> Response:
+        """
+        Serve the admin dashboard.
+
+        GET /dashboard
+        """
+        return HTMLResponse(DASHBOARD_HTML)
+
+    return [
+        Route("/dashboard", dashboard, methods=["GET"]),
+    ]
@@ -0,0 +1,259 @@
+"""
+Mobile device emulation for Camoufox Connector.
+
+Leases acquired with a ``device`` preset look like that device: new browser
+contexts get its viewport, pixel ratio, touch support and user agent, and
+the browser is launched with a matching Camoufox fingerprint (navigator,
+screen and pixel ratio). Built-in presets cover common phones and tablets;
+more can be defined in the configuration file or registered at runtime via
+``POST /devices``.
+"""
+
+from __future__ import annotations
+
+import logging
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING
+
+from pydantic import BaseModel, ConfigDict, Field, ValidationError
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+if TYPE_CHECKING:
+    from .pool import BrowserPool
+    from .relay import Relay, RelayConnection
+
+logger = logging.getLogger(__name__)
+
+
+class UnknownDeviceError(LookupError):
+    """Raised when a lease asks for a device preset that does not exist."""
+
+
+class DevicePreset(BaseModel):
+    """Screen, input and identity of an emulated device."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    name: str = Field(min_length=1, max_length=100, description="Name the preset is selected by")
+    width: int = Field(gt=0, le=4096, description="Viewport width in CSS pixels")
+    height: int = Field(gt=0, le=4096, description="Viewport height in CSS pixels")
+    device_scale_factor: float = Field(default=1.0, gt=0, le=5, description="Device pixel ratio")
+    has_touch: bool = Field(default=True, description="Whether the device has a touch screen")
+    max_touch_points: int = Field(default=5, ge=0, description="Reported navigator.maxTouchPoints")
+    user_agent: str = Field(description="User agent string")
+    platform: str = Field(description="Reported navigator.platform")
+
+    def context_params(self) -> dict:
+        """Browser context options emulating the device."""
+        size = {"width": self.width, "height": self.height}
+        return {
+            "viewport": size,
+            "screen": size,
+            "deviceScaleFactor": self.device_scale_factor,
+            "hasTouch": self.has_touch,
+            "userAgent": self.user_agent,
+        }
+
+    def fingerprint(self) -> dict:
+        """Camoufox fingerprint properties matching the device."""
+        return {
+            "navigator.userAgent": self.user_agent,
+            "navigator.platform": self.platform,
+            "navigator.maxTouchPoints": self.max_touch_points if self.has_touch else 0,
+            "screen.width": self.width,
+            "screen.height": self.height,
+            "screen.availWidth": self.width,
+            "screen.availHeight": self.height,
+            "window.devicePixelRatio": self.device_scale_factor,
+        }
+
+
+BUILTIN_DEVICES: dict[str, DevicePreset] = {
+    preset.name: preset
+    for preset in [
+        DevicePreset(
+            name="Pixel 8",
+            width=412,
+            height=915,
+            device_scale_factor=2.625,
+            user_agent="Mozilla/5.0 (Android 14; Mobile; rv:135.0) Gecko/135.0 Firefox/135.0",
+            platform="Linux armv81",
+        ),
+        DevicePreset(
+            name="Galaxy S24",
+            width=384,
+            height=832,
+            device_scale_factor=2.8125,
+            user_agent="Mozilla/5.0 (Android 14; Mobile; rv:135.0) Gecko/135.0 Firefox/135.0",
+            platform="Linux armv81",
+        ),
+        DevicePreset(
+            name="Galaxy Tab S9",
+            width=800,
+            height=1280,
+            device_scale_factor=2.0,
+            user_agent="Mozilla/5.0 (Android 14; Tablet; rv:135.0) Gecko/135.0 Firefox/135.0",
+            platform="Linux armv81",
+        ),
+        DevicePreset(
+            name="iPhone 15",
+            width=393,
+            height=852,
+            device_scale_factor=3.0,
+            user_agent=(
+                "Mozilla/5.0 (iPhone; CPU iPhone OS 17_6 like Mac OS X) AppleWebKit/605.1.15 "
+                "(KHTML, like Gecko) FxiOS/135.0 Mobile/15E148 Safari/605.1.15"
+            ),
+            platform="iPhone",
+        ),
+        DevicePreset(
+            name="iPhone 15 Pro Max",
+            width=430,
+            height=932,
+            device_scale_factor=3.0,
+            user_agent=(
+                "Mozilla/5.0 (iPhone; CPU iPhone OS 17_6 like Mac OS X) AppleWebKit/605.1.15 "
+                "(KHTML, like Gecko) FxiOS/135.0 Mobile/15E148 Safari/605.1.15"
+            ),
+            platform="iPhone",
+        ),
+        DevicePreset(
+            name="iPad Air",
+            width=820,
+            height=1180,
+            device_scale_factor=2.0,
+            user_agent=(
+                "Mozilla/5.0 (iPad; CPU OS 17_6 like Mac OS X) AppleWebKit/605.1.15 "
+                "(KHTML, like Gecko) FxiOS/135.0 Mobile/15E148 Safari/605.1.15"
+            ),
+            platform="iPad",
+        ),
+    ]
+}
+
+
+@dataclass
+class DeviceRegistry:
+    """
+    Looks up device presets.
+
+    Presets registered at runtime take precedence over those from the
+    configuration, which take precedence over the built-in ones.
+    """
+
+    pool: BrowserPool
+    custom: dict[str, DevicePreset] = field(default_factory=dict)
+
+    def all(self) -> dict[str, DevicePreset]:
+        """Get every preset by name."""
+        configured = {preset.name: preset for preset in self.pool.settings.devices}
+        return {**BUILTIN_DEVICES, **configured, **self.custom}
+
+    def get(self, name: str) -> DevicePreset:
+        """
+        Get a preset by name.
+
+        Raises:
+            UnknownDeviceError: If there is no such preset.
+        """
+        preset = self.all().get(name)
+        if preset is None:
+            raise UnknownDeviceError(f"Unknown device preset '{name}'")
+        return preset
+
+    def register(self, preset: DevicePreset) -> None:
+        """Add or replace a custom preset."""
+        self.custom[preset.name] = preset
+
+    def unregister(self, name: str) -> bool:
+        """Remove a custom preset; built-in and configured ones stay."""
+        return self.custom.pop(name, None) is not None
+
+
+@dataclass
+class DeviceEmulator:
+    """Applies the device preset of a lease to its new browser contexts."""
+
+    relay: Relay
+    registry: DeviceRegistry
+
+    def __post_init__(self) -> None:
+        self.relay.context_params_providers.append(self._context_params)
+
+    def _context_params(self, connection: RelayConnection) -> dict:
+        """Emulate the lease's device in a new context."""
+        session = connection.session
+        if session is None or session.options.device is None:
+            return {}
+        try:
+            return self.registry.get(session.options.device).context_params()
+        except UnknownDeviceError:
+            # The preset was unregistered after the lease was acquired
+            logger.warning(f"Device preset '{session.options.device}' of session {session.id} is gone")
+            return {}
+
+
+def create_device_routes(registry: DeviceRegistry) -> list[Route]:
+    """
+    Create HTTP routes for listing and registering device presets.
+
+    Args:
+        registry: Device registry
+
+    Returns:
+        List of Starlette routes
+    """
+
+    def render(preset: DevicePreset) -> dict:
+        """Serialize a preset with where it comes from."""
+        if preset.name in registry.custom:
+            source = "custom"
+        elif preset.name in BUILTIN_DEVICES and BUILTIN_DEVICES[preset.name] is preset:
+            source = "builtin"
+        else:
+            source = "config"
+        return {**preset.model_dump(), "source": source}
+
+    async def list_devices(request: Request) -> Response:
+        """
+        List device presets.
+
+        GET /devices
+        """
+        devices = [render(preset) for preset in registry.all().values()]
+        return JSONResponse({"devices": devices, "count": len(devices)})
+
+    async def register_device(request: Request) -> Response:
+        """
+        Register a custom device preset.
+
+        POST /devices
+        """
+        try:
+            preset = DevicePreset.model_validate_json(await request.body())
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid device preset", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+        registry.register(preset)
+        return JSONResponse(render(preset), status_code=201)
+
+    async def unregister_device(request: Request) -> Response:
+        """
+        Remove a custom device preset.
+
+        DELETE /devices/{name}
+        """
+        name = request.path_params["name"]
+        if not registry.unregister(name):
+            return JSONResponse({"error": "No custom device preset with this name"}, status_code=404)
+        return JSONResponse({"status": "removed", "name": name})
+
+    return [
+        Route("/devices", list_devices, methods=["GET"]),
+        Route("/devices", register_device, methods=["POST"]),
+        Route("/devices/{name}", unregister_device, methods=["DELETE"]),
+    ]
@@ -0,0 +1,94 @@
+"""
+JavaScript dialog handling for Camoufox Connector.
+
+Server-side tasks answer alert, confirm, prompt and beforeunload dialogs
+automatically so they never hang on an unexpected dialog. Rules pick the
+answer by page URL and dialog type; the first matching rule wins, and
+dialogs no rule matches are dismissed (beforeunload dialogs are accepted so
+navigations can proceed).
+"""
+
+from __future__ import annotations
+
+import fnmatch
+import logging
+from typing import Any, Literal, Optional, Sequence
+
+from pydantic import BaseModel, ConfigDict, Field
+
+logger = logging.getLogger(__name__)
+
+DialogType = Literal["alert", "confirm", "prompt", "beforeunload"]
+
+
+class DialogRule(BaseModel):
+    """How to answer dialogs on matching pages."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    url: str = Field(
+        default="*",
+        description="URL glob pattern of the page showing the dialog",
+    )
+
+    type: Optional[DialogType] = Field(
+        default=None,
+        description="Dialog type the rule applies to (default: all)",
+    )
+
+    action: Literal["accept", "dismiss"] = Field(
+        default="dismiss",
+        description="Whether to accept or dismiss the dialog",
+    )
+
+    prompt_text: Optional[str] = Field(
+        default=None,
+        description="Text entered into prompt dialogs before accepting",
+    )
+
+    def matches(self, url: str, dialog_type: str) -> bool:
+        """Check whether the rule applies to a dialog."""
+        if self.type is not None and self.type != dialog_type:
+            return False
+        return fnmatch.fnmatchcase(url, self.url)
+
+
+def match_dialog_rule(rules: Sequence[DialogRule], url: str, dialog_type: str) -> Optional[DialogRule]:
+    """Get the first rule applying to a dialog."""
+    for rule in rules:
+        if rule.matches(url, dialog_type):
+            return rule
+    return None
+
+
+async def answer_dialog(dialog: Any, page_url: str, rules: Sequence[DialogRule]) -> dict:
+    """
+    Answer a Playwright dialog according to the rules.
+
+    Returns:
+        A record of the dialog and how it was answered.
+    """
+    rule = match_dialog_rule(rules, page_url, dialog.type)
+    if rule is not None:
+        action = rule.action
+    else:
+        action = "accept" if dialog.type == "beforeunload" else "dismiss"
+
+    record = {
+        "type": dialog.type,
+        "message": dialog.message,
+        "url": page_url,
+        "action": action,
+    }
+    try:
+        if action == "accept":
+            if rule is not None and rule.prompt_text is not None:
+                await dialog.accept(rule.prompt_text)
+            else:
+                await dialog.accept()
+        else:
+            await dialog.dismiss()
+    except Exception as e:
+        logger.debug(f"Failed to answer {dialog.type} dialog: {e}")
+        record["error"] = str(e)
+    return record
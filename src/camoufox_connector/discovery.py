@@ -0,0 +1,443 @@
+"""
+Service discovery for Camoufox Connector.
+
+Service meshes and discovery-based clients find pools by name instead of a
+hardcoded API URL. With ``discovery`` configured, the connector registers
+itself as ``<service>`` and each healthy browser as ``<service>-browser``
+in Consul or etcd, and keeps the registrations in step as browsers launch,
+crash and are removed:
+
+- Consul: services on the local agent, with TTL checks the connector keeps
+  passing, so a connector that dies is deregistered after a minute or two.
+- etcd: JSON values under ``<prefix>/<service>/<node>``, attached to a lease
+  the connector keeps alive, so they disappear with it.
+
+Either way, ``GET /discovery/srv`` serves the same registrations as DNS-SD
+records (PTR, SRV and TXT; ``?format=zone`` for a zone file), for DNS
+servers fed from a file or for clients resolving SRV records themselves. A
+browser's WebSocket path, which SRV records cannot carry, is in its TXT
+record and registration metadata.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import base64
+import json
+import logging
+import re
+import socket
+import time
+from dataclasses import asdict, dataclass, field
+from typing import TYPE_CHECKING, Optional
+from urllib.parse import urlsplit
+
+import httpx
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .advertise import advertise_endpoint
+from .config import Discovery
+
+if TYPE_CHECKING:
+    from .events import Event, EventBus
+    from .pool import BrowserPool
+
+logger = logging.getLogger(__name__)
+
+REGISTRY_TIMEOUT = 10.0
+
+# Events after which the registrations are synced right away
+SYNC_EVENTS = {"browser-ready", "browser-crashed", "browser-restarted", "browser-failed", "browser-removed"}
+
+
+class DiscoveryError(Exception):
+    """Raised when a registry rejects a request or cannot be reached."""
+
+
+@dataclass
+class ServiceRecord:
+    """One registration: the connector's API or a browser."""
+
+    id: str
+    service: str
+    instance: str
+    host: str
+    port: int
+    path: str
+    scheme: str
+    meta: dict[str, str] = field(default_factory=dict)
+
+    @property
+    def url(self) -> str:
+        """URL the record points clients at."""
+        host = f"[{self.host}]" if ":" in self.host else self.host
+        return f"{self.scheme}://{host}:{self.port}{self.path}"
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {**asdict(self), "url": self.url}
+
+
+def _node_name(port: int) -> str:
+    """Name this connector is registered under, unique per host and port."""
+    name = re.sub(r"[^a-z0-9-]+", "-", socket.gethostname().lower()).strip("-") or "connector"
+    return f"{name}-{port}"
+
+
+def advertise_host(config: Discovery, api_host: str) -> str:
+    """Host clients reach this connector at."""
+    if config.advertise_host:
+        return config.advertise_host
+    if api_host not in ("", "0.0.0.0", "::"):
+        return api_host
+    return socket.gethostname()
+
+
+@dataclass
+class Registrar:
+    """Base class keeping a registry in step with the records."""
+
+    config: Discovery
+    client: httpx.AsyncClient
+    registered: dict[str, ServiceRecord] = field(default_factory=dict)
+
+    async def _request(self, method: str, path: str, **kwargs) -> dict:
+        """Call the registry's HTTP API."""
+        try:
+            response = await self.client.request(
+                method,
+                f"{self.config.url.rstrip('/')}{path}",
+                headers=self.headers(),
+                **kwargs,
+            )
+        except httpx.HTTPError as e:
+            raise DiscoveryError(f"{self.config.backend} unreachable: {e}") from e
+        if response.status_code >= 400:
+            raise DiscoveryError(f"{self.config.backend} returned HTTP {response.status_code}: {response.text[:200]}")
+        return response.json() if response.content else {}
+
+    def headers(self) -> dict:
+        """Headers of requests to the registry."""
+        return {}
+
+    async def sync(self, records: list[ServiceRecord]) -> None:
+        """Register new and changed records, deregister gone ones and heartbeat the rest."""
+        current = {record.id: record for record in records}
+        for record_id in [record_id for record_id in self.registered if record_id not in current]:
+            await self.remove(self.registered[record_id])
+            del self.registered[record_id]
+        for record in records:
+            if self.registered.get(record.id) != record:
+                await self.put(record)
+                self.registered[record.id] = record
+        await self.heartbeat()
+
+    async def put(self, record: ServiceRecord) -> None:
+        """Register or update a record."""
+        raise NotImplementedError
+
+    async def remove(self, record: ServiceRecord) -> None:
+        """Deregister a record."""
+        raise NotImplementedError
+
+    async def heartbeat(self) -> None:
+        """Keep the registrations alive."""
+        raise NotImplementedError
+
+    async def close(self) -> None:
+        """Deregister everything."""
+        for record in list(self.registered.values()):
+            await self.remove(record)
+        self.registered.clear()
+
+
+@dataclass
+class ConsulRegistrar(Registrar):
+    """Registers services with TTL checks on a Consul agent."""
+
+    def headers(self) -> dict:
+        return {"X-Consul-Token": self.config.token} if self.config.token else {}
+
+    async def put(self, record: ServiceRecord) -> None:
+        await self._request("PUT", "/v1/agent/service/register", json={
+            "ID": record.id,
+            "Name": record.service,
+            "Address": record.host,
+            "Port": record.port,
+            "Meta": record.meta,
+            "Check": {
+                "CheckID": f"service:{record.id}",
+                "TTL": f"{self.config.ttl}s",
+                # Consul's minimum is a minute
+                "DeregisterCriticalServiceAfter": f"{max(60, self.config.ttl * 2)}s",
+            },
+        })
+
+    async def remove(self, record: ServiceRecord) -> None:
+        await self._request("PUT", f"/v1/agent/service/deregister/{record.id}")
+
+    async def heartbeat(self) -> None:
+        for record_id in self.registered:
+            await self._request("PUT", f"/v1/agent/check/pass/service:{record_id}")
+
+
+def _b64(value: str) -> str:
+    """Encode a key or value for etcd's JSON API."""
+    return base64.b64encode(value.encode()).decode()
+
+
+@dataclass
+class EtcdRegistrar(Registrar):
+    """Puts records under a lease of an etcd cluster, through its JSON API."""
+
+    lease: Optional[str] = None
+
+    def headers(self) -> dict:
+        return {"Authorization": self.config.token} if self.config.token else {}
+
+    def _key(self, record: ServiceRecord) -> str:
+        """Key of a record."""
+        return f"{self.config.prefix.rstrip('/')}/{record.service}/{record.instance}"
+
+    async def _grant(self) -> str:
+        """Get a lease the records are attached to."""
+        if self.lease is None:
+            result = await self._request("POST", "/v3/lease/grant", json={"TTL": self.config.ttl})
+            self.lease = str(result["ID"])
+        return self.lease
+
+    async def put(self, record: ServiceRecord) -> None:
+        await self._request("POST", "/v3/kv/put", json={
+            "key": _b64(self._key(record)),
+            "value": _b64(json.dumps(record.to_dict())),
+            "lease": await self._grant(),
+        })
+
+    async def remove(self, record: ServiceRecord) -> None:
+        await self._request("POST", "/v3/kv/deleterange", json={"key": _b64(self._key(record))})
+
+    async def heartbeat(self) -> None:
+        if self.lease is None:
+            return
+        result = await self._request("POST", "/v3/lease/keepalive", json={"ID": self.lease})
+        if int((result.get("result") or {}).get("TTL", 0)) <= 0:
+            # The lease expired, taking the records with it; put them again
+            logger.warning("etcd discovery lease expired; registering again")
+            self.lease = None
+            for record in self.registered.values():
+                await self.put(record)
+
+    async def close(self) -> None:
+        if self.lease is not None:
+            await self._request("POST", "/v3/lease/revoke", json={"ID": self.lease})
+            self.lease = None
+        self.registered.clear()
+
+
+REGISTRARS = {
+    "consul": ConsulRegistrar,
+    "etcd": EtcdRegistrar,
+}
+
+
+@dataclass
+class ServiceDiscovery:
+    """Keeps the connector and its browsers registered for discovery."""
+
+    pool: BrowserPool
+    registrar: Optional[Registrar] = None
+    last_sync: Optional[float] = None
+    error: Optional[str] = None
+    _client: Optional[httpx.AsyncClient] = None
+    _task: Optional[asyncio.Task] = None
+    _wake: asyncio.Event = field(default_factory=asyncio.Event)
+
+    @property
+    def config(self) -> Discovery:
+        """Configured discovery, or the defaults when none is."""
+        return self.pool.settings.discovery or Discovery()
+
+    @property
+    def node(self) -> str:
+        """Name this connector is registered under."""
+        return _node_name(self.pool.settings.api_port)
+
+    def attach(self, bus: EventBus) -> None:
+        """Sync as soon as browsers come and go."""
+        bus.listeners.append(self.handle)
+
+    async def handle(self, event: Event) -> None:
+        """Wake the sync loop on browser changes."""
+        if event.type in SYNC_EVENTS:
+            self._wake.set()
+
+    def records(self) -> list[ServiceRecord]:
+        """The connector's API and its healthy browsers."""
+        settings = self.pool.settings
+        config = self.config
+        host = advertise_host(config, settings.api_host)
+        common = {"region": settings.region} if settings.region else {}
+        records = [ServiceRecord(
+            id=f"{config.service}-{self.node}",
+            service=config.service,
+            instance=self.node,
+            host=host,
+            port=settings.api_port,
+            path="/",
+            scheme="http",
+            meta={**common, "mode": settings.mode.value},
+        )]
+        for instance in self.pool.instances:
+            if not instance.is_healthy or not instance.ws_endpoint:
+                continue
+            if settings.relay:
+                port, path = settings.api_port, f"/browsers/{instance.index}/ws"
+            else:
+                # The browser's port as advertised, e.g. as published by Docker
+                endpoint = urlsplit(advertise_endpoint(settings, instance.ws_endpoint))
+                port, path = endpoint.port or 80, endpoint.path
+            meta = {**common, "index": str(instance.index), "path": path}
+            if instance.version:
+                meta["version"] = instance.version
+            meta.update({f"label-{key}": value for key, value in instance.labels.items()})
+            records.append(ServiceRecord(
+                id=f"{config.service}-browser-{self.node}-{instance.index}",
+                service=f"{config.service}-browser",
+                instance=f"{self.node}-{instance.index}",
+                host=host,
+                port=port,
+                path=path,
+                scheme="ws",
+                meta=meta,
+            ))
+        return records
+
+    def dns_records(self) -> list[dict]:
+        """The records as DNS-SD PTR, SRV and TXT records."""
+        config = self.config
+        dns = []
+        for record in self.records():
+            service = f"_{record.service}._tcp.{config.domain}"
+            name = f"{record.instance}.{service}"
+            txt = " ".join(f'"{key}={value}"' for key, value in sorted(record.meta.items()) if '"' not in value)
+            dns += [
+                {"name": service, "type": "PTR", "ttl": config.ttl, "data": f"{name}."},
+                {"name": name, "type": "SRV", "ttl": config.ttl, "data": f"0 0 {record.port} {record.host}."},
+                {"name": name, "type": "TXT", "ttl": config.ttl, "data": txt or '""'},
+            ]
+        return dns
+
+    def zone(self) -> str:
+        """Render the DNS records as zone file lines."""
+        return "".join(
+            f"{record['name']}. {record['ttl']} IN {record['type']} {record['data']}\n"
+            for record in self.dns_records()
+        )
+
+    async def sync(self) -> None:
+        """Bring the registry in step with the pool."""
+        config = self.pool.settings.discovery
+        if self.registrar is not None and self.registrar.config != config:
+            # Discovery was reconfigured; leave the old registry before joining the new one
+            await self._leave()
+        if self.registrar is None and config is not None and config.backend is not None:
+            if self._client is None:
+                self._client = httpx.AsyncClient(timeout=REGISTRY_TIMEOUT)
+            self.registrar = REGISTRARS[config.backend](config=config, client=self._client)
+            logger.info(f"Registering with {config.backend} at {config.url} as {config.service}")
+        if self.registrar is None:
+            return
+        try:
+            await self.registrar.sync(self.records())
+        except DiscoveryError as e:
+            if self.error != str(e):
+                logger.warning(f"Service discovery sync failed: {e}")
+            self.error = str(e)
+            return
+        self.error = None
+        self.last_sync = time.time()
+
+    async def _leave(self) -> None:
+        """Deregister from the current registry."""
+        registrar, self.registrar = self.registrar, None
+        if registrar is None:
+            return
+        try:
+            await registrar.close()
+        except DiscoveryError as e:
+            logger.warning(f"Service discovery deregistration failed: {e}")
+
+    def start(self) -> None:
+        """Start keeping the registrations in step."""
+        if self._task is None:
+            self._task = asyncio.create_task(self._loop())
+
+    async def _loop(self) -> None:
+        """Sync now, on browser changes and often enough to heartbeat within the TTL."""
+        while True:
+            self._wake.clear()
+            await self.sync()
+            try:
+                await asyncio.wait_for(self._wake.wait(), timeout=self.config.ttl / 3)
+            except asyncio.TimeoutError:
+                pass
+
+    def report(self) -> dict:
+        """Describe the registrations."""
+        config = self.pool.settings.discovery
+        return {
+            "backend": config.backend if config is not None else None,
+            "url": config.url if config is not None and config.backend else None,
+            "node": self.node,
+            "registered": [record.to_dict() for record in (self.registrar.registered.values() if self.registrar else [])],
+            "last_sync": self.last_sync,
+            "error": self.error,
+        }
+
+    async def close(self) -> None:
+        """Stop syncing and deregister."""
+        if self._task is not None:
+            self._task.cancel()
+            await asyncio.gather(self._task, return_exceptions=True)
+            self._task = None
+        await self._leave()
+        if self._client is not None:
+            await self._client.aclose()
+            self._client = None
+
+
+def create_discovery_routes(discovery: ServiceDiscovery) -> list[Route]:
+    """
+    Create routes describing service discovery.
+
+    Args:
+        discovery: Service discovery registering the connector
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_discovery(request: Request) -> Response:
+        """
+        The registry and what is registered in it.
+
+        GET /discovery
+        """
+        return JSONResponse(discovery.report())
+
+    async def get_srv(request: Request) -> Response:
+        """
+        The connector and its browsers as DNS-SD records; ``?format=zone`` for a zone file.
+
+        GET /discovery/srv
+        """
+        if request.query_params.get("format") == "zone":
+            return Response(discovery.zone(), media_type="text/plain")
+        return JSONResponse({"records": discovery.dns_records()})
+
+    return [
+        Route("/discovery", get_discovery, methods=["GET"]),
+        Route("/discovery/srv", get_srv, methods=["GET"]),
+    ]
@@ -0,0 +1,150 @@
+"""
+Virtual displays for headful browsers.
+
+Some targets detect headless browsers even with Camoufox. In headful mode
+each browser instance gets its own Xvfb display, so the browsers render to a
+real (virtual) screen without a desktop session. Displays are allocated
+starting at a base number, skipping any already in use on the host, and kept
+for the instance across relaunches until it is removed or the pool stops.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+import shutil
+import sys
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import Optional
+
+logger = logging.getLogger(__name__)
+
+X11_SOCKET_DIR = Path("/tmp/.X11-unix")
+DISPLAY_START_TIMEOUT = 10.0
+
+
+def needs_virtual_display() -> bool:
+    """Whether headful browsers need a virtual display on this platform."""
+    return sys.platform.startswith("linux")
+
+
+def display_in_use(number: int) -> bool:
+    """Check whether an X display number is taken on this host."""
+    return (
+        Path(f"/tmp/.X{number}-lock").exists()
+        or (X11_SOCKET_DIR / f"X{number}").exists()
+    )
+
+
+@dataclass
+class VirtualDisplay:
+    """An Xvfb server owned by the connector."""
+
+    number: int
+    process: asyncio.subprocess.Process
+
+    @property
+    def name(self) -> str:
+        """Value for the ``DISPLAY`` environment variable."""
+        return f":{self.number}"
+
+    @property
+    def running(self) -> bool:
+        """Whether the Xvfb process is still alive."""
+        return self.process.returncode is None
+
+    async def stop(self) -> None:
+        """Stop the Xvfb server."""
+        if not self.running:
+            return
+        self.process.terminate()
+        try:
+            await asyncio.wait_for(self.process.wait(), timeout=5.0)
+        except asyncio.TimeoutError:
+            self.process.kill()
+            await self.process.wait()
+
+
+@dataclass
+class DisplayManager:
+    """Allocates one virtual display per browser instance."""
+
+    displays: dict[int, VirtualDisplay] = field(default_factory=dict)
+    _lock: asyncio.Lock = field(default_factory=asyncio.Lock)
+
+    async def ensure(self, index: int, base: int, screen: str) -> str:
+        """
+        Get the display of an instance, starting one if it has none running.
+
+        Args:
+            index: Browser instance index
+            base: First display number to try
+            screen: Xvfb screen geometry, e.g. ``1920x1080x24``
+
+        Returns:
+            The ``DISPLAY`` value to launch the browser with.
+
+        Raises:
+            RuntimeError: If Xvfb is missing or fails to start.
+        """
+        async with self._lock:
+            display = self.displays.get(index)
+            if display is not None and display.running:
+                return display.name
+
+            xvfb = shutil.which("Xvfb")
+            if xvfb is None:
+                raise RuntimeError("Headful mode needs Xvfb; install it (e.g. apt-get install xvfb)")
+
+            taken = {d.number for d in self.displays.values() if d.running}
+            number = display.number if display is not None else base
+            while number in taken or display_in_use(number):
+                number += 1
+
+            process = await asyncio.create_subprocess_exec(
+                xvfb,
+                f":{number}",
+                "-screen", "0", screen,
+                "-nolisten", "tcp",
+                stdout=asyncio.subprocess.DEVNULL,
+                stderr=asyncio.subprocess.PIPE,
+            )
+            display = VirtualDisplay(number=number, process=process)
+            await self._wait_ready(display)
+            self.displays[index] = display
+            logger.info(f"Started virtual display {display.name} for browser instance {index}")
+            return display.name
+
+    @staticmethod
+    async def _wait_ready(display: VirtualDisplay) -> None:
+        """Wait for an Xvfb server to accept connections."""
+        socket = X11_SOCKET_DIR / f"X{display.number}"
+        deadline = asyncio.get_running_loop().time() + DISPLAY_START_TIMEOUT
+        while not socket.exists():
+            if not display.running:
+                stderr = await display.process.stderr.read() if display.process.stderr else b""
+                raise RuntimeError(
+                    f"Xvfb on {display.name} exited with code {display.process.returncode}: "
+                    f"{stderr.decode(errors='replace').strip()}"
+                )
+            if asyncio.get_running_loop().time() >= deadline:
+                await display.stop()
+                raise RuntimeError(f"Xvfb on {display.name} did not start in time")
+            await asyncio.sleep(0.1)
+
+    def get(self, index: int) -> Optional[str]:
+        """Get the display of an instance, if it has a running one."""
+        display = self.displays.get(index)
+        return display.name if display is not None and display.running else None
+
+    async def release(self, index: int) -> None:
+        """Stop the display of a removed instance."""
+        display = self.displays.pop(index, None)
+        if display is not None:
+            logger.info(f"Stopping virtual display {display.name}")
+            await display.stop()
+
+    async def stop(self) -> None:
+        """Stop every display."""
+        await asyncio.gather(*(self.release(index) for index in list(self.displays)))
@@ -0,0 +1,213 @@
+"""
+Download management for Camoufox Connector.
+
+Files downloaded inside a leased browser would otherwise end up in a
+temporary directory of the browser server, out of the client's reach. The
+relay saves every download of a lease into the session's ``downloads``
+artifact directory, from where ``GET /sessions/{id}/downloads`` lists them
+and ``GET /sessions/{id}/downloads/{download_id}`` streams them. Downloads
+count against a per-session size limit and are deleted when the lease is
+released, unless configured to be kept like other artifacts.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+import shutil
+import time
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import TYPE_CHECKING, Optional
+
+from starlette.requests import Request
+from starlette.responses import FileResponse, JSONResponse, Response
+from starlette.routing import Route
+
+from .relay import RelayCallError
+
+if TYPE_CHECKING:
+    from .artifacts import ArtifactStore
+    from .config import Settings
+    from .relay import Relay, RelayConnection
+    from .sessions import Session
+
+logger = logging.getLogger(__name__)
+
+DOWNLOAD_KIND = "downloads"
+
+# Downloads can take long; saveAs only returns once the file is complete
+SAVE_TIMEOUT = 600.0
+
+
+@dataclass
+class DownloadManager:
+    """Saves the downloads of leased browsers and keeps track of them."""
+
+    relay: Relay
+    store: ArtifactStore
+    downloads: dict[str, list[dict]] = field(default_factory=dict)
+    _saving: dict[str, set[asyncio.Task]] = field(default_factory=dict)
+
+    def __post_init__(self) -> None:
+        self.relay.event_filters.append(self._on_event)
+        self.relay.disconnect_hooks.append(self._on_disconnect)
+
+    @property
+    def settings(self) -> Settings:
+        """Current connector settings."""
+        return self.store.sessions.pool.settings
+
+    def _on_event(self, connection: RelayConnection, message: dict) -> bool:
+        """Start saving a download when a page reports one; never consumes the event."""
+        session = connection.session
+        if session is None or message.get("method") != "download" or not self.settings.save_downloads:
+            return False
+
+        params = message.get("params") or {}
+        artifact = (params.get("artifact") or {}).get("guid")
+        if not artifact:
+            return False
+
+        path = self.store.new_path(session.id, DOWNLOAD_KIND, "")
+        entry = {
+            "id": path.name,
+            "filename": params.get("suggestedFilename") or path.name,
+            "url": params.get("url"),
+            "page": message.get("guid"),
+            "status": "saving",
+            "size": None,
+            "error": None,
+            "started_at": time.time(),
+            "finished_at": None,
+        }
+        self.downloads.setdefault(session.id, []).append(entry)
+
+        task = asyncio.create_task(self._save(connection, session.id, artifact, path, entry))
+        saving = self._saving.setdefault(session.id, set())
+        saving.add(task)
+        task.add_done_callback(saving.discard)
+        return False
+
+    async def _save(
+        self,
+        connection: RelayConnection,
+        session_id: str,
+        artifact: str,
+        path: Path,
+        entry: dict,
+    ) -> None:
+        """Copy a finished download into the session's directory."""
+        try:
+            await connection.call(artifact, "saveAs", {"path": str(path)}, timeout=SAVE_TIMEOUT)
+        except RelayCallError as e:
+            logger.warning(f"Failed to save download {entry['filename']}: {e}")
+            entry.update(status="failed", error=str(e), finished_at=time.time())
+            return
+
+        entry["finished_at"] = time.time()
+        entry["size"] = path.stat().st_size if path.exists() else 0
+        limit = self.settings.max_downloads_mb
+        if limit is not None and self._total_size(session_id) > limit * 1024 * 1024:
+            path.unlink(missing_ok=True)
+            entry.update(status="rejected", error=f"Session download limit of {limit} MB exceeded")
+            logger.warning(f"Discarded download {entry['filename']} of session {session_id}: over {limit} MB")
+            return
+
+        entry["status"] = "complete"
+        logger.debug(f"Saved download {entry['filename']} to {path}")
+
+    def _total_size(self, session_id: str) -> int:
+        """Size of a session's saved downloads in bytes."""
+        return sum(p.stat().st_size for p in self.store.files(session_id, DOWNLOAD_KIND))
+
+    async def _on_disconnect(self, connection: RelayConnection) -> None:
+        """Let downloads in progress finish while the browser is still connected."""
+        if connection.session is None:
+            return
+        saving = self._saving.get(connection.session.id)
+        if saving:
+            await asyncio.wait(set(saving))
+
+    def for_session(self, session_id: str) -> list[dict]:
+        """Get the downloads of a session, oldest first."""
+        if session_id not in self.store.sessions.sessions:
+            # Kept downloads go away with the session's expired artifacts
+            directory = self.store.directory(session_id, DOWNLOAD_KIND)
+            if directory is None or not directory.is_dir():
+                self.downloads.pop(session_id, None)
+        return self.downloads.get(session_id, [])
+
+    def get(self, session_id: str, download_id: str) -> Optional[dict]:
+        """Get one download of a session."""
+        for entry in self.for_session(session_id):
+            if entry["id"] == download_id:
+                return entry
+        return None
+
+    async def release_session(self, session: Session) -> None:
+        """Delete a released session's downloads unless they are kept."""
+        for task in self._saving.pop(session.id, set()):
+            task.cancel()
+        if self.settings.keep_downloads:
+            return
+        self.downloads.pop(session.id, None)
+        directory = self.store.directory(session.id, DOWNLOAD_KIND)
+        if directory is not None and directory.is_dir():
+            await asyncio.to_thread(shutil.rmtree, directory, True)
+
+
+def create_download_routes(manager: DownloadManager) -> list[Route]:
+    """
+    Create HTTP routes for listing and fetching downloads.
+
+    Args:
+        manager: Download manager
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def list_downloads(request: Request) -> Response:
+        """
+        List the files downloaded during a session.
+
+        GET /sessions/{id}/downloads
+        """
+        session_id = request.path_params["session_id"]
+        if not await manager.store.accessible(request, session_id):
+            return JSONResponse({"error": "Session not found"}, status_code=404)
+        downloads = manager.for_session(session_id)
+        if not downloads and session_id not in manager.store.sessions.sessions:
+            return JSONResponse({"error": "Session not found"}, status_code=404)
+        return JSONResponse({"downloads": downloads, "count": len(downloads)})
+
+    async def get_download(request: Request) -> Response:
+        """
+        Download a file downloaded during a session.
+
+        GET /sessions/{id}/downloads/{download_id}
+        """
+        session_id = request.path_params["session_id"]
+        if not await manager.store.accessible(request, session_id):
+            return JSONResponse({"error": "Download not found"}, status_code=404)
+        entry = manager.get(session_id, request.path_params["download_id"])
+        if entry is None:
+            return JSONResponse({"error": "Download not found"}, status_code=404)
+        if entry["status"] != "complete":
+            return JSONResponse(
+                {"error": f"Download is {entry['status']}", "download": entry},
+                status_code=409,
+            )
+
+        await manager.store.restore(session_id)
+        directory = manager.store.directory(session_id, DOWNLOAD_KIND)
+        path = directory / entry["id"] if directory is not None else None
+        if path is None or not path.is_file():
+            return JSONResponse({"error": "Download file is gone"}, status_code=410)
+        return FileResponse(path, filename=entry["filename"])
+
+    return [
+        Route("/sessions/{session_id}/downloads", list_downloads, methods=["GET"]),
+        Route("/sessions/{session_id}/downloads/{download_id}", get_download, methods=["GET"]),
+    ]
@@ -0,0 +1,172 @@
+"""
+Event bus for Camoufox Connector.
+
+Subsystems publish lifecycle events (browser started, lease released, ...)
+to a shared bus. Clients can follow them live through the ``/events``
+Server-Sent Events stream.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import json
+import logging
+import time
+import uuid
+from collections import deque
+from dataclasses import dataclass, field
+from typing import AsyncIterator, Awaitable, Callable, Optional
+
+from starlette.requests import Request
+from starlette.responses import Response, StreamingResponse
+from starlette.routing import Route
+
+logger = logging.getLogger(__name__)
+
+# How long an idle SSE stream waits before sending a keep-alive comment
+KEEPALIVE_INTERVAL = 15.0
+
+
+@dataclass
+class Event:
+    """A single published event."""
+
+    type: str
+    data: dict
+    id: str = field(default_factory=lambda: uuid.uuid4().hex)
+    time: float = field(default_factory=time.time)
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "id": self.id,
+            "type": self.type,
+            "time": self.time,
+            "data": self.data,
+        }
+
+    def to_sse(self) -> str:
+        """Format as a Server-Sent Events message."""
+        return f"id: {self.id}\nevent: {self.type}\ndata: {json.dumps(self.to_dict())}\n\n"
+
+
+EventListener = Callable[[Event], Awaitable[None]]
+
+
+@dataclass
+class EventBus:
+    """
+    Fan-out of connector events to stream subscribers and listeners.
+
+    Publishing never blocks: slow stream subscribers drop events once their
+    queue is full, and listeners run as background tasks.
+    """
+
+    history_size: int = 100
+    queue_size: int = 1000
+    listeners: list[EventListener] = field(default_factory=list)
+    _subscribers: set[asyncio.Queue] = field(default_factory=set)
+    _history: deque = field(default_factory=deque)
+    # The loop only keeps weak references to tasks, so running listeners are held here
+    _listener_tasks: set[asyncio.Task] = field(default_factory=set)
+
+    def __post_init__(self) -> None:
+        self._history = deque(maxlen=self.history_size)
+
+    def publish(self, event_type: str, **data) -> Event:
+        """Publish an event to all subscribers and listeners."""
+        event = Event(type=event_type, data=data)
+        self._history.append(event)
+
+        for queue in list(self._subscribers):
+            try:
+                queue.put_nowait(event)
+            except asyncio.QueueFull:
+                logger.debug(f"Dropping {event_type} event for a slow subscriber")
+
+        for listener in self.listeners:
+            try:
+                task = asyncio.get_running_loop().create_task(listener(event))
+            except RuntimeError:
+                # No running loop (e.g. during interpreter shutdown)
+                continue
+            self._listener_tasks.add(task)
+            task.add_done_callback(self._listener_tasks.discard)
+
+        return event
+
+    @property
+    def history(self) -> list[Event]:
+        """Recently published events, oldest first."""
+        return list(self._history)
+
+    async def subscribe(self, types: Optional[set[str]] = None) -> AsyncIterator[Event]:
+        """Yield events as they are published, optionally filtered by type."""
+        queue: asyncio.Queue = asyncio.Queue(maxsize=self.queue_size)
+        self._subscribers.add(queue)
+        try:
+            while True:
+                event = await queue.get()
+                if types is None or event.type in types:
+                    yield event
+        finally:
+            self._subscribers.discard(queue)
+
+
+def create_event_routes(bus: EventBus) -> list[Route]:
+    """
+    Create the Server-Sent Events route.
+
+    Args:
+        bus: Event bus to stream from
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def events(request: Request) -> Response:
+        """
+        Stream connector events.
+
+        GET /events?types=browser-ready,browser-failed&history=true
+        """
+        types_param = request.query_params.get("types")
+        types = {t.strip() for t in types_param.split(",") if t.strip()} if types_param else None
+        include_history = request.query_params.get("history", "").lower() in ("1", "true", "yes")
+
+        async def stream() -> AsyncIterator[str]:
+            if include_history:
+                for event in bus.history:
+                    if types is None or event.type in types:
+                        yield event.to_sse()
+
+            subscription = bus.subscribe(types).__aiter__()
+            pending: Optional[asyncio.Task] = None
+            try:
+                while True:
+                    if await request.is_disconnected():
+                        return
+                    if pending is None:
+                        pending = asyncio.ensure_future(subscription.__anext__())
+                    done, _ = await asyncio.wait({pending}, timeout=KEEPALIVE_INTERVAL)
+                    if done:
+                        event = pending.result()
+                        pending = None
+                        yield event.to_sse()
+                    else:
+                        yield ": keep-alive\n\n"
+            finally:
+                if pending is not None:
+                    pending.cancel()
+                    await asyncio.gather(pending, return_exceptions=True)
+                await subscription.aclose()
+
+        return StreamingResponse(
+            stream(),
+            media_type="text/event-stream",
+            headers={"Cache-Control": "no-cache", "X-Accel-Buffering": "no"},
+        )
+
+    return [
+        Route("/events", events, methods=["GET"]),
+    ]
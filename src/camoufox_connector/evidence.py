@@ -0,0 +1,348 @@
+"""
+Evidence capture for Camoufox Connector.
+
+Compliance and brand-protection monitoring needs proof of what a page showed
+and when. Fetch tasks run with ``"evidence": true`` bundle the page into a
+signed ZIP archive stored with the task's session artifacts:
+
+- ``screenshot.png``: a full-page screenshot
+- ``page.html``: the rendered HTML
+- ``traffic.har``: the lease's network traffic
+- ``evidence.json``: the target URL, timestamps taken against an NTP server,
+  the IPs the target's host resolves to and the browser connected to, and
+  the target's TLS certificate, as seen by the browser and by the connector
+- ``manifest.json``: the SHA-256 digest of each file above and of
+  ``evidence.json``'s contents, signed with the connector's signing key
+
+Evidence archives need ``signing_key``; archives are kept as long as other
+artifacts, so set ``artifact_ttl`` to the retention the evidence needs.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import base64
+import hashlib
+import io
+import json
+import logging
+import socket
+import ssl
+import struct
+import time
+import zipfile
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import TYPE_CHECKING, Any, Optional
+from urllib.parse import urlsplit
+
+from starlette.requests import Request
+from starlette.responses import FileResponse, JSONResponse, Response
+from starlette.routing import Route
+
+from .har import merge_hars
+
+if TYPE_CHECKING:
+    from .artifacts import ArtifactStore
+    from .sessions import Session
+    from .signing import Signer
+    from .tasks import FetchResult
+
+logger = logging.getLogger(__name__)
+
+# Seconds between the NTP epoch (1900) and the Unix epoch (1970)
+NTP_EPOCH_OFFSET = 2208988800
+
+NTP_TIMEOUT = 5.0
+
+# How long an NTP offset is trusted before the server is asked again
+NTP_MAX_AGE = 600.0
+
+TLS_TIMEOUT = 10.0
+
+
+class EvidenceNotConfigured(ValueError):
+    """Raised when a task asks for evidence but signing is not configured."""
+
+
+@dataclass
+class NtpSample:
+    """Offset of the local clock against an NTP server."""
+
+    server: str
+    offset: float
+    delay: float
+    stratum: int
+    measured_at: float
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "server": self.server,
+            "offset": round(self.offset, 6),
+            "delay": round(self.delay, 6),
+            "stratum": self.stratum,
+            "measured_at": self.measured_at,
+        }
+
+
+class _NtpProtocol(asyncio.DatagramProtocol):
+    """Receives one NTP response."""
+
+    def __init__(self) -> None:
+        self.response: asyncio.Future = asyncio.get_running_loop().create_future()
+
+    def datagram_received(self, data: bytes, addr: Any) -> None:
+        if not self.response.done():
+            self.response.set_result((data, time.time()))
+
+    def error_received(self, exc: Exception) -> None:
+        if not self.response.done():
+            self.response.set_exception(exc)
+
+
+def _ntp_time(data: bytes, offset: int) -> float:
+    """Read an NTP timestamp from a packet as Unix time."""
+    seconds, fraction = struct.unpack("!II", data[offset:offset + 8])
+    return seconds - NTP_EPOCH_OFFSET + fraction / 2**32
+
+
+async def query_ntp(server: str) -> NtpSample:
+    """
+    Measure the local clock's offset against an NTP server (SNTP, RFC 4330).
+
+    Raises:
+        OSError: If the server could not be reached or sent a malformed response
+        asyncio.TimeoutError: If the server did not answer in time
+    """
+    loop = asyncio.get_running_loop()
+    transport, protocol = await loop.create_datagram_endpoint(_NtpProtocol, remote_addr=(server, 123))
+    try:
+        sent = time.time()
+        seconds = int(sent) + NTP_EPOCH_OFFSET
+        fraction = int((sent % 1) * 2**32)
+        # Version 4, client mode; the transmit timestamp is echoed back as the originate timestamp
+        transport.sendto(struct.pack("!B39xII", 0x23, seconds, fraction))
+        data, received = await asyncio.wait_for(protocol.response, timeout=NTP_TIMEOUT)
+    finally:
+        transport.close()
+
+    if len(data) < 48 or data[0] & 0x07 != 4 or data[1] == 0:
+        raise OSError(f"Invalid NTP response from {server}")
+    server_received = _ntp_time(data, 32)
+    server_sent = _ntp_time(data, 40)
+    offset = ((server_received - sent) + (server_sent - received)) / 2
+    delay = (received - sent) - (server_sent - server_received)
+    return NtpSample(server=server, offset=offset, delay=delay, stratum=data[1], measured_at=received)
+
+
+def _certificate(host: str, port: int) -> dict:
+    """Fetch and describe a host's TLS certificate with a connection of the connector's own."""
+    context = ssl.create_default_context()
+    with socket.create_connection((host, port), timeout=TLS_TIMEOUT) as sock:
+        with context.wrap_socket(sock, server_hostname=host) as tls:
+            der = tls.getpeercert(binary_form=True)
+            cert = tls.getpeercert()
+            return {
+                "peer": tls.getpeername()[0],
+                "protocol": tls.version(),
+                "subject": dict(item for rdn in cert.get("subject", ()) for item in rdn),
+                "issuer": dict(item for rdn in cert.get("issuer", ()) for item in rdn),
+                "serial_number": cert.get("serialNumber"),
+                "not_before": cert.get("notBefore"),
+                "not_after": cert.get("notAfter"),
+                "subject_alt_names": [value for _, value in cert.get("subjectAltName", ())],
+                "sha256": hashlib.sha256(der).hexdigest(),
+                "der": base64.b64encode(der).decode(),
+            }
+
+
+@dataclass
+class PageEvidence:
+    """What was collected from a loaded page, until its HAR is available."""
+
+    url: str
+    final_url: str
+    status: Optional[int]
+    loaded_at: float
+    screenshot: bytes
+    html: str
+    server_address: Optional[dict] = None
+    security_details: Optional[dict] = None
+    resolved_ips: list[str] = field(default_factory=list)
+    certificate: Optional[dict] = None
+    errors: dict[str, str] = field(default_factory=dict)
+
+
+@dataclass
+class EvidenceRecorder:
+    """Bundles fetched pages into signed evidence archives."""
+
+    store: ArtifactStore
+    signer: Signer
+    ntp_server: str
+    _ntp: Optional[NtpSample] = None
+    _ntp_lock: asyncio.Lock = field(default_factory=asyncio.Lock)
+
+    async def clock(self) -> tuple[Optional[NtpSample], Optional[str]]:
+        """Get a recent NTP sample, or the reason there is none."""
+        async with self._ntp_lock:
+            if self._ntp is None or time.time() - self._ntp.measured_at > NTP_MAX_AGE:
+                try:
+                    self._ntp = await query_ntp(self.ntp_server)
+                except (OSError, asyncio.TimeoutError) as e:
+                    error = f"NTP query to {self.ntp_server} failed: {e or type(e).__name__}"
+                    logger.warning(error)
+                    return None, error
+            return self._ntp, None
+
+    async def collect(self, page: Any, response: Any, result: FetchResult) -> PageEvidence:
+        """Collect a loaded page's evidence: its rendering and what its connection showed."""
+        evidence = PageEvidence(
+            url=result.url,
+            final_url=page.url,
+            status=result.status,
+            loaded_at=time.time(),
+            screenshot=await page.screenshot(full_page=True),
+            html=result.html or await page.content(),
+        )
+
+        # The navigation response is gone when a popup was followed
+        if response is not None:
+            try:
+                evidence.server_address = await response.server_addr()
+                evidence.security_details = await response.security_details()
+            except Exception as e:
+                evidence.errors["browser"] = str(e)
+
+        parts = urlsplit(evidence.final_url)
+        host = parts.hostname or ""
+        try:
+            infos = await asyncio.get_running_loop().getaddrinfo(host, None, type=socket.SOCK_STREAM)
+            evidence.resolved_ips = sorted({info[4][0] for info in infos})
+        except OSError as e:
+            evidence.errors["dns"] = str(e)
+        if parts.scheme == "https":
+            try:
+                evidence.certificate = await asyncio.to_thread(_certificate, host, parts.port or 443)
+            except (OSError, ssl.SSLError) as e:
+                evidence.errors["certificate"] = str(e)
+        return evidence
+
+    def _write(self, session: Session, evidence: PageEvidence, document: dict, har: Optional[dict]) -> Path:
+        """Write an evidence archive with its signed manifest."""
+        files = {
+            "screenshot.png": evidence.screenshot,
+            "page.html": evidence.html.encode(),
+            "evidence.json": json.dumps(document, indent=2).encode(),
+        }
+        if har is not None:
+            files["traffic.har"] = json.dumps(har).encode()
+        manifest = {
+            "session": session.id,
+            "url": evidence.url,
+            "sealed_at": document["timestamps"]["sealed_at"],
+            "files": [
+                {"path": name, "size": len(data), "sha256": hashlib.sha256(data).hexdigest()}
+                for name, data in files.items()
+            ],
+        }
+        manifest["signature"] = self.signer.sign(manifest)
+
+        path = self.store.new_path(session.id, "evidence", ".zip")
+        buffer = io.BytesIO()
+        with zipfile.ZipFile(buffer, "w", zipfile.ZIP_DEFLATED) as archive:
+            for name, data in files.items():
+                archive.writestr(name, data)
+            archive.writestr("manifest.json", json.dumps(manifest, indent=2))
+        path.write_bytes(buffer.getvalue())
+        return path
+
+    async def seal(self, session: Session, evidence: PageEvidence, result: FetchResult) -> dict:
+        """
+        Bundle a page's evidence with its session's HAR into a signed archive.
+
+        Call after the session is released, when its HAR has been stored.
+
+        Returns:
+            Where the archive is and its digest, for the task result
+        """
+        sample, ntp_error = await self.clock()
+        sealed_at = time.time()
+        offset = sample.offset if sample is not None else 0.0
+        document = {
+            "url": evidence.url,
+            "final_url": evidence.final_url,
+            "status": evidence.status,
+            "instance": result.instance,
+            "session": session.id,
+            "timestamps": {
+                "started_at": result.started_at + offset,
+                "loaded_at": evidence.loaded_at + offset,
+                "sealed_at": sealed_at + offset,
+                "synced": sample is not None,
+                "ntp": sample.to_dict() if sample is not None else None,
+                "error": ntp_error,
+            },
+            "network": {
+                "resolved_ips": evidence.resolved_ips,
+                "server_address": evidence.server_address,
+            },
+            "tls": {
+                "browser": evidence.security_details,
+                "connector": evidence.certificate,
+            },
+            "errors": evidence.errors,
+        }
+        har = await asyncio.to_thread(merge_hars, self.store.files(session.id, "har"))
+        path = await asyncio.to_thread(self._write, session, evidence, document, har)
+        digest = await asyncio.to_thread(lambda: hashlib.sha256(path.read_bytes()).hexdigest())
+        # Sealed after the release, when the session's other artifacts were stored
+        await self.store.persist(session.id, session.tenant)
+        logger.info(f"Sealed evidence of {evidence.final_url} in session {session.id}")
+        return {
+            "archive": f"/sessions/{session.id}/evidence/{path.stem}",
+            "sha256": digest,
+            "key_id": self.signer.key_id,
+            "timestamp": sealed_at + offset,
+            "synced": sample is not None,
+        }
+
+    def archive(self, session_id: str, name: str) -> Optional[Path]:
+        """Find a stored evidence archive by session and name."""
+        for path in self.store.files(session_id, "evidence"):
+            if path.stem == name:
+                return path
+        return None
+
+
+def create_evidence_routes(recorder: Optional[EvidenceRecorder]) -> list[Route]:
+    """
+    Create routes serving evidence archives.
+
+    Args:
+        recorder: Evidence recorder, or None when signing is not configured
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_archive(request: Request) -> Response:
+        """
+        Download a signed evidence archive.
+
+        GET /sessions/{id}/evidence/{name}
+        """
+        if recorder is None:
+            return JSONResponse({"error": "Signing is not configured"}, status_code=404)
+        session_id = request.path_params["session_id"]
+        if not await recorder.store.accessible(request, session_id):
+            return JSONResponse({"error": "Evidence archive not found"}, status_code=404)
+        path = recorder.archive(session_id, request.path_params["name"])
+        if path is None:
+            return JSONResponse({"error": "Evidence archive not found"}, status_code=404)
+        return FileResponse(path, media_type="application/zip", filename=f"evidence-{session_id}-{path.stem}.zip")
+
+    return [
+        Route("/sessions/{session_id}/evidence/{name}", get_archive, methods=["GET"]),
+    ]
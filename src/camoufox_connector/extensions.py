@@ -0,0 +1,277 @@
+"""
+Firefox extensions for Camoufox Connector.
+
+Extensions listed in the ``extensions`` setting are loaded into every
+browser of the pool; others can be uploaded as ``.xpi`` files via
+``POST /extensions`` and loaded into single leases by ID. Camoufox only
+loads unpacked extensions, so XPI archives are extracted into a directory
+of their own first.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import hashlib
+import io
+import json
+import logging
+import shutil
+import time
+import zipfile
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import TYPE_CHECKING, Literal, Optional
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .janitor import scratch_directory
+
+if TYPE_CHECKING:
+    from .sessions import SessionManager
+
+logger = logging.getLogger(__name__)
+
+MANIFEST = "manifest.json"
+MAX_EXTENSION_MB = 50
+# Total size an extension may unpack to, so small archives can't fill the disk
+MAX_UNPACKED_MB = 200
+
+
+class InvalidExtensionError(ValueError):
+    """Raised when an extension is not a valid XPI archive or extension directory."""
+
+
+class UnknownExtensionError(LookupError):
+    """Raised when a lease asks for an extension that was not uploaded."""
+
+
+@dataclass
+class Extension:
+    """An unpacked extension ready to be loaded."""
+
+    id: str
+    name: str
+    version: Optional[str]
+    path: Path
+    source: Literal["config", "upload"]
+    created_at: float = field(default_factory=time.time)
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "id": self.id,
+            "name": self.name,
+            "version": self.version,
+            "source": self.source,
+            "created_at": self.created_at,
+        }
+
+
+def read_manifest(directory: Path) -> dict:
+    """
+    Read an unpacked extension's manifest.
+
+    Raises:
+        InvalidExtensionError: If there is no readable manifest.json.
+    """
+    try:
+        manifest = json.loads((directory / MANIFEST).read_text(encoding="utf-8-sig"))
+    except (OSError, ValueError) as e:
+        raise InvalidExtensionError(f"No valid {MANIFEST} in {directory.name}: {e}") from e
+    if not isinstance(manifest, dict):
+        raise InvalidExtensionError(f"{MANIFEST} in {directory.name} is not an object")
+    return manifest
+
+
+@dataclass
+class ExtensionStore:
+    """Unpacks extensions and keeps track of them."""
+
+    root: Optional[Path] = None
+    uploaded: dict[str, Extension] = field(default_factory=dict)
+    _configured: dict[tuple[str, float], Extension] = field(default_factory=dict)
+    _failed: set[str] = field(default_factory=set)
+
+    def _directory(self) -> Path:
+        """Get the directory extensions are unpacked into."""
+        if self.root is None:
+            self.root = scratch_directory("extensions")
+        return self.root
+
+    def _unpack(self, data: bytes, source: Literal["config", "upload"]) -> Extension:
+        """
+        Extract an XPI archive; the same archive is only extracted once.
+
+        Raises:
+            InvalidExtensionError: If the data is not an XPI with a manifest.
+        """
+        ext_id = hashlib.sha256(data).hexdigest()[:16]
+        target = self._directory() / ext_id
+        if not (target / MANIFEST).is_file():
+            try:
+                with zipfile.ZipFile(io.BytesIO(data)) as archive:
+                    if MANIFEST not in archive.namelist():
+                        raise InvalidExtensionError(f"Archive has no {MANIFEST}")
+                    # zipfile stops each member at its declared size, so the sum bounds what is written
+                    if sum(info.file_size for info in archive.infolist()) > MAX_UNPACKED_MB * 1024 * 1024:
+                        raise InvalidExtensionError(f"Archive unpacks to more than {MAX_UNPACKED_MB} MB")
+                    # extractall drops absolute paths and '..' components
+                    archive.extractall(target)
+            except zipfile.BadZipFile as e:
+                raise InvalidExtensionError(f"Not an XPI archive: {e}") from e
+
+        manifest = read_manifest(target)
+        return Extension(
+            id=ext_id,
+            name=str(manifest.get("name") or ext_id),
+            version=manifest.get("version"),
+            path=target,
+            source=source,
+        )
+
+    def add(self, data: bytes) -> Extension:
+        """
+        Add an uploaded XPI.
+
+        Raises:
+            InvalidExtensionError: If the data is not an XPI with a manifest.
+        """
+        extension = self._unpack(data, "upload")
+        self.uploaded.setdefault(extension.id, extension)
+        logger.info(f"Extension {extension.name} uploaded as {extension.id}")
+        return self.uploaded[extension.id]
+
+    def get(self, ext_id: str) -> Extension:
+        """
+        Get an uploaded extension.
+
+        Raises:
+            UnknownExtensionError: If no extension was uploaded with this ID.
+        """
+        extension = self.uploaded.get(ext_id)
+        if extension is None:
+            raise UnknownExtensionError(f"Unknown extension '{ext_id}'")
+        return extension
+
+    def remove(self, ext_id: str) -> bool:
+        """Delete an uploaded extension."""
+        extension = self.uploaded.pop(ext_id, None)
+        if extension is None:
+            return False
+        if not any(e.path == extension.path for e in self._configured.values()):
+            shutil.rmtree(extension.path, ignore_errors=True)
+        return True
+
+    def load(self, path: str) -> Extension:
+        """
+        Load a configured extension from an XPI file or an unpacked directory.
+
+        Raises:
+            InvalidExtensionError: If the path is neither.
+        """
+        source = Path(path).expanduser()
+        try:
+            key = (str(source), source.stat().st_mtime)
+        except OSError as e:
+            raise InvalidExtensionError(f"Cannot read extension {path}: {e}") from e
+        if key in self._configured:
+            return self._configured[key]
+
+        if source.is_dir():
+            manifest = read_manifest(source)
+            extension = Extension(
+                id=hashlib.sha256(str(source).encode()).hexdigest()[:16],
+                name=str(manifest.get("name") or source.name),
+                version=manifest.get("version"),
+                path=source,
+                source="config",
+            )
+        else:
+            extension = self._unpack(source.read_bytes(), "config")
+        self._configured[key] = extension
+        return extension
+
+    def configured(self, paths: list[str]) -> list[Extension]:
+        """Load the configured extensions, skipping those that cannot be loaded."""
+        extensions = []
+        for path in paths:
+            try:
+                extensions.append(self.load(path))
+                self._failed.discard(path)
+            except InvalidExtensionError as e:
+                if path not in self._failed:
+                    logger.warning(f"Skipping extension: {e}")
+                    self._failed.add(path)
+        return extensions
+
+
+def create_extension_routes(store: ExtensionStore, sessions: SessionManager) -> list[Route]:
+    """
+    Create HTTP routes for uploading and listing extensions.
+
+    Args:
+        store: Extension store
+        sessions: Session manager, to keep extensions of active leases
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def list_extensions(request: Request) -> Response:
+        """
+        List configured and uploaded extensions.
+
+        GET /extensions
+        """
+        configured = store.configured(sessions.pool.settings.extensions)
+        extensions = [e.to_dict() for e in [*configured, *store.uploaded.values()]]
+        return JSONResponse({"extensions": extensions, "count": len(extensions)})
+
+    async def upload_extension(request: Request) -> Response:
+        """
+        Upload an XPI for leases to load.
+
+        POST /extensions
+        """
+        limit = MAX_EXTENSION_MB * 1024 * 1024
+        too_large = JSONResponse({"error": f"Extension larger than {MAX_EXTENSION_MB} MB"}, status_code=413)
+        declared = request.headers.get("content-length", "")
+        if declared.isdigit() and int(declared) > limit:
+            return too_large
+        chunks = []
+        size = 0
+        async for chunk in request.stream():
+            size += len(chunk)
+            if size > limit:
+                return too_large
+            chunks.append(chunk)
+        try:
+            extension = await asyncio.to_thread(store.add, b"".join(chunks))
+        except InvalidExtensionError as e:
+            return JSONResponse({"error": str(e)}, status_code=400)
+        return JSONResponse(extension.to_dict(), status_code=201)
+
+    async def delete_extension(request: Request) -> Response:
+        """
+        Delete an uploaded extension.
+
+        DELETE /extensions/{id}
+        """
+        ext_id = request.path_params["ext_id"]
+        users = [s.id for s in sessions.sessions.values() if ext_id in s.options.extensions]
+        if users:
+            return JSONResponse(
+                {"error": "Extension is loaded by active leases", "sessions": users},
+                status_code=409,
+            )
+        if not store.remove(ext_id):
+            return JSONResponse({"error": "No uploaded extension with this ID"}, status_code=404)
+        return JSONResponse({"status": "removed", "id": ext_id})
+
+    return [
+        Route("/extensions", list_extensions, methods=["GET"]),
+        Route("/extensions", upload_extension, methods=["POST"]),
+        Route("/extensions/{ext_id}", delete_extension, methods=["DELETE"]),
+    ]
@@ -0,0 +1,206 @@
+"""
+Declarative data extraction for Camoufox Connector.
+
+Fetch tasks can carry ``extract`` rules mapping field names to selectors, so
+clients get structured data back instead of parsing the HTML themselves.
+Rules can target content inside nested iframes (payment widgets, embedded
+listings) with a frame path: steps separated by ``>>`` that each pick a
+child frame of the previous one by name, URL pattern or index, e.g.
+``name=checkout >> url=*stripe.com* >> 0``.
+
+Selectors are Playwright selectors, so text (``text=Sign in``) and XPath
+(``xpath=//h1``) selectors work alongside CSS. CSS selectors pierce open
+shadow roots; ``>>>`` marks the step into a web component explicitly
+(``product-card >>> .price``), and with ``pierce: false`` only those
+explicit steps enter shadow trees.
+"""
+
+from __future__ import annotations
+
+import fnmatch
+import logging
+import re
+from dataclasses import dataclass
+from typing import Any, Literal, Optional
+
+from pydantic import BaseModel, ConfigDict, Field, field_validator
+
+logger = logging.getLogger(__name__)
+
+FRAME_SEPARATOR = ">>"
+SHADOW_COMBINATOR = ">>>"
+
+# Selector parts that already name a Playwright engine, e.g. "text=..." or "xpath=..."
+ENGINE_PREFIX = re.compile(r"^[a-z][a-z0-9_:-]*=")
+
+
+@dataclass(frozen=True)
+class FrameStep:
+    """One step of a frame path."""
+
+    kind: Literal["name", "url", "index"]
+    value: str
+
+    def select(self, frames: list) -> Optional[Any]:
+        """Pick the matching frame among the children of a frame."""
+        if self.kind == "index":
+            index = int(self.value)
+            return frames[index] if -len(frames) <= index < len(frames) else None
+        for frame in frames:
+            if self.kind == "name" and frame.name == self.value:
+                return frame
+            if self.kind == "url" and fnmatch.fnmatchcase(frame.url, self.value):
+                return frame
+        return None
+
+
+def parse_frame_path(path: str) -> list[FrameStep]:
+    """
+    Parse a frame path such as ``name=checkout >> url=*stripe.com* >> 0``.
+
+    Raises:
+        ValueError: If a step is empty or not a name, URL pattern or index.
+    """
+    steps = []
+    for raw in path.split(FRAME_SEPARATOR):
+        raw = raw.strip()
+        if raw.startswith("name="):
+            steps.append(FrameStep("name", raw[len("name="):]))
+        elif raw.startswith("url="):
+            steps.append(FrameStep("url", raw[len("url="):]))
+        elif raw.lstrip("-").isdigit():
+            steps.append(FrameStep("index", raw))
+        else:
+            raise ValueError(f"Invalid frame step {raw!r}, expected name=..., url=... or an index")
+    return steps
+
+
+def resolve_frame(page: Any, path: Optional[str]) -> Any:
+    """
+    Follow a frame path from a page's main frame.
+
+    Raises:
+        LookupError: If a step matches no child frame.
+    """
+    frame = page.main_frame
+    if not path:
+        return frame
+    for step in parse_frame_path(path):
+        child = step.select(frame.child_frames)
+        if child is None:
+            raise LookupError(f"No frame matches {step.kind}={step.value} in {frame.url}")
+        frame = child
+    return frame
+
+
+class ExtractRule(BaseModel):
+    """Where to find one extracted field."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    selector: str = Field(description="Selector of the element(s) holding the value")
+
+    frame: Optional[str] = Field(
+        default=None,
+        description="Frame path, e.g. 'name=checkout >> url=*stripe.com* >> 0' (default: main frame)",
+    )
+
+    attribute: Optional[str] = Field(
+        default=None,
+        description="Attribute to read instead of the element's text",
+    )
+
+    text: Optional[str] = Field(
+        default=None,
+        description="Only match elements whose text contains this string (case-insensitive)",
+    )
+
+    pierce: bool = Field(
+        default=True,
+        description="Let CSS selectors match inside open shadow roots",
+    )
+
+    html: bool = Field(
+        default=False,
+        description="Read the element's inner HTML instead of its text",
+    )
+
+    all: bool = Field(
+        default=False,
+        description="Return a list with every matching element instead of the first",
+    )
+
+    @field_validator("frame")
+    @classmethod
+    def validate_frame(cls, v: Optional[str]) -> Optional[str]:
+        """Validate the frame path syntax."""
+        if v is not None:
+            parse_frame_path(v)
+        return v
+
+    @field_validator("selector")
+    @classmethod
+    def validate_selector(cls, v: str) -> str:
+        """Reject selectors with empty shadow steps."""
+        if any(not part.strip() for part in v.split(SHADOW_COMBINATOR)):
+            raise ValueError(f"Empty step in selector {v!r}")
+        return v
+
+
+def build_selector(rule: ExtractRule) -> str:
+    """
+    Translate a rule's selector into a Playwright selector.
+
+    ``>>>`` steps become Playwright selector chains, which search inside the
+    previous match's shadow root. When the rule does not pierce, a plain CSS
+    first step is kept out of shadow trees.
+    """
+    parts = [part.strip() for part in rule.selector.split(SHADOW_COMBINATOR)]
+    if not rule.pierce and not ENGINE_PREFIX.match(parts[0]):
+        parts[0] = f"css:light={parts[0]}"
+    return " >> ".join(parts)
+
+
+async def _read(element: Any, rule: ExtractRule) -> Optional[str]:
+    """Read a rule's value from an element."""
+    if rule.attribute is not None:
+        return await element.get_attribute(rule.attribute)
+    if rule.html:
+        return await element.inner_html()
+    return (await element.text_content() or "").strip()
+
+
+async def extract_field(page: Any, rule: ExtractRule) -> Any:
+    """
+    Extract one field from a page.
+
+    Returns:
+        The value, a list of values for ``all`` rules, or None if nothing matched.
+    """
+    frame = resolve_frame(page, rule.frame)
+    elements = await frame.query_selector_all(build_selector(rule))
+    if rule.text is not None:
+        needle = rule.text.lower()
+        elements = [e for e in elements if needle in (await e.text_content() or "").lower()]
+    if rule.all:
+        return [await _read(element, rule) for element in elements]
+    return await _read(elements[0], rule) if elements else None
+
+
+async def extract(page: Any, rules: dict[str, ExtractRule]) -> tuple[dict, dict]:
+    """
+    Extract every field of a rule set from a page.
+
+    Returns:
+        The extracted values by field, and the errors of fields that failed.
+    """
+    data: dict = {}
+    errors: dict = {}
+    for name, rule in rules.items():
+        try:
+            data[name] = await extract_field(page, rule)
+        except Exception as e:
+            logger.debug(f"Extraction of {name} failed: {e}")
+            data[name] = None
+            errors[name] = str(e)
+    return data, errors
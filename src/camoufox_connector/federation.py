@@ -0,0 +1,272 @@
+"""
+Multi-region federation for Camoufox Connector.
+
+Connectors running in different regions can be federated under one API:
+each node knows its own region and its peers, and ``GET /next?region=eu``
+on any node hands out a browser from the EU node's pool. When the chosen
+region has no browser available, the fallback policy decides whether the
+request fails or moves on to the other regions, nearest first. Peers'
+latency is measured continuously; requests without a region are served
+locally first.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import json
+import logging
+import time
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Optional, Sequence
+
+import httpx
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .config import FederationPeer
+from .health import next_local_endpoint
+
+if TYPE_CHECKING:
+    from .pool import BrowserPool
+
+logger = logging.getLogger(__name__)
+
+# Marks requests forwarded by another node, which must not be forwarded again
+FORWARDED_HEADER = "X-Camoufox-Federated"
+
+PROBE_INTERVAL = 15.0
+PEER_TIMEOUT = 5.0
+
+
+@dataclass
+class PeerState:
+    """What is known about a peer's reachability."""
+
+    peer: FederationPeer
+    healthy: bool = False
+    latency: Optional[float] = None
+    last_checked: Optional[float] = None
+    error: Optional[str] = None
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "region": self.peer.region,
+            "url": self.peer.url,
+            "local": False,
+            "healthy": self.healthy,
+            "latency_ms": round(self.latency * 1000, 1) if self.latency is not None else None,
+            "last_checked": self.last_checked,
+            "error": self.error,
+        }
+
+
+@dataclass
+class Federation:
+    """Routes browser requests across the federated regions."""
+
+    pool: BrowserPool
+    peers: dict[str, PeerState] = field(default_factory=dict)
+    _client: Optional[httpx.AsyncClient] = None
+    _probe_task: Optional[asyncio.Task] = None
+
+    def __post_init__(self) -> None:
+        self.sync_peers()
+
+    @property
+    def region(self) -> Optional[str]:
+        """Region of this node."""
+        return self.pool.settings.region
+
+    def sync_peers(self) -> None:
+        """Pick up the configured peers, keeping what is known about unchanged ones."""
+        configured = {peer.region: peer for peer in self.pool.settings.federation_peers}
+        self.peers = {
+            region: (
+                self.peers[region]
+                if region in self.peers and self.peers[region].peer == peer
+                else PeerState(peer=peer)
+            )
+            for region, peer in configured.items()
+        }
+
+    def start(self) -> None:
+        """Start measuring the peers' latency."""
+        if self._probe_task is None:
+            self._probe_task = asyncio.create_task(self._probe_loop())
+
+    async def close(self) -> None:
+        """Stop probing and close the HTTP client."""
+        if self._probe_task is not None:
+            self._probe_task.cancel()
+            self._probe_task = None
+        if self._client is not None:
+            await self._client.aclose()
+            self._client = None
+
+    def _get_client(self) -> httpx.AsyncClient:
+        """Get the HTTP client used to talk to peers."""
+        if self._client is None:
+            self._client = httpx.AsyncClient(timeout=PEER_TIMEOUT)
+        return self._client
+
+    @staticmethod
+    def _headers(peer: FederationPeer) -> dict:
+        """Headers for requests to a peer."""
+        headers = {FORWARDED_HEADER: "1", "User-Agent": "camoufox-connector"}
+        if peer.api_key:
+            headers["Authorization"] = f"Bearer {peer.api_key}"
+        return headers
+
+    async def _probe_loop(self) -> None:
+        """Periodically check every peer."""
+        while True:
+            await asyncio.gather(*(self.probe(state) for state in list(self.peers.values())))
+            await asyncio.sleep(PROBE_INTERVAL)
+
+    async def probe(self, state: PeerState) -> None:
+        """Measure a peer's health check round trip."""
+        began = time.monotonic()
+        try:
+            response = await self._get_client().get(
+                f"{state.peer.url.rstrip('/')}/health",
+                headers=self._headers(state.peer),
+            )
+            state.healthy = response.status_code == 200
+            state.error = None if state.healthy else f"HTTP {response.status_code}"
+        except httpx.HTTPError as e:
+            state.healthy = False
+            state.error = str(e) or type(e).__name__
+        state.latency = time.monotonic() - began if state.healthy else None
+        state.last_checked = time.time()
+
+    def candidates(self, region: Optional[str], fallback: bool) -> list[Optional[str]]:
+        """
+        Order the regions to try for a request; None stands for this node.
+
+        Raises:
+            LookupError: If the region is neither this node's nor a peer's.
+        """
+        if region is not None and region != self.region and region not in self.peers:
+            raise LookupError(f"Unknown region '{region}'")
+
+        first = None if region is None or region == self.region else region
+        if not fallback:
+            return [first]
+
+        # Nearest first; this node is nearest of all
+        others = sorted(
+            (state for name, state in self.peers.items() if name != first and state.healthy),
+            key=lambda state: state.latency if state.latency is not None else float("inf"),
+        )
+        rest = [state.peer.region for state in others]
+        return [first, *rest] if first is None else [first, None, *rest]
+
+    async def next_from_peer(
+        self,
+        state: PeerState,
+        version: Optional[str],
+        labels: Sequence[str] = (),
+    ) -> Optional[dict]:
+        """Ask a peer for a browser; None if it has none or cannot be reached."""
+        params: dict = {"region": state.peer.region}
+        if version is not None:
+            params["version"] = version
+        if labels:
+            params["label"] = list(labels)
+        try:
+            response = await self._get_client().get(
+                f"{state.peer.url.rstrip('/')}/next",
+                params=params,
+                headers=self._headers(state.peer),
+            )
+        except httpx.HTTPError as e:
+            logger.warning(f"Federation peer {state.peer.region} unreachable: {e}")
+            state.healthy = False
+            state.error = str(e) or type(e).__name__
+            return None
+        if response.status_code != 200:
+            logger.debug(f"Federation peer {state.peer.region} returned HTTP {response.status_code}")
+            return None
+        return response.json()
+
+    def regions(self) -> list[dict]:
+        """Describe this node and its peers."""
+        local = {
+            "region": self.region,
+            "url": None,
+            "local": True,
+            "healthy": any(inst.is_healthy for inst in self.pool.instances),
+            "latency_ms": 0.0,
+            "last_checked": time.time(),
+            "error": None,
+        }
+        return [local, *(state.to_dict() for state in self.peers.values())]
+
+
+def create_federation_routes(federation: Federation) -> list[Route]:
+    """
+    Create routes for region-aware browser selection.
+
+    Args:
+        federation: Federation routing requests across regions
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def next_endpoint(request: Request) -> Response:
+        """
+        Get the next available endpoint, from ``?region=`` if given.
+
+        GET /next
+        """
+        region = request.query_params.get("region")
+        version = request.query_params.get("version")
+        forwarded = FORWARDED_HEADER in request.headers
+        fallback = not forwarded and federation.pool.settings.federation_fallback != "none"
+
+        try:
+            candidates = federation.candidates(region, fallback)
+        except LookupError as e:
+            return JSONResponse({"error": str(e)}, status_code=404)
+
+        for candidate in candidates:
+            if candidate is None:
+                response = await next_local_endpoint(federation.pool, request)
+                if response.status_code == 200:
+                    data = json.loads(response.body)
+                    return JSONResponse({**data, "region": federation.region})
+                if len(candidates) == 1:
+                    return response
+                continue
+
+            data = await federation.next_from_peer(
+                federation.peers[candidate],
+                version,
+                request.query_params.getlist("label"),
+            )
+            if data is not None:
+                if candidate != region:
+                    logger.info(f"Served /next from region {candidate} instead of {region or 'local'}")
+                return JSONResponse({**data, "region": candidate})
+
+        tried = [candidate or federation.region for candidate in candidates]
+        return JSONResponse(
+            {"error": "No browser instances available in any region", "tried": tried},
+            status_code=503,
+        )
+
+    async def list_regions(request: Request) -> Response:
+        """
+        List this node's region and its federation peers.
+
+        GET /regions
+        """
+        return JSONResponse({"regions": federation.regions()})
+
+    return [
+        Route("/next", next_endpoint, methods=["GET"]),
+        Route("/regions", list_regions, methods=["GET"]),
+    ]
@@ -0,0 +1,300 @@
+"""
+Fetch task result cache for Camoufox Connector.
+
+Monitoring jobs often fetch the same page many times a minute. With
+``fetch_cache`` configured, successful fetch task results are kept for a
+while, and repeated tasks are answered from the cache without taking a
+browser. Results are cached per client and keyed by the URL and every task
+option that changes the result; options that don't, such as the timeout or
+the lease's holder, are left out.
+
+Pages sent with ``Cache-Control: no-store`` or ``no-cache`` are not cached,
+and a ``max-age`` (or ``s-maxage``) shorter than the TTL shortens it. Tasks
+choose with ``cache``: ``use`` (default), ``refresh`` to fetch anew and
+replace the cached result, or ``off``.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import dataclasses
+import hashlib
+import json
+import logging
+import re
+import time
+from collections import OrderedDict
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import TYPE_CHECKING, Optional, Union
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .tasks import FetchResult
+
+if TYPE_CHECKING:
+    from .config import FetchCacheConfig
+    from .pool import BrowserPool
+    from .tasks import FetchTask
+
+logger = logging.getLogger(__name__)
+
+# Task options that don't change what a fetch returns
+INSIGNIFICANT_OPTIONS = {"timeout", "cache"}
+INSIGNIFICANT_LEASE_OPTIONS = {"holder", "ttl"}
+
+MAX_AGE = re.compile(r"\b(s-maxage|max-age)\s*=\s*(\d+)")
+
+
+def cache_key(task: FetchTask, tenant: Optional[str]) -> str:
+    """Key a task's result by its client, URL and significant options."""
+    options = task.model_dump(mode="json", exclude=INSIGNIFICANT_OPTIONS)
+    options["lease"] = {
+        key: value for key, value in options["lease"].items() if key not in INSIGNIFICANT_LEASE_OPTIONS
+    }
+    document = json.dumps({"tenant": tenant, **options}, sort_keys=True, separators=(",", ":"))
+    return hashlib.sha256(document.encode()).hexdigest()
+
+
+def cache_lifetime(cache_control: Optional[str], ttl: float) -> float:
+    """Seconds a page may be cached given its Cache-Control header; 0 for not at all."""
+    if not cache_control:
+        return ttl
+    directives = cache_control.lower()
+    if "no-store" in directives or "no-cache" in directives:
+        return 0.0
+    ages = dict(MAX_AGE.findall(directives))
+    age = ages.get("s-maxage", ages.get("max-age"))
+    return min(ttl, float(age)) if age is not None else ttl
+
+
+@dataclass
+class CacheEntry:
+    """A cached fetch result."""
+
+    result: dict
+    stored_at: float
+    expires_at: float
+
+
+@dataclass
+class MemoryBackend:
+    """Keeps cached results in memory."""
+
+    max_entries: int
+    entries: OrderedDict[str, CacheEntry] = field(default_factory=OrderedDict)
+
+    def get(self, key: str) -> Optional[CacheEntry]:
+        """Get an entry unless it expired."""
+        entry = self.entries.get(key)
+        if entry is None:
+            return None
+        if entry.expires_at <= time.time():
+            del self.entries[key]
+            return None
+        self.entries.move_to_end(key)
+        return entry
+
+    def put(self, key: str, entry: CacheEntry) -> None:
+        """Store an entry, dropping the least recently used beyond the limit."""
+        self.entries[key] = entry
+        self.entries.move_to_end(key)
+        while len(self.entries) > self.max_entries:
+            self.entries.popitem(last=False)
+
+    def delete(self, key: str) -> None:
+        """Drop an entry."""
+        self.entries.pop(key, None)
+
+    def clear(self) -> int:
+        """Drop every entry; returns how many there were."""
+        count = len(self.entries)
+        self.entries.clear()
+        return count
+
+    def count(self) -> int:
+        """Number of entries, including expired ones not looked up since."""
+        return len(self.entries)
+
+
+@dataclass
+class DiskBackend:
+    """Keeps cached results as JSON files in a directory."""
+
+    directory: Path
+    max_entries: int
+
+    def __post_init__(self) -> None:
+        self.directory.mkdir(parents=True, exist_ok=True)
+
+    def _path(self, key: str) -> Path:
+        """File of an entry."""
+        return self.directory / f"{key}.json"
+
+    def get(self, key: str) -> Optional[CacheEntry]:
+        """Get an entry unless it expired."""
+        path = self._path(key)
+        try:
+            entry = CacheEntry(**json.loads(path.read_text()))
+        except (OSError, ValueError, TypeError):
+            return None
+        if entry.expires_at <= time.time():
+            path.unlink(missing_ok=True)
+            return None
+        # The modification time orders entries by last use
+        path.touch()
+        return entry
+
+    def put(self, key: str, entry: CacheEntry) -> None:
+        """Store an entry, dropping the least recently used beyond the limit."""
+        path = self._path(key)
+        temp = path.with_suffix(".tmp")
+        temp.write_text(json.dumps(dataclasses.asdict(entry)))
+        temp.replace(path)
+        files = sorted(self.directory.glob("*.json"), key=lambda p: p.stat().st_mtime)
+        for stale in files[:max(0, len(files) - self.max_entries)]:
+            stale.unlink(missing_ok=True)
+
+    def delete(self, key: str) -> None:
+        """Drop an entry."""
+        self._path(key).unlink(missing_ok=True)
+
+    def clear(self) -> int:
+        """Drop every entry; returns how many there were."""
+        files = list(self.directory.glob("*.json"))
+        for path in files:
+            path.unlink(missing_ok=True)
+        return len(files)
+
+    def count(self) -> int:
+        """Number of entries, including expired ones not looked up since."""
+        return sum(1 for _ in self.directory.glob("*.json"))
+
+
+CacheBackend = Union[MemoryBackend, DiskBackend]
+
+
+@dataclass
+class FetchCache:
+    """Answers repeated fetch tasks from earlier results."""
+
+    pool: BrowserPool
+    hits: int = 0
+    misses: int = 0
+    stores: int = 0
+    _backend: Optional[CacheBackend] = None
+    _backend_config: Optional[FetchCacheConfig] = None
+
+    @property
+    def config(self) -> Optional[FetchCacheConfig]:
+        """Configured cache, if any."""
+        return self.pool.settings.fetch_cache
+
+    def backend(self) -> Optional[CacheBackend]:
+        """Get the configured backend, switching to a new one when the configuration changed."""
+        config = self.config
+        if config != self._backend_config:
+            self._backend_config = config
+            if config is None:
+                self._backend = None
+            elif config.backend == "disk":
+                self._backend = DiskBackend(directory=Path(config.directory), max_entries=config.max_entries)
+            else:
+                self._backend = MemoryBackend(max_entries=config.max_entries)
+        return self._backend
+
+    @staticmethod
+    def applies(task: FetchTask, launch_options: Optional[dict]) -> bool:
+        """Whether a task may use the cache: evidence and fingerprint experiments need fresh fetches."""
+        return task.cache != "off" and not task.evidence and not launch_options
+
+    async def get(self, task: FetchTask, tenant: Optional[str]) -> Optional[FetchResult]:
+        """Look up a task's cached result; None on a miss or when the task refreshes it."""
+        backend = self.backend()
+        if backend is None or task.cache == "refresh":
+            return None
+        entry = await asyncio.to_thread(backend.get, cache_key(task, tenant))
+        if entry is None:
+            self.misses += 1
+            return None
+        self.hits += 1
+        result = FetchResult(**entry.result)
+        result.cached_at = entry.stored_at
+        return result
+
+    async def put(self, task: FetchTask, tenant: Optional[str], result: FetchResult) -> None:
+        """Cache a successful fetch result for as long as the page allows."""
+        config = self.config
+        backend = self.backend()
+        if backend is None or result.error or result.status is None or result.status >= 400:
+            return
+        ttl = config.ttl
+        if config.respect_cache_control:
+            ttl = cache_lifetime(result.cache_control, ttl)
+        key = cache_key(task, tenant)
+        if ttl <= 0:
+            # A page that may no longer be cached mustn't be served from an older entry either
+            await asyncio.to_thread(backend.delete, key)
+            return
+        now = time.time()
+        entry = CacheEntry(result=dataclasses.asdict(result), stored_at=now, expires_at=now + ttl)
+        entry.result["signature"] = None
+        try:
+            await asyncio.to_thread(backend.put, key, entry)
+        except OSError as e:
+            logger.warning(f"Failed to cache the result of {task.url}: {e}")
+            return
+        self.stores += 1
+
+    async def clear(self) -> int:
+        """Drop every cached result; returns how many there were."""
+        backend = self.backend()
+        return await asyncio.to_thread(backend.clear) if backend is not None else 0
+
+    async def report(self) -> dict:
+        """Describe the cache and how well it does."""
+        backend = self.backend()
+        lookups = self.hits + self.misses
+        return {
+            "backend": self.config.backend if self.config is not None else None,
+            "entries": await asyncio.to_thread(backend.count) if backend is not None else 0,
+            "hits": self.hits,
+            "misses": self.misses,
+            "stores": self.stores,
+            "hit_rate": round(self.hits / lookups, 4) if lookups else None,
+        }
+
+
+def create_fetch_cache_routes(cache: FetchCache) -> list[Route]:
+    """
+    Create routes inspecting and clearing the fetch cache.
+
+    Args:
+        cache: Fetch task result cache
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_cache(request: Request) -> Response:
+        """
+        Entries, hits and misses of the fetch cache.
+
+        GET /tasks/cache
+        """
+        return JSONResponse(await cache.report())
+
+    async def clear_cache(request: Request) -> Response:
+        """
+        Drop every cached fetch result.
+
+        DELETE /tasks/cache
+        """
+        return JSONResponse({"status": "cleared", "removed": await cache.clear()})
+
+    return [
+        Route("/tasks/cache", get_cache, methods=["GET"]),
+        Route("/tasks/cache", clear_cache, methods=["DELETE"]),
+    ]
@@ -0,0 +1,544 @@
+"""
+Multi-step flows for Camoufox Connector.
+
+A fetch task loads one page. Many scrapes take two hops or more: a search
+page, then the detail page of the first hit. A flow runs such a chain of
+steps on one leased browser and page, so cookies and state carry over. Each
+step may navigate, act on the page (click, fill, press a key, wait for an
+element) and extract fields. Extracted values become variables that later
+steps use in their URLs and action values through ``{{ name }}``
+placeholders, alongside the flow's own ``vars``:
+
+    {"vars": {"query": "usb c cable"},
+     "steps": [
+       {"url": "https://shop.example.com/search?q={{ query | urlencode }}",
+        "extract": {"first": {"selector": "a.result", "attribute": "href"}}},
+       {"url": "{{ first }}",
+        "extract": {"price": {"selector": ".price"}}}]}
+
+Relative URLs are resolved against the current page. A step that fails ends
+the flow; the result reports which step it was.
+
+Steps can branch and check the page, which makes flows usable as synthetic
+monitors. A step with an ``if`` condition only runs when the condition holds
+on the current page, and its ``else`` steps run instead when it doesn't.
+``assert`` conditions are checked after the step's actions and extraction;
+the first that fails ends the flow and is reported with its step. Conditions
+test the last status code, whether an element exists and whether text
+matches a regular expression:
+
+    {"steps": [
+       {"url": "https://app.example.com/account"},
+       {"if": {"selector": "form#login"},
+        "actions": [{"action": "fill", "selector": "#user", "value": "{{ user }}"},
+                    {"action": "click", "selector": "button[type=submit]"}]},
+       {"assert": [{"status": 200},
+                   {"selector": ".greeting", "text": "Welcome, {{ user }}",
+                    "message": "Not logged in"}]}]}
+"""
+
+from __future__ import annotations
+
+import base64
+import logging
+import re
+import time
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Any, Literal, Optional
+from urllib.parse import quote, urljoin
+
+from pydantic import BaseModel, ConfigDict, Field, model_validator
+
+from .dialogs import DialogRule
+from .extract import ExtractRule, extract, resolve_frame
+from .sessions import LeaseOptions
+from .tasks import navigation_protocol
+
+if TYPE_CHECKING:
+    from .tasks import TaskRunner
+
+logger = logging.getLogger(__name__)
+
+MAX_FLOW_STEPS = 20
+
+PLACEHOLDER = re.compile(r"\{\{\s*([\w.-]+)\s*(?:\|\s*(\w+)\s*)?\}\}")
+
+FILTERS = {
+    "urlencode": lambda value: quote(value, safe=""),
+    "strip": str.strip,
+    "lower": str.lower,
+    "upper": str.upper,
+}
+
+
+class TemplateError(ValueError):
+    """Raised when a placeholder cannot be filled in."""
+
+
+def lookup(variables: dict, name: str) -> Any:
+    """
+    Look up a variable by a dotted path; numbers index lists, e.g. ``links.0``.
+
+    Raises:
+        TemplateError: If the variable is undefined or has no value.
+    """
+    value: Any = variables
+    for part in name.split("."):
+        if isinstance(value, dict) and part in value:
+            value = value[part]
+        elif isinstance(value, list) and part.lstrip("-").isdigit() and -len(value) <= int(part) < len(value):
+            value = value[int(part)]
+        else:
+            raise TemplateError(f"Variable {name!r} is not defined")
+    if value is None:
+        raise TemplateError(f"Variable {name!r} has no value")
+    return value
+
+
+def render(template: str, variables: dict) -> str:
+    """
+    Fill in the ``{{ name }}`` and ``{{ name | filter }}`` placeholders of a template.
+
+    Raises:
+        TemplateError: If a variable is undefined or a filter unknown.
+    """
+
+    def fill(match: re.Match) -> str:
+        name, filter_name = match.groups()
+        value = lookup(variables, name)
+        text = value if isinstance(value, str) else str(value)
+        if filter_name is None:
+            return text
+        if filter_name not in FILTERS:
+            raise TemplateError(f"Unknown filter {filter_name!r}, expected one of {', '.join(FILTERS)}")
+        return FILTERS[filter_name](text)
+
+    return PLACEHOLDER.sub(fill, template)
+
+
+class FlowAction(BaseModel):
+    """Something done on the page before a step extracts its fields."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    action: Literal["click", "fill", "press", "wait_for"] = Field(description="What to do")
+
+    selector: str = Field(min_length=1, description="Element to act on")
+
+    frame: Optional[str] = Field(
+        default=None,
+        description="Frame path to the element, e.g. 'name=search' (see extraction)",
+    )
+
+    value: Optional[str] = Field(
+        default=None,
+        description="Text to fill in, with {{ name }} placeholders",
+    )
+
+    key: Optional[str] = Field(
+        default=None,
+        description="Key to press, e.g. Enter",
+    )
+
+    timeout: float = Field(
+        default=30.0,
+        gt=0,
+        le=300,
+        description="Seconds to wait for the element",
+    )
+
+    @model_validator(mode="after")
+    def check_arguments(self) -> FlowAction:
+        """Fill needs a value and press a key."""
+        if self.action == "fill" and self.value is None:
+            raise ValueError("fill needs a value")
+        if self.action == "press" and self.key is None:
+            raise ValueError("press needs a key")
+        return self
+
+
+class Condition(BaseModel):
+    """A check on the current page; every check given must pass."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    status: Optional[int] = Field(
+        default=None,
+        ge=100,
+        le=599,
+        description="Status code the last page load must have returned",
+    )
+
+    selector: Optional[str] = Field(
+        default=None,
+        min_length=1,
+        description="Element that must exist, with {{ name }} placeholders",
+    )
+
+    frame: Optional[str] = Field(
+        default=None,
+        description="Frame path to the element, e.g. 'name=search' (see extraction)",
+    )
+
+    text: Optional[str] = Field(
+        default=None,
+        min_length=1,
+        description="Regular expression the element's text, or the page's, must match, with {{ name }} placeholders",
+    )
+
+    negate: bool = Field(
+        default=False,
+        description="Pass when the checks fail instead",
+    )
+
+    @model_validator(mode="after")
+    def check_checks(self) -> Condition:
+        """A condition checks something."""
+        if self.status is None and self.selector is None and self.text is None:
+            raise ValueError("A condition needs a status, selector or text")
+        return self
+
+
+class Assertion(Condition):
+    """A condition a step must meet."""
+
+    message: Optional[str] = Field(
+        default=None,
+        description="What failed, reported instead of the failed check",
+    )
+
+
+class AssertionFailed(Exception):
+    """Raised when a step's assertion does not hold."""
+
+    def __init__(self, index: int, message: str):
+        super().__init__(f"Assertion {index} failed: {message}")
+        self.index = index
+
+
+class StepFailed(Exception):
+    """Raised when a step of a flow, possibly an ``else`` step, fails."""
+
+    def __init__(self, path: str, message: str, assertion: Optional[int] = None):
+        super().__init__(f"Step {path}: {message}")
+        self.path = path
+        self.assertion = assertion
+
+
+class FlowStep(BaseModel):
+    """One step of a flow."""
+
+    # Job records store the fields by name
+    model_config = ConfigDict(extra="forbid", populate_by_name=True)
+
+    condition: Optional[Condition] = Field(
+        default=None,
+        alias="if",
+        description="Only run the step if this holds on the current page",
+    )
+
+    otherwise: list[FlowStep] = Field(
+        default_factory=list,
+        alias="else",
+        description="Steps run instead when the condition does not hold",
+    )
+
+    url: Optional[str] = Field(
+        default=None,
+        description="URL to load, with {{ name }} placeholders; relative to the current page (default: stay)",
+    )
+
+    wait_until: Literal["commit", "domcontentloaded", "load", "networkidle"] = Field(
+        default="load",
+        description="Navigation event to wait for, also after the actions",
+    )
+
+    timeout: float = Field(
+        default=30.0,
+        gt=0,
+        le=300,
+        description="Navigation timeout in seconds",
+    )
+
+    actions: list[FlowAction] = Field(
+        default_factory=list,
+        description="Actions taken on the page after loading it, in order",
+    )
+
+    extract: dict[str, ExtractRule] = Field(
+        default_factory=dict,
+        description="Fields to extract, which later steps can use as variables",
+    )
+
+    html: bool = Field(
+        default=False,
+        description="Include the page's HTML in the step's result",
+    )
+
+    screenshot: bool = Field(
+        default=False,
+        description="Include a base64-encoded PNG screenshot in the step's result",
+    )
+
+    assertions: list[Assertion] = Field(
+        default_factory=list,
+        alias="assert",
+        description="Conditions checked after the actions and extraction; the first that fails ends the flow",
+    )
+
+    @model_validator(mode="after")
+    def check_else(self) -> FlowStep:
+        """Else steps belong to a condition."""
+        if self.otherwise and self.condition is None:
+            raise ValueError("else needs an if")
+        return self
+
+    def count(self) -> int:
+        """Number of steps, counting the else steps."""
+        return 1 + sum(step.count() for step in self.otherwise)
+
+
+class Flow(BaseModel):
+    """A chain of steps run on one browser."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    steps: list[FlowStep] = Field(
+        min_length=1,
+        max_length=MAX_FLOW_STEPS,
+        description="Steps to run in order",
+    )
+
+    vars: dict[str, Any] = Field(
+        default_factory=dict,
+        description="Variables available to every step",
+    )
+
+    dialogs: list[DialogRule] = Field(
+        default_factory=list,
+        description="Dialog rules for this flow, tried before the configured ones",
+    )
+
+    lease: LeaseOptions = Field(
+        default_factory=LeaseOptions,
+        description="Options for the browser lease the flow runs on",
+    )
+
+    @model_validator(mode="after")
+    def check_start(self) -> Flow:
+        """A flow starts by loading a page, unconditionally, and isn't too long."""
+        if self.steps[0].url is None or self.steps[0].condition is not None:
+            raise ValueError("The first step needs a url and no condition")
+        if sum(step.count() for step in self.steps) > MAX_FLOW_STEPS:
+            raise ValueError(f"A flow has at most {MAX_FLOW_STEPS} steps, counting else steps")
+        return self
+
+    @property
+    def url(self) -> str:
+        """The flow's first URL, as written."""
+        return self.steps[0].url or ""
+
+
+@dataclass
+class FlowResult:
+    """Outcome of a flow."""
+
+    url: str
+    instance: Optional[int] = None
+    steps: list[dict] = field(default_factory=list)
+    data: dict = field(default_factory=dict)
+    dialogs: list[dict] = field(default_factory=list)
+    failed_step: Optional[int] = None
+    failed_path: Optional[str] = None
+    failed_assertion: Optional[int] = None
+    error: Optional[str] = None
+    started_at: float = field(default_factory=time.time)
+    duration: float = 0.0
+    last_status: Optional[int] = None
+    signature: Optional[dict] = None
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "url": self.url,
+            "instance": self.instance,
+            "steps": self.steps,
+            "data": self.data,
+            "dialogs": self.dialogs,
+            "failed_step": self.failed_step,
+            "failed_path": self.failed_path,
+            "failed_assertion": self.failed_assertion,
+            "error": self.error,
+            "started_at": self.started_at,
+            "duration": round(self.duration, 2),
+            "signature": self.signature,
+        }
+
+
+async def perform(page: Any, action: FlowAction, variables: dict) -> None:
+    """Take an action on a page."""
+    locator = resolve_frame(page, action.frame).locator(action.selector).first
+    timeout = action.timeout * 1000
+    if action.action == "click":
+        await locator.click(timeout=timeout)
+    elif action.action == "fill":
+        await locator.fill(render(action.value or "", variables), timeout=timeout)
+    elif action.action == "press":
+        await locator.press(action.key or "", timeout=timeout)
+    else:
+        await locator.wait_for(timeout=timeout)
+
+
+async def check(page: Any, condition: Condition, variables: dict, status: Optional[int]) -> Optional[str]:
+    """
+    Check a condition on a page.
+
+    Returns:
+        None if the condition holds, else why it doesn't
+    """
+    failure = None
+    locator = None
+    if condition.selector is not None:
+        selector = render(condition.selector, variables)
+        locator = resolve_frame(page, condition.frame).locator(selector).first
+    if condition.status is not None and status != condition.status:
+        failure = f"status is {status}, not {condition.status}"
+    elif locator is not None and not await locator.count():
+        failure = f"no element matches {condition.selector!r}"
+    elif condition.text is not None:
+        pattern = render(condition.text, variables)
+        text = await locator.inner_text() if locator is not None else await page.inner_text("body")
+        if not re.search(pattern, text):
+            failure = f"text does not match {pattern!r}"
+
+    if not condition.negate:
+        return failure
+    return "the condition holds" if failure is None else None
+
+
+async def run_step(page: Any, step: FlowStep, variables: dict, record: dict, status: Optional[int] = None) -> None:
+    """Run one step, recording its outcome and adding its extracted fields to the variables."""
+    if step.url is not None:
+        base = page.url if page.url.startswith(("http://", "https://")) else ""
+        url = urljoin(base, render(step.url, variables))
+        if not url.startswith(("http://", "https://")):
+            raise ValueError(f"URL must start with http:// or https://: {url}")
+        record["url"] = url
+        response = await page.goto(url, wait_until=step.wait_until, timeout=step.timeout * 1000)
+        record["status"] = response.status if response else None
+
+    for action in step.actions:
+        await perform(page, action, variables)
+    if step.actions and step.wait_until != "commit":
+        # Actions may have started a navigation
+        await page.wait_for_load_state(step.wait_until, timeout=step.timeout * 1000)
+
+    record["final_url"] = page.url
+    if step.url is not None:
+        record["protocol"] = await navigation_protocol(page)
+    if step.extract:
+        record["data"], record["extract_errors"] = await extract(page, step.extract)
+        variables.update(record["data"])
+    if step.html:
+        record["html"] = await page.content()
+    if step.screenshot:
+        record["screenshot"] = base64.b64encode(await page.screenshot()).decode()
+
+    status = record["status"] if step.url is not None else status
+    for index, assertion in enumerate(step.assertions):
+        failure = await check(page, assertion, variables, status)
+        if failure is not None:
+            raise AssertionFailed(index, assertion.message or failure)
+
+
+async def run_steps(
+    page: Any,
+    steps: list[FlowStep],
+    variables: dict,
+    result: FlowResult,
+    records: list[dict],
+    prefix: str = "",
+) -> None:
+    """
+    Run steps in order, following their conditions into else steps.
+
+    Raises:
+        StepFailed: When a step or one of its assertions fails
+    """
+    for index, step in enumerate(steps):
+        path = f"{prefix}{index}"
+        record: dict = {"index": index, "url": None, "status": None, "error": None}
+        records.append(record)
+        began = time.time()
+        try:
+            if step.condition is not None:
+                record["condition"] = await check(page, step.condition, variables, result.last_status) is None
+                if not record["condition"]:
+                    record["else"] = []
+                    await run_steps(page, step.otherwise, variables, result, record["else"], f"{path}.else.")
+                    continue
+            await run_step(page, step, variables, record, result.last_status)
+            result.data.update(record.get("data") or {})
+        except StepFailed:
+            raise
+        except AssertionFailed as e:
+            record["error"] = str(e)
+            raise StepFailed(path, str(e), e.index) from e
+        except Exception as e:
+            record["error"] = str(e)
+            raise StepFailed(path, str(e)) from e
+        finally:
+            if record["status"] is not None:
+                result.last_status = record["status"]
+            record["duration"] = round(time.time() - began, 2)
+
+
+async def run_flow(runner: TaskRunner, flow: Flow, tenant: Optional[str] = None) -> Optional[FlowResult]:
+    """
+    Wait for the first domain's rate limit, then run a flow on a leased browser.
+
+    Returns:
+        The flow result, or None if no browser was available.
+
+    Raises:
+        The same errors as :meth:`TaskRunner.fetch`.
+    """
+    try:
+        first_url = render(flow.url, flow.vars)
+    except TemplateError as e:
+        return FlowResult(url=flow.url, failed_step=0, failed_path="0", error=f"Step 0: {e}")
+
+    async with runner.limiter.slot(first_url):
+        session = await runner.sessions.acquire(flow.lease, tenant=tenant)
+        if session is None:
+            return None
+
+        result = FlowResult(url=first_url, instance=session.instance.index)
+        variables = dict(flow.vars)
+        try:
+            browser = await runner.connect(session)
+            try:
+                context = await browser.new_context()
+                runner.handle_dialogs(context, flow.dialogs, result.dialogs)
+                page = await context.new_page()
+
+                try:
+                    await run_steps(page, flow.steps, variables, result, result.steps)
+                except StepFailed as e:
+                    logger.warning(f"Flow from {first_url} failed: {e}")
+                    result.failed_step = int(e.path.split(".")[0])
+                    result.failed_path = e.path
+                    result.failed_assertion = e.assertion
+                    result.error = str(e)
+            finally:
+                await browser.close()
+        except Exception as e:
+            logger.warning(f"Flow from {first_url} failed: {e}")
+            result.error = str(e)
+        finally:
+            result.duration = time.time() - result.started_at
+            await runner.sessions.release(session.id)
+
+    if runner.signer is not None:
+        result.signature = runner.signer.sign(result.to_dict())
+    return result
@@ -0,0 +1,82 @@
+"""
+Proxy-aware geolocation for Camoufox Connector.
+
+Resolves the exit IP of a proxy and looks it up in the GeoIP database shipped
+with ``camoufox[geoip]`` so a browser's timezone, locale and coordinates can be
+aligned with the network it is browsing from.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+from dataclasses import dataclass
+from typing import Optional
+
+logger = logging.getLogger(__name__)
+
+
+@dataclass
+class GeoInfo:
+    """Geolocation details resolved for an exit IP."""
+
+    ip: str
+    timezone: Optional[str] = None
+    locale: Optional[str] = None
+    latitude: Optional[float] = None
+    longitude: Optional[float] = None
+    accuracy: Optional[float] = None
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "ip": self.ip,
+            "timezone": self.timezone,
+            "locale": self.locale,
+            "latitude": self.latitude,
+            "longitude": self.longitude,
+            "accuracy": self.accuracy,
+        }
+
+
+def _resolve_sync(proxy: Optional[str]) -> GeoInfo:
+    """Blocking implementation of :func:`resolve_proxy_geo`."""
+    from camoufox.ip import public_ip
+    from camoufox.locale import get_geolocation
+
+    ip = public_ip(proxy)
+    geolocation = get_geolocation(ip)
+
+    locale = geolocation.locale
+    locale_str = locale.as_string() if hasattr(locale, "as_string") else str(locale)
+
+    return GeoInfo(
+        ip=ip,
+        timezone=geolocation.timezone,
+        locale=locale_str,
+        latitude=geolocation.latitude,
+        longitude=geolocation.longitude,
+        accuracy=getattr(geolocation, "accuracy", None),
+    )
+
+
+async def resolve_proxy_geo(proxy: Optional[str]) -> GeoInfo:
+    """
+    Resolve the exit IP of a proxy and look up its geolocation.
+
+    Args:
+        proxy: Proxy URL to resolve through, or None for a direct connection
+
+    Returns:
+        Geolocation details for the exit IP.
+
+    Raises:
+        RuntimeError: If the exit IP or its location cannot be determined.
+    """
+    try:
+        geo = await asyncio.to_thread(_resolve_sync, proxy)
+    except Exception as e:
+        raise RuntimeError(f"Failed to resolve proxy geolocation: {e}") from e
+
+    logger.debug(f"Resolved exit IP {geo.ip} to {geo.timezone} / {geo.locale}")
+    return geo
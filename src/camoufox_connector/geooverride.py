@@ -0,0 +1,244 @@
+"""
+Per-session geolocation and locale overrides for Camoufox Connector.
+
+A lease acquired with ``geo_override``, or changed later through
+``PATCH /sessions/{id}/geo``, gets that position, timezone and
+Accept-Language in its browser contexts, so workflows simulating a
+traveling user don't have to relaunch browsers. New contexts are created
+with all of them. Open contexts follow geolocation and Accept-Language
+changes right away; Firefox fixes a context's timezone and locale when it is
+created, so those apply to contexts created after the change.
+"""
+
+from __future__ import annotations
+
+import logging
+import re
+from dataclasses import dataclass
+from typing import TYPE_CHECKING, Optional
+from zoneinfo import ZoneInfo, ZoneInfoNotFoundError
+
+from pydantic import BaseModel, ConfigDict, Field, ValidationError, field_validator, model_validator
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .relay import RelayCallError
+
+if TYPE_CHECKING:
+    from .relay import Relay, RelayConnection
+    from .sessions import Session, SessionManager
+
+logger = logging.getLogger(__name__)
+
+LANGUAGE_RANGE = re.compile(r"^(\*|[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*)(;q=(0(\.\d{0,3})?|1(\.0{0,3})?))?$")
+
+
+class GeoOverride(BaseModel):
+    """Position, timezone and language a session's browser contexts report."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    latitude: Optional[float] = Field(default=None, ge=-90, le=90, description="Latitude in degrees")
+
+    longitude: Optional[float] = Field(default=None, ge=-180, le=180, description="Longitude in degrees")
+
+    accuracy: Optional[float] = Field(
+        default=None,
+        ge=0,
+        description="Accuracy of the position in meters (default: 0)",
+    )
+
+    timezone: Optional[str] = Field(
+        default=None,
+        description="IANA timezone, e.g. Europe/Berlin",
+    )
+
+    accept_language: Optional[str] = Field(
+        default=None,
+        max_length=200,
+        description="Accept-Language header, e.g. de-DE,de;q=0.9; its first language is also the locale",
+    )
+
+    @field_validator("timezone")
+    @classmethod
+    def validate_timezone(cls, v: Optional[str]) -> Optional[str]:
+        """Only accept timezones Python's database knows."""
+        if v is None:
+            return v
+        try:
+            ZoneInfo(v)
+        except (ZoneInfoNotFoundError, ValueError):
+            raise ValueError(f"Unknown timezone: {v}")
+        return v
+
+    @field_validator("accept_language")
+    @classmethod
+    def validate_accept_language(cls, v: Optional[str]) -> Optional[str]:
+        """Validate the language ranges."""
+        if v is None:
+            return v
+        ranges = [part.replace(" ", "") for part in v.split(",")]
+        for part in ranges:
+            if not LANGUAGE_RANGE.match(part):
+                raise ValueError(f"Invalid language range: {part!r}")
+        return ",".join(ranges)
+
+    @model_validator(mode="after")
+    def check_position(self) -> GeoOverride:
+        """A position needs both coordinates."""
+        if (self.latitude is None) != (self.longitude is None):
+            raise ValueError("latitude and longitude must be given together")
+        if self.accuracy is not None and self.latitude is None:
+            raise ValueError("accuracy needs latitude and longitude")
+        return self
+
+    @property
+    def locale(self) -> Optional[str]:
+        """Locale of the first language of the Accept-Language header."""
+        if self.accept_language is None:
+            return None
+        first = self.accept_language.split(",")[0].split(";")[0]
+        return first if first != "*" else None
+
+    def geolocation(self) -> Optional[dict]:
+        """Playwright geolocation of the position, if one is set."""
+        if self.latitude is None or self.longitude is None:
+            return None
+        return {"latitude": self.latitude, "longitude": self.longitude, "accuracy": self.accuracy or 0}
+
+    def context_params(self) -> dict:
+        """Browser context options reporting the overrides."""
+        params: dict = {}
+        geolocation = self.geolocation()
+        if geolocation is not None:
+            params["geolocation"] = geolocation
+            params["permissions"] = ["geolocation"]
+        if self.timezone is not None:
+            params["timezoneId"] = self.timezone
+        if self.accept_language is not None:
+            params["extraHTTPHeaders"] = [{"name": "Accept-Language", "value": self.accept_language}]
+            if self.locale is not None:
+                params["locale"] = self.locale
+        return params
+
+
+def with_accept_language(headers: list[dict], accept_language: Optional[str]) -> list[dict]:
+    """Replace the Accept-Language header of a Playwright header list, or drop it for None."""
+    kept = [h for h in headers if h.get("name", "").lower() != "accept-language"]
+    if accept_language is None:
+        return kept
+    return [*kept, {"name": "Accept-Language", "value": accept_language}]
+
+
+@dataclass
+class GeoEmulator:
+    """Applies sessions' geolocation and locale overrides to their browser contexts."""
+
+    relay: Relay
+
+    def __post_init__(self) -> None:
+        self.relay.context_params_providers.append(self._context_params)
+        self.relay.call_rewriters.append(self._rewrite_call)
+
+    def _context_params(self, connection: RelayConnection) -> dict:
+        """Report the session's overrides in a new context."""
+        session = connection.session
+        if session is None or session.geo_override is None:
+            return {}
+        return session.geo_override.context_params()
+
+    def _rewrite_call(self, connection: RelayConnection, message: dict) -> bool:
+        """Keep the session's Accept-Language when the client sets a context's extra headers."""
+        if message.get("method") != "setExtraHTTPHeaders" or message.get("guid") not in connection.contexts:
+            return False
+        params = message.get("params") or {}
+        headers = list(params.get("headers") or [])
+        # Restored on open contexts when the override is removed
+        connection.state.setdefault("geo_headers", {})[message["guid"]] = headers
+
+        session = connection.session
+        if session is None or session.geo_override is None or session.geo_override.accept_language is None:
+            return False
+        message["params"] = {**params, "headers": with_accept_language(headers, session.geo_override.accept_language)}
+        return True
+
+    async def apply(self, session: Session, override: Optional[GeoOverride]) -> int:
+        """
+        Change a session's overrides and update its open contexts.
+
+        Returns:
+            The number of open contexts updated.
+        """
+        previous = session.geo_override
+        session.geo_override = override
+        position = override.geolocation() if override is not None else None
+        language = override.accept_language if override is not None else None
+        position_changed = position != (previous.geolocation() if previous is not None else None)
+        language_changed = language != (previous.accept_language if previous is not None else None)
+        if not position_changed and not language_changed:
+            return 0
+
+        updated = 0
+        for connection in self.relay.connections_for_session(session.id):
+            client_headers = connection.state.get("geo_headers", {})
+            for guid in list(connection.contexts):
+                try:
+                    if position_changed:
+                        if position is not None:
+                            await connection.call(guid, "grantPermissions", {"permissions": ["geolocation"]})
+                        await connection.call(guid, "setGeolocation", {"geolocation": position} if position else {})
+                    if language_changed:
+                        headers = with_accept_language(client_headers.get(guid, []), language)
+                        await connection.call(guid, "setExtraHTTPHeaders", {"headers": headers})
+                    updated += 1
+                except RelayCallError as e:
+                    logger.warning(f"Failed to update the geolocation and locale of {guid}: {e}")
+        return updated
+
+
+def create_geo_routes(emulator: GeoEmulator, sessions: SessionManager) -> list[Route]:
+    """
+    Create the route changing a session's geolocation and locale.
+
+    Args:
+        emulator: Geo emulator applying the overrides
+        sessions: Session manager holding the leases
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def patch_geo(request: Request) -> Response:
+        """
+        Change a session's position, timezone or Accept-Language; null removes one.
+
+        PATCH /sessions/{id}/geo
+        """
+        session = sessions.get_for(request, request.path_params["session_id"])
+        if session is None:
+            return JSONResponse({"error": "Session not found"}, status_code=404)
+
+        try:
+            patch = GeoOverride.model_validate_json(await request.body())
+            current = session.geo_override.model_dump() if session.geo_override is not None else {}
+            override = GeoOverride.model_validate({**current, **patch.model_dump(exclude_unset=True)})
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid geo override", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+
+        if not override.model_dump(exclude_none=True):
+            override = None
+        updated = await emulator.apply(session, override)
+        return JSONResponse({
+            "status": "updated",
+            "id": session.id,
+            "geo_override": override.model_dump(exclude_none=True) if override is not None else None,
+            "contexts": updated,
+        })
+
+    return [
+        Route("/sessions/{session_id}/geo", patch_geo, methods=["PATCH"]),
+    ]
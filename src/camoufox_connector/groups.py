@@ -0,0 +1,114 @@
+"""
+Pool groups for Camoufox Connector.
+
+One pool often serves different kinds of work: logged-in sessions that want
+stable identities, and anonymous crawling that wants to rotate them. With
+``pool_groups``, the pool is made up of named groups, each with its own
+size, fingerprint defaults and proxy rotation, and its own recycling
+policy: whether poisoned browsers are recycled, whether recycled browsers
+move on to the next proxy, and whether browsers are relaunched with a new
+identity after a number of leases. Instances carry a ``group=<name>``
+label, so clients select a group with ``/next?group=auth`` or a lease's
+``group`` option.
+"""
+
+from __future__ import annotations
+
+import logging
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .events import Event
+
+if TYPE_CHECKING:
+    from .pool import BrowserPool
+    from .recycle import PoisonDetector
+
+logger = logging.getLogger(__name__)
+
+
+@dataclass
+class GroupPolicy:
+    """Applies the pool groups' recycling policies."""
+
+    pool: BrowserPool
+    detector: PoisonDetector
+    # Leases each instance served since it was launched, by index
+    leases: dict[int, int] = field(default_factory=dict)
+
+    def __post_init__(self) -> None:
+        self.pool.events.listeners.append(self.handle)
+
+    async def handle(self, event: Event) -> None:
+        """Count leases, and recycle browsers that served their share once released."""
+        index = event.data.get("index")
+        if index is None:
+            return
+        if event.type == "browser-ready":
+            self.leases.pop(index, None)
+        elif event.type == "lease-acquired":
+            self.leases[index] = self.leases.get(index, 0) + 1
+        elif event.type == "lease-released":
+            self._check(index)
+
+    def _check(self, index: int) -> None:
+        """Recycle an instance that reached its group's lease limit and is idle."""
+        group = self.pool.settings.group_for(index)
+        if group is None or group.recycle_after_leases is None:
+            return
+        served = self.leases.get(index, 0)
+        if served < group.recycle_after_leases:
+            return
+        instance = next((inst for inst in self.pool.instances if inst.index == index), None)
+        if instance is None or not instance.is_available:
+            # Context leases still running, or already relaunching
+            return
+        self.leases.pop(index, None)
+        self.detector.schedule_recycle(instance, None, f"served {served} lease(s) in group {group.name}")
+
+    def report(self) -> dict:
+        """The groups, their policies and how many of their browsers are up, idle and leased."""
+        groups = {}
+        for group in self.pool.settings.pool_groups:
+            instances = [inst for inst in self.pool.instances if inst.labels.get("group") == group.name]
+            groups[group.name] = {
+                "size": group.size,
+                "instances": len(instances),
+                "healthy": sum(1 for inst in instances if inst.is_healthy),
+                "idle": sum(1 for inst in instances if inst.is_available),
+                "leased": sum(1 for inst in instances if inst.is_leased),
+                "proxies": len(group.proxies),
+                "rotate_proxy_on_recycle": group.rotate_proxy_on_recycle,
+                "recycle_poisoned": group.recycle_poisoned,
+                "recycle_after_leases": group.recycle_after_leases,
+                "recycles": sum(inst.recycles for inst in instances),
+            }
+        return groups
+
+
+def create_group_routes(policy: GroupPolicy) -> list[Route]:
+    """
+    Create routes reporting the pool groups.
+
+    Args:
+        policy: Policy applying the groups' recycling rules
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def list_groups(request: Request) -> Response:
+        """
+        The pool groups, their policies and browsers.
+
+        GET /groups
+        """
+        return JSONResponse({"groups": policy.report()})
+
+    return [
+        Route("/groups", list_groups, methods=["GET"]),
+    ]
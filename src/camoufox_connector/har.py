@@ -0,0 +1,141 @@
+"""
+HAR capture for Camoufox Connector.
+
+Leases acquired with ``"har": true`` have the network traffic of every
+browser context recorded by the browser itself. The relay exports each
+context's HAR when it is closed (or when the client disconnects) and stores
+it as a session artifact; ``GET /sessions/{id}/har`` returns all of them
+merged into one HAR, also after the lease was released.
+"""
+
+from __future__ import annotations
+
+import json
+import logging
+from dataclasses import dataclass
+from pathlib import Path
+from typing import TYPE_CHECKING, Optional
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .relay import RelayCallError
+
+if TYPE_CHECKING:
+    from .artifacts import ArtifactStore
+    from .relay import Relay, RelayConnection
+
+logger = logging.getLogger(__name__)
+
+HAR_OPTIONS = {"content": "embed", "mode": "full", "zip": False}
+
+
+def merge_hars(paths: list[Path]) -> Optional[dict]:
+    """Merge several HAR files into one, keeping the first file's metadata."""
+    merged: Optional[dict] = None
+    for path in paths:
+        try:
+            log = json.loads(path.read_text())["log"]
+        except (OSError, ValueError, KeyError) as e:
+            logger.warning(f"Skipping unreadable HAR {path}: {e}")
+            continue
+        if merged is None:
+            merged = {"log": {**log, "pages": list(log.get("pages", [])), "entries": list(log.get("entries", []))}}
+        else:
+            merged["log"]["pages"].extend(log.get("pages", []))
+            merged["log"]["entries"].extend(log.get("entries", []))
+    if merged is not None:
+        merged["log"]["entries"].sort(key=lambda e: e.get("startedDateTime", ""))
+    return merged
+
+
+@dataclass
+class HarRecorder:
+    """Records HARs for the browser contexts of leases that ask for them."""
+
+    relay: Relay
+    store: ArtifactStore
+
+    def __post_init__(self) -> None:
+        self.relay.context_hooks.append(self._on_context)
+        self.relay.call_hooks.append(self._on_call)
+        self.relay.disconnect_hooks.append(self._on_disconnect)
+
+    @staticmethod
+    def _recordings(connection: RelayConnection) -> Optional[dict[str, str]]:
+        """Get the HAR IDs of a connection's recorded contexts, if it records."""
+        if connection.session is None or not connection.session.options.har:
+            return None
+        return connection.state.setdefault("har", {})
+
+    async def _on_context(self, connection: RelayConnection, guid: str) -> None:
+        """Start recording a new context."""
+        recordings = self._recordings(connection)
+        if recordings is None:
+            return
+        result = await connection.call(guid, "harStart", {"options": HAR_OPTIONS})
+        recordings[guid] = result["harId"]
+
+    async def _on_call(self, connection: RelayConnection, message: dict) -> None:
+        """Export a context's HAR before the client closes it."""
+        recordings = self._recordings(connection)
+        if recordings and message.get("method") == "close" and message.get("guid") in recordings:
+            await self.export(connection, message["guid"])
+
+    async def _on_disconnect(self, connection: RelayConnection) -> None:
+        """Export the HARs of contexts the client left open."""
+        for guid in list(self._recordings(connection) or {}):
+            await self.export(connection, guid)
+
+    async def export(self, connection: RelayConnection, guid: str) -> Optional[Path]:
+        """Save a context's HAR as a session artifact."""
+        har_id = connection.state.get("har", {}).pop(guid, None)
+        if har_id is None or connection.session is None:
+            return None
+
+        path = self.store.new_path(connection.session.id, "har", ".har")
+        try:
+            result = await connection.call(guid, "harExport", {"harId": har_id})
+            artifact = result["artifact"]["guid"]
+            await connection.call(artifact, "saveAs", {"path": str(path)})
+            await connection.call(artifact, "delete")
+        except (RelayCallError, KeyError) as e:
+            logger.warning(f"Failed to export HAR of {guid}: {e}")
+            return None
+
+        logger.debug(f"Saved HAR of {guid} to {path}")
+        return path
+
+
+def create_har_routes(store: ArtifactStore) -> list[Route]:
+    """
+    Create the route serving captured HARs.
+
+    Args:
+        store: Artifact store the HARs are saved to
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_har(request: Request) -> Response:
+        """
+        Download the HAR captured for a session.
+
+        GET /sessions/{id}/har
+        """
+        session_id = request.path_params["session_id"]
+        if not await store.accessible(request, session_id):
+            return JSONResponse({"error": "No HAR captured for this session"}, status_code=404)
+        har = merge_hars(store.files(session_id, "har"))
+        if har is None:
+            return JSONResponse({"error": "No HAR captured for this session"}, status_code=404)
+        return JSONResponse(
+            har,
+            headers={"Content-Disposition": f'attachment; filename="{session_id}.har"'},
+        )
+
+    return [
+        Route("/sessions/{session_id}/har", get_har, methods=["GET"]),
+    ]
@@ -6,27 +6,149 @@ Provides endpoints for health monitoring and browser pool management.
 
 from __future__ import annotations
 
+import asyncio
 import json
 import logging
-from typing import TYPE_CHECKING
+from typing import TYPE_CHECKING, Optional, Sequence
+from urllib.parse import urlsplit
 
+from pydantic import BaseModel, ConfigDict, Field, ValidationError, field_validator
 from starlette.applications import Starlette
+from starlette.middleware import Middleware
 from starlette.requests import Request
 from starlette.responses import JSONResponse, Response
-from starlette.routing import Route
+from starlette.routing import BaseRoute, Route
+
+from .advertise import client_endpoint
+from .auth import ApiKeyMiddleware
+from .config import parse_label_selector
+from .listeners import bind_sockets
+from .netpolicy import IpAllowlistMiddleware
+from .proxyheaders import ProxyHeadersMiddleware
+from .relay import websocket_url
 
 if TYPE_CHECKING:
     from .pool import BrowserPool
 
 logger = logging.getLogger(__name__)
 
+# Seconds /readyz waits for a browser's endpoint to accept a connection
+CONNECT_TIMEOUT = 2.0
+
+
+class LabelUpdate(BaseModel):
+    """Changes to a browser instance's labels."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    labels: dict[str, Optional[str]] = Field(
+        description="Labels to set, by name; a null value removes the label",
+    )
+
+    @field_validator("labels")
+    @classmethod
+    def validate_names(cls, v: dict[str, Optional[str]]) -> dict[str, Optional[str]]:
+        """Label names must be usable in ?label= selectors."""
+        for key in v:
+            if not key.strip() or "=" in key:
+                raise ValueError(f"Invalid label name: {key!r}")
+        return v
+
+
+async def connectable(endpoint: str) -> bool:
+    """Whether a browser's WebSocket endpoint accepts TCP connections."""
+    parts = urlsplit(endpoint)
+    try:
+        _, writer = await asyncio.wait_for(
+            asyncio.open_connection(parts.hostname, parts.port or 80),
+            timeout=CONNECT_TIMEOUT,
+        )
+    except (OSError, asyncio.TimeoutError):
+        return False
+    writer.close()
+    return True
+
+
+def select_group(pool: BrowserPool, request: Request, labels: dict[str, Optional[str]]) -> Optional[Response]:
+    """Add a ``?group=`` selection to a label selector; returns an error response for unknown groups."""
+    group = request.query_params.get("group")
+    if group is None:
+        return None
+    if pool.settings.get_group(group) is None:
+        return JSONResponse(
+            {"error": f"No pool group named {group}", "groups": [g.name for g in pool.settings.pool_groups]},
+            status_code=404,
+        )
+    labels["group"] = group
+    return None
+
+
+async def next_local_endpoint(pool: BrowserPool, request: Request) -> Response:
+    """Hand out the next available browser of this connector's own pool."""
+    if not pool.is_ready():
+        # Still starting, or too few browsers survived
+        return JSONResponse(
+            {
+                "error": "Browser pool is not ready",
+                "ready": len(pool.get_ready_instances()),
+                "min_ready": pool.min_ready,
+            },
+            status_code=503,
+            headers={"Retry-After": "5"},
+        )
+    version = request.query_params.get("version")
+    if version is not None and not pool.has_version(version):
+        return JSONResponse(
+            {"error": f"No browser instances run version {version}", "versions": pool.get_versions()},
+            status_code=404,
+        )
+    try:
+        labels = parse_label_selector(request.query_params.getlist("label"))
+    except ValueError as e:
+        return JSONResponse({"error": str(e)}, status_code=400)
+    error = select_group(pool, request, labels)
+    if error is not None:
+        return error
+    if labels and not pool.has_labels(labels):
+        return JSONResponse(
+            {"error": "No browser instances have the requested labels", "labels": pool.get_labels()},
+            status_code=404,
+        )
+
+    instance = await pool.get_next_instance(version, labels)
+
+    if instance is None:
+        return JSONResponse(
+            {"error": "No healthy browser instances available"},
+            status_code=503,
+        )
+
+    if pool.settings.relay:
+        endpoint = websocket_url(request, f"/browsers/{instance.index}/ws")
+    else:
+        endpoint = client_endpoint(request, pool.settings, instance.ws_endpoint)
+
+    return JSONResponse({
+        "endpoint": endpoint,
+        "version": instance.version,
+        "labels": instance.labels,
+    })
+
 
-def create_health_app(pool: BrowserPool) -> Starlette:
+def create_health_app(
+    pool: BrowserPool,
+    extra_routes: Sequence[BaseRoute] = (),
+    extra_middleware: Sequence[Middleware] = (),
+) -> Starlette:
     """
     Create a Starlette application for health checks and management.
 
     Args:
         pool: Browser pool instance to monitor
+        extra_routes: Additional routes provided by other subsystems; they
+            are matched first, so they can take over built-in paths
+        extra_middleware: Middleware provided by other subsystems; only
+            requests access control lets through reach it
 
     Returns:
         Starlette application instance
@@ -51,13 +173,57 @@ def create_health_app(pool: BrowserPool) -> Starlette:
             status_code=status_code,
         )
 
+    async def livez(request: Request) -> Response:
+        """
+        Liveness probe: the process is up and serving requests.
+
+        GET /livez
+        """
+        return JSONResponse({"status": "alive"})
+
+    async def readyz(request: Request) -> Response:
+        """
+        Readiness probe: at least ``min_ready`` browsers are up and connectable.
+
+        GET /readyz
+        """
+        instances = pool.get_ready_instances()
+        results = await asyncio.gather(*(connectable(inst.ws_endpoint) for inst in instances))
+        connected = sum(results)
+        ready = connected >= pool.min_ready
+        return JSONResponse(
+            {
+                "status": "ready" if ready else "not ready",
+                "connectable": connected,
+                "launched": len(instances),
+                "min_ready": pool.min_ready,
+                "pool_size": len(pool.instances),
+            },
+            status_code=200 if ready else 503,
+        )
+
     async def endpoints(request: Request) -> Response:
         """
         Get available WebSocket endpoints.
 
-        Returns a list of all healthy browser endpoints.
+        Returns a list of all healthy browser endpoints; ``?version=``
+        limits it to one browser version, ``?label=`` to instances
+        with matching labels and ``?group=`` to a pool group.
         """
-        all_endpoints = pool.get_all_endpoints()
+        version = request.query_params.get("version")
+        try:
+            labels = parse_label_selector(request.query_params.getlist("label"))
+        except ValueError as e:
+            return JSONResponse({"error": str(e)}, status_code=400)
+        error = select_group(pool, request, labels)
+        if error is not None:
+            return error
+        # Leased browsers are only reachable through their session
+        available = pool.get_available_instances(version, labels)
+        if pool.settings.relay:
+            all_endpoints = [websocket_url(request, f"/browsers/{inst.index}/ws") for inst in available]
+        else:
+            all_endpoints = [client_endpoint(request, pool.settings, inst.ws_endpoint) for inst in available]
 
         return JSONResponse({
             "endpoints": all_endpoints,
@@ -68,19 +234,12 @@ def create_health_app(pool: BrowserPool) -> Starlette:
         """
         Get the next available endpoint using round-robin.
 
-        This is the primary endpoint for clients to get a browser.
+        This is the primary endpoint for clients to get a browser;
+        ``?version=`` selects among the configured browser versions and
+        ``?label=key=value`` (repeatable) by instance labels and
+        ``?group=`` by pool group.
         """
-        endpoint = await pool.get_next_endpoint()
-
-        if endpoint is None:
-            return JSONResponse(
-                {"error": "No healthy browser instances available"},
-                status_code=503,
-            )
-
-        return JSONResponse({
-            "endpoint": endpoint,
-        })
+        return await next_local_endpoint(pool, request)
 
     async def stats(request: Request) -> Response:
         """
@@ -88,6 +247,7 @@ def create_health_app(pool: BrowserPool) -> Starlette:
 
         Returns connection counts, uptime, and instance details.
         """
+        await pool.sample_memory()
         return JSONResponse(pool.get_stats())
 
     async def restart_instance(request: Request) -> Response:
@@ -117,6 +277,56 @@ def create_health_app(pool: BrowserPool) -> Starlette:
                 status_code=500,
             )
 
+    async def capacity(request: Request) -> Response:
+        """
+        Get the estimated browser capacity of this host or container.
+
+        Derived from cgroup CPU quotas and memory limits, so autoscalers can
+        avoid overcommitting small containers.
+        """
+        return JSONResponse(pool.get_capacity())
+
+    async def drain_instance(request: Request) -> Response:
+        """
+        Stop handing out a browser instance (POST) or resume it (DELETE).
+
+        POST /browsers/{index}/drain
+        DELETE /browsers/{index}/drain
+        """
+        index = request.path_params["index"]
+        draining = request.method == "POST"
+
+        if not pool.set_draining(index, draining):
+            return JSONResponse(
+                {"error": "Invalid instance index"},
+                status_code=404,
+            )
+
+        return JSONResponse({
+            "status": "draining" if draining else "resumed",
+            "index": index,
+        })
+
+    async def label_instance(request: Request) -> Response:
+        """
+        Set or remove a browser instance's labels.
+
+        PATCH /browsers/{index}
+        """
+        try:
+            update = LabelUpdate.model_validate_json(await request.body())
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid labels", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+
+        labels = pool.set_labels(request.path_params["index"], update.labels)
+        if labels is None:
+            return JSONResponse({"error": "Invalid instance index"}, status_code=404)
+
+        return JSONResponse({"index": request.path_params["index"], "labels": labels})
+
     async def info(request: Request) -> Response:
         """
         Get server information and configuration.
@@ -131,47 +341,83 @@ def create_health_app(pool: BrowserPool) -> Starlette:
             "config": {
                 "headless": pool.settings.headless,
                 "geoip": pool.settings.geoip,
+                "geo_align": pool.settings.geo_align,
+                "relay": pool.settings.relay,
                 "humanize": pool.settings.humanize,
                 "block_images": pool.settings.block_images,
                 "proxy": "configured" if pool.settings.proxy else None,
+                "proxies": len(pool.settings.proxies),
+                "auth": bool(pool.settings.api_keys),
             },
         })
 
     routes = [
+        *extra_routes,
         Route("/", info, methods=["GET"]),
         Route("/health", health, methods=["GET"]),
+        Route("/livez", livez, methods=["GET"]),
+        Route("/readyz", readyz, methods=["GET"]),
         Route("/endpoints", endpoints, methods=["GET"]),
         Route("/next", next_endpoint, methods=["GET"]),
         Route("/stats", stats, methods=["GET"]),
+        Route("/capacity", capacity, methods=["GET"]),
         Route("/restart/{index:int}", restart_instance, methods=["POST"]),
+        Route("/browsers/{index:int}/drain", drain_instance, methods=["POST", "DELETE"]),
+        Route("/browsers/{index:int}", label_instance, methods=["PATCH"]),
     ]
 
     app = Starlette(
         debug=pool.settings.debug,
         routes=routes,
+        middleware=[
+            # Outermost, so the others see paths without the base path and forwarded clients
+            Middleware(ProxyHeadersMiddleware, pool=pool),
+            # Before keys, so addresses not allowed learn nothing about them
+            Middleware(IpAllowlistMiddleware, pool=pool),
+            Middleware(ApiKeyMiddleware, pool=pool),
+            *extra_middleware,
+        ],
     )
 
     return app
 
 
-async def run_health_server(pool: BrowserPool) -> None:
+async def run_health_server(
+    pool: BrowserPool,
+    extra_routes: Sequence[BaseRoute] = (),
+    extra_middleware: Sequence[Middleware] = (),
+) -> None:
     """
     Run the health check HTTP server.
 
     Args:
         pool: Browser pool instance to monitor
+        extra_routes: Additional routes provided by other subsystems
+        extra_middleware: Middleware provided by other subsystems
     """
     import uvicorn
 
-    app = create_health_app(pool)
+    app = create_health_app(pool, extra_routes, extra_middleware)
+    settings = pool.settings
 
     config = uvicorn.Config(
         app,
-        host=pool.settings.api_host,
-        port=pool.settings.api_port,
-        log_level="info" if pool.settings.debug else "warning",
-        access_log=pool.settings.debug,
+        host=settings.api_host,
+        port=settings.api_port,
+        log_level="info" if settings.debug else "warning",
+        access_log=settings.debug,
     )
 
+    # Bound here rather than by uvicorn, which binds a single address without SO_REUSEPORT
+    try:
+        sockets = bind_sockets([settings.api_host, *settings.api_listen], settings.api_port, settings.reuse_port)
+    except OSError as e:
+        # Exits like uvicorn does when it can't bind
+        logger.error(f"Failed to bind the HTTP API to port {settings.api_port}: {e}")
+        raise SystemExit(1)
     server = uvicorn.Server(config)
-    await server.serve()
+    try:
+        await server.serve(sockets=sockets)
+    finally:
+        for sock in sockets:
+            sock.close()
@@ -0,0 +1,211 @@
+"""
+Per-session JavaScript init scripts for Camoufox Connector.
+
+Clients often need the same small script on every page they open: a shim,
+a stealth patch of their own, instrumentation. Instead of each client
+calling ``addInitScript`` on every context it creates, a lease can carry
+``init_scripts``, and more can be added while it runs with
+``POST /sessions/{id}/init-script``. The relay adds them to each browser
+context of the session, so they run before the page's own scripts on every
+new page and navigation. Scripts added later reach open contexts from their
+next page or navigation; removed ones are taken out of open contexts where
+the browser's Playwright supports it.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+import time
+import uuid
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Optional
+
+from pydantic import BaseModel, ConfigDict, Field, ValidationError
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .relay import RelayCallError
+
+if TYPE_CHECKING:
+    from .relay import Relay, RelayConnection
+    from .sessions import Session, SessionManager
+
+logger = logging.getLogger(__name__)
+
+# Init scripts a session may hold at once
+MAX_INIT_SCRIPTS = 20
+
+
+class InitScriptSpec(BaseModel):
+    """A script run before the page's own scripts, as sent by clients."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    source: str = Field(
+        min_length=1,
+        max_length=65536,
+        description="JavaScript run in every new page and frame before the page's own scripts",
+    )
+
+    name: Optional[str] = Field(
+        default=None,
+        max_length=100,
+        description="Free-form name shown when listing the session's scripts",
+    )
+
+
+@dataclass
+class InitScript:
+    """An init script held by a session."""
+
+    spec: InitScriptSpec
+    id: str = field(default_factory=lambda: uuid.uuid4().hex[:12])
+    added_at: float = field(default_factory=time.time)
+
+    def script(self) -> str:
+        """The source, marked with where it comes from for debugging."""
+        return f"// camoufox-connector init script {self.id}\n{self.spec.source}"
+
+    def to_dict(self, source: bool = False) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        data = {"id": self.id, "name": self.spec.name, "added_at": self.added_at}
+        if source:
+            data["source"] = self.spec.source
+        return data
+
+
+@dataclass
+class InitScriptInjector:
+    """Adds sessions' init scripts to their relayed browser contexts."""
+
+    relay: Relay
+    _lock: asyncio.Lock = field(default_factory=asyncio.Lock)
+
+    def __post_init__(self) -> None:
+        self.relay.context_hooks.append(self._on_context)
+
+    async def _on_context(self, connection: RelayConnection, guid: str) -> None:
+        """Add the session's scripts to a new context."""
+        if connection.session is not None and connection.session.init_scripts:
+            async with self._lock:
+                await self._apply(connection, guid)
+
+    async def _apply(self, connection: RelayConnection, guid: str) -> None:
+        """Bring a context's scripts up to date with its session's."""
+        applied: dict[str, Optional[str]] = connection.state.setdefault("init_scripts", {}).setdefault(guid, {})
+        wanted = {script.id: script for script in connection.session.init_scripts}
+
+        for script_id, disposable in list(applied.items()):
+            if script_id in wanted:
+                continue
+            del applied[script_id]
+            if disposable is None:
+                continue
+            try:
+                await connection.call(disposable, "dispose")
+            except RelayCallError as e:
+                logger.debug(f"Failed to remove init script {script_id} from {guid}: {e}")
+
+        for script_id, script in wanted.items():
+            if script_id in applied:
+                continue
+            try:
+                result = await connection.call(guid, "addInitScript", {"source": script.script()})
+            except RelayCallError as e:
+                logger.warning(f"Failed to add init script {script_id} to {guid}: {e}")
+                continue
+            # Newer Playwright versions return a handle to remove the script with
+            disposable = result.get("disposable")
+            applied[script_id] = disposable.get("guid") if isinstance(disposable, dict) else None
+
+    async def sync(self, session: Session) -> int:
+        """
+        Bring the open contexts of a session up to date with its scripts.
+
+        Returns:
+            The number of open contexts updated.
+        """
+        updated = 0
+        async with self._lock:
+            for connection in self.relay.connections_for_session(session.id):
+                for guid in list(connection.contexts):
+                    await self._apply(connection, guid)
+                    updated += 1
+        return updated
+
+
+def create_init_script_routes(injector: InitScriptInjector, sessions: SessionManager) -> list[Route]:
+    """
+    Create routes managing a session's init scripts.
+
+    Args:
+        injector: Injector adding the scripts to browser contexts
+        sessions: Session manager holding the leases
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def list_scripts(request: Request) -> Response:
+        """
+        List a session's init scripts.
+
+        GET /sessions/{id}/init-script
+        """
+        session = sessions.get_for(request, request.path_params["session_id"])
+        if session is None:
+            return JSONResponse({"error": "Session not found"}, status_code=404)
+        return JSONResponse({"scripts": [script.to_dict(source=True) for script in session.init_scripts]})
+
+    async def add_script(request: Request) -> Response:
+        """
+        Add an init script to every page of a session, including contexts already open.
+
+        POST /sessions/{id}/init-script
+        """
+        session = sessions.get_for(request, request.path_params["session_id"])
+        if session is None:
+            return JSONResponse({"error": "Session not found"}, status_code=404)
+
+        try:
+            spec = InitScriptSpec.model_validate_json(await request.body())
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid init script", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+        if len(session.init_scripts) >= MAX_INIT_SCRIPTS:
+            return JSONResponse(
+                {"error": f"A session holds at most {MAX_INIT_SCRIPTS} init scripts"},
+                status_code=409,
+            )
+
+        script = InitScript(spec=spec)
+        session.init_scripts.append(script)
+        updated = await injector.sync(session)
+        return JSONResponse({**script.to_dict(), "contexts": updated}, status_code=201)
+
+    async def remove_script(request: Request) -> Response:
+        """
+        Remove an init script from a session.
+
+        DELETE /sessions/{id}/init-script/{script_id}
+        """
+        session = sessions.get_for(request, request.path_params["session_id"])
+        if session is None:
+            return JSONResponse({"error": "Session not found"}, status_code=404)
+        script_id = request.path_params["script_id"]
+        if not any(script.id == script_id for script in session.init_scripts):
+            return JSONResponse({"error": "Init script not found"}, status_code=404)
+
+        session.init_scripts = [script for script in session.init_scripts if script.id != script_id]
+        updated = await injector.sync(session)
+        return JSONResponse({"status": "removed", "id": script_id, "contexts": updated})
+
+    return [
+        Route("/sessions/{session_id}/init-script", list_scripts, methods=["GET"]),
+        Route("/sessions/{session_id}/init-script", add_script, methods=["POST"]),
+        Route("/sessions/{session_id}/init-script/{script_id}", remove_script, methods=["DELETE"]),
+    ]
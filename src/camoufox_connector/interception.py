@@ -0,0 +1,317 @@
+"""
+Server-side request interception for Camoufox Connector.
+
+Leases can carry network rules that the relay applies to every browser
+context of the session: blocking requests by URL pattern or resource type,
+answering them with canned responses, injecting headers and rewriting hosts. The relay intercepts requests at the
+context level, so clients get the bandwidth savings without implementing
+route handling themselves, and client-side routes keep working alongside.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import base64
+import fnmatch
+import json
+import logging
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Any, Optional
+from urllib.parse import urlsplit, urlunsplit
+
+from pydantic import BaseModel, ConfigDict, Field
+
+from .relay import RelayCallError
+
+if TYPE_CHECKING:
+    from .relay import Relay, RelayConnection
+
+logger = logging.getLogger(__name__)
+
+# Interception pattern matching every request
+CATCH_ALL_PATTERNS = [{"glob": "**/*"}]
+
+# URL patterns blocked by ``block_analytics``
+ANALYTICS_PATTERNS = [
+    "*://*.google-analytics.com/*",
+    "*://*.googletagmanager.com/*",
+    "*://*.doubleclick.net/*",
+    "*://connect.facebook.net/*",
+    "*://*.hotjar.com/*",
+    "*://*.segment.io/*",
+    "*://*.mixpanel.com/*",
+    "*://*.clarity.ms/*",
+    "*://*.newrelic.com/*",
+    "*://*.nr-data.net/*",
+]
+
+
+class StubResponse(BaseModel):
+    """A canned response served instead of the real one."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    url: str = Field(description="URL glob pattern of the requests to answer")
+
+    method: Optional[str] = Field(
+        default=None,
+        description="HTTP method the stub applies to (default: all)",
+    )
+
+    status: int = Field(default=200, ge=100, le=599, description="Response status code")
+
+    headers: dict[str, str] = Field(
+        default_factory=dict,
+        description="Response headers",
+    )
+
+    body: Any = Field(
+        default="",
+        description="Response body; anything but a string is sent as JSON",
+    )
+
+    base64: bool = Field(
+        default=False,
+        description="Whether a string body is base64-encoded binary data",
+    )
+
+    def matches(self, url: str, method: Optional[str]) -> bool:
+        """Check whether the stub answers a request."""
+        if self.method is not None and (method or "").upper() != self.method.upper():
+            return False
+        return fnmatch.fnmatchcase(url, self.url)
+
+    def fulfill_params(self) -> dict:
+        """Build the ``fulfill`` params of the stubbed response."""
+        headers = dict(self.headers)
+        if isinstance(self.body, str):
+            body = self.body
+        else:
+            body = json.dumps(self.body)
+            if not any(name.lower() == "content-type" for name in headers):
+                headers["Content-Type"] = "application/json"
+        if self.base64 and isinstance(self.body, str):
+            length = len(base64.b64decode(body))
+        else:
+            length = len(body.encode())
+        if not any(name.lower() == "content-length" for name in headers):
+            headers["Content-Length"] = str(length)
+        return {
+            "status": self.status,
+            "headers": [{"name": name, "value": value} for name, value in headers.items()],
+            "body": body,
+            "isBase64": self.base64 and isinstance(self.body, str),
+        }
+
+
+class InterceptionRules(BaseModel):
+    """Network rules applied to a lease's browser contexts."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    block: list[str] = Field(
+        default_factory=list,
+        description="URL glob patterns of requests to block, e.g. *://*.example.com/ads/*",
+    )
+
+    block_resource_types: list[str] = Field(
+        default_factory=list,
+        description="Resource types to block, e.g. image, font, media, stylesheet",
+    )
+
+    block_analytics: bool = Field(
+        default=False,
+        description="Block common analytics and tracking hosts",
+    )
+
+    headers: dict[str, str] = Field(
+        default_factory=dict,
+        description="Headers to add to (or replace on) every request",
+    )
+
+    rewrite_hosts: dict[str, str] = Field(
+        default_factory=dict,
+        description="Hosts to redirect requests to, keyed by the original host",
+    )
+
+    stubs: list[StubResponse] = Field(
+        default_factory=list,
+        description="Canned responses for matching requests; the first match wins",
+    )
+
+    @property
+    def is_empty(self) -> bool:
+        """Whether the rules change nothing."""
+        return not (
+            self.block
+            or self.block_resource_types
+            or self.block_analytics
+            or self.headers
+            or self.rewrite_hosts
+            or self.stubs
+        )
+
+    def stub_for(self, url: str, method: Optional[str]) -> Optional[StubResponse]:
+        """Get the stub answering a request, if any."""
+        for stub in self.stubs:
+            if stub.matches(url, method):
+                return stub
+        return None
+
+    def is_blocked(self, url: str, resource_type: Optional[str]) -> bool:
+        """Check whether a request should be blocked."""
+        if resource_type and resource_type in self.block_resource_types:
+            return True
+        patterns = self.block + (ANALYTICS_PATTERNS if self.block_analytics else [])
+        return any(fnmatch.fnmatchcase(url, pattern) for pattern in patterns)
+
+    def rewrite_url(self, url: str) -> Optional[str]:
+        """Get the rewritten URL for a request, or None if its host is kept."""
+        parts = urlsplit(url)
+        target = self.rewrite_hosts.get(parts.hostname or "")
+        if target is None:
+            return None
+        netloc = target if parts.port is None or ":" in target else f"{target}:{parts.port}"
+        return urlunsplit(parts._replace(netloc=netloc))
+
+    def continue_overrides(self, request: dict) -> dict:
+        """Build the ``continue`` params applying header and host rules to a request."""
+        overrides: dict = {}
+
+        url = self.rewrite_url(request.get("url", ""))
+        if url:
+            overrides["url"] = url
+
+        if self.headers:
+            injected = {name.lower() for name in self.headers}
+            headers = [
+                h for h in request.get("headers") or []
+                if h.get("name", "").lower() not in injected
+            ]
+            headers += [{"name": name, "value": value} for name, value in self.headers.items()]
+            overrides["headers"] = headers
+
+        return overrides
+
+
+@dataclass
+class RequestInterceptor:
+    """
+    Applies lease interception rules to relayed connections.
+
+    The relay intercepts every request of a ruled context. Requests the
+    rules stub are fulfilled and requests they block are aborted before the
+    client sees them; the others are
+    continued with the rules' headers and hosts, or, if the client has
+    routes of its own on the context, handed to the client with the
+    rules merged into its eventual ``continue`` call.
+    """
+
+    relay: Relay
+    _tasks: set[asyncio.Task] = field(default_factory=set)
+
+    def __post_init__(self) -> None:
+        self.relay.context_hooks.append(self._on_context)
+        self.relay.event_filters.append(self._on_event)
+        self.relay.call_rewriters.append(self._rewrite_call)
+
+    @staticmethod
+    def rules_for(connection: RelayConnection) -> Optional[InterceptionRules]:
+        """Get the interception rules of a connection's session, if any."""
+        if connection.session is None:
+            return None
+        rules = connection.session.options.interception
+        if rules is None or rules.is_empty:
+            return None
+        return rules
+
+    @staticmethod
+    def _state(connection: RelayConnection) -> dict:
+        """Get the interception state of a connection."""
+        return connection.state.setdefault("interception", {"client_routed": set(), "pending": {}})
+
+    async def _on_context(self, connection: RelayConnection, guid: str) -> None:
+        """Start intercepting a new context's requests."""
+        if self.rules_for(connection) is None:
+            return
+        await connection.call(guid, "setNetworkInterceptionPatterns", {"patterns": CATCH_ALL_PATTERNS})
+
+    def _on_event(self, connection: RelayConnection, message: dict) -> bool:
+        """Handle a context's ``route`` event; True if the client must not see it."""
+        if message.get("method") != "route" or message.get("guid") not in connection.contexts:
+            return False
+        rules = self.rules_for(connection)
+        if rules is None:
+            return False
+
+        route_guid = ((message.get("params") or {}).get("route") or {}).get("guid")
+        route = connection.initializer(route_guid) or {}
+        request = connection.initializer((route.get("request") or {}).get("guid")) or {}
+
+        stub = rules.stub_for(request.get("url", ""), request.get("method"))
+        if stub is not None:
+            self._spawn(connection.call(route_guid, "fulfill", stub.fulfill_params()))
+            return True
+
+        if rules.is_blocked(request.get("url", ""), request.get("resourceType")):
+            self._spawn(connection.call(route_guid, "abort", {"errorCode": "blockedbyclient"}))
+            return True
+
+        overrides = rules.continue_overrides(request)
+        state = self._state(connection)
+        if message.get("guid") in state["client_routed"]:
+            if overrides:
+                state["pending"][route_guid] = overrides
+            return False
+
+        self._spawn(connection.call(route_guid, "continue", {**overrides, "isFallback": False}))
+        return True
+
+    def _rewrite_call(self, connection: RelayConnection, message: dict) -> bool:
+        """Keep the relay's interception in place and merge rules into client routes."""
+        rules = self.rules_for(connection)
+        if rules is None:
+            return False
+
+        method = message.get("method")
+        guid = message.get("guid")
+        params = message.setdefault("params", {})
+        state = self._state(connection)
+
+        if method == "setNetworkInterceptionPatterns" and guid in connection.contexts:
+            # The client's patterns would replace ours, so intercept everything
+            # instead; the client falls back on requests it has no route for.
+            if params.get("patterns"):
+                state["client_routed"].add(guid)
+            else:
+                state["client_routed"].discard(guid)
+            params["patterns"] = CATCH_ALL_PATTERNS
+            return True
+
+        if method in ("continue", "abort", "fulfill") and guid in state["pending"]:
+            overrides = state["pending"].pop(guid)
+            if method != "continue":
+                return False
+            if "url" in overrides and not params.get("url"):
+                params["url"] = overrides["url"]
+            if "headers" in overrides:
+                injected = {name.lower() for name in rules.headers}
+                headers = params.get("headers") or overrides["headers"]
+                params["headers"] = [
+                    h for h in headers if h.get("name", "").lower() not in injected
+                ] + [{"name": name, "value": value} for name, value in rules.headers.items()]
+            return True
+
+        return False
+
+    def _spawn(self, call) -> None:
+        """Issue a route call without holding up the relay's message pump."""
+        async def run() -> None:
+            try:
+                await call
+            except RelayCallError as e:
+                logger.debug(f"Interception call failed: {e}")
+
+        task = asyncio.create_task(run())
+        self._tasks.add(task)
+        task.add_done_callback(self._tasks.discard)
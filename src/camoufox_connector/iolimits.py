@@ -0,0 +1,295 @@
+"""
+Per-browser disk I/O limits for Camoufox Connector.
+
+Profile-heavy pages (large IndexedDB sites, cache churn) can keep a disk
+busy enough to starve the other browsers and the connector's own
+persistence. With ``io_limits`` set, each browser's launcher is given an
+I/O scheduling class and priority (``ionice``) and moved into a cgroup of
+its own whose ``io.max`` (cgroup v2) or ``blkio.throttle.*`` (cgroup v1)
+caps its bandwidth and IOPS on one device. Both are inherited by the Node.js
+server, Firefox and its content processes, which the launcher starts later.
+Limits are applied at launch, so changed settings take effect as browsers
+are relaunched. Only Linux is supported; cgroup limits need a writable,
+delegated cgroup (e.g. a privileged container or ``Delegate=yes``).
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+import os
+import re
+import shutil
+import tempfile
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import TYPE_CHECKING, Optional
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .resources import CGROUP_ROOT
+
+if TYPE_CHECKING:
+    from .config import IoLimits
+    from .pool import BrowserInstance, BrowserPool
+
+logger = logging.getLogger(__name__)
+
+PROC_CGROUP = Path("/proc/self/cgroup")
+SYS_DEV_BLOCK = Path("/sys/dev/block")
+
+# ionice class numbers
+IOPRIO_CLASSES = {"best-effort": "2", "idle": "3"}
+
+# cgroup v1 throttle files by io_limits field
+BLKIO_FILES = {
+    "read_bps": "blkio.throttle.read_bps_device",
+    "write_bps": "blkio.throttle.write_bps_device",
+    "read_iops": "blkio.throttle.read_iops_device",
+    "write_iops": "blkio.throttle.write_iops_device",
+}
+
+
+def block_device(device: Optional[str], path: str) -> str:
+    """
+    Resolve the device to throttle to the major:minor of its whole disk.
+
+    Args:
+        device: Configured device, as /dev/sdX or major:minor; None for the one holding path
+        path: Directory whose device is throttled by default
+
+    Raises:
+        ValueError: If the device is not a block device the kernel can throttle.
+    """
+    if device and re.fullmatch(r"\d+:\d+", device):
+        return device
+    dev = os.stat(device).st_rdev if device else os.stat(path).st_dev
+    number = f"{os.major(dev)}:{os.minor(dev)}"
+    entry = SYS_DEV_BLOCK / number
+    if not entry.exists():
+        # e.g. overlayfs or tmpfs, whose device numbers are anonymous
+        raise ValueError(f"{device or path} is not on a block device ({number}); set io_limits.device")
+    # Throttling works on whole disks, not partitions
+    if (entry / "partition").exists():
+        number = (entry.resolve().parent / "dev").read_text().strip()
+    return number
+
+
+def own_cgroup() -> tuple[int, Path]:
+    """
+    Find the cgroup the connector runs in.
+
+    Returns:
+        The cgroup version and the directory of the connector's cgroup in it.
+
+    Raises:
+        RuntimeError: If neither the cgroup v2 io nor the v1 blkio controller is mounted.
+    """
+    try:
+        lines = PROC_CGROUP.read_text().splitlines()
+    except OSError:
+        raise RuntimeError("Disk I/O limits need Linux cgroups")
+    paths = {}
+    for line in lines:
+        _, controllers, path = line.split(":", 2)
+        for controller in controllers.split(","):
+            paths[controller] = path.lstrip("/")
+
+    if (CGROUP_ROOT / "cgroup.controllers").exists() and "" in paths:
+        return 2, CGROUP_ROOT / paths[""]
+    if (CGROUP_ROOT / "blkio").is_dir() and "blkio" in paths:
+        return 1, CGROUP_ROOT / "blkio" / paths["blkio"]
+    raise RuntimeError("Neither the cgroup v2 io controller nor the v1 blkio controller is available")
+
+
+def enable_io_controller(root: Path) -> None:
+    """
+    Enable the cgroup v2 io controller for a cgroup's children.
+
+    A cgroup whose children have controllers enabled can't hold processes
+    itself, so the processes in it are moved to a ``connector`` child first.
+    """
+    available = (root / "cgroup.controllers").read_text().split()
+    if "io" not in available:
+        raise RuntimeError(f"The io controller is not delegated to {root}")
+    if "io" in (root / "cgroup.subtree_control").read_text().split():
+        return
+
+    leaf = root / "connector"
+    leaf.mkdir(exist_ok=True)
+    for pid in (root / "cgroup.procs").read_text().split():
+        try:
+            (leaf / "cgroup.procs").write_text(pid)
+        except ProcessLookupError:
+            pass
+    (root / "cgroup.subtree_control").write_text("+io")
+
+
+def io_stat(cgroup: Path, device: str) -> Optional[dict[str, int]]:
+    """Get the bytes and operations a cgroup v2 cgroup did on a device."""
+    try:
+        lines = (cgroup / "io.stat").read_text().splitlines()
+    except OSError:
+        return None
+    for line in lines:
+        number, *counters = line.split()
+        if number == device:
+            return {key: int(value) for key, value in (c.split("=", 1) for c in counters)}
+    return {}
+
+
+@dataclass
+class IoLimiter:
+    """Gives each launching browser its I/O priority and a throttled cgroup."""
+
+    pool: BrowserPool
+    # Limits applied to each browser's current launch, by instance index
+    applied: dict[int, dict] = field(default_factory=dict)
+    # Cgroup version and the directory holding a cgroup per browser, once set up
+    version: Optional[int] = None
+    root: Optional[Path] = None
+    _ionice: Optional[str] = None
+    _slots: set[Path] = field(default_factory=set)
+
+    def __post_init__(self) -> None:
+        self.pool.spawn_hooks.append(self._apply)
+
+    async def _apply(self, instance: BrowserInstance) -> None:
+        """Limit the disk I/O of a browser's launcher before it starts the browser."""
+        limits = self.pool.settings.io_limits_for(instance.index)
+        if limits is None or instance.process is None:
+            self.applied.pop(instance.index, None)
+            return
+
+        pid = instance.process.pid
+        state = {
+            "pid": pid,
+            "priority_class": limits.priority_class,
+            "priority": limits.priority if limits.priority_class == "best-effort" else None,
+            "device": None,
+            "cgroup": None,
+            "limits": limits.throttles(),
+            "errors": [],
+        }
+        self.applied[instance.index] = state
+
+        if limits.priority_class is not None:
+            try:
+                await self._set_priority(pid, limits)
+            except Exception as e:
+                state["errors"].append(str(e))
+                logger.warning(f"Failed to set the I/O priority of browser instance {instance.index}: {e}")
+
+        if state["limits"]:
+            try:
+                state["device"], cgroup = await asyncio.to_thread(self._throttle, instance.index, pid, limits)
+                state["cgroup"] = str(cgroup)
+            except Exception as e:
+                state["errors"].append(str(e))
+                logger.warning(f"Failed to throttle the disk I/O of browser instance {instance.index}: {e}")
+
+    async def _set_priority(self, pid: int, limits: IoLimits) -> None:
+        """Set a process's I/O scheduling class and priority with ionice."""
+        if self._ionice is None:
+            self._ionice = shutil.which("ionice")
+            if self._ionice is None:
+                raise RuntimeError("I/O priorities need ionice; install it (e.g. apt-get install util-linux)")
+
+        args = ["-c", IOPRIO_CLASSES[limits.priority_class]]
+        if limits.priority_class == "best-effort":
+            args += ["-n", str(limits.priority)]
+        process = await asyncio.create_subprocess_exec(
+            self._ionice,
+            *args,
+            "-p", str(pid),
+            stdout=asyncio.subprocess.DEVNULL,
+            stderr=asyncio.subprocess.PIPE,
+        )
+        _, stderr = await process.communicate()
+        if process.returncode != 0:
+            raise RuntimeError(stderr.decode(errors="replace").strip() or f"ionice exited with {process.returncode}")
+
+    def _prepare(self) -> None:
+        """Find the cgroup to create the browsers' cgroups in, once."""
+        if self.root is not None:
+            return
+        version, root = own_cgroup()
+        configured = self.pool.settings.io_cgroup
+        if configured:
+            root = Path(configured)
+        if version == 2:
+            enable_io_controller(root)
+        self.version, self.root = version, root
+        logger.info(f"Throttling browser disk I/O in cgroup v{version} {root}")
+
+    def _throttle(self, index: int, pid: int, limits: IoLimits) -> tuple[str, Path]:
+        """Move a process into the browser's cgroup, capped by the limits."""
+        self._prepare()
+        device = block_device(limits.device, tempfile.gettempdir())
+        cgroup = self.root / f"browser-{index}"
+        cgroup.mkdir(exist_ok=True)
+        self._slots.add(cgroup)
+
+        throttles = limits.throttles()
+        if self.version == 2:
+            values = " ".join(
+                f"{key.replace('read_', 'r').replace('write_', 'w')}={throttles.get(key, 'max')}"
+                for key in BLKIO_FILES
+            )
+            (cgroup / "io.max").write_text(f"{device} {values}")
+        else:
+            for key, name in BLKIO_FILES.items():
+                # 0 removes a v1 limit set by an earlier launch
+                (cgroup / name).write_text(f"{device} {throttles.get(key, 0)}")
+
+        (cgroup / "cgroup.procs").write_text(str(pid))
+        return device, cgroup
+
+    def report(self) -> dict:
+        """Get the limits of each browser and, on cgroup v2, the I/O it did."""
+        browsers = []
+        for index, state in sorted(self.applied.items()):
+            entry = {"index": index, **state}
+            if self.version == 2 and state["cgroup"] and state["device"]:
+                entry["usage"] = io_stat(Path(state["cgroup"]), state["device"])
+            browsers.append(entry)
+        return {
+            "cgroup_version": self.version,
+            "cgroup": str(self.root) if self.root is not None else None,
+            "browsers": browsers,
+        }
+
+    async def close(self) -> None:
+        """Remove the browsers' cgroups; those with processes left are kept."""
+        for cgroup in self._slots:
+            try:
+                cgroup.rmdir()
+            except OSError as e:
+                logger.debug(f"Keeping cgroup {cgroup}: {e}")
+        self._slots.clear()
+
+
+def create_io_routes(limiter: IoLimiter) -> list[Route]:
+    """
+    Create the route reporting disk I/O limits.
+
+    Args:
+        limiter: I/O limiter to report on
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def io_limits(request: Request) -> Response:
+        """
+        Get each browser's I/O priority, throttles and, on cgroup v2, disk usage.
+
+        GET /io
+        """
+        return JSONResponse(limiter.report())
+
+    return [
+        Route("/io", io_limits, methods=["GET"]),
+    ]
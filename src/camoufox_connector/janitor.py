@@ -0,0 +1,339 @@
+"""
+Garbage collection of temporary files for Camoufox Connector.
+
+Long-running deployments accumulate files nothing else cleans up: scratch
+directories of earlier connector runs, Firefox profiles and Playwright
+artifact directories of browsers that crashed or were killed, screenshots
+of long-lived sessions and downloads that never finished. The janitor
+sweeps them periodically by the ``janitor`` settings' age and size
+policies, and counts what it reclaims per category for ``GET /janitor``
+and the ``janitor-swept`` event.
+
+The connector's own scratch directories are named after its PID, so a
+sweep can tell those of a run that is gone from those still in use.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+import os
+import re
+import shutil
+import tempfile
+import time
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import TYPE_CHECKING, Optional
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .procutil import command_lines, process_alive
+
+if TYPE_CHECKING:
+    from .artifacts import ArtifactStore
+    from .config import JanitorConfig
+    from .downloads import DownloadManager
+    from .pool import BrowserPool
+
+logger = logging.getLogger(__name__)
+
+# Checked for settings turning the janitor on while it is off
+IDLE_INTERVAL = 60.0
+
+# When this process started; same-PID scratch directories older than that are an earlier run's
+STARTED = time.time()
+
+SCRATCH_NAME = re.compile(r"^camoufox-[a-z]+-(\d+)-")
+PROFILE_PREFIX = "playwright_firefoxdev_profile-"
+BROWSER_LEFTOVERS = (PROFILE_PREFIX, "playwright-artifacts-")
+
+CATEGORIES = ("temp_dirs", "browser_leftovers", "screenshots", "partial_downloads")
+
+
+def scratch_directory(kind: str) -> Path:
+    """Create a temporary directory the janitor can tell apart from an earlier run's."""
+    return Path(tempfile.mkdtemp(prefix=f"camoufox-{kind}-{os.getpid()}-"))
+
+
+def tree_usage(path: Path) -> tuple[int, int]:
+    """Number and size in bytes of a file, or of all files under a directory."""
+    if path.is_file():
+        return 1, path.stat().st_size
+    files = size = 0
+    for p in path.rglob("*"):
+        try:
+            if p.is_file():
+                files += 1
+                size += p.stat().st_size
+        except OSError:
+            pass
+    return files, size
+
+
+def newest_change(path: Path) -> float:
+    """Modification time of the most recently changed entry under a path."""
+    newest = path.stat().st_mtime
+    for p in path.rglob("*"):
+        try:
+            newest = max(newest, p.stat().st_mtime)
+        except OSError:
+            pass
+    return newest
+
+
+@dataclass
+class Reclaimed:
+    """Files and bytes a category of clean-up removed."""
+
+    files: int = 0
+    bytes: int = 0
+
+    def add(self, other: Reclaimed) -> None:
+        """Count what another clean-up removed, too."""
+        self.files += other.files
+        self.bytes += other.bytes
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {"files": self.files, "bytes": self.bytes}
+
+
+@dataclass
+class Janitor:
+    """Periodically removes temporary files that are no longer needed."""
+
+    store: ArtifactStore
+    downloads: DownloadManager
+    temp_root: Path = field(default_factory=lambda: Path(tempfile.gettempdir()))
+    # Reclaimed since startup, by category
+    totals: dict[str, Reclaimed] = field(default_factory=lambda: {c: Reclaimed() for c in CATEGORIES})
+    sweeps: int = 0
+    last_sweep: Optional[dict] = None
+    _lock: asyncio.Lock = field(default_factory=asyncio.Lock)
+    _task: Optional[asyncio.Task] = None
+
+    @property
+    def pool(self) -> BrowserPool:
+        """Browser pool whose scratch space is cleaned."""
+        return self.store.sessions.pool
+
+    @property
+    def config(self) -> Optional[JanitorConfig]:
+        """Current janitor settings; None turns sweeps off."""
+        return self.pool.settings.janitor
+
+    def start(self) -> None:
+        """Start sweeping periodically."""
+        if self._task is None:
+            self._task = asyncio.create_task(self._loop())
+
+    async def _loop(self) -> None:
+        """Sweep at the configured interval, read anew each time."""
+        while True:
+            config = self.config
+            await asyncio.sleep(config.interval if config is not None else IDLE_INTERVAL)
+            if self.config is None:
+                continue
+            try:
+                await self.sweep()
+            except Exception as e:
+                logger.error(f"Janitor sweep failed: {e}")
+
+    async def sweep(self) -> dict:
+        """
+        Remove what the policies allow, once.
+
+        Returns:
+            The files and bytes reclaimed per category.
+        """
+        config = self.config
+        if config is None:
+            raise RuntimeError("The janitor is turned off")
+
+        async with self._lock:
+            began = time.time()
+            reclaimed = {c: Reclaimed() for c in CATEGORIES}
+            reclaimed["partial_downloads"] = await self._partial_downloads()
+            reclaimed["temp_dirs"] = await asyncio.to_thread(self._temp_dirs, config)
+            if config.browser_leftovers:
+                reclaimed["browser_leftovers"] = await asyncio.to_thread(self._browser_leftovers, config)
+            reclaimed["screenshots"] = await asyncio.to_thread(self._screenshots, config)
+
+            for category, amount in reclaimed.items():
+                self.totals[category].add(amount)
+            self.sweeps += 1
+            self.last_sweep = {
+                "at": began,
+                "duration": round(time.time() - began, 3),
+                "reclaimed": {c: r.to_dict() for c, r in reclaimed.items()},
+            }
+
+        files = sum(r.files for r in reclaimed.values())
+        if files:
+            total = sum(r.bytes for r in reclaimed.values())
+            logger.info(f"Janitor removed {files} file(s), {total / 1024 / 1024:.1f} MB")
+            self.pool.events.publish("janitor-swept", **self.last_sweep["reclaimed"])
+        return self.last_sweep
+
+    def _remove(self, path: Path) -> Reclaimed:
+        """Remove a file or directory tree, counting what it held."""
+        try:
+            files, size = tree_usage(path)
+            if path.is_dir():
+                shutil.rmtree(path)
+            else:
+                path.unlink()
+        except OSError as e:
+            logger.debug(f"Janitor could not remove {path}: {e}")
+            return Reclaimed()
+        return Reclaimed(files=files, bytes=size)
+
+    def _own_directories(self) -> set[Path]:
+        """Scratch directories this run uses."""
+        own = {self.store.root, self.pool.extensions.root, self.pool.cache_root}
+        return {path for path in own if path is not None}
+
+    def _temp_dirs(self, config: JanitorConfig) -> Reclaimed:
+        """Remove scratch directories of earlier connector runs."""
+        reclaimed = Reclaimed()
+        own = self._own_directories()
+        cutoff = time.time() - config.temp_max_age
+        for path in self.temp_root.glob("camoufox-*"):
+            match = SCRATCH_NAME.match(path.name)
+            if match is None or path in own or not path.is_dir():
+                continue
+            pid = int(match.group(1))
+            try:
+                if pid == os.getpid():
+                    # e.g. PID 1 of a restarted container
+                    if path.stat().st_ctime >= STARTED:
+                        continue
+                elif process_alive(pid):
+                    continue
+                if newest_change(path) >= cutoff:
+                    continue
+            except OSError:
+                continue
+            reclaimed.add(self._remove(path))
+        return reclaimed
+
+    def _browser_leftovers(self, config: JanitorConfig) -> Reclaimed:
+        """Remove Firefox profiles and Playwright artifacts no running browser uses."""
+        reclaimed = Reclaimed()
+        in_use = {
+            Path(arg).name
+            for args in command_lines()
+            for arg in args
+            if PROFILE_PREFIX in arg
+        }
+        cutoff = time.time() - config.temp_max_age
+        for prefix in BROWSER_LEFTOVERS:
+            for path in self.temp_root.glob(f"{prefix}*"):
+                if path.name in in_use or not path.is_dir():
+                    continue
+                try:
+                    if newest_change(path) >= cutoff:
+                        continue
+                except OSError:
+                    continue
+                reclaimed.add(self._remove(path))
+        return reclaimed
+
+    def _screenshots(self, config: JanitorConfig) -> Reclaimed:
+        """Remove screenshots older than the maximum age, then the oldest beyond the size limit."""
+        reclaimed = Reclaimed()
+        if config.screenshot_max_age is None and config.screenshot_max_mb is None:
+            return reclaimed
+
+        files = []
+        for path in self.store.root.glob("*/screenshots/*"):
+            try:
+                stat = path.stat()
+            except OSError:
+                continue
+            files.append((stat.st_mtime, stat.st_size, path))
+        files.sort()
+
+        if config.screenshot_max_age is not None:
+            cutoff = time.time() - config.screenshot_max_age
+            while files and files[0][0] < cutoff:
+                reclaimed.add(self._remove(files.pop(0)[2]))
+        if config.screenshot_max_mb is not None:
+            total = sum(size for _, size, _ in files)
+            while files and total > config.screenshot_max_mb * 1024 * 1024:
+                _, size, path = files.pop(0)
+                total -= size
+                reclaimed.add(self._remove(path))
+        return reclaimed
+
+    async def _partial_downloads(self) -> Reclaimed:
+        """Remove what failed downloads and those interrupted by a release left behind."""
+        reclaimed = Reclaimed()
+        for session_id, entries in list(self.downloads.downloads.items()):
+            active = session_id in self.store.sessions.sessions
+            for entry in entries:
+                interrupted = entry["status"] == "saving" and not active
+                if entry["status"] != "failed" and not interrupted:
+                    continue
+                if interrupted:
+                    entry.update(status="failed", error="Interrupted by the lease's release", finished_at=time.time())
+                directory = self.store.directory(session_id, "downloads")
+                path = directory / entry["id"] if directory is not None else None
+                if path is not None and path.exists():
+                    reclaimed.add(await asyncio.to_thread(self._remove, path))
+        return reclaimed
+
+    def report(self) -> dict:
+        """Get the janitor's policies and what it has reclaimed."""
+        config = self.config
+        return {
+            "enabled": config is not None,
+            "policies": config.model_dump() if config is not None else None,
+            "sweeps": self.sweeps,
+            "last_sweep": self.last_sweep,
+            "reclaimed": {c: r.to_dict() for c, r in self.totals.items()},
+        }
+
+    async def close(self) -> None:
+        """Stop sweeping."""
+        if self._task is not None:
+            self._task.cancel()
+            self._task = None
+
+
+def create_janitor_routes(janitor: Janitor) -> list[Route]:
+    """
+    Create routes reporting and running clean-up.
+
+    Args:
+        janitor: Janitor cleaning the connector's scratch space
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_janitor(request: Request) -> Response:
+        """
+        Get the clean-up policies and the space reclaimed per category.
+
+        GET /janitor
+        """
+        return JSONResponse(janitor.report())
+
+    async def run_janitor(request: Request) -> Response:
+        """
+        Sweep right away.
+
+        POST /janitor/run
+        """
+        if janitor.config is None:
+            return JSONResponse({"error": "The janitor is turned off"}, status_code=409)
+        return JSONResponse(await janitor.sweep())
+
+    return [
+        Route("/janitor", get_janitor, methods=["GET"]),
+        Route("/janitor/run", run_janitor, methods=["POST"]),
+    ]
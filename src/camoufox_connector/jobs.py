@@ -0,0 +1,490 @@
+"""
+Batch jobs for Camoufox Connector.
+
+``POST /tasks/fetch`` keeps the client waiting until its page is loaded.
+Clients that can't hold long connections submit a batch of URLs or fetch
+tasks to ``POST /jobs`` instead: the job runs in the background with a
+bounded number of tasks at a time, and ``GET /jobs/{id}`` reports its
+progress and the results collected so far. Finished jobs are kept for
+``job_ttl`` seconds. Besides single-page tasks, jobs can run multi-step
+flows (see ``flows``). With a ``job_store`` configured, jobs survive restarts
+(see ``jobstore``).
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+import time
+import uuid
+from collections import deque
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Any, Awaitable, Literal, Optional, Union
+
+from pydantic import BaseModel, ConfigDict, Field, ValidationError, model_validator
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .flows import Flow, run_flow
+from .jobstore import MAX_DEAD_LETTERS
+from .proxyheaders import base_path
+from .ratelimit import RateLimited
+from .sessions import LeaseLimitError
+from .tasks import FetchTask
+
+if TYPE_CHECKING:
+    from .jobstore import JobStore
+    from .tasks import TaskRunner
+
+logger = logging.getLogger(__name__)
+
+MAX_JOB_TASKS = 1000
+
+# How long a task waits between attempts while no browser is available
+RETRY_INTERVAL = 2.0
+
+JobStatus = Literal["running", "completed", "cancelled"]
+
+# What a job runs: a single page or a chain of steps
+JobTask = Union[FetchTask, Flow]
+
+
+class JobRequest(BaseModel):
+    """A batch of pages to load."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    urls: list[str] = Field(
+        default_factory=list,
+        description="URLs to load, each with the options in 'defaults'",
+    )
+
+    defaults: dict[str, Any] = Field(
+        default_factory=dict,
+        description="Fetch task options applied to every entry of 'urls', e.g. screenshot or extract",
+    )
+
+    tasks: list[FetchTask] = Field(
+        default_factory=list,
+        description="Fully specified fetch tasks, run after the URLs",
+    )
+
+    flows: list[Flow] = Field(
+        default_factory=list,
+        description="Multi-step flows, run after the tasks",
+    )
+
+    concurrency: int = Field(
+        default=4,
+        ge=1,
+        le=100,
+        description="Maximum number of the job's tasks running at once",
+    )
+
+    @model_validator(mode="after")
+    def expand_urls(self) -> JobRequest:
+        """Turn the URLs into fetch tasks and check the batch size."""
+        if "url" in self.defaults:
+            raise ValueError("defaults cannot contain a url")
+        self.tasks = [FetchTask.model_validate({**self.defaults, "url": url}) for url in self.urls] + self.tasks
+        self.urls = []
+        if not self.tasks and not self.flows:
+            raise ValueError("A job needs at least one URL, task or flow")
+        if len(self.tasks) + len(self.flows) > MAX_JOB_TASKS:
+            raise ValueError(f"A job can have at most {MAX_JOB_TASKS} tasks and flows")
+        return self
+
+    @property
+    def entries(self) -> list[JobTask]:
+        """The tasks, then the flows, in the order they are reported."""
+        return [*self.tasks, *self.flows]
+
+
+@dataclass
+class Job:
+    """A batch of fetch tasks running in the background."""
+
+    id: str
+    tasks: list[JobTask]
+    concurrency: int
+    tenant: Optional[str] = None
+    status: JobStatus = "running"
+    results: list[Optional[dict]] = field(default_factory=list)
+    attempts: list[int] = field(default_factory=list)
+    created_at: float = field(default_factory=time.time)
+    finished_at: Optional[float] = None
+    _runner: Optional[asyncio.Task] = None
+
+    def __post_init__(self) -> None:
+        if not self.results:
+            self.results = [None] * len(self.tasks)
+        if not self.attempts:
+            self.attempts = [0] * len(self.tasks)
+
+    @classmethod
+    def from_record(cls, record: dict) -> Job:
+        """Restore a job loaded from the job store."""
+        return cls(
+            id=record["id"],
+            tasks=[
+                Flow.model_validate(task) if "steps" in task else FetchTask.model_validate(task)
+                for task in record["tasks"]
+            ],
+            concurrency=record["concurrency"],
+            tenant=record["tenant"],
+            status=record["status"],
+            results=record["results"],
+            attempts=record["attempts"],
+            created_at=record["created_at"],
+            finished_at=record["finished_at"],
+        )
+
+    def to_record(self) -> dict:
+        """Convert to the job store's record, without the tasks' progress."""
+        return {
+            "id": self.id,
+            "tasks": [task.model_dump(mode="json") for task in self.tasks],
+            "concurrency": self.concurrency,
+            "tenant": self.tenant,
+            "status": self.status,
+            "created_at": self.created_at,
+            "finished_at": self.finished_at,
+        }
+
+    @property
+    def done(self) -> int:
+        """Number of tasks with a result."""
+        return sum(1 for result in self.results if result is not None)
+
+    @property
+    def failed(self) -> int:
+        """Number of tasks that ended with an error."""
+        return sum(1 for result in self.results if result is not None and result.get("error"))
+
+    def to_dict(self, results: bool = False, offset: int = 0, limit: Optional[int] = None) -> dict:
+        """Convert to dictionary for JSON serialization, optionally with a page of results."""
+        data = {
+            "id": self.id,
+            "status": self.status,
+            "total": len(self.tasks),
+            "done": self.done,
+            "failed": self.failed,
+            "concurrency": self.concurrency,
+            "tenant": self.tenant,
+            "created_at": self.created_at,
+            "finished_at": self.finished_at,
+        }
+        if results:
+            end = None if limit is None else offset + limit
+            data["results"] = [
+                {"index": index, **result} if result is not None else {"index": index, "url": self.tasks[index].url}
+                for index, result in enumerate(self.results[offset:end], start=offset)
+            ]
+        return data
+
+
+@dataclass
+class JobManager:
+    """Runs batch jobs on the task runner."""
+
+    runner: TaskRunner
+    store: Optional[JobStore] = None
+    jobs: dict[str, Job] = field(default_factory=dict)
+    dead_letters: deque[dict] = field(default_factory=lambda: deque(maxlen=MAX_DEAD_LETTERS))
+    _closing: bool = False
+
+    async def _save(self, operation: Awaitable[None]) -> None:
+        """Write to the job store; a failed write is logged, not fatal."""
+        try:
+            await operation
+        except Exception as e:
+            logger.warning(f"Could not write to the job store: {e}")
+
+    async def start(self) -> None:
+        """Resume the jobs left running by the previous run of the connector."""
+        if self.store is None:
+            return
+        self.dead_letters.extend(await self.store.dead_letters())
+        for record in await self.store.load():
+            try:
+                job = Job.from_record(record)
+            except Exception as e:
+                logger.warning(f"Dropping stored job {record.get('id')}: {e}")
+                await self._save(self.store.delete_job(record["id"]))
+                continue
+            self.jobs[job.id] = job
+            if job.status == "running":
+                job._runner = asyncio.create_task(self._run(job))
+                logger.info(f"Job {job.id} resumed: {job.done}/{len(job.tasks)} done")
+        await self.purge_expired()
+
+    async def submit(self, request: JobRequest, tenant: Optional[str] = None) -> Job:
+        """Start running a batch."""
+        await self.purge_expired()
+        job = Job(
+            id=uuid.uuid4().hex,
+            tasks=request.entries,
+            concurrency=request.concurrency,
+            tenant=tenant,
+        )
+        if self.store is not None:
+            # Acknowledged jobs must survive a restart
+            await self.store.save_job(job.to_record())
+        self.jobs[job.id] = job
+        job._runner = asyncio.create_task(self._run(job))
+        logger.info(f"Job {job.id} started with {len(job.tasks)} task(s)")
+        return job
+
+    async def _run(self, job: Job) -> None:
+        """Run a job's tasks without a result, with bounded concurrency."""
+        semaphore = asyncio.Semaphore(job.concurrency)
+
+        async def run_one(index: int) -> None:
+            async with semaphore:
+                job.results[index] = await self._run_task(job, index)
+            if self.store is not None:
+                await self._save(self.store.save_task(job.id, index, job.attempts[index], job.results[index]))
+
+        try:
+            await asyncio.gather(*(
+                run_one(index) for index in range(len(job.tasks)) if job.results[index] is None
+            ))
+            job.status = "completed"
+        except asyncio.CancelledError:
+            if self._closing:
+                # Left running in the store, to be resumed on the next start
+                return
+            job.status = "cancelled"
+        finally:
+            job.finished_at = time.time()
+
+        if self.store is not None:
+            await self._save(self.store.save_job(job.to_record()))
+
+        logger.info(f"Job {job.id} {job.status}: {job.done}/{len(job.tasks)} done, {job.failed} failed")
+        self.runner.sessions.pool.events.publish(
+            "job-finished",
+            job_id=job.id,
+            status=job.status,
+            total=len(job.tasks),
+            done=job.done,
+            failed=job.failed,
+        )
+
+    async def _run_task(self, job: Job, index: int) -> dict:
+        """Run one task, waiting while no browser or lease is available and retrying failures."""
+        task = job.tasks[index]
+        max_attempts = self.runner.sessions.pool.settings.job_max_attempts
+        error = "The connector stopped during the last attempt"
+        while True:
+            if job.attempts[index] >= max_attempts:
+                return await self._dead_letter(job, index, error)
+
+            job.attempts[index] += 1
+            if self.store is not None:
+                # Recorded before the attempt, so a task that takes the connector down isn't retried forever
+                await self._save(self.store.save_task(job.id, index, job.attempts[index], None))
+            try:
+                if isinstance(task, Flow):
+                    result = await run_flow(self.runner, task, tenant=job.tenant)
+                else:
+                    result = await self.runner.fetch(task, tenant=job.tenant)
+            except RateLimited as e:
+                job.attempts[index] -= 1
+                await asyncio.sleep(max(e.retry_after, RETRY_INTERVAL))
+                continue
+            except LeaseLimitError:
+                # The job's own tasks hold the tenant's leases; wait for one to finish
+                result = None
+            except Exception as e:
+                error = str(e)
+                if job.attempts[index] < max_attempts:
+                    await asyncio.sleep(RETRY_INTERVAL)
+                continue
+
+            if result is None:
+                job.attempts[index] -= 1
+                await asyncio.sleep(RETRY_INTERVAL)
+            elif not result.error:
+                return result.to_dict()
+            elif job.attempts[index] < max_attempts:
+                error = result.error
+                await asyncio.sleep(RETRY_INTERVAL)
+            else:
+                return await self._dead_letter(job, index, result.error, result.to_dict())
+
+    async def _dead_letter(self, job: Job, index: int, error: str, result: Optional[dict] = None) -> dict:
+        """Give up on a task that kept failing."""
+        task = job.tasks[index]
+        entry = {
+            "job_id": job.id,
+            "index": index,
+            "url": task.url,
+            "tenant": job.tenant,
+            "attempts": job.attempts[index],
+            "error": error,
+            "time": time.time(),
+            "task": task.model_dump(mode="json"),
+        }
+        self.dead_letters.append(entry)
+        if self.store is not None:
+            await self._save(self.store.add_dead_letter(entry))
+        logger.warning(f"Job {job.id} task {index} ({task.url}) failed {job.attempts[index]} time(s): {error}")
+        self.runner.sessions.pool.events.publish(
+            "job-task-dead-lettered",
+            job_id=job.id,
+            index=index,
+            url=task.url,
+            attempts=job.attempts[index],
+            error=error,
+        )
+        return {**(result or {"url": task.url, "error": error}), "attempts": job.attempts[index]}
+
+    async def clear_dead_letters(self, tenant: Optional[str]) -> None:
+        """Drop the dead letters of one tenant."""
+        kept = [entry for entry in self.dead_letters if entry["tenant"] != tenant]
+        self.dead_letters.clear()
+        self.dead_letters.extend(kept)
+        if self.store is not None:
+            await self._save(self.store.clear_dead_letters(tenant))
+
+    async def get(self, job_id: str) -> Optional[Job]:
+        """Get a job by ID."""
+        await self.purge_expired()
+        return self.jobs.get(job_id)
+
+    def cancel(self, job_id: str) -> bool:
+        """Cancel a running job; results collected so far are kept."""
+        job = self.jobs.get(job_id)
+        if job is None or job._runner is None or job._runner.done():
+            return False
+        job._runner.cancel()
+        return True
+
+    async def purge_expired(self) -> None:
+        """Forget finished jobs older than the configured TTL."""
+        cutoff = time.time() - self.runner.sessions.pool.settings.job_ttl
+        for job_id, job in list(self.jobs.items()):
+            if job.status != "running" and job.finished_at is not None and job.finished_at < cutoff:
+                del self.jobs[job_id]
+                if self.store is not None:
+                    await self._save(self.store.delete_job(job_id))
+
+    async def close(self) -> None:
+        """Stop every running job; stored jobs are resumed on the next start."""
+        self._closing = True
+        runners = [job._runner for job in self.jobs.values() if job._runner is not None and not job._runner.done()]
+        for runner in runners:
+            runner.cancel()
+        if runners:
+            await asyncio.gather(*runners, return_exceptions=True)
+        if self.store is not None:
+            await self.store.close()
+
+
+def create_job_routes(manager: JobManager) -> list[Route]:
+    """
+    Create HTTP routes for batch jobs.
+
+    Args:
+        manager: Job manager running the jobs
+
+    Returns:
+        List of Starlette routes
+    """
+
+    def visible(request: Request, job: Optional[Job]) -> bool:
+        """Jobs are only visible to the API key that submitted them."""
+        return job is not None and job.tenant == getattr(request.state, "api_key_name", None)
+
+    async def submit_job(request: Request) -> Response:
+        """
+        Submit a batch of URLs or fetch tasks.
+
+        POST /jobs
+        """
+        try:
+            job_request = JobRequest.model_validate_json(await request.body())
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid job", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+        try:
+            job = await manager.submit(job_request, tenant=getattr(request.state, "api_key_name", None))
+        except Exception as e:
+            logger.error(f"Could not store job: {e}")
+            return JSONResponse({"error": f"Could not store job: {e}"}, status_code=503)
+        return JSONResponse(job.to_dict(), status_code=202, headers={"Location": f"{base_path(request)}/jobs/{job.id}"})
+
+    async def list_jobs(request: Request) -> Response:
+        """
+        List jobs without their results.
+
+        GET /jobs
+        """
+        await manager.purge_expired()
+        jobs = [job.to_dict() for job in manager.jobs.values() if visible(request, job)]
+        return JSONResponse({"jobs": jobs, "count": len(jobs)})
+
+    async def get_job(request: Request) -> Response:
+        """
+        Get a job's progress and results.
+
+        GET /jobs/{id}
+        """
+        job = await manager.get(request.path_params["job_id"])
+        if not visible(request, job):
+            return JSONResponse({"error": "Job not found"}, status_code=404)
+        try:
+            offset = int(request.query_params.get("offset", 0))
+            limit = int(request.query_params["limit"]) if "limit" in request.query_params else None
+        except ValueError:
+            return JSONResponse({"error": "offset and limit must be integers"}, status_code=400)
+        if offset < 0 or (limit is not None and limit < 0):
+            return JSONResponse({"error": "offset and limit must not be negative"}, status_code=400)
+        with_results = request.query_params.get("results", "true").lower() != "false"
+        return JSONResponse(job.to_dict(results=with_results, offset=offset, limit=limit))
+
+    async def cancel_job(request: Request) -> Response:
+        """
+        Cancel a running job.
+
+        DELETE /jobs/{id}
+        """
+        job_id = request.path_params["job_id"]
+        if not visible(request, manager.jobs.get(job_id)):
+            return JSONResponse({"error": "Job not found"}, status_code=404)
+        if not manager.cancel(job_id):
+            return JSONResponse({"error": "Job is not running"}, status_code=409)
+        return JSONResponse({"status": "cancelling", "id": job_id})
+
+    async def list_dead_letters(request: Request) -> Response:
+        """
+        List the tasks that failed on every attempt.
+
+        GET /jobs/dead-letters
+        """
+        tenant = getattr(request.state, "api_key_name", None)
+        entries = [entry for entry in manager.dead_letters if entry["tenant"] == tenant]
+        return JSONResponse({"dead_letters": entries, "count": len(entries)})
+
+    async def clear_dead_letters(request: Request) -> Response:
+        """
+        Drop the dead letters.
+
+        DELETE /jobs/dead-letters
+        """
+        await manager.clear_dead_letters(getattr(request.state, "api_key_name", None))
+        return JSONResponse({"status": "cleared"})
+
+    return [
+        Route("/jobs", submit_job, methods=["POST"]),
+        Route("/jobs", list_jobs, methods=["GET"]),
+        # Before /jobs/{job_id}, which would match them too
+        Route("/jobs/dead-letters", list_dead_letters, methods=["GET"]),
+        Route("/jobs/dead-letters", clear_dead_letters, methods=["DELETE"]),
+        Route("/jobs/{job_id}", get_job, methods=["GET"]),
+        Route("/jobs/{job_id}", cancel_job, methods=["DELETE"]),
+    ]
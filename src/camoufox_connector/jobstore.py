@@ -0,0 +1,248 @@
+"""
+Durable storage for batch jobs.
+
+Without a store, batch jobs live in memory and are lost when the connector
+restarts. With ``job_store`` set to a SQLite database or a Redis server,
+every job is written before it is acknowledged, each task's attempts are
+recorded before it runs and its result as soon as it is known. A restarted
+connector resumes the jobs that were still running and reruns the tasks
+without a result, so each task runs at least once. Tasks that keep failing
+are moved to a dead-letter list.
+
+Job records hold the fetch tasks as submitted, including any proxy
+credentials in their lease options.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import json
+import logging
+import sqlite3
+import threading
+from pathlib import Path
+from typing import Any, Optional
+
+logger = logging.getLogger(__name__)
+
+# Dead letters kept; the oldest are dropped first
+MAX_DEAD_LETTERS = 1000
+
+# Prefix of the Redis keys
+REDIS_PREFIX = "camoufox:"
+
+
+class JobStore:
+    """Base class for durable job stores."""
+
+    async def load(self) -> list[dict]:
+        """Load every stored job with its tasks' attempts and results."""
+        raise NotImplementedError
+
+    async def save_job(self, record: dict) -> None:
+        """Create or update a job, without its tasks' progress."""
+        raise NotImplementedError
+
+    async def save_task(self, job_id: str, index: int, attempts: int, result: Optional[dict]) -> None:
+        """Record a task's attempts and, once known, its result."""
+        raise NotImplementedError
+
+    async def delete_job(self, job_id: str) -> None:
+        """Forget a job and its tasks' progress."""
+        raise NotImplementedError
+
+    async def add_dead_letter(self, entry: dict) -> None:
+        """Append a task that kept failing to the dead-letter list."""
+        raise NotImplementedError
+
+    async def dead_letters(self) -> list[dict]:
+        """List the dead letters, oldest first."""
+        raise NotImplementedError
+
+    async def clear_dead_letters(self, tenant: Optional[str]) -> None:
+        """Drop the dead letters of one tenant."""
+        raise NotImplementedError
+
+    async def close(self) -> None:
+        """Release the store's connection."""
+
+
+class SQLiteJobStore(JobStore):
+    """Job store in a SQLite database file."""
+
+    def __init__(self, path: str):
+        self.path = path
+        Path(path).parent.mkdir(parents=True, exist_ok=True)
+        self._db = sqlite3.connect(path, check_same_thread=False)
+        self._lock = threading.Lock()
+        with self._lock, self._db:
+            self._db.execute("PRAGMA journal_mode=WAL")
+            self._db.execute("CREATE TABLE IF NOT EXISTS jobs (id TEXT PRIMARY KEY, record TEXT NOT NULL)")
+            self._db.execute(
+                "CREATE TABLE IF NOT EXISTS job_tasks ("
+                "job_id TEXT NOT NULL, idx INTEGER NOT NULL, attempts INTEGER NOT NULL, result TEXT, "
+                "PRIMARY KEY (job_id, idx))"
+            )
+            self._db.execute(
+                "CREATE TABLE IF NOT EXISTS dead_letters ("
+                "id INTEGER PRIMARY KEY AUTOINCREMENT, tenant TEXT, entry TEXT NOT NULL)"
+            )
+
+    async def _execute(self, statements: list[tuple[str, tuple]]) -> list[list[tuple]]:
+        """Run statements in one transaction on a worker thread."""
+
+        def run() -> list[list[tuple]]:
+            with self._lock, self._db:
+                return [self._db.execute(sql, params).fetchall() for sql, params in statements]
+
+        return await asyncio.to_thread(run)
+
+    async def load(self) -> list[dict]:
+        jobs, tasks = await self._execute([
+            ("SELECT record FROM jobs", ()),
+            ("SELECT job_id, idx, attempts, result FROM job_tasks", ()),
+        ])
+        records = {}
+        for (record,) in jobs:
+            record = json.loads(record)
+            record["attempts"] = [0] * len(record["tasks"])
+            record["results"] = [None] * len(record["tasks"])
+            records[record["id"]] = record
+        for job_id, index, attempts, result in tasks:
+            record = records.get(job_id)
+            if record is not None and index < len(record["tasks"]):
+                record["attempts"][index] = attempts
+                record["results"][index] = json.loads(result) if result is not None else None
+        return list(records.values())
+
+    async def save_job(self, record: dict) -> None:
+        await self._execute([
+            ("INSERT OR REPLACE INTO jobs (id, record) VALUES (?, ?)", (record["id"], json.dumps(record))),
+        ])
+
+    async def save_task(self, job_id: str, index: int, attempts: int, result: Optional[dict]) -> None:
+        await self._execute([(
+            "INSERT OR REPLACE INTO job_tasks (job_id, idx, attempts, result) VALUES (?, ?, ?, ?)",
+            (job_id, index, attempts, json.dumps(result) if result is not None else None),
+        )])
+
+    async def delete_job(self, job_id: str) -> None:
+        await self._execute([
+            ("DELETE FROM job_tasks WHERE job_id = ?", (job_id,)),
+            ("DELETE FROM jobs WHERE id = ?", (job_id,)),
+        ])
+
+    async def add_dead_letter(self, entry: dict) -> None:
+        await self._execute([
+            ("INSERT INTO dead_letters (tenant, entry) VALUES (?, ?)", (entry.get("tenant"), json.dumps(entry))),
+            (
+                "DELETE FROM dead_letters WHERE id NOT IN "
+                "(SELECT id FROM dead_letters ORDER BY id DESC LIMIT ?)",
+                (MAX_DEAD_LETTERS,),
+            ),
+        ])
+
+    async def dead_letters(self) -> list[dict]:
+        (rows,) = await self._execute([("SELECT entry FROM dead_letters ORDER BY id", ())])
+        return [json.loads(entry) for (entry,) in rows]
+
+    async def clear_dead_letters(self, tenant: Optional[str]) -> None:
+        await self._execute([("DELETE FROM dead_letters WHERE tenant IS ?", (tenant,))])
+
+    async def close(self) -> None:
+        with self._lock:
+            self._db.close()
+
+
+class RedisJobStore(JobStore):
+    """Job store on a Redis server."""
+
+    def __init__(self, url: str):
+        try:
+            import redis.asyncio
+        except ImportError as e:
+            raise RuntimeError(
+                "The Redis job store needs the redis package: pip install 'camoufox-connector[redis]'"
+            ) from e
+        self.url = url
+        self._redis: Any = redis.asyncio.from_url(url, decode_responses=True)
+
+    @staticmethod
+    def _job_key(job_id: str) -> str:
+        return f"{REDIS_PREFIX}job:{job_id}"
+
+    @staticmethod
+    def _tasks_key(job_id: str) -> str:
+        return f"{REDIS_PREFIX}job:{job_id}:tasks"
+
+    async def load(self) -> list[dict]:
+        records = []
+        for job_id in await self._redis.smembers(f"{REDIS_PREFIX}jobs"):
+            record = await self._redis.get(self._job_key(job_id))
+            if record is None:
+                continue
+            record = json.loads(record)
+            record["attempts"] = [0] * len(record["tasks"])
+            record["results"] = [None] * len(record["tasks"])
+            for index, progress in (await self._redis.hgetall(self._tasks_key(job_id))).items():
+                index = int(index)
+                if index < len(record["tasks"]):
+                    progress = json.loads(progress)
+                    record["attempts"][index] = progress["attempts"]
+                    record["results"][index] = progress["result"]
+            records.append(record)
+        return records
+
+    async def save_job(self, record: dict) -> None:
+        async with self._redis.pipeline(transaction=True) as pipe:
+            pipe.set(self._job_key(record["id"]), json.dumps(record))
+            pipe.sadd(f"{REDIS_PREFIX}jobs", record["id"])
+            await pipe.execute()
+
+    async def save_task(self, job_id: str, index: int, attempts: int, result: Optional[dict]) -> None:
+        await self._redis.hset(
+            self._tasks_key(job_id), str(index), json.dumps({"attempts": attempts, "result": result})
+        )
+
+    async def delete_job(self, job_id: str) -> None:
+        async with self._redis.pipeline(transaction=True) as pipe:
+            pipe.delete(self._job_key(job_id), self._tasks_key(job_id))
+            pipe.srem(f"{REDIS_PREFIX}jobs", job_id)
+            await pipe.execute()
+
+    async def add_dead_letter(self, entry: dict) -> None:
+        async with self._redis.pipeline(transaction=True) as pipe:
+            pipe.rpush(f"{REDIS_PREFIX}dead-letters", json.dumps(entry))
+            pipe.ltrim(f"{REDIS_PREFIX}dead-letters", -MAX_DEAD_LETTERS, -1)
+            await pipe.execute()
+
+    async def dead_letters(self) -> list[dict]:
+        return [json.loads(entry) for entry in await self._redis.lrange(f"{REDIS_PREFIX}dead-letters", 0, -1)]
+
+    async def clear_dead_letters(self, tenant: Optional[str]) -> None:
+        kept = [entry for entry in await self.dead_letters() if entry.get("tenant") != tenant]
+        async with self._redis.pipeline(transaction=True) as pipe:
+            pipe.delete(f"{REDIS_PREFIX}dead-letters")
+            if kept:
+                pipe.rpush(f"{REDIS_PREFIX}dead-letters", *(json.dumps(entry) for entry in kept))
+            await pipe.execute()
+
+    async def close(self) -> None:
+        await self._redis.aclose()
+
+
+def open_job_store(url: Optional[str]) -> Optional[JobStore]:
+    """
+    Open the configured job store.
+
+    Args:
+        url: sqlite:///path/to/jobs.db, redis://host:port/db, or None for none
+
+    Returns:
+        The job store, or None when jobs are kept in memory only
+    """
+    if not url:
+        return None
+    if url.startswith("sqlite://"):
+        return SQLiteJobStore(url[len("sqlite://"):])
+    return RedisJobStore(url)
@@ -0,0 +1,207 @@
+"""
+Launcher processes for Camoufox browser servers.
+
+Each browser runs under a small Python launcher that computes the Camoufox
+launch options and starts Playwright's Node.js browser server. Importing
+camoufox and playwright dominates the launcher's own startup, so idle
+launchers can be pre-warmed: they finish importing and then block until the
+launch kwargs arrive on stdin.
+
+Pre-warming only shortens the launcher's part of a launch. Playwright gives
+every browser server a new temporary profile and refuses one of ours, so
+profiles are neither pre-extracted nor cached between launches; profile
+templates seed browsers with a warmed HTTP cache instead. Firefox's omni.ja
+archives are already shared, as every browser maps them read-only from the
+same installation.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import json
+import logging
+import sys
+from dataclasses import dataclass, field
+from typing import Optional
+
+from .supervise import adopt, release, spawn_options, stop_process_tree
+
+logger = logging.getLogger(__name__)
+
+
+# Custom launch script that filters None values from config
+# This works around a bug in camoufox 0.4.11 where proxy=None
+# gets serialized as null and breaks the Node.js server
+LAUNCHER_SCRIPT = """
+import sys
+if sys.platform == 'win32':
+    import codecs
+    sys.stdout = codecs.getwriter('utf-8')(sys.stdout.buffer)
+    sys.stderr = codecs.getwriter('utf-8')(sys.stderr.buffer)
+
+import os
+import json
+import subprocess
+
+# Take the browser down once the connector is gone; on Windows, the
+# launcher's job object does
+if sys.platform != 'win32':
+    import signal
+    import threading
+    import time
+
+    def _watch_connector(parent=os.getppid()):
+        while os.getppid() == parent:
+            time.sleep(1)
+        os.killpg(0, signal.SIGTERM)
+
+    threading.Thread(target=_watch_connector, daemon=True).start()
+
+import base64
+import orjson
+from pathlib import Path
+from playwright._impl._driver import compute_driver_executable
+from camoufox.pkgman import LOCAL_DATA
+from camoufox.utils import launch_options
+from camoufox.server import to_camel_case_dict
+
+LAUNCH_SCRIPT = LOCAL_DATA / "launchServer.js"
+_nodejs = compute_driver_executable()[0]
+nodejs = _nodejs[0] if isinstance(_nodejs, tuple) else _nodejs
+
+# Everything above is the expensive part; a pre-warmed launcher waits here
+line = sys.stdin.readline()
+if not line:
+    sys.exit(0)
+kwargs = json.loads(line)
+
+# Headful browsers render to the virtual display the connector started
+display = kwargs.pop("display", None)
+if display:
+    os.environ["DISPLAY"] = display
+
+# Get config from launch_options
+config = launch_options(**kwargs)
+
+# Filter out None values (workaround for camoufox bug)
+config = {k: v for k, v in config.items() if v is not None}
+
+# Launch the server (same as camoufox.server.launch_server but with filtered config)
+data = orjson.dumps(to_camel_case_dict(config))
+
+process = subprocess.Popen(
+    [nodejs, str(LAUNCH_SCRIPT)],
+    cwd=Path(nodejs).parent / "package",
+    stdin=subprocess.PIPE,
+    text=True,
+)
+if process.stdin:
+    process.stdin.write(base64.b64encode(data).decode())
+    process.stdin.close()
+
+process.wait()
+raise RuntimeError("Server process terminated unexpectedly")
+""".strip()
+
+
+async def spawn_launcher() -> asyncio.subprocess.Process:
+    """Spawn a launcher process that waits for its launch kwargs on stdin."""
+    process = await asyncio.create_subprocess_exec(
+        sys.executable,
+        "-c",
+        LAUNCHER_SCRIPT,
+        stdin=asyncio.subprocess.PIPE,
+        stdout=asyncio.subprocess.PIPE,
+        stderr=asyncio.subprocess.PIPE,
+        **spawn_options(),
+    )
+    adopt(process)
+    return process
+
+
+async def send_launch_kwargs(process: asyncio.subprocess.Process, kwargs: dict) -> None:
+    """Hand launch kwargs to a launcher, starting the browser server."""
+    if process.stdin is None:
+        raise RuntimeError("Launcher process has no stdin")
+
+    # Only include non-None values
+    payload = {k: v for k, v in kwargs.items() if v is not None}
+    process.stdin.write((json.dumps(payload) + "\n").encode())
+    await process.stdin.drain()
+    process.stdin.close()
+
+
+@dataclass
+class LauncherPool:
+    """
+    Keeps a number of pre-warmed launcher processes ready.
+
+    Taking a launcher returns a standby process when one is available and
+    schedules a replacement in the background, so relaunching a browser
+    skips the interpreter and import startup cost.
+    """
+
+    size: int = 0
+    _standby: list[asyncio.subprocess.Process] = field(default_factory=list)
+    _refill_task: Optional[asyncio.Task] = None
+    _closed: bool = False
+
+    async def start(self) -> None:
+        """Spawn the initial standby launchers."""
+        self._closed = False
+        if self.size > 0:
+            logger.info(f"Pre-warming {self.size} browser launcher(s)")
+            await self._refill()
+
+    async def _refill(self) -> None:
+        """Top up the standby launchers to the configured size."""
+        self._standby = [p for p in self._standby if p.returncode is None]
+        while not self._closed and len(self._standby) < self.size:
+            try:
+                self._standby.append(await spawn_launcher())
+            except Exception as e:
+                logger.error(f"Failed to pre-warm browser launcher: {e}")
+                return
+
+    def _schedule_refill(self) -> None:
+        """Refill standby launchers in the background."""
+        if self.size <= 0 or self._closed:
+            return
+        if self._refill_task is None or self._refill_task.done():
+            self._refill_task = asyncio.create_task(self._refill())
+
+    async def take(self) -> asyncio.subprocess.Process:
+        """Get a launcher process, preferring a pre-warmed one."""
+        while self._standby:
+            process = self._standby.pop(0)
+            if process.returncode is None:
+                self._schedule_refill()
+                return process
+
+        self._schedule_refill()
+        return await spawn_launcher()
+
+    @property
+    def ready(self) -> int:
+        """Number of standby launchers currently alive."""
+        return sum(1 for p in self._standby if p.returncode is None)
+
+    async def stop(self) -> None:
+        """Terminate all standby launchers."""
+        self._closed = True
+        if self._refill_task is not None:
+            self._refill_task.cancel()
+
+        for process in self._standby:
+            if process.returncode is None:
+                try:
+                    # Closing stdin makes an idle launcher exit on its own
+                    if process.stdin:
+                        process.stdin.close()
+                    await asyncio.wait_for(process.wait(), timeout=5.0)
+                except asyncio.TimeoutError:
+                    await stop_process_tree(process, grace=0)
+                except Exception as e:
+                    logger.debug(f"Error stopping standby launcher: {e}")
+            release(process)
+        self._standby.clear()
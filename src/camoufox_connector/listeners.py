@@ -0,0 +1,78 @@
+"""
+Listening sockets of the Camoufox Connector HTTP API.
+
+The API, and the relay served with it, binds ``api_host`` and every
+address of ``api_listen`` (``--listen``), e.g. ``0.0.0.0`` and ``::`` to
+serve IPv4 and IPv6 clients, or one address per interface. IPv6 sockets
+only take IPv6 clients, so both families can be bound on the same port.
+With ``reuse_port`` (``--reuse-port``), the sockets are opened with
+``SO_REUSEPORT``: several connector processes on one host can bind the same
+port, and the kernel spreads new connections across them, so a new process
+can start before the old one stops, or more processes can use more CPUs.
+"""
+
+from __future__ import annotations
+
+import logging
+import socket
+
+logger = logging.getLogger(__name__)
+
+# Pending connections each socket queues, as uvicorn's default
+BACKLOG = 2048
+
+
+def _addresses(host: str, port: int) -> list[tuple]:
+    """Resolve a listen address to the socket addresses to bind."""
+    infos = socket.getaddrinfo(
+        host or None,
+        port,
+        type=socket.SOCK_STREAM,
+        flags=socket.AI_PASSIVE,
+    )
+    return [(family, address) for family, _, _, _, address in infos]
+
+
+def bind_sockets(hosts: list[str], port: int, reuse_port: bool = False) -> list[socket.socket]:
+    """
+    Open listening sockets for every address of the given hosts.
+
+    Args:
+        hosts: Hosts or IP addresses to bind; hostnames bind each address they resolve to
+        port: Port to bind
+        reuse_port: Whether to open the sockets with SO_REUSEPORT
+
+    Returns:
+        Bound, listening sockets
+
+    Raises:
+        OSError: An address can't be bound, e.g. it's in use without SO_REUSEPORT
+    """
+    if reuse_port and not hasattr(socket, "SO_REUSEPORT"):
+        raise OSError("SO_REUSEPORT is not supported on this platform")
+
+    sockets: list[socket.socket] = []
+    bound: set[tuple] = set()
+    try:
+        for host in hosts:
+            for family, address in _addresses(host, port):
+                if (family, address[:2]) in bound:
+                    continue
+                sock = socket.socket(family, socket.SOCK_STREAM)
+                sockets.append(sock)
+                sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+                if reuse_port:
+                    sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEPORT, 1)
+                if family == socket.AF_INET6:
+                    # Leaves IPv4 on the same port to a socket of its own
+                    sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_V6ONLY, 1)
+                sock.bind(address)
+                sock.listen(BACKLOG)
+                sock.setblocking(False)
+                bound.add((family, address[:2]))
+                logger.debug(f"Listening on {address[0]} port {address[1]}")
+    except OSError:
+        for sock in sockets:
+            sock.close()
+        raise
+    return sockets
@@ -0,0 +1,420 @@
+"""
+Scheduled maintenance for Camoufox Connector.
+
+Long-running browsers collect memory and state, and some pool changes are
+best made when nobody is looking. ``maintenance`` schedules them for quiet
+hours with cron expressions:
+
+- ``rolling-restart``: relaunch the browsers one at a time, each once it is
+  free, never leaving fewer than ``min_available`` browsers available for
+  clients. Browsers still leased when ``timeout`` runs out are skipped.
+- ``purge-cache``: clear the fetch task result cache.
+- ``resize``: scale the pool to ``pool_size``, like ``POST /admin/scale``.
+
+Schedules are five-field cron expressions (minute, hour, day of month,
+month, day of week) or ``@hourly``, ``@daily``, ``@weekly`` and
+``@monthly``, in each task's ``timezone``. Tasks run one at a time; a task
+that is still running when it is due again is skipped.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+import re
+import time
+from dataclasses import dataclass, field
+from datetime import datetime, timedelta
+from typing import TYPE_CHECKING, Awaitable, Callable, Literal, Optional
+from zoneinfo import ZoneInfo, ZoneInfoNotFoundError
+
+from pydantic import BaseModel, ConfigDict, Field, field_validator, model_validator
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+if TYPE_CHECKING:
+    from .fetchcache import FetchCache
+    from .pool import BrowserInstance, BrowserPool
+
+logger = logging.getLogger(__name__)
+
+TASK_NAME = re.compile(r"^[A-Za-z0-9._-]+$")
+
+MACROS = {
+    "@hourly": "0 * * * *",
+    "@daily": "0 0 * * *",
+    "@midnight": "0 0 * * *",
+    "@weekly": "0 0 * * 0",
+    "@monthly": "0 0 1 * *",
+}
+
+# Minimum and maximum of each cron field
+FIELD_RANGES = [(0, 59), (0, 23), (1, 31), (1, 12), (0, 7)]
+
+# Longest the scheduler sleeps, so reloaded schedules are picked up
+MAX_SLEEP = 60.0
+
+# How often a rolling restart checks whether it may go on
+ROLLING_CHECK_INTERVAL = 5.0
+
+
+def _parse_field(text: str, low: int, high: int) -> set[int]:
+    """Parse one cron field into the values it matches."""
+    values: set[int] = set()
+    for part in text.split(","):
+        expression, _, step_text = part.partition("/")
+        step = int(step_text) if step_text else 1
+        if step < 1:
+            raise ValueError(f"Invalid step in {part!r}")
+        if expression == "*":
+            start, end = low, high
+        elif "-" in expression:
+            start_text, end_text = expression.split("-", 1)
+            start, end = int(start_text), int(end_text)
+        else:
+            start = int(expression)
+            end = high if step_text else start
+        if not low <= start <= end <= high:
+            raise ValueError(f"{part!r} is outside {low}-{high}")
+        values.update(range(start, end + 1, step))
+    return values
+
+
+@dataclass
+class CronSchedule:
+    """A parsed cron expression."""
+
+    minutes: set[int]
+    hours: set[int]
+    days: set[int]
+    months: set[int]
+    weekdays: set[int]
+    # Cron matches either day field when both are restricted
+    any_day: bool
+
+    @classmethod
+    def parse(cls, expression: str) -> CronSchedule:
+        """
+        Parse a five-field cron expression or macro.
+
+        Raises:
+            ValueError: If the expression is invalid
+        """
+        fields = MACROS.get(expression.strip(), expression).split()
+        if len(fields) != 5:
+            raise ValueError(f"Cron expression needs 5 fields: {expression!r}")
+        try:
+            minutes, hours, days, months, weekdays = (
+                _parse_field(text, low, high) for text, (low, high) in zip(fields, FIELD_RANGES)
+            )
+        except ValueError as e:
+            raise ValueError(f"Invalid cron expression {expression!r}: {e}") from e
+        # Sunday is 0 or 7
+        weekdays = {day % 7 for day in weekdays}
+        return cls(
+            minutes=minutes,
+            hours=hours,
+            days=days,
+            months=months,
+            weekdays=weekdays,
+            any_day=fields[2] != "*" and fields[4] != "*",
+        )
+
+    def _day_matches(self, moment: datetime) -> bool:
+        """Whether a date matches the day-of-month and day-of-week fields."""
+        day = moment.day in self.days
+        weekday = (moment.isoweekday() % 7) in self.weekdays
+        return day or weekday if self.any_day else day and weekday
+
+    def next_after(self, moment: datetime) -> datetime:
+        """Get the first time after a moment that matches, in the moment's timezone."""
+        candidate = moment.replace(second=0, microsecond=0) + timedelta(minutes=1)
+        # Within five years, unless the expression never matches (e.g. 30 February)
+        limit = candidate + timedelta(days=5 * 366)
+        while candidate < limit:
+            if candidate.month not in self.months:
+                year, month = divmod(candidate.month, 12)
+                candidate = candidate.replace(year=candidate.year + year, month=month + 1, day=1, hour=0, minute=0)
+            elif not self._day_matches(candidate):
+                candidate = (candidate + timedelta(days=1)).replace(hour=0, minute=0)
+            elif candidate.hour not in self.hours:
+                candidate = (candidate + timedelta(hours=1)).replace(minute=0)
+            elif candidate.minute not in self.minutes:
+                candidate += timedelta(minutes=1)
+            else:
+                return candidate
+        raise ValueError("Cron expression never matches")
+
+
+class MaintenanceTask(BaseModel):
+    """A maintenance action run on a schedule."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    name: str = Field(min_length=1, max_length=100, description="Name the task is reported and run by")
+
+    schedule: str = Field(description="Cron expression, e.g. '0 3 * * *' for 03:00 every day")
+
+    action: Literal["rolling-restart", "purge-cache", "resize"] = Field(description="What to do")
+
+    timezone: str = Field(default="UTC", description="Timezone of the schedule, e.g. Europe/Berlin")
+
+    min_available: int = Field(
+        default=1,
+        ge=0,
+        description="Browsers left available for clients during a rolling restart",
+    )
+
+    timeout: float = Field(
+        default=3600.0,
+        gt=0,
+        description="Seconds a rolling restart may wait for leased browsers before skipping them",
+    )
+
+    pool_size: Optional[int] = Field(
+        default=None,
+        ge=1,
+        le=20,
+        description="Pool size to resize to",
+    )
+
+    @field_validator("name")
+    @classmethod
+    def validate_name(cls, v: str) -> str:
+        """Keep names usable in URLs."""
+        if not TASK_NAME.match(v):
+            raise ValueError("Name may only contain letters, digits, '.', '_' and '-'")
+        return v
+
+    @field_validator("schedule")
+    @classmethod
+    def validate_schedule(cls, v: str) -> str:
+        """Check the cron expression, and that it ever matches."""
+        CronSchedule.parse(v).next_after(datetime(2000, 1, 1))
+        return v
+
+    @field_validator("timezone")
+    @classmethod
+    def validate_timezone(cls, v: str) -> str:
+        """Check the timezone is known."""
+        try:
+            ZoneInfo(v)
+        except (ZoneInfoNotFoundError, ValueError) as e:
+            raise ValueError(f"Unknown timezone: {v}") from e
+        return v
+
+    @model_validator(mode="after")
+    def check_pool_size(self) -> MaintenanceTask:
+        """Resizing needs the size."""
+        if self.action == "resize" and self.pool_size is None:
+            raise ValueError("A resize task needs pool_size")
+        return self
+
+    def next_run(self, after: float) -> float:
+        """Get the Unix time the task is next due after a time."""
+        zone = ZoneInfo(self.timezone)
+        return CronSchedule.parse(self.schedule).next_after(datetime.fromtimestamp(after, zone)).timestamp()
+
+
+@dataclass
+class TaskState:
+    """When a maintenance task ran and how it went."""
+
+    next_run: Optional[float] = None
+    last_started: Optional[float] = None
+    last_finished: Optional[float] = None
+    last_outcome: Optional[dict] = None
+    running: bool = False
+
+
+@dataclass
+class MaintenanceScheduler:
+    """Runs the configured maintenance tasks when they are due."""
+
+    pool: BrowserPool
+    scale: Callable[[int], Awaitable[int]]
+    cache: Optional[FetchCache] = None
+    states: dict[str, TaskState] = field(default_factory=dict)
+    _schedules: dict[str, tuple[str, str]] = field(default_factory=dict)
+    _lock: asyncio.Lock = field(default_factory=asyncio.Lock)
+    _task: Optional[asyncio.Task] = None
+    _runs: set[asyncio.Task] = field(default_factory=set)
+
+    @property
+    def tasks(self) -> dict[str, MaintenanceTask]:
+        """Configured tasks by name."""
+        return {task.name: task for task in self.pool.settings.maintenance}
+
+    def _sync(self, now: float) -> None:
+        """Plan the next run of each task, again for tasks whose schedule changed."""
+        tasks = self.tasks
+        for name in list(self.states):
+            if name not in tasks and not self.states[name].running:
+                del self.states[name]
+                self._schedules.pop(name, None)
+        for name, task in tasks.items():
+            state = self.states.setdefault(name, TaskState())
+            schedule = (task.schedule, task.timezone)
+            if self._schedules.get(name) != schedule or state.next_run is None:
+                self._schedules[name] = schedule
+                state.next_run = task.next_run(now)
+
+    def start(self) -> None:
+        """Start running tasks when they are due."""
+        if self._task is None:
+            self._task = asyncio.create_task(self._loop())
+
+    async def _loop(self) -> None:
+        """Sleep until the next task is due and start it."""
+        while True:
+            now = time.time()
+            try:
+                self._sync(now)
+            except Exception as e:
+                logger.error(f"Maintenance scheduling failed: {e}")
+            for name, state in self.states.items():
+                if state.next_run is not None and state.next_run <= now:
+                    state.next_run = self.tasks[name].next_run(now)
+                    if state.running:
+                        logger.warning(f"Skipping maintenance task {name}: its last run has not finished")
+                    else:
+                        self.run_in_background(name)
+            upcoming = [s.next_run for s in self.states.values() if s.next_run is not None]
+            await asyncio.sleep(max(1.0, min([MAX_SLEEP, *(t - time.time() for t in upcoming)])))
+
+    def run_in_background(self, name: str) -> None:
+        """Run a task now, without waiting for it."""
+        job = asyncio.create_task(self.run(name))
+        self._runs.add(job)
+        job.add_done_callback(self._runs.discard)
+
+    async def run(self, name: str) -> dict:
+        """
+        Run a task, after any other task that is running.
+
+        Raises:
+            KeyError: If there is no such task
+        """
+        task = self.tasks[name]
+        state = self.states.setdefault(name, TaskState())
+        state.running = True
+        try:
+            async with self._lock:
+                state.last_started = time.time()
+                logger.info(f"Running maintenance task {name} ({task.action})")
+                self.pool.events.publish("maintenance-started", name=name, action=task.action)
+                try:
+                    outcome = await self._perform(task)
+                except Exception as e:
+                    logger.error(f"Maintenance task {name} failed: {e}")
+                    outcome = {"error": str(e)}
+                state.last_finished = time.time()
+                state.last_outcome = outcome
+                self.pool.events.publish("maintenance-finished", name=name, action=task.action, **outcome)
+                return outcome
+        finally:
+            state.running = False
+
+    async def _perform(self, task: MaintenanceTask) -> dict:
+        """Carry out a task's action."""
+        if task.action == "purge-cache":
+            removed = await self.cache.clear() if self.cache is not None else 0
+            return {"removed": removed}
+        if task.action == "resize":
+            previous = await self.scale(task.pool_size)
+            return {"previous": previous, "pool_size": task.pool_size}
+        return await self.rolling_restart(task.min_available, task.timeout)
+
+    def _may_take(self, instance: BrowserInstance, min_available: int) -> bool:
+        """Whether a free browser may be taken out without going below the floor."""
+        others = [other for other in self.pool.get_available_instances() if other is not instance]
+        return instance.is_available and len(others) >= min_available
+
+    async def rolling_restart(self, min_available: int, timeout: float) -> dict:
+        """Relaunch the browsers one at a time, each once it is free and enough others are available."""
+        deadline = time.monotonic() + timeout
+        restarted: list[int] = []
+        skipped: list[int] = []
+        failed: list[int] = []
+        for instance in list(self.pool.instances):
+            while instance in self.pool.instances and not self._may_take(instance, min_available):
+                if time.monotonic() >= deadline:
+                    break
+                await asyncio.sleep(ROLLING_CHECK_INTERVAL)
+            if instance not in self.pool.instances:
+                continue
+            if not self._may_take(instance, min_available):
+                skipped.append(instance.index)
+                continue
+            # Nobody may lease the browser while it is relaunched
+            instance.is_healthy = False
+            if await self.pool.relaunch_instance(instance):
+                restarted.append(instance.index)
+            else:
+                failed.append(instance.index)
+        if skipped:
+            logger.warning(f"Rolling restart skipped browser instance(s) {skipped}, still busy at the timeout")
+        return {"restarted": restarted, "skipped": skipped, "failed": failed}
+
+    def report(self) -> list[dict]:
+        """Describe each task with its next and last run."""
+        self._sync(time.time())
+        return [
+            {
+                **task.model_dump(exclude_none=True),
+                "next_run": self.states[name].next_run,
+                "last_started": self.states[name].last_started,
+                "last_finished": self.states[name].last_finished,
+                "last_outcome": self.states[name].last_outcome,
+                "running": self.states[name].running,
+            }
+            for name, task in self.tasks.items()
+        ]
+
+    async def close(self) -> None:
+        """Stop scheduling and cancel running tasks."""
+        jobs = [job for job in (self._task, *self._runs) if job is not None]
+        for job in jobs:
+            job.cancel()
+        await asyncio.gather(*jobs, return_exceptions=True)
+        self._task = None
+
+
+def create_maintenance_routes(scheduler: MaintenanceScheduler) -> list[Route]:
+    """
+    Create routes reporting and running maintenance tasks.
+
+    Args:
+        scheduler: Scheduler running the configured tasks
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def list_tasks(request: Request) -> Response:
+        """
+        Maintenance tasks with their next and last run.
+
+        GET /maintenance
+        """
+        return JSONResponse({"tasks": scheduler.report()})
+
+    async def run_task(request: Request) -> Response:
+        """
+        Run a maintenance task now, in the background.
+
+        POST /maintenance/{name}/run
+        """
+        name = request.path_params["name"]
+        if name not in scheduler.tasks:
+            return JSONResponse({"error": "Maintenance task not found"}, status_code=404)
+        if name in scheduler.states and scheduler.states[name].running:
+            return JSONResponse({"error": "Maintenance task is already running"}, status_code=409)
+        scheduler.run_in_background(name)
+        return JSONResponse({"status": "started", "name": name}, status_code=202)
+
+    return [
+        Route("/maintenance", list_tasks, methods=["GET"]),
+        Route("/maintenance/{name}/run", run_task, methods=["POST"]),
+    ]
@@ -0,0 +1,241 @@
+"""
+Request mirroring for A/B fingerprint evaluation.
+
+Whether a new fingerprint or proxy does better against a site is best
+answered with real traffic. With a ``mirror`` experiment configured, a
+sample of the fetch tasks on matching domains is repeated in the background
+on a browser launched with the experiment's fingerprint and proxy. The
+client only ever gets the original (control) result. Both outcomes are
+classified as success, block or error, and ``GET /mirror`` compares the
+success rates per domain and names the better configuration once a domain
+has enough samples.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import fnmatch
+import logging
+import random
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Optional
+from urllib.parse import urlsplit
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .blocks import Outcome, classify
+
+if TYPE_CHECKING:
+    from .config import MirrorExperiment
+    from .tasks import FetchResult, FetchTask, TaskRunner
+
+logger = logging.getLogger(__name__)
+
+# Difference in success rate below which neither configuration is called better
+MIN_DIFFERENCE = 0.05
+
+
+@dataclass
+class GroupStats:
+    """Outcomes of one configuration on one domain."""
+
+    success: int = 0
+    blocked: int = 0
+    error: int = 0
+
+    @property
+    def runs(self) -> int:
+        """Number of recorded outcomes."""
+        return self.success + self.blocked + self.error
+
+    @property
+    def success_rate(self) -> Optional[float]:
+        """Share of successful runs."""
+        return self.success / self.runs if self.runs else None
+
+    def add(self, outcome: Outcome) -> None:
+        """Count an outcome."""
+        setattr(self, outcome, getattr(self, outcome) + 1)
+
+    def merge(self, other: GroupStats) -> None:
+        """Add another group's outcomes to this one."""
+        self.success += other.success
+        self.blocked += other.blocked
+        self.error += other.error
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        rate = self.success_rate
+        return {
+            "runs": self.runs,
+            "success": self.success,
+            "blocked": self.blocked,
+            "error": self.error,
+            "success_rate": round(rate, 3) if rate is not None else None,
+        }
+
+
+@dataclass
+class DomainStats:
+    """Paired outcomes of the control and the experiment on one domain."""
+
+    control: GroupStats = field(default_factory=GroupStats)
+    experiment: GroupStats = field(default_factory=GroupStats)
+
+    def winner(self, min_samples: int) -> Optional[str]:
+        """The better configuration, "tie", or None while samples are missing."""
+        if self.experiment.runs < min_samples:
+            return None
+        difference = (self.experiment.success_rate or 0.0) - (self.control.success_rate or 0.0)
+        if abs(difference) < MIN_DIFFERENCE:
+            return "tie"
+        return "experiment" if difference > 0 else "control"
+
+
+@dataclass
+class Mirror:
+    """Mirrors a sample of fetch tasks onto the configured experiment."""
+
+    runner: TaskRunner
+    domains: dict[str, DomainStats] = field(default_factory=dict)
+    experiment_name: Optional[str] = None
+    skipped: int = 0
+    _mirror_tasks: set[int] = field(default_factory=set)
+    _pending: set[asyncio.Task] = field(default_factory=set)
+
+    def __post_init__(self) -> None:
+        self.runner.completion_hooks.append(self._on_result)
+
+    @property
+    def experiment(self) -> Optional[MirrorExperiment]:
+        """The configured experiment, if any."""
+        return self.runner.sessions.pool.settings.mirror
+
+    def _on_result(self, task: FetchTask, result: FetchResult) -> None:
+        """Sample a finished control task for mirroring."""
+        if id(task) in self._mirror_tasks:
+            return
+        experiment = self.experiment
+        if experiment is None:
+            return
+        host = urlsplit(task.url).hostname or ""
+        if not any(fnmatch.fnmatchcase(host, pattern) for pattern in experiment.domains):
+            return
+        if random.random() >= experiment.sample_rate:
+            return
+
+        if experiment.name != self.experiment_name:
+            # A different experiment starts from scratch
+            self.reset()
+            self.experiment_name = experiment.name
+
+        if not self.runner.sessions.pool.get_available_instances(task.lease.version, task.lease.labels):
+            # Mirroring must not take browsers from real traffic
+            self.skipped += 1
+            return
+
+        control = classify(result, self.runner.sessions.pool.settings.block_markers)
+        job = asyncio.create_task(self._run(experiment, task, host, control))
+        self._pending.add(job)
+        job.add_done_callback(self._pending.discard)
+
+    async def _run(self, experiment: MirrorExperiment, task: FetchTask, host: str, control: Outcome) -> None:
+        """Repeat a task on the experiment and record both outcomes."""
+        lease = task.lease.model_copy(update={"proxy": experiment.proxy or task.lease.proxy})
+        mirrored = task.model_copy(update={"lease": lease, "screenshot": False, "capture": None})
+        self._mirror_tasks.add(id(mirrored))
+        try:
+            result = await self.runner.fetch(mirrored, launch_options=experiment.fingerprint)
+        except Exception as e:
+            logger.debug(f"Mirror of {task.url} could not run: {e}")
+            self.skipped += 1
+            return
+        finally:
+            self._mirror_tasks.discard(id(mirrored))
+
+        if result is None:
+            self.skipped += 1
+            return
+        if experiment.name != self.experiment_name:
+            return
+
+        outcome = classify(result, self.runner.sessions.pool.settings.block_markers)
+        stats = self.domains.setdefault(host, DomainStats())
+        stats.control.add(control)
+        stats.experiment.add(outcome)
+        logger.debug(f"Mirrored {task.url}: control {control}, experiment {outcome}")
+
+    def reset(self) -> None:
+        """Forget the recorded outcomes."""
+        self.domains.clear()
+        self.skipped = 0
+
+    def report(self) -> dict:
+        """Compare the control and the experiment per domain and overall."""
+        experiment = self.experiment
+        min_samples = experiment.min_samples if experiment is not None else 1
+        total = DomainStats()
+        domains = {}
+        for host, stats in sorted(self.domains.items()):
+            total.control.merge(stats.control)
+            total.experiment.merge(stats.experiment)
+            domains[host] = {
+                "control": stats.control.to_dict(),
+                "experiment": stats.experiment.to_dict(),
+                "winner": stats.winner(min_samples),
+            }
+        return {
+            # The proxy may carry credentials
+            "experiment": experiment.model_dump(exclude={"proxy"}) if experiment is not None else None,
+            "pending": len(self._pending),
+            "skipped": self.skipped,
+            "overall": {
+                "control": total.control.to_dict(),
+                "experiment": total.experiment.to_dict(),
+                "winner": total.winner(min_samples),
+            },
+            "domains": domains,
+        }
+
+    async def close(self) -> None:
+        """Cancel mirrored tasks still running."""
+        for job in list(self._pending):
+            job.cancel()
+        if self._pending:
+            await asyncio.gather(*self._pending, return_exceptions=True)
+
+
+def create_mirror_routes(mirror: Mirror) -> list[Route]:
+    """
+    Create routes reporting the mirroring experiment.
+
+    Args:
+        mirror: Mirror recording the experiment's outcomes
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_report(request: Request) -> Response:
+        """
+        Compare the control and the experiment per domain.
+
+        GET /mirror
+        """
+        return JSONResponse(mirror.report())
+
+    async def reset_report(request: Request) -> Response:
+        """
+        Forget the recorded outcomes and start over.
+
+        DELETE /mirror
+        """
+        mirror.reset()
+        return JSONResponse({"status": "reset"})
+
+    return [
+        Route("/mirror", get_report, methods=["GET"]),
+        Route("/mirror", reset_report, methods=["DELETE"]),
+    ]
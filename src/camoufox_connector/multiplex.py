@@ -0,0 +1,60 @@
+"""
+Context multiplexing for Camoufox Connector.
+
+A browser per client wastes memory when clients only need a page or two.
+With ``contexts_per_browser`` above 1, leases that need no launch options
+of their own share browsers: each gets a slot in a browser and reaches it
+through its session endpoint, where it works in one browser context of its
+own. Playwright keeps the contexts of different connections apart, so
+clients never see each other's pages, cookies or storage.
+
+The relay holds each context lease to one context at a time, and closes it
+when the lease is released, before the connection goes, so its browser is
+left clean for the next lease.
+"""
+
+from __future__ import annotations
+
+import logging
+from dataclasses import dataclass
+from typing import TYPE_CHECKING
+
+from .relay import NEW_CONTEXT_METHODS, RelayCallError, RelayCallRejected
+
+if TYPE_CHECKING:
+    from .relay import Relay, RelayConnection
+
+logger = logging.getLogger(__name__)
+
+
+@dataclass
+class ContextMultiplexer:
+    """Keeps context leases to one context each and cleans up after them."""
+
+    relay: Relay
+
+    def __post_init__(self) -> None:
+        self.relay.call_hooks.append(self._on_call)
+        self.relay.disconnect_hooks.append(self._on_disconnect)
+
+    async def _on_call(self, connection: RelayConnection, message: dict) -> None:
+        """Reject a second context in a context lease."""
+        session = connection.session
+        if session is None or not session.shared or message.get("method") not in NEW_CONTEXT_METHODS:
+            return
+        if any(conn.contexts for conn in self.relay.connections_for_session(session.id)):
+            raise RelayCallRejected(
+                "A context lease holds one browser context at a time; "
+                'close it first or lease a whole browser with "scope": "browser"'
+            )
+
+    async def _on_disconnect(self, connection: RelayConnection) -> None:
+        """Close the contexts a context lease left open, while the browser is still connected."""
+        session = connection.session
+        if session is None or not session.shared:
+            return
+        for guid in list(connection.contexts):
+            try:
+                await connection.call(guid, "close")
+            except RelayCallError as e:
+                logger.debug(f"Failed to close context {guid} of session {session.id}: {e}")
@@ -0,0 +1,96 @@
+"""
+Source IP allowlists for Camoufox Connector.
+
+A simple hardening layer for deployments that cannot put the connector
+behind a proxy: with ``allowed_ips`` set, only clients whose address is in
+one of the listed networks reach the API and relayed WebSockets, and with
+``admin_allowed_ips`` set, admin endpoints (reloading and scaling, restarts,
+drains, the dashboard, patches, templates, ...) are reachable only from
+those. Rejected attempts are logged and published as ``access-denied``
+events. The client's address is the TCP peer's; ``X-Forwarded-For`` is only
+trusted from ``trusted_proxies`` (see :mod:`.proxyheaders`). Health probes
+stay reachable from anywhere, as they do without a key. Lists are read from
+the current settings on every request, so they change with a configuration
+reload.
+"""
+
+from __future__ import annotations
+
+import ipaddress
+import json
+import logging
+from functools import lru_cache
+from typing import TYPE_CHECKING, Optional, Union
+
+from .auth import PUBLIC_PATHS, WS_FORBIDDEN, is_admin_path
+
+if TYPE_CHECKING:
+    from .pool import BrowserPool
+
+logger = logging.getLogger(__name__)
+
+Network = Union[ipaddress.IPv4Network, ipaddress.IPv6Network]
+
+
+@lru_cache(maxsize=32)
+def parse_networks(entries: tuple[str, ...]) -> tuple[Network, ...]:
+    """Parse addresses and CIDR networks; a bare address is a network of one."""
+    return tuple(ipaddress.ip_network(entry, strict=False) for entry in entries)
+
+
+def address_allowed(address: Optional[str], entries: list[str]) -> bool:
+    """Whether an address is in one of the listed networks."""
+    if address is None:
+        return False
+    try:
+        ip = ipaddress.ip_address(address)
+    except ValueError:
+        return False
+    # IPv4 clients of a dual-stack socket arrive as ::ffff:a.b.c.d
+    if isinstance(ip, ipaddress.IPv6Address) and ip.ipv4_mapped is not None:
+        ip = ip.ipv4_mapped
+    return any(ip in network for network in parse_networks(tuple(entries)))
+
+
+class IpAllowlistMiddleware:
+    """ASGI middleware rejecting requests from addresses not allowed for the endpoint."""
+
+    def __init__(self, app, pool: BrowserPool):
+        self.app = app
+        self.pool = pool
+
+    def _allowlist(self, path: str, method: str) -> tuple[str, list[str]]:
+        """Which plane a request belongs to and its allowlist; empty allows everyone."""
+        settings = self.pool.settings
+        if is_admin_path(path, method):
+            return "admin", settings.admin_allowed_ips or settings.allowed_ips
+        return "data", settings.allowed_ips
+
+    async def __call__(self, scope, receive, send) -> None:
+        if scope["type"] not in ("http", "websocket") or scope["path"] in PUBLIC_PATHS:
+            await self.app(scope, receive, send)
+            return
+
+        plane, allowed = self._allowlist(scope["path"], scope.get("method", "GET"))
+        address = scope["client"][0] if scope.get("client") else None
+        if not allowed or address_allowed(address, allowed):
+            await self.app(scope, receive, send)
+            return
+
+        method = scope.get("method", "WEBSOCKET")
+        logger.warning(f"Rejected {method} {scope['path']} from {address}: not in the {plane} allowlist")
+        self.pool.events.publish("access-denied", address=address, method=method, path=scope["path"], plane=plane)
+
+        if scope["type"] == "websocket":
+            await send({"type": "websocket.close", "code": WS_FORBIDDEN})
+            return
+        body = json.dumps({"error": "Address not allowed"}).encode()
+        await send({
+            "type": "http.response.start",
+            "status": 403,
+            "headers": [
+                (b"content-type", b"application/json"),
+                (b"content-length", str(len(body)).encode()),
+            ],
+        })
+        await send({"type": "http.response.body", "body": body})
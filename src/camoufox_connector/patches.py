@@ -0,0 +1,427 @@
+"""
+Per-domain JavaScript patches for Camoufox Connector.
+
+Sites sometimes need a small fix: neutralizing a detection script, closing
+a consent wall, working around a UI quirk. Patches are snippets of
+JavaScript bound to a domain (and its subdomains) that the relay adds as
+init scripts to every relayed browser context, so they run before the
+site's own scripts on each page of that domain.
+
+Patches come from ``js_patches`` in the configuration and from the API.
+Every change to a patch makes a new version, and earlier versions can be
+rolled back to. Changes roll out at once: new contexts get the current
+patches, and contexts already open get them from their next navigation.
+Where the browser's Playwright supports it, disabled and superseded
+versions are removed from open contexts as well; otherwise they keep
+running there until the context is closed.
+
+Leases acquired with ``"patches": false`` get no patches.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import json
+import logging
+import re
+import time
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Literal, Optional
+
+from pydantic import BaseModel, ConfigDict, Field, ValidationError, field_validator
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .relay import RelayCallError
+
+if TYPE_CHECKING:
+    from .relay import Relay, RelayConnection
+
+logger = logging.getLogger(__name__)
+
+# Earlier versions kept per patch for rollbacks
+MAX_VERSIONS = 10
+
+PATCH_NAME = re.compile(r"^[A-Za-z0-9_.-]+$")
+
+
+def normalize_domain(domain: str) -> str:
+    """Reduce a domain to the bare host patches are matched against."""
+    domain = domain.strip().lower().removeprefix("*.").strip(".")
+    if not domain or "/" in domain or ":" in domain or " " in domain:
+        raise ValueError("Domain must be a host name such as shop.example.com")
+    return domain
+
+
+class PatchSpec(BaseModel):
+    """What a patch does and where, as sent to the API."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    domain: str = Field(description="Domain the patch applies to, including its subdomains")
+
+    source: str = Field(
+        min_length=1,
+        max_length=65536,
+        description="JavaScript run before the page's own scripts",
+    )
+
+    enabled: bool = Field(default=True, description="Whether the patch is applied")
+
+    description: Optional[str] = Field(
+        default=None,
+        max_length=500,
+        description="What the patch fixes",
+    )
+
+    @field_validator("domain")
+    @classmethod
+    def validate_domain(cls, v: str) -> str:
+        """Normalize the domain."""
+        return normalize_domain(v)
+
+
+class JsPatch(PatchSpec):
+    """A named per-domain JavaScript patch."""
+
+    name: str = Field(min_length=1, max_length=100, description="Name the patch is managed by")
+
+    @field_validator("name")
+    @classmethod
+    def validate_name(cls, v: str) -> str:
+        """Keep names usable in URLs."""
+        if not PATCH_NAME.match(v):
+            raise ValueError("Name may only contain letters, digits, '.', '_' and '-'")
+        return v
+
+
+class Toggle(BaseModel):
+    """Enables or disables patches."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    enabled: bool = Field(description="Whether the patches are applied")
+
+
+class Rollback(BaseModel):
+    """Which earlier version of a patch to restore."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    version: Optional[int] = Field(default=None, ge=1, description="Version to restore (default: the previous one)")
+
+
+@dataclass
+class PatchVersion:
+    """One version of a patch."""
+
+    patch: JsPatch
+    version: int
+    origin: Literal["config", "api"]
+    created_at: float = field(default_factory=time.time)
+
+    def script(self) -> str:
+        """The init script running the patch on its domain only."""
+        patch = self.patch
+        return (
+            f"// camoufox-connector patch {patch.name} v{self.version}\n"
+            "(() => {\n"
+            f"const domain = {json.dumps(patch.domain)};\n"
+            "const host = location.hostname;\n"
+            "if (host !== domain && !host.endsWith('.' + domain)) return;\n"
+            f"{patch.source}\n"
+            "})();"
+        )
+
+    def to_dict(self, source: bool = True) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        data = {
+            **self.patch.model_dump(),
+            "version": self.version,
+            "origin": self.origin,
+            "created_at": self.created_at,
+        }
+        if not source:
+            data.pop("source")
+        return data
+
+
+@dataclass
+class PatchRegistry:
+    """Keeps the versions of each patch and applies the current ones to relayed contexts."""
+
+    relay: Relay
+    versions: dict[str, list[PatchVersion]] = field(default_factory=dict)
+    _configured: dict[str, JsPatch] = field(default_factory=dict)
+    _lock: asyncio.Lock = field(default_factory=asyncio.Lock)
+    _rollout: Optional[asyncio.Task] = None
+
+    def __post_init__(self) -> None:
+        self.relay.context_hooks.append(self._on_context)
+
+    def current(self, name: str) -> Optional[PatchVersion]:
+        """Get the current version of a patch."""
+        versions = self.versions.get(name)
+        return versions[-1] if versions else None
+
+    def all(self) -> list[PatchVersion]:
+        """Get the current version of every patch."""
+        return [versions[-1] for versions in self.versions.values()]
+
+    def _commit(self, patch: JsPatch, origin: Literal["config", "api"]) -> PatchVersion:
+        """Make a patch's definition its current version, unless it already is."""
+        versions = self.versions.setdefault(patch.name, [])
+        if versions and versions[-1].patch == patch:
+            return versions[-1]
+        entry = PatchVersion(patch=patch, version=versions[-1].version + 1 if versions else 1, origin=origin)
+        versions.append(entry)
+        del versions[:-MAX_VERSIONS]
+        self.relay.pool.events.publish(
+            "patch-updated",
+            name=patch.name,
+            domain=patch.domain,
+            version=entry.version,
+            enabled=patch.enabled,
+        )
+        self._schedule_rollout()
+        return entry
+
+    def sync_config(self, patches: list[JsPatch]) -> None:
+        """
+        Take over the configured patches, at start and on every reload.
+
+        Configured patches whose definition changed get a new version, and
+        ones dropped from the configuration are removed unless the API has
+        changed them since. Changes made through the API stay until the
+        configured definition changes.
+        """
+        configured = {patch.name: patch for patch in patches}
+        for name, patch in configured.items():
+            if self._configured.get(name) != patch:
+                self._commit(patch, "config")
+        for name in set(self._configured) - set(configured):
+            current = self.current(name)
+            if current is not None and current.origin == "config":
+                self.remove(name)
+        self._configured = configured
+
+    def put(self, patch: JsPatch) -> PatchVersion:
+        """Create or change a patch."""
+        return self._commit(patch, "api")
+
+    def set_enabled(self, name: str, enabled: bool) -> Optional[PatchVersion]:
+        """Enable or disable a patch; None if there is no such patch."""
+        current = self.current(name)
+        if current is None:
+            return None
+        return self._commit(current.patch.model_copy(update={"enabled": enabled}), "api")
+
+    def set_domain_enabled(self, domain: str, enabled: bool) -> list[PatchVersion]:
+        """Enable or disable every patch of a domain."""
+        domain = normalize_domain(domain)
+        return [
+            self._commit(current.patch.model_copy(update={"enabled": enabled}), "api")
+            for current in self.all()
+            if current.patch.domain == domain
+        ]
+
+    def rollback(self, name: str, version: Optional[int] = None) -> Optional[PatchVersion]:
+        """
+        Restore an earlier version of a patch as a new version.
+
+        Returns:
+            The new current version, or None if the patch or version is unknown
+        """
+        versions = self.versions.get(name) or []
+        if version is None:
+            target = versions[-2] if len(versions) > 1 else None
+        else:
+            target = next((entry for entry in versions if entry.version == version), None)
+        if target is None:
+            return None
+        return self._commit(target.patch, "api")
+
+    def remove(self, name: str) -> bool:
+        """Remove a patch with all its versions."""
+        if self.versions.pop(name, None) is None:
+            return False
+        self.relay.pool.events.publish("patch-updated", name=name, domain=None, version=None, enabled=False)
+        self._schedule_rollout()
+        return True
+
+    @staticmethod
+    def _wants_patches(connection: RelayConnection) -> bool:
+        """Whether a connection's lease takes patches."""
+        return connection.session is None or connection.session.options.patches
+
+    async def _on_context(self, connection: RelayConnection, guid: str) -> None:
+        """Add the current patches to a new context."""
+        if self._wants_patches(connection):
+            async with self._lock:
+                await self._apply(connection, guid)
+
+    async def _apply(self, connection: RelayConnection, guid: str) -> None:
+        """Bring a context's patches up to date with the registry."""
+        applied: dict[str, tuple[int, Optional[str]]] = connection.state.setdefault("patches", {}).setdefault(guid, {})
+        wanted = {entry.patch.name: entry for entry in self.all() if entry.patch.enabled}
+
+        for name, (version, disposable) in list(applied.items()):
+            entry = wanted.get(name)
+            if entry is not None and entry.version == version:
+                continue
+            del applied[name]
+            if disposable is None:
+                continue
+            try:
+                await connection.call(disposable, "dispose")
+            except RelayCallError as e:
+                logger.debug(f"Failed to remove patch {name} v{version} from {guid}: {e}")
+
+        for name, entry in wanted.items():
+            if name in applied:
+                continue
+            try:
+                result = await connection.call(guid, "addInitScript", {"source": entry.script()})
+            except RelayCallError as e:
+                logger.warning(f"Failed to add patch {name} v{entry.version} to {guid}: {e}")
+                continue
+            # Newer Playwright versions return a handle to remove the script with
+            disposable = result.get("disposable")
+            applied[name] = (entry.version, disposable.get("guid") if isinstance(disposable, dict) else None)
+
+    async def _roll_out(self) -> None:
+        """Bring the patches of every open context up to date."""
+        async with self._lock:
+            for connection in list(self.relay.connections):
+                if not self._wants_patches(connection):
+                    continue
+                for guid in list(connection.contexts):
+                    await self._apply(connection, guid)
+
+    def _schedule_rollout(self) -> None:
+        """Roll changes out to open contexts in the background."""
+        try:
+            self._rollout = asyncio.get_running_loop().create_task(self._roll_out())
+        except RuntimeError:
+            # No loop yet: only at start, before any context exists
+            pass
+
+
+def create_patch_routes(registry: PatchRegistry) -> list[Route]:
+    """
+    Create HTTP routes for managing JavaScript patches.
+
+    Args:
+        registry: Patch registry
+
+    Returns:
+        List of Starlette routes
+    """
+
+    def invalid(what: str, e: ValidationError) -> Response:
+        return JSONResponse(
+            {"error": f"Invalid {what}", "details": e.errors(include_url=False, include_context=False)},
+            status_code=400,
+        )
+
+    not_found = {"error": "No patch with this name"}
+
+    async def list_patches(request: Request) -> Response:
+        """
+        List the current version of every patch, without their source.
+
+        GET /patches
+        """
+        patches = [entry.to_dict(source=False) for entry in registry.all()]
+        return JSONResponse({"patches": patches, "count": len(patches)})
+
+    async def get_patch(request: Request) -> Response:
+        """
+        Get a patch with all its kept versions.
+
+        GET /patches/{name}
+        """
+        versions = registry.versions.get(request.path_params["name"])
+        if not versions:
+            return JSONResponse(not_found, status_code=404)
+        return JSONResponse({**versions[-1].to_dict(), "versions": [entry.to_dict() for entry in versions]})
+
+    async def put_patch(request: Request) -> Response:
+        """
+        Create or change a patch.
+
+        PUT /patches/{name}
+        """
+        try:
+            spec = PatchSpec.model_validate_json(await request.body())
+            patch = JsPatch(name=request.path_params["name"], **spec.model_dump())
+        except ValidationError as e:
+            return invalid("patch", e)
+        return JSONResponse(registry.put(patch).to_dict())
+
+    async def toggle_patch(request: Request) -> Response:
+        """
+        Enable or disable a patch.
+
+        PATCH /patches/{name}
+        """
+        try:
+            body = Toggle.model_validate_json(await request.body())
+        except ValidationError as e:
+            return invalid("toggle", e)
+        entry = registry.set_enabled(request.path_params["name"], body.enabled)
+        if entry is None:
+            return JSONResponse(not_found, status_code=404)
+        return JSONResponse(entry.to_dict(source=False))
+
+    async def toggle_domain(request: Request) -> Response:
+        """
+        Enable or disable every patch of a domain.
+
+        PATCH /patches/domains/{domain}
+        """
+        try:
+            body = Toggle.model_validate_json(await request.body())
+            entries = registry.set_domain_enabled(request.path_params["domain"], body.enabled)
+        except ValidationError as e:
+            return invalid("toggle", e)
+        except ValueError as e:
+            return JSONResponse({"error": str(e)}, status_code=400)
+        return JSONResponse({"patches": [entry.to_dict(source=False) for entry in entries], "count": len(entries)})
+
+    async def rollback_patch(request: Request) -> Response:
+        """
+        Restore an earlier version of a patch.
+
+        POST /patches/{name}/rollback
+        """
+        try:
+            body = Rollback.model_validate_json(await request.body() or b"{}")
+        except ValidationError as e:
+            return invalid("rollback", e)
+        entry = registry.rollback(request.path_params["name"], body.version)
+        if entry is None:
+            return JSONResponse({"error": "No such patch or version"}, status_code=404)
+        return JSONResponse(entry.to_dict(source=False))
+
+    async def delete_patch(request: Request) -> Response:
+        """
+        Remove a patch.
+
+        DELETE /patches/{name}
+        """
+        name = request.path_params["name"]
+        if not registry.remove(name):
+            return JSONResponse(not_found, status_code=404)
+        return JSONResponse({"status": "removed", "name": name})
+
+    return [
+        Route("/patches", list_patches, methods=["GET"]),
+        Route("/patches/domains/{domain}", toggle_domain, methods=["PATCH"]),
+        Route("/patches/{name}", get_patch, methods=["GET"]),
+        Route("/patches/{name}", put_patch, methods=["PUT"]),
+        Route("/patches/{name}", toggle_patch, methods=["PATCH"]),
+        Route("/patches/{name}", delete_patch, methods=["DELETE"]),
+        Route("/patches/{name}/rollback", rollback_patch, methods=["POST"]),
+    ]
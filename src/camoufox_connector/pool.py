@@ -9,12 +9,21 @@ from __future__ import annotations
 import asyncio
 import logging
 import re
-import sys
 import time
+from collections import deque
 from dataclasses import dataclass, field
-from typing import Optional
-
-from .config import Settings
+from pathlib import Path
+from typing import Awaitable, Callable, Optional
+
+from .config import Settings, labels_match, version_matches
+from .display import DisplayManager, needs_virtual_display
+from .events import EventBus
+from .extensions import ExtensionStore
+from .launcher import LauncherPool, send_launch_kwargs
+from .procutil import tree_rss
+from .proxies import playwright_proxy, proxy_prefs
+from .resources import compute_capacity, has_memory_for_browser
+from .supervise import stop_process_tree
 
 logger = logging.getLogger(__name__)
 
@@ -32,6 +41,58 @@ class BrowserInstance:
     total_connections: int = 0
     is_healthy: bool = False
     last_health_check: Optional[float] = None
+    launch_duration: Optional[float] = None
+    launch_overrides: dict = field(default_factory=dict)
+    session_id: Optional[str] = None
+    draining: bool = False
+    retiring: bool = False
+    uses_since_launch: int = 0
+    launch_kwargs: dict = field(default_factory=dict)
+    display: Optional[str] = None
+    version: Optional[str] = None
+    recycles: int = 0
+    labels: dict[str, str] = field(default_factory=dict)
+    context_sessions: set[str] = field(default_factory=set)
+    errors: deque = field(default_factory=lambda: deque(maxlen=20))
+    # Resident memory of the browser's process tree in bytes, as last sampled
+    memory: Optional[int] = None
+
+    @property
+    def is_leased(self) -> bool:
+        """Whether a lease holds the whole browser or a context in it."""
+        return self.session_id is not None or bool(self.context_sessions)
+
+    @property
+    def is_idle(self) -> bool:
+        """Whether the instance is up and neither leased nor being taken out of service."""
+        return (
+            self.is_healthy
+            and self.ws_endpoint is not None
+            and not self.is_leased
+            and not self.draining
+            and not self.retiring
+        )
+
+    @property
+    def is_available(self) -> bool:
+        """Whether the instance can be handed out to a new client."""
+        # A browser launched for a lease keeps its proxy, locale and prefs until it is relaunched
+        return self.is_idle and not self.launch_overrides
+
+    def has_context_slot(self, limit: int) -> bool:
+        """Whether another context lease fits next to the ones the browser holds."""
+        return (
+            self.is_healthy
+            and self.ws_endpoint is not None
+            and self.session_id is None
+            and len(self.context_sessions) < limit
+            and not self.draining
+            and not self.retiring
+        )
+
+    def record_error(self, message: str) -> None:
+        """Remember a recent error for this instance."""
+        self.errors.append({"time": time.time(), "message": message})
 
     @property
     def uptime(self) -> float:
@@ -50,6 +111,20 @@ class BrowserInstance:
             "connections": self.connections,
             "total_connections": self.total_connections,
             "is_healthy": self.is_healthy,
+            "launch_duration": (
+                round(self.launch_duration, 2) if self.launch_duration is not None else None
+            ),
+            "leased": self.is_leased,
+            "session_id": self.session_id,
+            "context_sessions": sorted(self.context_sessions),
+            "draining": self.draining,
+            "retiring": self.retiring,
+            "display": self.display,
+            "version": self.version,
+            "recycles": self.recycles,
+            "labels": self.labels,
+            "memory": self.memory,
+            "errors": list(self.errors),
         }
 
 
@@ -64,9 +139,24 @@ class BrowserPool:
 
     settings: Settings
     instances: list[BrowserInstance] = field(default_factory=list)
+    launchers: LauncherPool = field(default_factory=LauncherPool)
+    displays: DisplayManager = field(default_factory=DisplayManager)
+    extensions: ExtensionStore = field(default_factory=ExtensionStore)
+    events: EventBus = field(default_factory=EventBus)
+    # Directory keeping each browser's HTTP cache, by instance index
+    cache_root: Optional[Path] = None
+    # Run before each launch, e.g. to prepare the browser's cache directory
+    launch_hooks: list[Callable[[BrowserInstance], Awaitable[None]]] = field(default_factory=list)
+    # Run once the instance's launcher process exists, before it starts the browser
+    spawn_hooks: list[Callable[[BrowserInstance], Awaitable[None]]] = field(default_factory=list)
+    # Instances added past the configured size to keep warm spares
+    spare_instances: int = 0
     _current_index: int = 0
     _lock: asyncio.Lock = field(default_factory=asyncio.Lock)
     _running: bool = False
+    _monitor_task: Optional[asyncio.Task] = None
+    # Launches that were granted memory their browser doesn't use yet
+    _memory_reserved: int = 0
 
     async def start(self) -> None:
         """Start all browser instances in the pool."""
@@ -75,21 +165,31 @@ class BrowserPool:
             return
 
         self._running = True
-        pool_size = 1 if self.settings.mode.value == "single" else self.settings.pool_size
+        pool_size = self._target_size()
 
         logger.info(f"Starting browser pool with {pool_size} instance(s)")
 
-        # Create and start instances concurrently
-        tasks = []
+        capacity = self.get_capacity()
+        if capacity["max_browsers"] is not None and pool_size > capacity["max_browsers"]:
+            logger.warning(
+                f"Pool size {pool_size} exceeds the estimated capacity of "
+                f"{capacity['max_browsers']} browser(s) for {capacity['cpus']} CPU(s); "
+                "browsers may be starved of CPU or memory"
+            )
+
+        self.launchers.size = self.settings.prewarm_launchers
+
         for i in range(pool_size):
-            instance = BrowserInstance(
+            self.instances.append(BrowserInstance(
                 index=i,
                 port=self.settings.get_ws_port(i),
-            )
-            self.instances.append(instance)
-            tasks.append(self._start_instance(instance))
+                labels=self.settings.labels_for(i),
+            ))
+
+        results = await self._start_instances(self.instances)
 
-        results = await asyncio.gather(*tasks, return_exceptions=True)
+        # Pre-warm launchers after the initial launch so they don't compete with it
+        await self.launchers.start()
 
         # Check for failures
         failed = sum(1 for r in results if isinstance(r, Exception))
@@ -99,34 +199,111 @@ class BrowserPool:
         healthy = sum(1 for inst in self.instances if inst.is_healthy)
         logger.info(f"Browser pool started: {healthy}/{pool_size} healthy instances")
 
+        if self.settings.health_check_interval > 0:
+            self._monitor_task = asyncio.create_task(self._monitor())
+
+    async def _monitor(self) -> None:
+        """Periodically check instances so crashes are noticed without a /health call."""
+        while self._running:
+            await asyncio.sleep(self.settings.health_check_interval)
+            try:
+                await self.health_check()
+            except Exception as e:
+                logger.error(f"Background health check failed: {e}")
+
+    async def _start_instances(self, instances: list[BrowserInstance]) -> list:
+        """
+        Start several instances in parallel, reporting progress as events.
+
+        The first instance is launched on its own so that one-time work
+        (unpacking browser binaries, GeoIP and fingerprint data) happens once
+        rather than in every concurrent launcher. The rest are launched with
+        bounded parallelism, each waiting until the host has memory for it.
+        """
+        if not instances:
+            return []
+
+        total = len(instances)
+        progress = {"ready": 0, "failed": 0}
+        parallelism = self.settings.startup_parallelism or total
+        semaphore = asyncio.Semaphore(parallelism)
+
+        async def launch(instance: BrowserInstance) -> None:
+            async with semaphore:
+                try:
+                    await self._wait_for_resources(instance)
+                    try:
+                        await self._start_instance(instance)
+                    finally:
+                        # Once launched, the browser's memory shows up as used
+                        self._memory_reserved -= 1
+                    progress["ready"] += 1
+                except Exception:
+                    progress["failed"] += 1
+                    raise
+                finally:
+                    self.events.publish(
+                        "pool-startup-progress",
+                        ready=progress["ready"],
+                        failed=progress["failed"],
+                        total=total,
+                    )
+
+        logger.info(f"Launching {total} instance(s) with parallelism {min(parallelism, total)}")
+
+        first = await asyncio.gather(launch(instances[0]), return_exceptions=True)
+        rest = await asyncio.gather(*(launch(inst) for inst in instances[1:]), return_exceptions=True)
+        return first + rest
+
+    async def _wait_for_resources(self, instance: BrowserInstance) -> None:
+        """Wait until the host has enough free memory for another browser, and reserve it."""
+        deadline = time.time() + self.settings.resource_wait_timeout
+        # Parallel launches each reserve their memory, so they don't all count the same free memory
+        while not has_memory_for_browser(self.settings.browser_memory_mb, self._memory_reserved):
+            if time.time() >= deadline:
+                raise RuntimeError(
+                    f"Not enough free memory for browser instance {instance.index} "
+                    f"(needs {self.settings.browser_memory_mb} MB)"
+                )
+            self.events.publish("browser-waiting-for-resources", index=instance.index)
+            await asyncio.sleep(2.0)
+        self._memory_reserved += 1
+
     async def _start_instance(self, instance: BrowserInstance) -> None:
         """Start a single browser instance."""
         try:
             logger.info(f"Starting browser instance {instance.index} on port {instance.port}")
+            self.events.publish("browser-starting", index=instance.index)
 
-            # Create the launcher script content
-            launcher_code = self._generate_launcher_script(instance.port)
-
-            # Start the process
-            if sys.platform == "win32":
-                instance.process = await asyncio.create_subprocess_exec(
-                    sys.executable,
-                    "-c",
-                    launcher_code,
-                    stdout=asyncio.subprocess.PIPE,
-                    stderr=asyncio.subprocess.PIPE,
-                    creationflags=0x08000000,  # CREATE_NO_WINDOW on Windows
-                )
-            else:
-                instance.process = await asyncio.create_subprocess_exec(
-                    sys.executable,
-                    "-c",
-                    launcher_code,
-                    stdout=asyncio.subprocess.PIPE,
-                    stderr=asyncio.subprocess.PIPE,
+            launch_began = time.time()
+
+            if self.settings.headful and needs_virtual_display():
+                instance.display = await self.displays.ensure(
+                    instance.index,
+                    self.settings.display_base,
+                    self.settings.virtual_screen,
                 )
 
+            for hook in self.launch_hooks:
+                try:
+                    await hook(instance)
+                except Exception as e:
+                    logger.warning(f"Launch hook failed for browser instance {instance.index}: {e}")
+
+            # Take a (possibly pre-warmed) launcher and hand it the config
+            instance.process = await self.launchers.take()
+            for hook in self.spawn_hooks:
+                try:
+                    await hook(instance)
+                except Exception as e:
+                    logger.warning(f"Spawn hook failed for browser instance {instance.index}: {e}")
+            instance.launch_kwargs = self._launch_kwargs(instance)
+            build = self.settings.build_for(instance.index)
+            instance.version = build.version if build is not None else None
+            await send_launch_kwargs(instance.process, instance.launch_kwargs)
+
             instance.started_at = time.time()
+            instance.uses_since_launch = 0
 
             # Wait for the WebSocket endpoint to be printed
             ws_endpoint = await self._wait_for_endpoint(instance)
@@ -134,6 +311,13 @@ class BrowserPool:
             if ws_endpoint:
                 instance.ws_endpoint = ws_endpoint
                 instance.is_healthy = True
+                instance.launch_duration = time.time() - launch_began
+                self.events.publish(
+                    "browser-ready",
+                    index=instance.index,
+                    endpoint=ws_endpoint,
+                    launch_duration=round(instance.launch_duration, 2),
+                )
                 logger.info(
                     f"Browser instance {instance.index} ready at {ws_endpoint}"
                 )
@@ -143,73 +327,49 @@ class BrowserPool:
         except Exception as e:
             logger.error(f"Failed to start browser instance {instance.index}: {e}")
             instance.is_healthy = False
+            instance.record_error(f"Failed to start: {e}")
+            self.events.publish("browser-failed", index=instance.index, error=str(e))
             raise
 
-    def _generate_launcher_script(self, port: int) -> str:
-        """Generate Python script to launch Camoufox server."""
-        kwargs = self.settings.to_camoufox_kwargs()
-
-        # Build kwargs string, only including non-None values
-        kwargs_items = []
-        for key, value in kwargs.items():
-            if value is not None:
-                if isinstance(value, bool):
-                    kwargs_items.append(f"    {key}={value},")
-                elif isinstance(value, str):
-                    kwargs_items.append(f"    {key}='{value}',")
-                else:
-                    kwargs_items.append(f"    {key}={value!r},")
-
-        kwargs_str = "\n".join(kwargs_items)
-
-        # Custom launch script that filters None values from config
-        # This works around a bug in camoufox 0.4.11 where proxy=None
-        # gets serialized as null and breaks the Node.js server
-        script = f"""
-import sys
-if sys.platform == 'win32':
-    import codecs
-    sys.stdout = codecs.getwriter('utf-8')(sys.stdout.buffer)
-    sys.stderr = codecs.getwriter('utf-8')(sys.stderr.buffer)
-
-import subprocess
-import base64
-import orjson
-from pathlib import Path
-from playwright._impl._driver import compute_driver_executable
-from camoufox.pkgman import LOCAL_DATA
-from camoufox.utils import launch_options
-from camoufox.server import to_camel_case_dict
-
-# Get config from launch_options
-config = launch_options(
-{kwargs_str}
-)
-
-# Filter out None values (workaround for camoufox bug)
-config = {{k: v for k, v in config.items() if v is not None}}
-
-# Launch the server (same as camoufox.server.launch_server but with filtered config)
-LAUNCH_SCRIPT = LOCAL_DATA / "launchServer.js"
-_nodejs = compute_driver_executable()[0]
-nodejs = _nodejs[0] if isinstance(_nodejs, tuple) else _nodejs
-
-data = orjson.dumps(to_camel_case_dict(config))
-
-process = subprocess.Popen(
-    [nodejs, str(LAUNCH_SCRIPT)],
-    cwd=Path(nodejs).parent / "package",
-    stdin=subprocess.PIPE,
-    text=True,
-)
-if process.stdin:
-    process.stdin.write(base64.b64encode(data).decode())
-    process.stdin.close()
-
-process.wait()
-raise RuntimeError("Server process terminated unexpectedly")
-"""
-        return script.strip()
+    def _launch_kwargs(self, instance: BrowserInstance) -> dict:
+        """Get the Camoufox launch kwargs for an instance."""
+        kwargs = self.settings.to_camoufox_kwargs(instance.index)
+        if instance.recycles:
+            # A recycled instance moves on to the next proxy of the rotation
+            proxy = self.settings.get_proxy(instance.index, instance.recycles)
+            if proxy:
+                kwargs["proxy"] = proxy
+        configured = self.extensions.configured(self.settings.extensions)
+        if configured:
+            kwargs["addons"] = [*kwargs.get("addons", []), *(str(e.path) for e in configured)]
+        for key, value in instance.launch_overrides.items():
+            # Firefox prefs, fingerprint properties and extensions from the settings and the overrides are combined
+            if key in ("firefox_user_prefs", "config") and isinstance(kwargs.get(key), dict):
+                kwargs[key] = {**kwargs[key], **value}
+            elif key == "addons":
+                kwargs[key] = [*kwargs.get(key, []), *value]
+            else:
+                kwargs[key] = value
+        proxy = kwargs.get("proxy")
+        if isinstance(proxy, str):
+            # Playwright takes the server and credentials apart
+            kwargs["proxy"] = playwright_proxy(proxy)
+            prefs = proxy_prefs(proxy, self.settings.proxy_remote_dns)
+            if prefs:
+                kwargs["firefox_user_prefs"] = {**kwargs.get("firefox_user_prefs", {}), **prefs}
+        if self.settings.headful and instance.display:
+            # Not a Camoufox option; the launcher exports it as DISPLAY
+            kwargs["display"] = instance.display
+        if self.cache_root is not None:
+            kwargs["firefox_user_prefs"] = {
+                **kwargs.get("firefox_user_prefs", {}),
+                "browser.cache.disk.parent_directory": str(self.cache_root / str(instance.index)),
+            }
+        return kwargs
+
+    def cache_directory(self, instance: BrowserInstance) -> Optional[Path]:
+        """Get the directory holding a browser's HTTP cache, if the pool manages it."""
+        return self.cache_root / str(instance.index) if self.cache_root is not None else None
 
     async def _wait_for_endpoint(
         self,
@@ -327,8 +487,14 @@ raise RuntimeError("Server process terminated unexpectedly")
         logger.info("Stopping browser pool...")
         self._running = False
 
+        if self._monitor_task is not None:
+            self._monitor_task.cancel()
+            self._monitor_task = None
+
         tasks = [self._stop_instance(inst) for inst in self.instances]
         await asyncio.gather(*tasks, return_exceptions=True)
+        await self.launchers.stop()
+        await self.displays.stop()
 
         self.instances.clear()
         self._current_index = 0
@@ -340,13 +506,8 @@ raise RuntimeError("Server process terminated unexpectedly")
             return
 
         try:
-            instance.process.terminate()
-            try:
-                await asyncio.wait_for(instance.process.wait(), timeout=5.0)
-            except asyncio.TimeoutError:
-                logger.warning(f"Force killing browser instance {instance.index}")
-                instance.process.kill()
-                await instance.process.wait()
+            if not await stop_process_tree(instance.process):
+                logger.warning(f"Force killed browser instance {instance.index}")
         except Exception as e:
             logger.error(f"Error stopping browser instance {instance.index}: {e}")
 
@@ -360,6 +521,24 @@ raise RuntimeError("Server process terminated unexpectedly")
         Returns:
             WebSocket endpoint URL or None if no healthy instances available.
         """
+        instance = await self.get_next_instance()
+        return instance.ws_endpoint if instance else None
+
+    async def get_next_instance(
+        self,
+        version: Optional[str] = None,
+        labels: Optional[dict[str, Optional[str]]] = None,
+    ) -> Optional[BrowserInstance]:
+        """
+        Get the next available browser instance using round-robin.
+
+        Args:
+            version: Only consider instances running this browser version
+            labels: Only consider instances matching these label selectors
+
+        Returns:
+            Browser instance or None if no healthy instances available.
+        """
         async with self._lock:
             if not self.instances:
                 return None
@@ -370,15 +549,133 @@ raise RuntimeError("Server process terminated unexpectedly")
                 instance = self.instances[self._current_index]
                 self._current_index = (self._current_index + 1) % len(self.instances)
 
-                if instance.is_healthy and instance.ws_endpoint:
+                if self._matches(instance, version, labels):
                     instance.connections += 1
                     instance.total_connections += 1
-                    return instance.ws_endpoint
+                    instance.uses_since_launch += 1
+                    return instance
 
                 attempts += 1
 
+            self.events.publish(
+                "pool-exhausted",
+                total_instances=len(self.instances),
+                leased=sum(1 for inst in self.instances if inst.is_leased),
+            )
             return None
 
+    @staticmethod
+    def _matches(
+        instance: BrowserInstance,
+        version: Optional[str],
+        labels: Optional[dict[str, Optional[str]]],
+    ) -> bool:
+        """Check whether an instance is available and of the requested version and labels."""
+        return instance.is_available and BrowserPool._selects(instance, version, labels)
+
+    @staticmethod
+    def _selects(
+        instance: BrowserInstance,
+        version: Optional[str],
+        labels: Optional[dict[str, Optional[str]]],
+    ) -> bool:
+        """Check whether an instance is of the requested version and labels."""
+        return (
+            (version is None or version_matches(instance.version, version))
+            and (not labels or labels_match(instance.labels, labels))
+        )
+
+    def get_available_instances(
+        self,
+        version: Optional[str] = None,
+        labels: Optional[dict[str, Optional[str]]] = None,
+    ) -> list[BrowserInstance]:
+        """Get all instances that can be handed out to a new client, optionally of one browser version and labels."""
+        return [inst for inst in self.instances if self._matches(inst, version, labels)]
+
+    def get_idle_instances(
+        self,
+        version: Optional[str] = None,
+        labels: Optional[dict[str, Optional[str]]] = None,
+    ) -> list[BrowserInstance]:
+        """
+        Get all instances free for a lease, optionally of one browser version and labels.
+
+        Unlike :meth:`get_available_instances`, this includes instances still
+        running the launch overrides of a past lease, which a new lease with
+        the same overrides can take without a relaunch.
+        """
+        return [inst for inst in self.instances if inst.is_idle and self._selects(inst, version, labels)]
+
+    def get_context_instances(
+        self,
+        version: Optional[str] = None,
+        labels: Optional[dict[str, Optional[str]]] = None,
+    ) -> list[BrowserInstance]:
+        """Get all instances with room for another context lease, optionally of one browser version and labels."""
+        limit = self.settings.contexts_per_browser
+        return [
+            inst for inst in self.instances
+            if inst.has_context_slot(limit)
+            and (version is None or version_matches(inst.version, version))
+            and (not labels or labels_match(inst.labels, labels))
+        ]
+
+    def has_version(self, version: str) -> bool:
+        """Check whether any instance runs a browser version."""
+        return any(version_matches(inst.version, version) for inst in self.instances)
+
+    def has_labels(self, labels: dict[str, Optional[str]]) -> bool:
+        """Check whether any instance matches label selectors."""
+        return any(labels_match(inst.labels, labels) for inst in self.instances)
+
+    def get_labels(self) -> dict[str, list[str]]:
+        """List the values of every label in use."""
+        values: dict[str, set[str]] = {}
+        for inst in self.instances:
+            for key, value in inst.labels.items():
+                values.setdefault(key, set()).add(value)
+        return {key: sorted(found) for key, found in sorted(values.items())}
+
+    def set_labels(self, index: int, changes: dict[str, Optional[str]]) -> Optional[dict[str, str]]:
+        """
+        Change a browser instance's labels; a None value removes the label.
+
+        Returns:
+            The instance's labels, or None if the index is invalid.
+        """
+        if index < 0 or index >= len(self.instances):
+            return None
+        labels = self.instances[index].labels
+        for key, value in changes.items():
+            if value is None:
+                labels.pop(key, None)
+            else:
+                labels[key] = value
+        logger.info(f"Browser instance {index} labels: {labels}")
+        return labels
+
+    def get_versions(self) -> dict[str, int]:
+        """Count instances per browser version."""
+        versions: dict[str, int] = {}
+        for inst in self.instances:
+            if inst.version is not None:
+                versions[inst.version] = versions.get(inst.version, 0) + 1
+        return versions
+
+    @property
+    def min_ready(self) -> int:
+        """Browsers that must be up for the pool to be ready, at most the pool's size."""
+        return min(self.settings.min_ready, max(1, len(self.instances)))
+
+    def get_ready_instances(self) -> list[BrowserInstance]:
+        """Get the instances that are up, leased or not."""
+        return [inst for inst in self.instances if inst.is_healthy and inst.ws_endpoint]
+
+    def is_ready(self) -> bool:
+        """Whether enough browsers are up to hand them out."""
+        return len(self.get_ready_instances()) >= self.min_ready
+
     def get_all_endpoints(self) -> list[str]:
         """Get all healthy WebSocket endpoints."""
         return [
@@ -392,6 +689,9 @@ raise RuntimeError("Server process terminated unexpectedly")
         healthy = sum(1 for inst in self.instances if inst.is_healthy)
         total_connections = sum(inst.total_connections for inst in self.instances)
         active_connections = sum(inst.connections for inst in self.instances)
+        launch_durations = [
+            inst.launch_duration for inst in self.instances if inst.launch_duration is not None
+        ]
 
         return {
             "mode": self.settings.mode.value,
@@ -399,17 +699,52 @@ raise RuntimeError("Server process terminated unexpectedly")
             "healthy_instances": healthy,
             "active_connections": active_connections,
             "total_connections": total_connections,
+            "avg_launch_duration": (
+                round(sum(launch_durations) / len(launch_durations), 2)
+                if launch_durations else None
+            ),
+            "prewarmed_launchers": self.launchers.ready,
+            "idle_instances": len(self.get_available_instances()),
+            "spare_instances": self.spare_instances,
+            "versions": self.get_versions(),
+            "capacity": self.get_capacity(),
             "instances": [inst.to_dict() for inst in self.instances],
         }
 
+    async def sample_memory(self) -> None:
+        """Measure the resident memory of every browser, reading the process table once in a thread."""
+        sampled = [(inst, inst.process.pid) for inst in self.instances if inst.process is not None]
+        totals = await asyncio.to_thread(tree_rss, [pid for _, pid in sampled])
+        for inst in self.instances:
+            inst.memory = None
+        for inst, pid in sampled:
+            inst.memory = totals.get(pid)
+
     async def restart_instance(self, index: int) -> bool:
         """Restart a specific browser instance."""
         if index < 0 or index >= len(self.instances):
             return False
 
-        instance = self.instances[index]
+        return await self.relaunch_instance(self.instances[index])
+
+    async def relaunch_instance(
+        self,
+        instance: BrowserInstance,
+        launch_overrides: Optional[dict] = None,
+    ) -> bool:
+        """
+        Relaunch a browser instance, optionally with new launch overrides.
+
+        Args:
+            instance: Instance to relaunch
+            launch_overrides: Camoufox kwargs applied on top of the settings,
+                or None to keep the instance's current overrides
+        """
         await self._stop_instance(instance)
 
+        if launch_overrides is not None:
+            instance.launch_overrides = launch_overrides
+
         # Reset instance state
         instance.ws_endpoint = None
         instance.started_at = None
@@ -418,11 +753,131 @@ raise RuntimeError("Server process terminated unexpectedly")
 
         try:
             await self._start_instance(instance)
+            self.events.publish("browser-restarted", index=instance.index)
             return True
         except Exception as e:
-            logger.error(f"Failed to restart instance {index}: {e}")
+            logger.error(f"Failed to restart instance {instance.index}: {e}")
+            return False
+
+    def get_capacity(self) -> dict:
+        """Estimate how many browsers this host or container can hold."""
+        capacity = compute_capacity(
+            browsers_per_cpu=self.settings.browsers_per_cpu,
+            browser_memory_mb=self.settings.browser_memory_mb,
+            cpu_override=self.settings.cpu_limit,
+        )
+        capacity["current_browsers"] = len(self.instances)
+        if capacity["max_browsers"] is not None:
+            capacity["headroom"] = capacity["max_browsers"] - len(self.instances)
+        else:
+            capacity["headroom"] = None
+        return capacity
+
+    def is_stale(self, instance: BrowserInstance) -> bool:
+        """Whether an instance was launched with options the settings no longer match."""
+        return instance.process is not None and instance.launch_kwargs != self._launch_kwargs(instance)
+
+    def _target_size(self) -> int:
+        """Get the number of instances the current settings ask for."""
+        if self.settings.mode.value == "single":
+            return 1
+        if self.settings.browser_builds:
+            return sum(build.instances for build in self.settings.browser_builds) + self.spare_instances
+        if self.settings.pool_groups:
+            return sum(group.size for group in self.settings.pool_groups) + self.spare_instances
+        return self.settings.pool_size + self.spare_instances
+
+    async def apply_settings(self, settings: Settings) -> None:
+        """
+        Switch to new settings without interrupting leased browsers.
+
+        The pool grows or shrinks to the new size, and instances whose launch
+        options changed are relaunched. Leased instances are left alone until
+        their lease is released; see :meth:`reconcile`.
+        """
+        self.settings = settings
+        self.launchers.size = settings.prewarm_launchers
+
+        # Configured labels win over ones set through the API
+        for instance in self.instances:
+            instance.labels.update(settings.labels_for(instance.index))
+
+        await self._grow()
+        await self.reconcile()
+
+    async def resize_spares(self, count: int) -> None:
+        """Change how many instances are kept past the configured size for warm spares."""
+        self.spare_instances = count
+        await self._grow()
+        await self.reconcile()
+
+    async def _grow(self) -> None:
+        """Add and launch instances up to the target size."""
+        target = self._target_size()
+        added = []
+        for i in range(len(self.instances), target):
+            instance = BrowserInstance(
+                index=i,
+                port=self.settings.get_ws_port(i),
+                labels=self.settings.labels_for(i),
+            )
+            self.instances.append(instance)
+            added.append(instance)
+
+        if added:
+            logger.info(f"Growing pool to {target} instance(s)")
+            await self._start_instances(added)
+
+    async def reconcile(self) -> None:
+        """
+        Bring idle instances in line with the current settings.
+
+        Removes surplus instances from the end of the pool once they are no
+        longer leased, and relaunches idle instances one at a time if their
+        launch options are out of date or were overridden for a lease.
+        """
+        async with self._lock:
+            target = self._target_size()
+            for instance in self.instances:
+                instance.retiring = instance.index >= target
+
+            while len(self.instances) > target and not self.instances[-1].is_leased:
+                instance = self.instances.pop()
+                logger.info(f"Removing browser instance {instance.index}")
+                await self._stop_instance(instance)
+                await self.displays.release(instance.index)
+                self.events.publish("browser-removed", index=instance.index)
+
+            stale = [
+                inst for inst in self.instances
+                if not inst.is_leased and (inst.launch_overrides or self.is_stale(inst))
+            ]
+
+        for instance in stale:
+            # The instance may have been leased while we were relaunching others
+            if instance.is_leased or instance not in self.instances:
+                continue
+            if instance.launch_overrides:
+                logger.info(f"Relaunching browser instance {instance.index} without its last lease's overrides")
+                await self.relaunch_instance(instance, launch_overrides={})
+            else:
+                logger.info(f"Relaunching browser instance {instance.index} with new settings")
+                await self.relaunch_instance(instance)
+
+    def set_draining(self, index: int, draining: bool) -> bool:
+        """
+        Drain or resume a browser instance.
+
+        A draining instance keeps serving its existing clients but is no
+        longer handed out by /next or for new leases.
+        """
+        if index < 0 or index >= len(self.instances):
             return False
 
+        self.instances[index].draining = draining
+        logger.info(f"Browser instance {index} {'draining' if draining else 'resumed'}")
+        return True
+
     async def health_check(self) -> dict:
         """Perform health check on all instances."""
         results = {
@@ -442,6 +897,15 @@ raise RuntimeError("Server process terminated unexpectedly")
             if not is_alive and instance.is_healthy:
                 logger.warning(f"Browser instance {instance.index} died unexpectedly")
                 instance.is_healthy = False
+                instance.record_error("Browser process died unexpectedly")
+                self.events.publish(
+                    "browser-crashed",
+                    index=instance.index,
+                    exit_code=instance.process.returncode if instance.process else None,
+                    session_id=instance.session_id,
+                )
+                if self.settings.auto_restart and self._running:
+                    asyncio.create_task(self.relaunch_instance(instance))
 
             results["instances"].append({
                 "index": instance.index,
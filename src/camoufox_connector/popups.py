@@ -0,0 +1,103 @@
+"""
+Popup handling for Camoufox Connector.
+
+OAuth-style flows and ad popups open new windows that derail unattended
+work. A lease's popup policy decides what happens to them:
+
+- ``allow``: popups open normally (default)
+- ``block``: popups are closed as soon as they open
+- ``follow``: server-side tasks continue in the last popup that opened
+- ``capture``: server-side tasks return each popup as a separate result entry
+
+For relayed clients, ``follow`` and ``capture`` behave like ``allow``; the
+client sees the popups and decides itself.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Literal, Optional
+
+from .relay import RelayCallError
+
+if TYPE_CHECKING:
+    from .relay import Relay, RelayConnection
+
+logger = logging.getLogger(__name__)
+
+PopupPolicy = Literal["allow", "block", "follow", "capture"]
+
+
+def popup_policy_for(connection: RelayConnection) -> PopupPolicy:
+    """Get the popup policy applying to a relayed connection."""
+    settings = connection.relay.pool.settings
+    if connection.session is not None and connection.session.options.popups is not None:
+        return connection.session.options.popups
+    return settings.popup_policy
+
+
+@dataclass
+class PopupBlocker:
+    """Closes popups opened on relayed connections whose policy blocks them."""
+
+    relay: Relay
+    _tasks: set[asyncio.Task] = field(default_factory=set)
+
+    def __post_init__(self) -> None:
+        self.relay.event_filters.append(self._on_event)
+
+    def _on_event(self, connection: RelayConnection, message: dict) -> bool:
+        """Close a new page if it is a popup and popups are blocked."""
+        if message.get("method") != "page" or message.get("guid") not in connection.contexts:
+            return False
+        if popup_policy_for(connection) != "block":
+            return False
+
+        guid = ((message.get("params") or {}).get("page") or {}).get("guid")
+        page = connection.initializer(guid) or {}
+        if page.get("opener"):
+            logger.debug(f"Closing popup {guid}")
+            task = asyncio.create_task(self._close(connection, guid))
+            self._tasks.add(task)
+            task.add_done_callback(self._tasks.discard)
+        # The client still learns about the page, and then about its closing
+        return False
+
+    @staticmethod
+    async def _close(connection: RelayConnection, guid: str) -> None:
+        """Close a popup page."""
+        try:
+            await connection.call(guid, "close", {"runBeforeUnload": False})
+        except RelayCallError as e:
+            logger.debug(f"Failed to close popup {guid}: {e}")
+
+
+async def wait_loaded(page, wait_until: str, timeout: float) -> None:
+    """Wait for a popup page to reach the task's load state."""
+    state = wait_until if wait_until in ("load", "domcontentloaded", "networkidle") else "load"
+    await page.wait_for_load_state(state, timeout=timeout * 1000)
+
+
+async def collect_popups(popups: list, wait_until: str, timeout: float) -> list[dict]:
+    """Wait for captured popup pages to load and describe them."""
+    entries = []
+    for popup in popups:
+        entry: dict = {"url": None, "title": None, "html": None, "error": None}
+        try:
+            await wait_loaded(popup, wait_until, timeout)
+            entry["url"] = popup.url
+            entry["title"] = await popup.title()
+            entry["html"] = await popup.content()
+        except Exception as e:
+            entry["url"] = getattr(popup, "url", None)
+            entry["error"] = str(e)
+        entries.append(entry)
+    return entries
+
+
+def pick_followed(popups: list) -> Optional[object]:
+    """Get the popup a ``follow`` policy continues in."""
+    open_popups = [p for p in popups if not p.is_closed()]
+    return open_popups[-1] if open_popups else None
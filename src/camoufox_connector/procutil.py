@@ -0,0 +1,170 @@
+"""
+Process inspection helpers for Camoufox Connector.
+
+Each browser runs as a tree of processes (Python launcher, Node.js browser
+server, Firefox and its content processes), so resource usage has to be
+summed over the whole tree. Linux's /proc is read directly; macOS and the
+BSDs have no /proc, so ``ps`` is asked instead. On Windows, process trees
+are not inspected and the helpers return None; browsers are held together by
+job objects there (see supervise).
+"""
+
+from __future__ import annotations
+
+import os
+import subprocess
+import sys
+from pathlib import Path
+from typing import Optional
+
+PROC = Path("/proc")
+
+# Windows process access right needed to read a process's exit code
+PROCESS_QUERY_LIMITED_INFORMATION = 0x1000
+STILL_ACTIVE = 259
+
+
+def _ps_table() -> dict[int, tuple[int, int]]:
+    """Parent PID and resident memory in bytes of each process, from ps; empty if ps is missing."""
+    try:
+        output = subprocess.run(
+            ["ps", "-A", "-o", "pid=", "-o", "ppid=", "-o", "rss="],
+            capture_output=True, text=True, timeout=10, check=True,
+        ).stdout
+    except (OSError, subprocess.SubprocessError):
+        return {}
+
+    table = {}
+    for line in output.splitlines():
+        fields = line.split()
+        if len(fields) == 3 and all(f.isdigit() for f in fields):
+            # ps reports kilobytes
+            table[int(fields[0])] = (int(fields[1]), int(fields[2]) * 1024)
+    return table
+
+
+def _parent_map(ps_table: Optional[dict[int, tuple[int, int]]] = None) -> dict[int, list[int]]:
+    """Map each PID to its direct children, from /proc or else a ps table."""
+    children: dict[int, list[int]] = {}
+    if not PROC.is_dir():
+        for pid, (ppid, _) in (ps_table if ps_table is not None else _ps_table()).items():
+            children.setdefault(ppid, []).append(pid)
+        return children
+    for entry in PROC.iterdir():
+        if not entry.name.isdigit():
+            continue
+        try:
+            stat = (entry / "stat").read_text()
+        except OSError:
+            continue
+        # The command name may contain spaces, so split after its closing paren
+        fields = stat[stat.rfind(")") + 2:].split()
+        if len(fields) < 2:
+            continue
+        children.setdefault(int(fields[1]), []).append(int(entry.name))
+    return children
+
+
+def process_tree(pid: int) -> list[int]:
+    """Get a PID and all of its descendants."""
+    if sys.platform == "win32":
+        return [pid]
+
+    return _walk(pid, _parent_map())
+
+
+def _walk(pid: int, children: dict[int, list[int]]) -> list[int]:
+    """Collect a PID and its descendants from a parent map."""
+    tree = []
+    stack = [pid]
+    while stack:
+        current = stack.pop()
+        tree.append(current)
+        stack.extend(children.get(current, []))
+    return tree
+
+
+def _rss_bytes(pid: int) -> int:
+    """Get the resident set size of a single process."""
+    try:
+        with open(PROC / str(pid) / "statm") as f:
+            resident_pages = int(f.read().split()[1])
+    except (OSError, IndexError, ValueError):
+        return 0
+    return resident_pages * os.sysconf("SC_PAGE_SIZE")
+
+
+def tree_rss(pids: list[int]) -> dict[int, Optional[int]]:
+    """
+    Get the combined resident memory of several process trees in bytes.
+
+    The process table is read once for all of them. This is blocking, so
+    callers on the event loop run it in a thread.
+
+    Returns:
+        Total RSS in bytes of each PID's tree, or None where it cannot be
+        determined on this platform.
+    """
+    if sys.platform == "win32":
+        return {pid: None for pid in pids}
+    ps_table = None if PROC.is_dir() else _ps_table()
+    children = _parent_map(ps_table)
+    totals: dict[int, Optional[int]] = {}
+    for pid in pids:
+        if ps_table is None:
+            totals[pid] = sum(_rss_bytes(p) for p in _walk(pid, children))
+        elif pid in ps_table:
+            totals[pid] = sum(ps_table[p][1] for p in _walk(pid, children) if p in ps_table)
+        else:
+            totals[pid] = None
+    return totals
+
+
+def process_alive(pid: int) -> bool:
+    """Whether a process with a PID exists."""
+    if sys.platform == "win32":
+        # os.kill would terminate the process on Windows
+        import ctypes
+
+        kernel32 = ctypes.windll.kernel32
+        handle = kernel32.OpenProcess(PROCESS_QUERY_LIMITED_INFORMATION, False, pid)
+        if not handle:
+            return False
+        try:
+            code = ctypes.c_ulong()
+            if not kernel32.GetExitCodeProcess(handle, ctypes.byref(code)):
+                return True
+            return code.value == STILL_ACTIVE
+        finally:
+            kernel32.CloseHandle(handle)
+
+    try:
+        os.kill(pid, 0)
+    except ProcessLookupError:
+        return False
+    except PermissionError:
+        return True
+    try:
+        stat = (PROC / str(pid) / "stat").read_text()
+    except OSError:
+        return True
+    # Zombies have exited and only wait to be reaped
+    return stat[stat.rfind(")") + 2:][:1] != "Z"
+
+
+def command_lines() -> list[list[str]]:
+    """Get the arguments of every running process; empty if /proc is missing."""
+    if not PROC.is_dir():
+        return []
+
+    lines = []
+    for entry in PROC.iterdir():
+        if not entry.name.isdigit():
+            continue
+        try:
+            raw = (entry / "cmdline").read_bytes()
+        except OSError:
+            continue
+        if raw:
+            lines.append(raw.rstrip(b"\0").decode(errors="replace").split("\0"))
+    return lines
@@ -0,0 +1,110 @@
+"""
+Reverse proxy support for Camoufox Connector.
+
+Behind nginx or Traefik the connector is often reached under a subpath
+(``https://tools.example.com/camoufox/...``) and over TLS the proxy
+terminates. With ``base_path`` set, requests are served with or without
+that prefix, so proxies that strip it and ones that pass it on both work.
+Requests from ``trusted_proxies`` have their ``X-Forwarded-Proto``,
+``X-Forwarded-Host``, ``X-Forwarded-Port``, ``X-Forwarded-Prefix`` and
+``X-Forwarded-For`` headers applied, so the URLs the connector returns
+(session and browser endpoints, artifact links, the dashboard's API calls)
+point at the proxy, and IP allowlists see the real client's address.
+Forwarded headers from anyone else are ignored.
+"""
+
+from __future__ import annotations
+
+from typing import TYPE_CHECKING, Optional
+
+from starlette.requests import HTTPConnection
+
+from .netpolicy import address_allowed
+
+if TYPE_CHECKING:
+    from .pool import BrowserPool
+
+DEFAULT_PORTS = {"http": 80, "https": 443}
+
+
+def base_path(request: HTTPConnection) -> str:
+    """Path prefix the client reaches the connector under, without a trailing slash."""
+    return request.scope.get("state", {}).get("base_path", "")
+
+
+def public_url(request: HTTPConnection, path: str) -> str:
+    """Build a URL on this server, as the client reaches it, for the given path."""
+    return f"{request.url.scheme}://{request.url.netloc}{base_path(request)}{path}"
+
+
+def _header(headers: list, name: bytes) -> Optional[str]:
+    """Last value of a request header; proxies append to what clients sent."""
+    value = None
+    for key, raw in headers:
+        if key.lower() == name:
+            value = raw.decode("latin-1")
+    return value
+
+
+def _first(value: Optional[str]) -> Optional[str]:
+    """First entry of a comma-separated header value, as set by the outermost proxy."""
+    if value is None:
+        return None
+    entry = value.split(",")[0].strip()
+    return entry or None
+
+
+class ProxyHeadersMiddleware:
+    """ASGI middleware applying the base path and trusted proxies' forwarded headers."""
+
+    def __init__(self, app, pool: BrowserPool):
+        self.app = app
+        self.pool = pool
+
+    def _forward(self, scope: dict, trusted: list[str]) -> Optional[str]:
+        """Apply forwarded headers to the scope; returns the forwarded prefix, if any."""
+        headers = scope.get("headers") or []
+        proto = _first(_header(headers, b"x-forwarded-proto"))
+        if proto in ("http", "https"):
+            scope["scheme"] = proto if scope["type"] == "http" else {"http": "ws", "https": "wss"}[proto]
+
+        host = _first(_header(headers, b"x-forwarded-host"))
+        port = _first(_header(headers, b"x-forwarded-port"))
+        if host is not None:
+            if port and port.isdigit() and not host.endswith("]") and ":" not in host:
+                if int(port) != DEFAULT_PORTS.get(proto or "http"):
+                    host = f"{host}:{port}"
+            scope["headers"] = [(k, v) for k, v in headers if k.lower() != b"host"] + [(b"host", host.encode("latin-1"))]
+
+        forwarded_for = _header(headers, b"x-forwarded-for")
+        if forwarded_for and scope.get("client"):
+            # The client is the last address not added by one of our proxies
+            for address in reversed([a.strip() for a in forwarded_for.split(",") if a.strip()]):
+                if not address_allowed(address, trusted):
+                    scope["client"] = (address, 0)
+                    break
+
+        prefix = _first(_header(headers, b"x-forwarded-prefix"))
+        return prefix.rstrip("/") if prefix else None
+
+    async def __call__(self, scope, receive, send) -> None:
+        if scope["type"] not in ("http", "websocket"):
+            await self.app(scope, receive, send)
+            return
+
+        settings = self.pool.settings
+        prefix = settings.base_path or ""
+        path = scope["path"]
+        if prefix and (path == prefix or path.startswith(prefix + "/")):
+            scope["path"] = path[len(prefix):] or "/"
+            if scope.get("raw_path"):
+                scope["raw_path"] = scope["raw_path"][len(prefix.encode()):] or b"/"
+
+        client = scope.get("client")
+        if settings.trusted_proxies and client and address_allowed(client[0], settings.trusted_proxies):
+            forwarded = self._forward(scope, settings.trusted_proxies)
+            if forwarded is not None:
+                prefix = forwarded
+
+        scope.setdefault("state", {})["base_path"] = prefix
+        await self.app(scope, receive, send)
@@ -0,0 +1,232 @@
+"""
+Per-domain rate limiting for Camoufox Connector.
+
+Spreads work on the same site across time instead of hitting it from every
+pool browser at once. Limits are configured per domain pattern with a
+maximum of concurrent tasks and of navigations per minute; excess work is
+queued until it fits, or rejected, depending on the configured mode.
+
+Server-side tasks are subject to both limits. Navigations (``page.goto``)
+of relayed clients, which include the connector's own tasks, count towards
+and wait for the per-minute limit.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import fnmatch
+import logging
+import time
+from collections import deque
+from contextlib import asynccontextmanager
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, AsyncIterator, Optional
+from urllib.parse import urlsplit
+
+from pydantic import BaseModel, ConfigDict, Field
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .relay import RelayCallRejected
+
+if TYPE_CHECKING:
+    from .pool import BrowserPool
+    from .relay import Relay, RelayConnection
+
+logger = logging.getLogger(__name__)
+
+WINDOW = 60.0
+
+
+class DomainLimit(BaseModel):
+    """Rate limits for the domains matching a pattern."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    domain: str = Field(description="Domain glob pattern, e.g. example.com or *.example.com")
+
+    concurrency: Optional[int] = Field(
+        default=None,
+        ge=1,
+        description="Maximum concurrent tasks per matching domain",
+    )
+
+    requests_per_minute: Optional[int] = Field(
+        default=None,
+        ge=1,
+        description="Maximum navigations per minute per matching domain",
+    )
+
+    def matches(self, host: str) -> bool:
+        """Check whether the limit applies to a host."""
+        return fnmatch.fnmatchcase(host, self.domain)
+
+
+class RateLimited(Exception):
+    """Raised when work for a domain is over its limits."""
+
+    def __init__(self, host: str, retry_after: float):
+        super().__init__(f"Rate limit for {host} exceeded, retry in {retry_after:.0f}s")
+        self.host = host
+        self.retry_after = retry_after
+
+
+@dataclass
+class _DomainState:
+    """Usage of one domain."""
+
+    active: int = 0
+    starts: deque = field(default_factory=deque)
+
+
+@dataclass
+class DomainRateLimiter:
+    """Enforces the configured per-domain limits across the whole pool."""
+
+    pool: BrowserPool
+    _domains: dict[str, _DomainState] = field(default_factory=dict)
+    _changed: asyncio.Condition = field(default_factory=asyncio.Condition)
+
+    def limit_for(self, host: str) -> Optional[DomainLimit]:
+        """Get the first configured limit matching a host."""
+        for limit in self.pool.settings.domain_limits:
+            if limit.matches(host):
+                return limit
+        return None
+
+    def _wait_time(self, host: str, limit: DomainLimit, concurrent: bool) -> float:
+        """Seconds until work for a host fits its limits, 0 if it fits now."""
+        state = self._domains.setdefault(host, _DomainState())
+        now = time.time()
+        while state.starts and state.starts[0] <= now - WINDOW:
+            state.starts.popleft()
+
+        wait = 0.0
+        if limit.requests_per_minute is not None and len(state.starts) >= limit.requests_per_minute:
+            wait = state.starts[0] + WINDOW - now
+        if concurrent and limit.concurrency is not None and state.active >= limit.concurrency:
+            # No telling when a slot frees up; poll again shortly
+            wait = max(wait, 1.0)
+        return wait
+
+    async def _admit(self, url: str, concurrent: bool) -> Optional[str]:
+        """Wait until work for a URL may start; returns the limited host, if any."""
+        host = urlsplit(url).hostname or ""
+        limit = self.limit_for(host)
+        if limit is None:
+            return None
+
+        settings = self.pool.settings
+        deadline = time.time() + settings.rate_limit_max_wait
+        async with self._changed:
+            while True:
+                wait = self._wait_time(host, limit, concurrent)
+                if wait <= 0:
+                    break
+                if settings.rate_limit_mode == "reject" or time.time() + wait > deadline:
+                    self.pool.events.publish("rate-limited", domain=host, retry_after=round(wait, 1))
+                    raise RateLimited(host, wait)
+                try:
+                    await asyncio.wait_for(self._changed.wait(), timeout=wait)
+                except asyncio.TimeoutError:
+                    pass
+
+            state = self._domains[host]
+            if concurrent:
+                state.active += 1
+            else:
+                state.starts.append(time.time())
+        return host
+
+    @asynccontextmanager
+    async def slot(self, url: str) -> AsyncIterator[None]:
+        """
+        Hold a concurrency slot for work on a URL's domain.
+
+        Also waits for the per-minute limit to have room, but leaves counting
+        to the navigation itself, which passes through the relay.
+
+        Raises:
+            RateLimited: If the work is rejected or would wait too long.
+        """
+        host = await self._admit(url, concurrent=True)
+        try:
+            yield
+        finally:
+            if host is not None:
+                async with self._changed:
+                    self._domains[host].active -= 1
+                    self._changed.notify_all()
+
+    async def navigation(self, url: str) -> None:
+        """
+        Count a navigation towards its domain's per-minute limit.
+
+        Raises:
+            RateLimited: If the navigation is rejected or would wait too long.
+        """
+        await self._admit(url, concurrent=False)
+
+    def stats(self) -> dict:
+        """Current usage of every limited domain."""
+        now = time.time()
+        return {
+            host: {
+                "active": state.active,
+                "last_minute": sum(1 for t in state.starts if t > now - WINDOW),
+            }
+            for host, state in sorted(self._domains.items())
+        }
+
+
+@dataclass
+class NavigationThrottle:
+    """Applies per-minute domain limits to relayed clients' navigations."""
+
+    relay: Relay
+    limiter: DomainRateLimiter
+
+    def __post_init__(self) -> None:
+        self.relay.call_hooks.append(self._on_call)
+
+    async def _on_call(self, connection: RelayConnection, message: dict) -> None:
+        """Hold back a ``goto`` until its domain's rate allows it."""
+        if message.get("method") != "goto":
+            return
+        url = (message.get("params") or {}).get("url")
+        if not url:
+            return
+        try:
+            await self.limiter.navigation(url)
+        except RateLimited as e:
+            raise RelayCallRejected(str(e)) from e
+
+
+def create_ratelimit_routes(limiter: DomainRateLimiter) -> list[Route]:
+    """
+    Create the route reporting per-domain rate limit usage.
+
+    Args:
+        limiter: Rate limiter to report on
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_ratelimits(request: Request) -> Response:
+        """
+        Get the configured domain limits and their current usage.
+
+        GET /ratelimits
+        """
+        settings = limiter.pool.settings
+        return JSONResponse({
+            "mode": settings.rate_limit_mode,
+            "limits": [limit.model_dump() for limit in settings.domain_limits],
+            "domains": limiter.stats(),
+        })
+
+    return [
+        Route("/ratelimits", get_ratelimits, methods=["GET"]),
+    ]
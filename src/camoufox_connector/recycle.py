@@ -0,0 +1,174 @@
+"""
+Recycling of poisoned browsers for Camoufox Connector.
+
+A browser whose fingerprint or proxy has been flagged by a site keeps
+getting challenge pages there while the rest of the pool gets through. The
+detector follows the fetch task results per domain and browser: a result
+is bad when it is classified as blocked, or when the browser gets the same
+page (by hash of its normalized HTML) for different URLs, a page no other
+browser was served. Once a browser's last ``poison_threshold`` results on a
+domain are all bad while another browser succeeded there recently, it is
+relaunched with a fresh fingerprint and the next proxy of the rotation, and
+a ``browser-recycled`` event says why.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import hashlib
+import logging
+import re
+import time
+from collections import deque
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Optional
+from urllib.parse import urlsplit
+
+from .blocks import classify
+
+if TYPE_CHECKING:
+    from .pool import BrowserInstance, BrowserPool
+    from .tasks import FetchResult, FetchTask, TaskRunner
+
+logger = logging.getLogger(__name__)
+
+# Results remembered per domain and browser
+HISTORY_SIZE = 20
+
+# Request IDs, nonces and timestamps differ between otherwise identical block pages
+VOLATILE = re.compile(r"[0-9a-f]{8,}|\d+")
+WHITESPACE = re.compile(r"\s+")
+
+
+def content_hash(html: str) -> str:
+    """Hash a page's HTML with its volatile parts removed."""
+    normalized = WHITESPACE.sub(" ", VOLATILE.sub("", html.lower())).strip()
+    return hashlib.sha256(normalized.encode()).hexdigest()[:16]
+
+
+@dataclass(frozen=True)
+class Observation:
+    """One task result of a browser on a domain."""
+
+    time: float
+    url: str
+    hash: Optional[str]
+    blocked: bool
+    success: bool
+
+
+@dataclass
+class PoisonDetector:
+    """Recycles browsers that keep getting blocked where others succeed."""
+
+    runner: TaskRunner
+    history: dict[str, dict[int, deque[Observation]]] = field(default_factory=dict)
+    _recycling: set[asyncio.Task] = field(default_factory=set)
+
+    def __post_init__(self) -> None:
+        self.runner.completion_hooks.append(self._on_result)
+
+    @property
+    def pool(self) -> BrowserPool:
+        """Browser pool the tasks run on."""
+        return self.runner.sessions.pool
+
+    def _on_result(self, task: FetchTask, result: FetchResult) -> None:
+        """Record a task result and recycle its browser if it is poisoned."""
+        threshold = self.pool.settings.poison_threshold
+        if threshold is None or result.instance is None:
+            return
+        group = self.pool.settings.group_for(result.instance)
+        if group is not None and not group.recycle_poisoned:
+            return
+
+        domain = urlsplit(task.url).hostname or ""
+        outcome = classify(result, self.pool.settings.block_markers)
+        if outcome == "error" and result.status is None:
+            # Timeouts and network errors say nothing about the browser's identity
+            return
+
+        observation = Observation(
+            time=time.time(),
+            url=task.url,
+            hash=content_hash(result.html) if result.html else None,
+            blocked=outcome == "blocked",
+            success=outcome == "success",
+        )
+        browsers = self.history.setdefault(domain, {})
+        browsers.setdefault(result.instance, deque(maxlen=HISTORY_SIZE)).append(observation)
+
+        reason = self.poisoned(domain, result.instance, threshold)
+        if reason is not None:
+            instance = self._instance(result.instance)
+            if instance is not None and instance.is_available:
+                self.schedule_recycle(instance, domain, reason)
+
+    def schedule_recycle(self, instance: BrowserInstance, domain: Optional[str], reason: str) -> None:
+        """Recycle a browser in the background."""
+        job = asyncio.create_task(self.recycle(instance, domain, reason))
+        self._recycling.add(job)
+        job.add_done_callback(self._recycling.discard)
+
+    def _instance(self, index: int) -> Optional[BrowserInstance]:
+        """Get a pool instance by index."""
+        for instance in self.pool.instances:
+            if instance.index == index:
+                return instance
+        return None
+
+    def poisoned(self, domain: str, index: int, threshold: int) -> Optional[str]:
+        """Explain why a browser looks poisoned on a domain, or None if it doesn't."""
+        window = self.pool.settings.poison_window
+        cutoff = time.time() - window
+        browsers = self.history.get(domain, {})
+        recent = [o for o in browsers.get(index, ()) if o.time >= cutoff][-threshold:]
+        if len(recent) < threshold:
+            return None
+
+        others = [o for i, obs in browsers.items() if i != index for o in obs if o.time >= cutoff]
+        other_successes = [o for o in others if o.success]
+        if not other_successes:
+            # Everyone is blocked: the site, not this browser's identity
+            return None
+        others_hashes = {o.hash for o in other_successes}
+
+        if all(o.blocked for o in recent):
+            return f"last {threshold} results on {domain} were block pages while other browsers succeeded"
+
+        hashes = {o.hash for o in recent}
+        if (
+            len(hashes) == 1
+            and None not in hashes
+            and len({o.url for o in recent}) > 1
+            and not hashes & others_hashes
+        ):
+            return (
+                f"served the same page ({recent[0].hash}) for {len({o.url for o in recent})} different URLs "
+                f"on {domain} that no other browser got"
+            )
+        return None
+
+    async def recycle(self, instance: BrowserInstance, domain: Optional[str], reason: str) -> None:
+        """Relaunch a poisoned or worn-out browser with a new identity."""
+        # Nobody may lease the instance while it is being relaunched
+        instance.is_healthy = False
+        instance.recycles += 1
+        for browsers in self.history.values():
+            browsers.pop(instance.index, None)
+
+        logger.warning(f"Recycling browser instance {instance.index}: {reason}")
+        self.pool.events.publish(
+            "browser-recycled",
+            index=instance.index,
+            domain=domain,
+            reason=reason,
+            recycles=instance.recycles,
+        )
+        # Dropping the overrides also drops a proxy pinned by an earlier lease
+        await self.pool.relaunch_instance(instance, {})
+
+    async def close(self) -> None:
+        """Wait for recycling in progress."""
+        if self._recycling:
+            await asyncio.gather(*self._recycling, return_exceptions=True)
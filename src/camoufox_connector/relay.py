@@ -0,0 +1,598 @@
+"""
+WebSocket relay between Playwright clients and pool browsers.
+
+Clients that connect through the relay instead of a browser's own endpoint
+let the connector observe and take part in the Playwright protocol: it tracks
+the browser contexts a client creates, can merge connector-side options into
+``newContext`` calls and can issue its own protocol calls on those contexts.
+
+A session's relayed connection outlives a dropped client for
+``reconnect_grace`` seconds: the browser connection, and with it the open
+pages, is kept while browser messages are buffered, and a client presenting
+the session's reconnect token picks up the same protocol stream where it
+left off. Clients that close the connection themselves end it right away.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import hmac
+import itertools
+import json
+import logging
+from collections import OrderedDict
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Any, Awaitable, Callable, Optional
+
+from starlette.requests import HTTPConnection
+from starlette.routing import WebSocketRoute
+from starlette.websockets import WebSocket, WebSocketDisconnect
+
+from .proxyheaders import base_path
+
+if TYPE_CHECKING:
+    from .config import Settings
+    from .pool import BrowserInstance, BrowserPool
+    from .sessions import Session, SessionManager
+
+logger = logging.getLogger(__name__)
+
+# Calls issued by the relay itself use IDs far above anything a client
+# reaches, so their responses can be told apart and swallowed.
+RELAY_CALL_ID_START = 1_000_000_000
+
+NEW_CONTEXT_METHODS = ("newContext", "newContextForReuse")
+
+# Protocol objects whose initializers are remembered for relay features,
+# capped so long-lived connections don't grow without bound
+TRACKED_OBJECT_TYPES = ("Request", "Route", "Response", "Page", "Frame")
+MAX_TRACKED_OBJECTS = 10_000
+
+ContextParamsProvider = Callable[["RelayConnection"], dict]
+ContextHook = Callable[["RelayConnection", str], Awaitable[None]]
+EventFilter = Callable[["RelayConnection", dict], bool]
+CallRewriter = Callable[["RelayConnection", dict], bool]
+CallHook = Callable[["RelayConnection", dict], Awaitable[None]]
+DisconnectHook = Callable[["RelayConnection"], Awaitable[None]]
+
+# How long disconnect hooks may keep the browser connection open
+DISCONNECT_HOOK_TIMEOUT = 30.0
+
+# Close codes of clients that left on purpose; others may reconnect
+CLEAN_CLOSE_CODES = (1000, 1001)
+
+# Browser messages buffered for a client to reconnect, past which it can't
+MAX_RESUME_BUFFER = 16 * 1024 * 1024
+
+# WebSocket close codes for reconnects that can't be served
+WS_BAD_TOKEN = 4403
+WS_NOTHING_TO_RESUME = 4409
+
+
+def websocket_url(request: HTTPConnection, path: str) -> str:
+    """Build a WebSocket URL on this server, as the client reaches it, for the given path."""
+    scheme = "wss" if request.url.scheme in ("https", "wss") else "ws"
+    return f"{scheme}://{request.url.netloc}{base_path(request)}{path}"
+
+
+def local_websocket_url(settings: Settings, path: str) -> str:
+    """Build a WebSocket URL for reaching this server from the connector itself."""
+    host = settings.api_host
+    if host in ("", "0.0.0.0"):
+        host = "127.0.0.1"
+    elif host == "::":
+        host = "::1"
+    if ":" in host:
+        host = f"[{host}]"
+    return f"ws://{host}:{settings.api_port}{path}"
+
+
+def merge_context_params(client_params: dict, relay_params: dict) -> dict:
+    """
+    Merge connector-side options into a client's ``newContext`` params.
+
+    Connector options win, except for storage state, whose cookies and
+    origins are combined with the client's, and permissions and extra HTTP
+    headers, which are added to the client's.
+    """
+    merged = dict(client_params)
+    for key, value in relay_params.items():
+        if key == "storageState" and isinstance(merged.get(key), dict):
+            state = dict(merged[key])
+            state["cookies"] = list(state.get("cookies") or []) + list(value.get("cookies") or [])
+            state["origins"] = list(state.get("origins") or []) + list(value.get("origins") or [])
+            merged[key] = state
+        elif key == "permissions" and isinstance(merged.get(key), list):
+            merged[key] = [*merged[key], *(p for p in value if p not in merged[key])]
+        elif key == "extraHTTPHeaders" and isinstance(merged.get(key), list):
+            names = {header["name"].lower() for header in value}
+            merged[key] = [h for h in merged[key] if h.get("name", "").lower() not in names] + list(value)
+        else:
+            merged[key] = value
+    return merged
+
+
+class RelayCallError(RuntimeError):
+    """Raised when a protocol call issued by the relay fails."""
+
+
+class RelayCallRejected(Exception):
+    """Raised by a call hook to answer a client call with an error instead of forwarding it."""
+
+
+@dataclass
+class RelayConnection:
+    """
+    A single relayed client connection to a browser instance.
+
+    Relay features keep per-connection data in ``state``, keyed by feature,
+    so it goes away with the connection.
+    """
+
+    relay: Relay
+    instance: BrowserInstance
+    session: Optional[Session] = None
+    contexts: set[str] = field(default_factory=set)
+    objects: OrderedDict = field(default_factory=OrderedDict)
+    state: dict = field(default_factory=dict)
+    closed: asyncio.Event = field(default_factory=asyncio.Event)
+    bytes_from_client: int = 0
+    bytes_from_browser: int = 0
+    _upstream: Any = None
+    _client: Optional[WebSocket] = None
+    _client_send_lock: asyncio.Lock = field(default_factory=asyncio.Lock)
+    # While the client is gone: browser messages kept for it, and the reconnect awaited
+    _buffer: Optional[list[str]] = None
+    _buffered: int = 0
+    _resume: Optional[asyncio.Future] = None
+    # Set when the current client's turn on the connection is over
+    _detached: Optional[asyncio.Event] = None
+    _closing: bool = False
+    _pending_new_context: set[int] = field(default_factory=set)
+    _calls: dict[int, asyncio.Future] = field(default_factory=dict)
+    _call_ids: Any = field(default_factory=lambda: itertools.count(RELAY_CALL_ID_START))
+
+    async def call(self, guid: str, method: str, params: Optional[dict] = None, timeout: float = 30.0) -> dict:
+        """
+        Issue a protocol call on an object of this connection.
+
+        Returns:
+            The call's result payload.
+
+        Raises:
+            RelayCallError: If the browser rejects the call or it times out.
+        """
+        if self._upstream is None:
+            raise RelayCallError("Relay connection is not open")
+
+        call_id = next(self._call_ids)
+        future = asyncio.get_running_loop().create_future()
+        self._calls[call_id] = future
+
+        message = {
+            "id": call_id,
+            "guid": guid,
+            "method": method,
+            "params": params or {},
+            "metadata": {},
+        }
+        try:
+            await self._upstream.send(json.dumps(message))
+            return await asyncio.wait_for(future, timeout=timeout)
+        except asyncio.TimeoutError as e:
+            raise RelayCallError(f"{method} timed out") from e
+        finally:
+            self._calls.pop(call_id, None)
+
+    def initializer(self, guid: Optional[str]) -> Optional[dict]:
+        """Get the initializer of a tracked protocol object."""
+        entry = self.objects.get(guid) if guid else None
+        return entry["initializer"] if entry else None
+
+    def _track_object(self, params: dict) -> None:
+        """Remember a newly created protocol object."""
+        if params.get("type") not in TRACKED_OBJECT_TYPES:
+            return
+        self.objects[params.get("guid")] = {
+            "type": params.get("type"),
+            "initializer": params.get("initializer") or {},
+        }
+        while len(self.objects) > MAX_TRACKED_OBJECTS:
+            self.objects.popitem(last=False)
+
+    @property
+    def suspended(self) -> bool:
+        """Whether the client dropped and may still reconnect."""
+        return self._resume is not None and not self._resume.done()
+
+    async def send_to_client(self, text: str) -> None:
+        """Send a raw protocol message to the client, or keep it while the client may reconnect."""
+        async with self._client_send_lock:
+            if self._client is not None:
+                try:
+                    await self._client.send_text(text)
+                    return
+                except Exception:
+                    # The client dropped; kept in case it reconnects
+                    self._client = None
+                    if self._buffer is None and not self._closing:
+                        self._buffer, self._buffered = [], 0
+            if self._buffer is not None:
+                self._keep_for_resume(text)
+
+    def _keep_for_resume(self, text: str) -> None:
+        """Buffer a message for a reconnecting client, giving up on it past the limit."""
+        self._buffer.append(text)
+        self._buffered += len(text)
+        if self._buffered > MAX_RESUME_BUFFER:
+            logger.warning(f"Relayed connection to browser instance {self.instance.index} buffered too much to be resumed")
+            self._buffer = None
+            self._closing = True
+            if self.suspended:
+                self._resume.set_result(None)
+
+    def resume(self, websocket: WebSocket) -> Optional[asyncio.Event]:
+        """
+        Hand a suspended connection to a reconnected client.
+
+        Returns:
+            An event set once the client's turn on the connection is over,
+            or None if the connection is no longer waiting for a client.
+        """
+        if not self.suspended:
+            return None
+        detached = asyncio.Event()
+        self._resume.set_result((websocket, detached))
+        return detached
+
+    async def close_client(self, reason: str) -> None:
+        """Disconnect the client, or stop waiting for it to reconnect."""
+        self._closing = True
+        if self.suspended:
+            self._resume.set_result(None)
+        if self._client is not None:
+            try:
+                await self._client.close(code=1000, reason=reason)
+            except Exception as e:
+                logger.debug(f"Error closing relayed connection: {e}")
+
+    async def _wait_for_resume(self) -> Optional[tuple[WebSocket, asyncio.Event]]:
+        """Keep the browser connection while the client may reconnect; None when it won't."""
+        grace = self.relay.pool.settings.reconnect_grace
+        if self.session is None or not grace or self._closing:
+            return None
+
+        self._resume = asyncio.get_running_loop().create_future()
+        logger.info(f"Client of session {self.session.id} dropped; keeping its browser connection for {grace:g}s")
+        self.relay.pool.events.publish("session-disconnected", session_id=self.session.id, grace=grace)
+        try:
+            resumed = await asyncio.wait_for(asyncio.shield(self._resume), timeout=grace)
+        except asyncio.TimeoutError:
+            resumed = None
+            self._resume.cancel()
+        if resumed is None and not self._closing:
+            self.relay.pool.events.publish("session-reconnect-expired", session_id=self.session.id)
+        return resumed
+
+    async def _handle_client_message(self, text: str) -> Optional[str]:
+        """Inspect and possibly rewrite a client → browser message; None means it is not forwarded."""
+        try:
+            message = json.loads(text)
+        except ValueError:
+            return text
+
+        if message.get("method") in NEW_CONTEXT_METHODS:
+            relay_params = self.relay.context_params(self)
+            if relay_params:
+                message["params"] = merge_context_params(message.get("params") or {}, relay_params)
+                text = json.dumps(message)
+            self._pending_new_context.add(message.get("id"))
+
+        rewritten = False
+        for rewriter in self.relay.call_rewriters:
+            try:
+                rewritten = rewriter(self, message) or rewritten
+            except Exception as e:
+                logger.warning(f"Relay call rewriter failed for {message.get('method')}: {e}")
+        if rewritten:
+            text = json.dumps(message)
+
+        for hook in self.relay.call_hooks:
+            try:
+                await hook(self, message)
+            except RelayCallRejected as e:
+                await self.send_to_client(json.dumps({
+                    "id": message.get("id"),
+                    "error": {"error": {"name": "Error", "message": str(e)}},
+                }))
+                return None
+            except Exception as e:
+                logger.warning(f"Relay call hook failed for {message.get('method')}: {e}")
+
+        return text
+
+    async def _handle_upstream_message(self, text: str) -> Optional[str]:
+        """Inspect a browser → client message; None means it is not forwarded."""
+        try:
+            message = json.loads(text)
+        except ValueError:
+            return text
+
+        call_id = message.get("id")
+        if call_id is not None and call_id in self._calls:
+            future = self._calls[call_id]
+            if not future.done():
+                if "error" in message:
+                    error = message["error"].get("error", message["error"])
+                    future.set_exception(RelayCallError(error.get("message", str(error))))
+                else:
+                    future.set_result(message.get("result") or {})
+            return None
+
+        method = message.get("method")
+        if method == "__create__":
+            params = message.get("params") or {}
+            if params.get("type") == "BrowserContext":
+                self.contexts.add(params.get("guid"))
+            self._track_object(params)
+        elif method == "__dispose__":
+            self.contexts.discard(message.get("guid"))
+            self.objects.pop(message.get("guid"), None)
+        elif method is not None and call_id is None:
+            for event_filter in self.relay.event_filters:
+                try:
+                    if event_filter(self, message):
+                        return None
+                except Exception as e:
+                    logger.warning(f"Relay event filter failed for {method}: {e}")
+
+        if call_id is not None and call_id in self._pending_new_context:
+            self._pending_new_context.discard(call_id)
+            context = (message.get("result") or {}).get("context") or {}
+            guid = context.get("guid")
+            if guid and self.relay.context_hooks:
+                self.contexts.add(guid)
+                # Hooks issue their own calls, whose responses arrive through
+                # this very pump, so they must run outside of it.
+                asyncio.create_task(self._run_context_hooks(guid, text))
+                return None
+
+        return text
+
+    async def _run_context_hooks(self, guid: str, response: str) -> None:
+        """Run context hooks, then release the held ``newContext`` response."""
+        for hook in self.relay.context_hooks:
+            try:
+                await hook(self, guid)
+            except Exception as e:
+                logger.warning(f"Relay context hook failed for {guid}: {e}")
+        try:
+            await self.send_to_client(response)
+        except Exception as e:
+            logger.debug(f"Failed to forward newContext response: {e}")
+
+    async def _run_disconnect_hooks(self) -> None:
+        """Run disconnect hooks while the browser connection is still open."""
+        for hook in self.relay.disconnect_hooks:
+            try:
+                await asyncio.wait_for(hook(self), timeout=DISCONNECT_HOOK_TIMEOUT)
+            except Exception as e:
+                logger.warning(f"Relay disconnect hook failed: {e}")
+
+    async def run(self, websocket: WebSocket) -> None:
+        """Pump messages between the client and the browser until either side closes."""
+        import websockets
+
+        async with websockets.connect(self.instance.ws_endpoint, max_size=None) as upstream:
+            self._upstream = upstream
+
+            async def client_to_upstream(client: WebSocket) -> int:
+                """Forward the client's messages; returns its close code."""
+                while True:
+                    message = await client.receive()
+                    if message["type"] == "websocket.disconnect":
+                        return message.get("code", 1000)
+                    text = message.get("text")
+                    if text is None:
+                        text = (message.get("bytes") or b"").decode("utf-8")
+                    self.bytes_from_client += len(text.encode())
+                    text = await self._handle_client_message(text)
+                    if text is not None:
+                        await upstream.send(text)
+
+            async def upstream_to_client() -> None:
+                async for data in upstream:
+                    self.bytes_from_browser += len(data) if isinstance(data, bytes) else len(data.encode())
+                    text = data.decode("utf-8") if isinstance(data, bytes) else data
+                    text = await self._handle_upstream_message(text)
+                    if text is not None:
+                        await self.send_to_client(text)
+
+            upstream_task = asyncio.create_task(upstream_to_client())
+            client_task = None
+            try:
+                while True:
+                    self._client = websocket
+                    client_task = asyncio.create_task(client_to_upstream(websocket))
+                    await asyncio.wait([client_task, upstream_task], return_when=asyncio.FIRST_COMPLETED)
+                    if upstream_task.done():
+                        break
+
+                    code = client_task.result() if not client_task.cancelled() and client_task.exception() is None else None
+                    async with self._client_send_lock:
+                        self._client = None
+                        if self._buffer is None and not self._closing:
+                            self._buffer, self._buffered = [], 0
+                    if self._detached is not None:
+                        self._detached.set()
+
+                    resumed = await self._wait_for_resume() if code not in CLEAN_CLOSE_CODES else None
+                    if resumed is None:
+                        self._buffer = None
+                        # The browser side is still up, so hooks can wrap up
+                        # (e.g. export data from contexts) before it is closed
+                        await self._run_disconnect_hooks()
+                        break
+
+                    websocket, self._detached = resumed
+                    async with self._client_send_lock:
+                        for text in self._buffer:
+                            await websocket.send_text(text)
+                        self._buffer = None
+                        self._client = websocket
+                    logger.info(f"Client of session {self.session.id} reconnected")
+                    self.relay.pool.events.publish("session-reconnected", session_id=self.session.id)
+            finally:
+                for task in (client_task, upstream_task):
+                    if task is not None:
+                        task.cancel()
+                self._client = None
+                self._buffer = None
+                if self._detached is not None:
+                    self._detached.set()
+                self._upstream = None
+                for future in self._calls.values():
+                    if not future.done():
+                        future.set_exception(RelayCallError("Relay connection closed"))
+
+
+@dataclass
+class Relay:
+    """
+    Tracks relayed connections and the hooks applied to them.
+
+    Other subsystems register ``context_params_providers`` to inject options
+    into new browser contexts, ``context_hooks`` to act on a context right
+    after it has been created, ``event_filters`` to consume browser events
+    before they reach the client, ``call_rewriters`` to modify client calls in
+    place, ``call_hooks`` to act before a client call is forwarded (or to
+    reject it by raising ``RelayCallRejected``), and
+    ``disconnect_hooks`` to act after a client left but before its browser
+    connection is closed.
+    """
+
+    pool: BrowserPool
+    sessions: Optional[SessionManager] = None
+    connections: list[RelayConnection] = field(default_factory=list)
+    context_params_providers: list[ContextParamsProvider] = field(default_factory=list)
+    context_hooks: list[ContextHook] = field(default_factory=list)
+    event_filters: list[EventFilter] = field(default_factory=list)
+    call_rewriters: list[CallRewriter] = field(default_factory=list)
+    call_hooks: list[CallHook] = field(default_factory=list)
+    disconnect_hooks: list[DisconnectHook] = field(default_factory=list)
+
+    def context_params(self, connection: RelayConnection) -> dict:
+        """Collect the ``newContext`` params all providers want to inject."""
+        params: dict = {}
+        for provider in self.context_params_providers:
+            params = merge_context_params(params, provider(connection) or {})
+        return params
+
+    def connections_for(self, instance: BrowserInstance) -> list[RelayConnection]:
+        """Get the open relayed connections to an instance."""
+        return [conn for conn in self.connections if conn.instance is instance]
+
+    def connections_for_session(self, session_id: str) -> list[RelayConnection]:
+        """Get the open relayed connections belonging to a session."""
+        return [
+            conn for conn in self.connections
+            if conn.session is not None and conn.session.id == session_id
+        ]
+
+    async def close_session(self, session: Session) -> None:
+        """Disconnect every relayed connection of a session and wait for them to wind down."""
+        connections = self.connections_for_session(session.id)
+        for conn in connections:
+            await conn.close_client("Session released")
+        for conn in connections:
+            try:
+                await asyncio.wait_for(conn.closed.wait(), timeout=DISCONNECT_HOOK_TIMEOUT + 5)
+            except asyncio.TimeoutError:
+                logger.warning(f"Relayed connection of session {session.id} did not close in time")
+
+    async def _serve(
+        self,
+        websocket: WebSocket,
+        instance: BrowserInstance,
+        session: Optional[Session] = None,
+    ) -> None:
+        """Relay a client connection to a browser instance."""
+        await websocket.accept()
+
+        connection = RelayConnection(relay=self, instance=instance, session=session)
+        self.connections.append(connection)
+        try:
+            await connection.run(websocket)
+        except WebSocketDisconnect:
+            pass
+        except Exception as e:
+            logger.warning(f"Relay to browser instance {instance.index} failed: {e}")
+        finally:
+            self.connections.remove(connection)
+            connection.closed.set()
+            try:
+                await websocket.close()
+            except Exception:
+                pass
+
+    async def _reconnect(self, websocket: WebSocket, session: Session, token: str) -> None:
+        """Hand a session's suspended connection to its reconnected client."""
+        if not hmac.compare_digest(token.encode(), session.reconnect_token.encode()):
+            await websocket.close(code=WS_BAD_TOKEN, reason="Invalid reconnect token")
+            return
+        suspended = [conn for conn in self.connections_for_session(session.id) if conn.suspended]
+        if not suspended:
+            await websocket.close(code=WS_NOTHING_TO_RESUME, reason="No dropped connection to resume")
+            return
+
+        await websocket.accept()
+        # The grace period may have ended while accepting
+        detached = suspended[-1].resume(websocket)
+        if detached is None:
+            await websocket.close(code=WS_NOTHING_TO_RESUME, reason="No dropped connection to resume")
+            return
+        await detached.wait()
+        try:
+            await websocket.close()
+        except Exception:
+            pass
+
+    def routes(self) -> list[WebSocketRoute]:
+        """Create WebSocket routes for relayed browser access."""
+
+        async def browser_ws(websocket: WebSocket) -> None:
+            """Relay to a pool instance by index."""
+            index = websocket.path_params["index"]
+            if index < 0 or index >= len(self.pool.instances):
+                await websocket.close(code=4404, reason="Instance not found")
+                return
+            instance = self.pool.instances[index]
+            if not instance.is_healthy or not instance.ws_endpoint:
+                await websocket.close(code=1013, reason="Instance not available")
+                return
+            # Leased browsers are only reached through their session
+            if instance.is_leased:
+                await websocket.close(code=4409, reason="Instance is leased")
+                return
+            await self._serve(websocket, instance)
+
+        async def session_ws(websocket: WebSocket) -> None:
+            """Relay to the browser leased by a session, or reconnect to its dropped connection."""
+            session_id = websocket.path_params["session_id"]
+            session = self.sessions.get_for(websocket, session_id) if self.sessions else None
+            if session is None:
+                await websocket.close(code=4404, reason="Session not found")
+                return
+            token = websocket.query_params.get("reconnect_token")
+            if token is not None:
+                await self._reconnect(websocket, session, token)
+                return
+            if not session.instance.ws_endpoint:
+                await websocket.close(code=1013, reason="Instance not available")
+                return
+            await self._serve(websocket, session.instance, session)
+
+        return [
+            WebSocketRoute("/browsers/{index:int}/ws", browser_ws),
+            WebSocketRoute("/sessions/{session_id}/ws", session_ws),
+        ]
@@ -0,0 +1,314 @@
+"""
+Interactive REPL for Camoufox Connector.
+
+``camoufox-connector repl`` leases a browser from a running connector and
+opens a prompt driving one of its pages, for trying selectors and flows
+against the stealth browser before writing code:
+
+    camoufox> goto https://example.com
+    camoufox> count "a[href]"
+    camoufox> click "text=More information"
+    camoufox> eval document.title
+    camoufox> screenshot example.png
+
+Arguments are split like a shell's, so quote selectors with spaces; ``eval``
+takes the rest of the line as it is. Tab completes commands, and URLs and
+selectors used earlier in the session. The lease is released when the prompt
+is left with ``exit`` or Ctrl-D.
+"""
+
+from __future__ import annotations
+
+import argparse
+import asyncio
+import json
+import os
+import shlex
+import sys
+from dataclasses import dataclass, field
+from typing import Any, Awaitable, Callable, Optional
+
+from .ctl import DEFAULT_URL, CtlError, call
+
+try:
+    import readline
+except ImportError:  # Windows
+    readline = None
+
+PROMPT = "camoufox> "
+
+HISTORY_FILE = os.path.expanduser("~/.camoufox_connector_history")
+
+# Milliseconds page commands wait for their target
+COMMAND_TIMEOUT = 30_000
+
+# Commands taking the rest of the line as it is, since JavaScript has quotes of its own
+RAW_COMMANDS = {"eval"}
+
+
+class ReplError(Exception):
+    """Raised when a command is used wrongly."""
+
+
+def parse_args(argv: list[str]) -> argparse.Namespace:
+    """Parse ``repl`` command line arguments."""
+    parser = argparse.ArgumentParser(
+        prog="camoufox-connector repl",
+        description="Lease a browser and drive it from an interactive prompt",
+    )
+    parser.add_argument(
+        "--url",
+        default=os.environ.get("CAMOUFOX_CONNECTOR_URL", DEFAULT_URL),
+        help=f"Connector API URL (default: $CAMOUFOX_CONNECTOR_URL or {DEFAULT_URL})",
+    )
+    parser.add_argument(
+        "--api-key",
+        default=os.environ.get("CAMOUFOX_CONNECTOR_API_KEY"),
+        help="API key (default: $CAMOUFOX_CONNECTOR_API_KEY)",
+    )
+    parser.add_argument("--holder", default="repl", help="Name shown for the lease on the dashboard (default: repl)")
+    parser.add_argument("--ttl", type=float, help="Seconds after which the lease expires")
+    parser.add_argument("--proxy", help="Proxy URL for the lease")
+    parser.add_argument("--version", help="Browser version to lease")
+    return parser.parse_args(argv)
+
+
+def _format(value: Any) -> str:
+    """Render an evaluated value for the prompt."""
+    if isinstance(value, str):
+        return value
+    return json.dumps(value, indent=2, default=str)
+
+
+@dataclass
+class Repl:
+    """Runs prompt commands against one page."""
+
+    page: Any
+    # Arguments used so far, offered by tab completion
+    seen: set[str] = field(default_factory=set)
+
+    @property
+    def commands(self) -> dict[str, Callable[[list[str]], Awaitable[Optional[str]]]]:
+        """Commands by name."""
+        return {
+            "goto": self.goto,
+            "back": self.back,
+            "reload": self.reload,
+            "url": self.url,
+            "click": self.click,
+            "fill": self.fill,
+            "type": self.type,
+            "press": self.press,
+            "wait": self.wait,
+            "count": self.count,
+            "text": self.text,
+            "eval": self.eval,
+            "screenshot": self.screenshot,
+            "help": self.help,
+        }
+
+    @staticmethod
+    def _expect(args: list[str], count: int, usage: str) -> None:
+        """Check a command got its arguments."""
+        if len(args) != count:
+            raise ReplError(f"usage: {usage}")
+
+    async def goto(self, args: list[str]) -> str:
+        """goto URL: load a page"""
+        self._expect(args, 1, "goto URL")
+        url = args[0] if "://" in args[0] else f"https://{args[0]}"
+        response = await self.page.goto(url, timeout=COMMAND_TIMEOUT)
+        status = response.status if response is not None else "-"
+        return f"{status} {self.page.url}"
+
+    async def back(self, args: list[str]) -> str:
+        """back: go back in history"""
+        await self.page.go_back(timeout=COMMAND_TIMEOUT)
+        return self.page.url
+
+    async def reload(self, args: list[str]) -> str:
+        """reload: reload the page"""
+        await self.page.reload(timeout=COMMAND_TIMEOUT)
+        return self.page.url
+
+    async def url(self, args: list[str]) -> str:
+        """url: show the page's URL and title"""
+        return f"{self.page.url} {await self.page.title()!r}"
+
+    async def click(self, args: list[str]) -> None:
+        """click SELECTOR: click an element"""
+        self._expect(args, 1, "click SELECTOR")
+        await self.page.click(args[0], timeout=COMMAND_TIMEOUT)
+
+    async def fill(self, args: list[str]) -> None:
+        """fill SELECTOR TEXT: fill an input"""
+        self._expect(args, 2, "fill SELECTOR TEXT")
+        await self.page.fill(args[0], args[1], timeout=COMMAND_TIMEOUT)
+
+    async def type(self, args: list[str]) -> None:
+        """type TEXT: type into the focused element"""
+        self._expect(args, 1, "type TEXT")
+        await self.page.keyboard.type(args[0], delay=50)
+
+    async def press(self, args: list[str]) -> None:
+        """press KEY: press a key, e.g. Enter or Control+A"""
+        self._expect(args, 1, "press KEY")
+        await self.page.keyboard.press(args[0])
+
+    async def wait(self, args: list[str]) -> None:
+        """wait SELECTOR: wait for an element to appear"""
+        self._expect(args, 1, "wait SELECTOR")
+        await self.page.wait_for_selector(args[0], timeout=COMMAND_TIMEOUT)
+
+    async def count(self, args: list[str]) -> str:
+        """count SELECTOR: count the elements a selector matches"""
+        self._expect(args, 1, "count SELECTOR")
+        return str(await self.page.locator(args[0]).count())
+
+    async def text(self, args: list[str]) -> str:
+        """text [SELECTOR]: show the text of the matching elements, or of the page"""
+        if not args:
+            return await self.page.inner_text("body")
+        self._expect(args, 1, "text [SELECTOR]")
+        return "\n".join(await self.page.locator(args[0]).all_inner_texts())
+
+    async def eval(self, args: list[str]) -> str:
+        """eval EXPRESSION: evaluate JavaScript on the page"""
+        self._expect(args, 1, "eval EXPRESSION")
+        return _format(await self.page.evaluate(args[0]))
+
+    async def screenshot(self, args: list[str]) -> str:
+        """screenshot [PATH]: save a full-page screenshot (default: screenshot.png)"""
+        path = args[0] if args else "screenshot.png"
+        await self.page.screenshot(path=path, full_page=True)
+        return f"Saved {path}"
+
+    async def help(self, args: list[str]) -> str:
+        """help: list the commands"""
+        lines = [(command.__doc__ or name).strip() for name, command in self.commands.items()]
+        return "\n".join([*lines, "exit: release the browser and leave"])
+
+    async def run(self, line: str) -> Optional[str]:
+        """
+        Run one prompt line.
+
+        Raises:
+            ReplError: If the command is unknown or used wrongly
+        """
+        name, _, rest = line.strip().partition(" ")
+        if not name:
+            return None
+        command = self.commands.get(name)
+        if command is None:
+            raise ReplError(f"Unknown command {name}, try help")
+        if name in RAW_COMMANDS:
+            args = [rest.strip()] if rest.strip() else []
+        else:
+            try:
+                args = shlex.split(rest)
+            except ValueError as e:
+                raise ReplError(str(e)) from e
+            self.seen.update(args)
+        return await command(args)
+
+    def complete(self, text: str, state: int) -> Optional[str]:
+        """Readline completer: commands first, then arguments used before."""
+        buffer = readline.get_line_buffer() if readline is not None else ""
+        if " " in buffer.lstrip():
+            candidates = self.seen
+        else:
+            candidates = [*self.commands, "exit"]
+        matches = sorted(candidate for candidate in candidates if candidate.startswith(text))
+        return matches[state] if state < len(matches) else None
+
+
+def _setup_readline(repl: Repl) -> None:
+    """Enable history and tab completion where readline is available."""
+    if readline is None:
+        return
+    try:
+        readline.read_history_file(HISTORY_FILE)
+    except OSError:
+        pass
+    # Selectors contain quotes and brackets, so only spaces separate words
+    readline.set_completer_delims(" ")
+    readline.set_completer(repl.complete)
+    if "libedit" in (readline.__doc__ or ""):
+        readline.parse_and_bind("bind ^I rl_complete")
+    else:
+        readline.parse_and_bind("tab: complete")
+
+
+def _save_history() -> None:
+    """Keep the prompt history for the next session."""
+    if readline is None:
+        return
+    try:
+        readline.write_history_file(HISTORY_FILE)
+    except OSError:
+        pass
+
+
+async def prompt(repl: Repl) -> None:
+    """Read and run commands until the user leaves."""
+    while True:
+        try:
+            line = await asyncio.to_thread(input, PROMPT)
+        except EOFError:
+            print()
+            return
+        if line.strip() in ("exit", "quit"):
+            return
+        try:
+            output = await repl.run(line)
+        except ReplError as e:
+            print(e)
+            continue
+        except Exception as e:
+            # Playwright errors carry a call log after the first line
+            print(f"error: {str(e).splitlines()[0] if str(e) else type(e).__name__}")
+            continue
+        if output:
+            print(output)
+
+
+async def session(args: argparse.Namespace) -> None:
+    """Lease a browser, run the prompt on a page of it and release it."""
+    from playwright.async_api import async_playwright
+
+    options = {"holder": args.holder, "ttl": args.ttl, "proxy": args.proxy, "version": args.version}
+    lease = await asyncio.to_thread(
+        call, args, "POST", "/sessions", {k: v for k, v in options.items() if v is not None}
+    )
+    print(f"Leased browser {lease['instance']} as session {lease['id']}; type help for commands")
+    try:
+        headers = {"Authorization": f"Bearer {args.api_key}"} if args.api_key else {}
+        async with async_playwright() as playwright:
+            browser = await playwright.firefox.connect(lease["endpoint"], headers=headers)
+            try:
+                page = await (await browser.new_context()).new_page()
+                repl = Repl(page=page)
+                _setup_readline(repl)
+                try:
+                    await prompt(repl)
+                finally:
+                    _save_history()
+            finally:
+                await browser.close()
+    finally:
+        await asyncio.to_thread(call, args, "DELETE", f"/sessions/{lease['id']}")
+        print(f"Released session {lease['id']}")
+
+
+def main(argv: list[str]) -> int:
+    """Entry point of ``camoufox-connector repl``; returns the exit status."""
+    args = parse_args(argv)
+    try:
+        asyncio.run(session(args))
+    except CtlError as e:
+        print(f"error: {e}", file=sys.stderr)
+        return 1
+    except KeyboardInterrupt:
+        pass
+    return 0
@@ -0,0 +1,210 @@
+"""
+Host resource checks for Camoufox Connector.
+
+Used to avoid launching more browsers than the host can hold. Limits are
+container-aware: cgroup (v1 and v2) CPU quotas and memory limits take
+precedence over what the host itself reports. Only Linux is inspected; on
+other platforms the checks fall back to the CPU count or are skipped.
+"""
+
+from __future__ import annotations
+
+import math
+import os
+from pathlib import Path
+from typing import Optional
+
+MEMINFO = Path("/proc/meminfo")
+CGROUP_ROOT = Path("/sys/fs/cgroup")
+
+# cgroup v1 reports "unlimited" memory as a huge page-aligned number
+UNLIMITED_MEMORY_THRESHOLD = 1 << 60
+
+
+def _read(path: Path) -> Optional[str]:
+    """Read a small kernel file, returning None if it is missing."""
+    try:
+        return path.read_text().strip()
+    except OSError:
+        return None
+
+
+def cgroup_cpu_limit() -> Optional[float]:
+    """
+    Get the CPU quota of the current cgroup in CPUs.
+
+    Returns:
+        Number of CPUs the quota allows, or None if unlimited or unknown.
+    """
+    # cgroup v2: "<quota> <period>" or "max <period>"
+    cpu_max = _read(CGROUP_ROOT / "cpu.max")
+    if cpu_max:
+        parts = cpu_max.split()
+        if len(parts) == 2 and parts[0] != "max":
+            try:
+                return int(parts[0]) / int(parts[1])
+            except (ValueError, ZeroDivisionError):
+                return None
+        return None
+
+    # cgroup v1
+    for cpu_dir in (CGROUP_ROOT / "cpu", CGROUP_ROOT / "cpu,cpuacct"):
+        quota = _read(cpu_dir / "cpu.cfs_quota_us")
+        period = _read(cpu_dir / "cpu.cfs_period_us")
+        if quota and period:
+            try:
+                quota_us, period_us = int(quota), int(period)
+            except ValueError:
+                return None
+            if quota_us > 0 and period_us > 0:
+                return quota_us / period_us
+            return None
+    return None
+
+
+def cgroup_memory_limit() -> Optional[int]:
+    """
+    Get the memory limit of the current cgroup in bytes.
+
+    Returns:
+        Memory limit in bytes, or None if unlimited or unknown.
+    """
+    for path in (CGROUP_ROOT / "memory.max", CGROUP_ROOT / "memory" / "memory.limit_in_bytes"):
+        value = _read(path)
+        if value is None:
+            continue
+        if value == "max":
+            return None
+        try:
+            limit = int(value)
+        except ValueError:
+            return None
+        return limit if limit < UNLIMITED_MEMORY_THRESHOLD else None
+    return None
+
+
+def cgroup_memory_usage() -> Optional[int]:
+    """Get the current memory usage of the cgroup in bytes."""
+    for path in (CGROUP_ROOT / "memory.current", CGROUP_ROOT / "memory" / "memory.usage_in_bytes"):
+        value = _read(path)
+        if value is not None:
+            try:
+                return int(value)
+            except ValueError:
+                return None
+    return None
+
+
+def effective_cpus(override: Optional[float] = None) -> float:
+    """
+    Get the number of CPUs this process can actually use.
+
+    Takes the smallest of the CPU affinity mask, the cgroup quota and an
+    explicit override.
+    """
+    try:
+        cpus = float(len(os.sched_getaffinity(0)))
+    except (AttributeError, OSError):
+        cpus = float(os.cpu_count() or 1)
+
+    quota = cgroup_cpu_limit()
+    if quota is not None:
+        cpus = min(cpus, quota)
+    if override is not None and override > 0:
+        cpus = min(cpus, override) if quota is not None else override
+    return max(cpus, 0.1)
+
+
+def available_memory() -> Optional[int]:
+    """
+    Get the memory available for new processes in bytes.
+
+    Inside a memory-limited container this is the headroom left below the
+    cgroup limit, if that is lower than what the host has available.
+
+    Returns:
+        Available memory in bytes, or None if it cannot be determined.
+    """
+    host_available = None
+    try:
+        with open(MEMINFO) as f:
+            for line in f:
+                if line.startswith("MemAvailable:"):
+                    host_available = int(line.split()[1]) * 1024
+                    break
+    except (OSError, ValueError, IndexError):
+        host_available = None
+
+    limit = cgroup_memory_limit()
+    usage = cgroup_memory_usage()
+    if limit is not None and usage is not None:
+        headroom = max(limit - usage, 0)
+        return headroom if host_available is None else min(host_available, headroom)
+    return host_available
+
+
+def has_memory_for_browser(browser_memory_mb: int, reserved: int = 0) -> bool:
+    """
+    Check whether another browser fits in the available memory.
+
+    Args:
+        browser_memory_mb: Memory each browser is expected to need
+        reserved: Browsers already granted memory they don't use yet, because they are still launching
+    """
+    if browser_memory_mb <= 0:
+        return True
+    available = available_memory()
+    if available is None:
+        return True
+    return available >= (reserved + 1) * browser_memory_mb * 1024 * 1024
+
+
+def executor_workers(cpus: float) -> int:
+    """Size the default thread pool like Python does, but from the usable CPUs."""
+    return min(32, math.ceil(cpus) + 4)
+
+
+def compute_capacity(
+    browsers_per_cpu: float,
+    browser_memory_mb: int,
+    cpu_override: Optional[float] = None,
+) -> dict:
+    """
+    Estimate how many browsers fit in this host or container.
+
+    Args:
+        browsers_per_cpu: Browsers budgeted per usable CPU
+        browser_memory_mb: Memory budgeted per browser in MB
+        cpu_override: Explicit CPU limit, if configured
+
+    Returns:
+        Capacity details, including the overall ``max_browsers``.
+    """
+    cpus = effective_cpus(cpu_override)
+    by_cpu = max(1, math.floor(cpus * browsers_per_cpu)) if browsers_per_cpu > 0 else None
+
+    memory_limit = cgroup_memory_limit()
+    if memory_limit is None:
+        try:
+            with open(MEMINFO) as f:
+                for line in f:
+                    if line.startswith("MemTotal:"):
+                        memory_limit = int(line.split()[1]) * 1024
+                        break
+        except (OSError, ValueError, IndexError):
+            memory_limit = None
+
+    by_memory = None
+    if memory_limit is not None and browser_memory_mb > 0:
+        by_memory = max(1, memory_limit // (browser_memory_mb * 1024 * 1024))
+
+    limits = [n for n in (by_cpu, by_memory) if n is not None]
+    return {
+        "cpus": round(cpus, 2),
+        "cpu_quota": cgroup_cpu_limit(),
+        "memory_limit": memory_limit,
+        "memory_available": available_memory(),
+        "max_browsers_by_cpu": by_cpu,
+        "max_browsers_by_memory": by_memory,
+        "max_browsers": min(limits) if limits else None,
+    }
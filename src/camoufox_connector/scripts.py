@@ -0,0 +1,1020 @@
+"""
+Server-side scripts for Camoufox Connector.
+
+Flows chain declarative steps; some journeys need real control flow: log in
+only when the login form shows, page through results until there is no next
+link, collect fields from every page into one structured result. A script is
+a small program in a sandboxed subset of Python, much like Starlark, run by
+the connector against a page of a leased browser:
+
+    if exists("form#login"):
+        fill("#user", user)
+        fill("#password", password)
+        click("button[type=submit]")
+        wait_for(".greeting")
+    result["items"] = []
+    for n in range(5):
+        result["items"].extend(extract({"names": {"selector": ".item h2", "all": True}})["names"])
+        next = attr("a.next", "href")
+        if not next:
+            break
+        goto(next)
+
+Scripts have variables, ``if``, ``for`` loops over lists and ranges,
+arithmetic, comparisons, f-strings, indexing, and a fixed set of functions:
+page functions (``goto``, ``click``, ``fill``, ``text``, ``extract``...) and
+pure helpers (``len``, ``range``, ``search``...), plus a few string, list and
+dict methods. There are no imports, function definitions, ``while`` loops,
+attribute access or names starting with an underscore, so a script reaches
+nothing but its page. Scripts are checked before they run, and stopped when
+they exceed their operation budget or time limit. Whatever the script leaves
+in ``result`` is returned.
+"""
+
+from __future__ import annotations
+
+import ast
+import asyncio
+import base64
+import inspect
+import logging
+import multiprocessing
+import operator
+import re
+import threading
+import time
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Any, Literal, Optional
+from urllib.parse import urljoin
+
+from pydantic import BaseModel, ConfigDict, Field, ValidationError, field_validator
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .devices import UnknownDeviceError
+from .dialogs import DialogRule
+from .evidence import EvidenceNotConfigured
+from .extensions import UnknownExtensionError
+from .extract import ExtractRule, extract, resolve_frame
+from .ratelimit import RateLimited
+from .sessions import LeaseLimitError, LeaseOptions, LeaseScopeError, UnknownLabelError, UnknownVersionError
+from .tasks import navigation_protocol
+
+if TYPE_CHECKING:
+    from .tasks import TaskRunner
+
+logger = logging.getLogger(__name__)
+
+MAX_SCRIPT_LENGTH = 20_000
+
+# Statements and expressions evaluated per script
+MAX_OPERATIONS = 100_000
+
+# Characters and items of a string, list or dict a script may build, nested ones included
+MAX_VALUE_LENGTH = 1_000_000
+
+# Characters and items of all the strings and lists a script builds together
+MAX_ALLOCATED = 20_000_000
+
+# Longest string int() and float() convert
+MAX_NUMBER_LENGTH = 100
+
+# Integers stay within 64 bits
+MAX_INT = 2**63
+
+MAX_LOGS = 1000
+
+# Characters of a log line; longer ones are cut short
+MAX_LOG_LENGTH = 10_000
+
+# Lists and dicts nested in a script's result
+MAX_RESULT_DEPTH = 100
+
+# Seconds a search() may take; some regular expressions take exponential time
+SEARCH_TIMEOUT = 1.0
+
+# Search processes kept for later searches
+MAX_IDLE_SEARCH_WORKERS = 4
+
+# Operations between yields to the event loop, so the time limit can interrupt busy loops
+YIELD_EVERY = 1000
+
+ALLOWED_NODES = (
+    ast.Module, ast.Expr, ast.Assign, ast.AugAssign, ast.If, ast.For, ast.Break, ast.Continue, ast.Pass,
+    ast.Constant, ast.Name, ast.Load, ast.Store, ast.List, ast.Tuple, ast.Dict,
+    ast.BinOp, ast.UnaryOp, ast.BoolOp, ast.Compare, ast.IfExp, ast.Subscript, ast.Slice,
+    ast.Call, ast.keyword, ast.Attribute, ast.JoinedStr, ast.FormattedValue,
+    ast.Add, ast.Sub, ast.Mult, ast.Div, ast.FloorDiv, ast.Mod,
+    ast.And, ast.Or, ast.Not, ast.USub, ast.UAdd,
+    ast.Eq, ast.NotEq, ast.Lt, ast.LtE, ast.Gt, ast.GtE, ast.In, ast.NotIn, ast.Is, ast.IsNot,
+)
+
+BINARY = {
+    ast.Add: operator.add,
+    ast.Sub: operator.sub,
+    ast.Mult: operator.mul,
+    ast.Div: operator.truediv,
+    ast.FloorDiv: operator.floordiv,
+    ast.Mod: operator.mod,
+}
+
+UNARY = {
+    ast.Not: operator.not_,
+    ast.USub: operator.neg,
+    ast.UAdd: operator.pos,
+}
+
+COMPARE = {
+    ast.Eq: operator.eq,
+    ast.NotEq: operator.ne,
+    ast.Lt: operator.lt,
+    ast.LtE: operator.le,
+    ast.Gt: operator.gt,
+    ast.GtE: operator.ge,
+    ast.In: lambda a, b: a in b,
+    ast.NotIn: lambda a, b: a not in b,
+    ast.Is: operator.is_,
+    ast.IsNot: operator.is_not,
+}
+
+# Methods scripts may call, by the type they belong to
+METHODS = {
+    str: {"strip", "lstrip", "rstrip", "lower", "upper", "split", "replace", "startswith", "endswith", "join", "find"},
+    list: {"append", "extend", "pop", "index", "count"},
+    dict: {"get", "keys", "values", "items", "pop", "update"},
+}
+
+PAGE_FUNCTIONS = {
+    "goto", "click", "fill", "press", "wait_for", "exists", "text", "attr",
+    "extract", "url", "html", "screenshot", "sleep", "log", "fail",
+}
+
+
+class ScriptError(Exception):
+    """Raised when a script is invalid or fails, with the line it failed on."""
+
+    def __init__(self, line: Optional[int], message: str):
+        super().__init__(f"Line {line}: {message}" if line else message)
+        self.line = line
+
+
+class ScriptFailed(Exception):
+    """Raised by a script calling ``fail``."""
+
+
+class _Break(Exception):
+    """Leaves the innermost loop."""
+
+
+class _Continue(Exception):
+    """Skips to the next iteration of the innermost loop."""
+
+
+def _length(value: Any) -> int:
+    return len(value) if isinstance(value, (str, list, tuple, dict)) else 0
+
+
+def _check_length(length: int) -> None:
+    """Refuse to build a value that would be too long."""
+    if length > MAX_VALUE_LENGTH:
+        raise ValueError(f"value longer than {MAX_VALUE_LENGTH}")
+
+
+def _size(value: Any) -> int:
+    """
+    Characters and items of a value, nested ones included.
+
+    A list holding the same list a thousand times costs little memory, but
+    takes a thousand times its size to print or return, so repeated
+    references count each time they appear. Counting stops, with an error,
+    as soon as the value is too large, so it is cheap even for self-containing
+    or exponentially nested values.
+    """
+    if isinstance(value, str):
+        return len(value)
+    if not isinstance(value, (list, tuple, dict)):
+        return 0
+    total = 0
+    stack = [value]
+    while stack:
+        current = stack.pop()
+        total += len(current)
+        # Script values are never subclasses, and exact type checks keep this loop fast
+        for item in (*current.keys(), *current.values()) if type(current) is dict else current:
+            kind = type(item)
+            if kind is str:
+                total += len(item)
+            elif kind is list or kind is tuple or kind is dict:
+                stack.append(item)
+        _check_length(total)
+    return total
+
+
+class _TooLong(Exception):
+    """Raised by _format when the text grows past its limit."""
+
+
+def _format(value: Any, limit: int = MAX_VALUE_LENGTH, quote: bool = False, cut: bool = False) -> str:
+    """
+    A script value as text, like str(), or repr() with quote.
+
+    The text is written piece by piece and given up as soon as it grows past
+    limit, rather than built in full first. With cut, the text so far is
+    returned instead of failing.
+    """
+    parts: list[str] = []
+    left = limit
+
+    def write(text: str) -> None:
+        nonlocal left
+        left -= len(text)
+        if left < 0:
+            parts.append(text[:left])
+            raise _TooLong()
+        parts.append(text)
+
+    def walk(item: Any, parents: tuple[int, ...]) -> None:
+        if not isinstance(item, (list, tuple, dict)):
+            write(repr(item))
+            return
+        if id(item) in parents:
+            write("{...}" if isinstance(item, dict) else "[...]")
+            return
+        if len(parents) >= MAX_RESULT_DEPTH:
+            raise ValueError(f"value nested more than {MAX_RESULT_DEPTH} levels deep")
+        parents = (*parents, id(item))
+        if isinstance(item, dict):
+            write("{")
+            for n, (key, entry) in enumerate(item.items()):
+                write(", " if n else "")
+                walk(key, parents)
+                write(": ")
+                walk(entry, parents)
+            write("}")
+            return
+        write("[" if isinstance(item, list) else "(")
+        for n, entry in enumerate(item):
+            write(", " if n else "")
+            walk(entry, parents)
+        write("]" if isinstance(item, list) else ",)" if len(item) == 1 else ")")
+
+    try:
+        if isinstance(value, str) and not quote:
+            write(value)
+        else:
+            walk(value, ())
+    except _TooLong:
+        if not cut:
+            raise ValueError(f"value longer than {limit} characters as text") from None
+        return "".join(parts) + "..."
+    return "".join(parts)
+
+
+def _str(value: Any = "") -> str:
+    return _format(value)
+
+
+def _number(kind: type) -> Any:
+    """int or float, refusing long strings that take long to convert."""
+
+    def convert(value: Any = 0, *args: Any) -> Any:
+        if isinstance(value, str) and len(value) > MAX_NUMBER_LENGTH:
+            raise ValueError(f"can't convert a string longer than {MAX_NUMBER_LENGTH} to a number")
+        return kind(value, *args)
+
+    return convert
+
+
+def _first_match(pattern: str, text: str) -> Optional[str]:
+    """The first group of a regular expression's first match, or the whole match."""
+    match = re.search(pattern, text)
+    if match is None:
+        return None
+    return match.group(1) if match.groups() else match.group(0)
+
+
+def _serve_searches(connection: Any) -> None:
+    """Run searches sent over a connection, in a search worker's process."""
+    connection.send(None)
+    while True:
+        try:
+            pattern, text = connection.recv()
+        except EOFError:
+            return
+        try:
+            connection.send((True, _first_match(pattern, text)))
+        except Exception as e:
+            connection.send((False, e))
+
+
+class _SearchWorker:
+    """
+    A process matching scripts' regular expressions, one search at a time.
+
+    ``re`` can't be interrupted and holds the GIL while it matches, so a
+    catastrophic pattern would stall the whole server; in a process of its
+    own, it is killed when it runs out of time, without affecting searches
+    running in other workers.
+    """
+
+    def __init__(self):
+        context = multiprocessing.get_context("spawn")
+        self.connection, child = context.Pipe()
+        self.process = context.Process(target=_serve_searches, args=(child,), daemon=True)
+        self.process.start()
+        child.close()
+        # Starting imports the package, which mustn't count against the time limit
+        self.connection.recv()
+
+    def search(self, pattern: str, text: str, timeout: float) -> Optional[str]:
+        self.connection.send((pattern, text))
+        if not self.connection.poll(timeout):
+            raise TimeoutError(f"search() took longer than {timeout:g} seconds")
+        ok, value = self.connection.recv()
+        if not ok:
+            raise value
+        return value
+
+    def close(self) -> None:
+        self.connection.close()
+        self.process.kill()
+        self.process.join()
+
+
+class _SearchWorkers:
+    """Search workers handed out to one search each, and kept for later ones when done."""
+
+    def __init__(self):
+        self._idle: list[_SearchWorker] = []
+        self._lock = threading.Lock()
+
+    def search(self, pattern: str, text: str, timeout: float) -> Optional[str]:
+        with self._lock:
+            worker = self._idle.pop() if self._idle else None
+        if worker is None:
+            worker = _SearchWorker()
+        try:
+            value = worker.search(pattern, text, timeout)
+        except (TimeoutError, OSError, EOFError):
+            worker.close()
+            raise
+        except Exception:
+            # Raised by the search itself, such as an invalid pattern; the worker is fine
+            self._keep(worker)
+            raise
+        self._keep(worker)
+        return value
+
+    def _keep(self, worker: _SearchWorker) -> None:
+        with self._lock:
+            if len(self._idle) < MAX_IDLE_SEARCH_WORKERS:
+                self._idle.append(worker)
+                return
+        worker.close()
+
+
+_search_workers = _SearchWorkers()
+
+
+async def _search(pattern: str, text: Optional[str]) -> Optional[str]:
+    if text is None:
+        return None
+    if not isinstance(pattern, str) or not isinstance(text, str):
+        raise TypeError("search() takes a pattern and a string")
+    return await asyncio.to_thread(_search_workers.search, pattern, text, SEARCH_TIMEOUT)
+
+
+def _range(*args: int) -> list:
+    values = range(*args)
+    if len(values) > MAX_VALUE_LENGTH:
+        raise ValueError(f"range longer than {MAX_VALUE_LENGTH}")
+    return list(values)
+
+
+# Functions without side effects
+PURE_FUNCTIONS = {
+    "len": len,
+    "str": _str,
+    "int": _number(int),
+    "float": _number(float),
+    "bool": bool,
+    "abs": abs,
+    "min": min,
+    "max": max,
+    "round": round,
+    "sorted": sorted,
+    "list": list,
+    "range": _range,
+    "enumerate": lambda values, start=0: list(enumerate(values, start)),
+    "zip": lambda *values: list(zip(*values)),
+    "search": _search,
+}
+
+FUNCTIONS = PURE_FUNCTIONS.keys() | PAGE_FUNCTIONS
+
+
+def parse_script(source: str) -> ast.Module:
+    """
+    Parse a script and check it only uses what scripts may.
+
+    Raises:
+        ScriptError: If the script has a syntax error or uses anything outside the sandbox.
+    """
+    try:
+        tree = ast.parse(source, mode="exec")
+    except SyntaxError as e:
+        raise ScriptError(e.lineno, f"Syntax error: {e.msg}") from e
+
+    for node in ast.walk(tree):
+        line = getattr(node, "lineno", None)
+        if not isinstance(node, ALLOWED_NODES):
+            raise ScriptError(line, f"{type(node).__name__} is not allowed in scripts")
+        if isinstance(node, ast.Name) and node.id.startswith("_"):
+            raise ScriptError(line, f"Names can't start with an underscore: {node.id}")
+        if isinstance(node, ast.Attribute) and node.attr not in set().union(*METHODS.values()):
+            raise ScriptError(line, f"Unknown method {node.attr!r}")
+        if isinstance(node, ast.Call):
+            if isinstance(node.func, ast.Name):
+                if node.func.id not in FUNCTIONS:
+                    raise ScriptError(line, f"Unknown function {node.func.id!r}")
+            elif not isinstance(node.func, ast.Attribute):
+                raise ScriptError(line, "Only functions and methods can be called")
+            if any(keyword.arg is None for keyword in node.keywords):
+                raise ScriptError(line, "** arguments are not allowed in scripts")
+        if isinstance(node, ast.FormattedValue) and node.format_spec is not None:
+            raise ScriptError(line, "Format specs are not allowed in scripts")
+        if isinstance(node, (ast.Assign, ast.AugAssign, ast.For)):
+            targets = node.targets if isinstance(node, ast.Assign) else [node.target]
+            for target in targets:
+                for part in target.elts if isinstance(target, ast.Tuple) else [target]:
+                    if not isinstance(part, (ast.Name, ast.Subscript)):
+                        raise ScriptError(line, "Only names and items can be assigned")
+
+    # Attributes are only allowed as the method of a call, break and continue only in loops
+    calls = {id(node.func) for node in ast.walk(tree) if isinstance(node, ast.Call)}
+    looped = {
+        id(inner)
+        for node in ast.walk(tree) if isinstance(node, ast.For)
+        for statement in node.body
+        for inner in ast.walk(statement)
+    }
+    for node in ast.walk(tree):
+        if isinstance(node, ast.Attribute) and id(node) not in calls:
+            raise ScriptError(node.lineno, "Attributes can only be called as methods")
+        if isinstance(node, (ast.Break, ast.Continue)) and id(node) not in looped:
+            raise ScriptError(node.lineno, f"{type(node).__name__.lower()} outside a loop")
+    return tree
+
+
+class Script(BaseModel):
+    """A script run against a page of a pool browser."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    url: str = Field(description="Page loaded before the script runs")
+
+    source: str = Field(
+        min_length=1,
+        max_length=MAX_SCRIPT_LENGTH,
+        description="The script, in the sandboxed Python subset",
+    )
+
+    vars: dict[str, Any] = Field(
+        default_factory=dict,
+        description="Variables the script starts with",
+    )
+
+    wait_until: Literal["commit", "domcontentloaded", "load", "networkidle"] = Field(
+        default="load",
+        description="Navigation event to wait for before the script runs",
+    )
+
+    timeout: float = Field(
+        default=60.0,
+        gt=0,
+        le=300,
+        description="Seconds the script may run, the first page load included",
+    )
+
+    max_operations: int = Field(
+        default=MAX_OPERATIONS,
+        ge=1,
+        le=MAX_OPERATIONS,
+        description="Statements and expressions the script may evaluate",
+    )
+
+    dialogs: list[DialogRule] = Field(
+        default_factory=list,
+        description="Dialog rules for this script, tried before the configured ones",
+    )
+
+    lease: LeaseOptions = Field(
+        default_factory=LeaseOptions,
+        description="Options for the browser lease the script runs on",
+    )
+
+    @field_validator("url")
+    @classmethod
+    def validate_url(cls, v: str) -> str:
+        """The first page is an http(s) URL."""
+        if not v.startswith(("http://", "https://")):
+            raise ValueError("URL must start with http:// or https://")
+        return v
+
+    @field_validator("source")
+    @classmethod
+    def validate_source(cls, v: str) -> str:
+        """Scripts are checked before they are queued or run."""
+        try:
+            parse_script(v)
+        except ScriptError as e:
+            raise ValueError(str(e)) from e
+        return v
+
+    @field_validator("vars")
+    @classmethod
+    def validate_vars(cls, v: dict[str, Any]) -> dict[str, Any]:
+        """Variables are names a script can refer to."""
+        for name in v:
+            if not name.isidentifier() or name.startswith("_"):
+                raise ValueError(f"Invalid variable name {name!r}")
+        return v
+
+
+@dataclass
+class ScriptResult:
+    """Outcome of a script."""
+
+    url: str
+    instance: Optional[int] = None
+    result: Any = None
+    logs: list[str] = field(default_factory=list)
+    dialogs: list[dict] = field(default_factory=list)
+    status: Optional[int] = None
+    final_url: Optional[str] = None
+    protocol: Optional[str] = None
+    operations: int = 0
+    error: Optional[str] = None
+    error_line: Optional[int] = None
+    started_at: float = field(default_factory=time.time)
+    duration: float = 0.0
+    signature: Optional[dict] = None
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "url": self.url,
+            "instance": self.instance,
+            "result": self.result,
+            "logs": self.logs,
+            "dialogs": self.dialogs,
+            "status": self.status,
+            "final_url": self.final_url,
+            "protocol": self.protocol,
+            "operations": self.operations,
+            "error": self.error,
+            "error_line": self.error_line,
+            "started_at": self.started_at,
+            "duration": round(self.duration, 2),
+            "signature": self.signature,
+        }
+
+
+class Interpreter:
+    """Evaluates a checked script against a page."""
+
+    def __init__(self, page: Any, variables: dict, result: ScriptResult, max_operations: int):
+        self.page = page
+        self.variables = variables
+        self.result = result
+        self.max_operations = max_operations
+        self.allocated = 0
+        self.yielded_at = 0
+        self.functions = {**PURE_FUNCTIONS, **{name: getattr(self, f"_{name}") for name in PAGE_FUNCTIONS}}
+
+    async def run(self, tree: ast.Module) -> None:
+        """Run a script's statements."""
+        await self._block(tree.body)
+
+    def _built(self, value: Any) -> Any:
+        """Account for a newly built value, refusing those out of bounds."""
+        if isinstance(value, int) and not isinstance(value, bool) and not -MAX_INT <= value < MAX_INT:
+            raise ValueError("integer out of range")
+        self._account(value)
+        return value
+
+    def _account(self, value: Any) -> None:
+        """Count a value built or stored into a list or dict, with everything nested in it."""
+        self.allocated += _size(value)
+        if self.allocated > MAX_ALLOCATED:
+            raise ValueError(f"the script built more than {MAX_ALLOCATED} characters and items")
+
+    def _binary(self, op: type, left: Any, right: Any) -> Any:
+        """Apply an arithmetic operator, checking the size of the result before building it."""
+        if op is ast.Mult:
+            for sequence, count in ((left, right), (right, left)):
+                if isinstance(sequence, (str, list, tuple)) and isinstance(count, int):
+                    _check_length(len(sequence) * count)
+        elif op is ast.Add:
+            _check_length(_length(left) + _length(right))
+        elif op is ast.Mod and isinstance(left, str):
+            raise ValueError("use f-strings to format strings")
+        return self._built(BINARY[op](left, right))
+
+    def _tick(self, node: ast.AST) -> None:
+        self.result.operations += 1
+        if self.result.operations > self.max_operations:
+            raise ScriptError(getattr(node, "lineno", None), f"Exceeded {self.max_operations} operations")
+
+    async def _block(self, statements: list[ast.stmt]) -> None:
+        for statement in statements:
+            try:
+                await self._statement(statement)
+            except (ScriptError, _Break, _Continue):
+                raise
+            except ScriptFailed as e:
+                raise ScriptError(statement.lineno, str(e)) from e
+            except Exception as e:
+                raise ScriptError(statement.lineno, f"{type(e).__name__}: {e}") from e
+
+    async def _statement(self, node: ast.stmt) -> None:
+        self._tick(node)
+        # Counting what large values hold takes time too
+        if self.result.operations % YIELD_EVERY == 0 or self.allocated - self.yielded_at > MAX_VALUE_LENGTH:
+            self.yielded_at = self.allocated
+            await asyncio.sleep(0)
+        if isinstance(node, ast.Expr):
+            await self._eval(node.value)
+        elif isinstance(node, ast.Assign):
+            value = await self._eval(node.value)
+            for target in node.targets:
+                await self._assign(target, value)
+        elif isinstance(node, ast.AugAssign):
+            if isinstance(node.target, ast.Subscript):
+                container = await self._eval(node.target.value)
+                key = await self._eval(node.target.slice)
+                container[key] = self._binary(type(node.op), container[key], await self._eval(node.value))
+            else:
+                current = self._lookup(node.target.id)
+                self.variables[node.target.id] = self._binary(type(node.op), current, await self._eval(node.value))
+        elif isinstance(node, ast.If):
+            await self._block(node.body if await self._eval(node.test) else node.orelse)
+        elif isinstance(node, ast.For):
+            await self._loop(node)
+        elif isinstance(node, ast.Break):
+            raise _Break()
+        elif isinstance(node, ast.Continue):
+            raise _Continue()
+
+    async def _loop(self, node: ast.For) -> None:
+        values = await self._eval(node.iter)
+        if not isinstance(values, (list, tuple, dict, str)):
+            raise TypeError(f"can't loop over {type(values).__name__}")
+        # Copied, so the loop body may change what it loops over
+        for value in list(values):
+            await self._assign(node.target, value)
+            try:
+                await self._block(node.body)
+            except _Break:
+                return
+            except _Continue:
+                continue
+        await self._block(node.orelse)
+
+    async def _assign(self, target: ast.expr, value: Any) -> None:
+        if isinstance(target, ast.Name):
+            self.variables[target.id] = value
+        elif isinstance(target, ast.Tuple):
+            values = list(value)
+            if len(values) != len(target.elts):
+                raise ValueError(f"expected {len(target.elts)} values to unpack, got {len(values)}")
+            for part, item in zip(target.elts, values):
+                await self._assign(part, item)
+        else:
+            container = await self._eval(target.value)
+            if not isinstance(container, (list, dict)):
+                raise TypeError(f"can't assign items of {type(container).__name__}")
+            self._account(value)
+            container[await self._eval(target.slice)] = value
+            _check_length(len(container))
+
+    def _lookup(self, name: str) -> Any:
+        if name not in self.variables:
+            raise NameError(f"{name!r} is not defined")
+        return self.variables[name]
+
+    async def _eval(self, node: ast.expr) -> Any:
+        self._tick(node)
+        if isinstance(node, ast.Constant):
+            return node.value
+        if isinstance(node, ast.Name):
+            return self._lookup(node.id)
+        if isinstance(node, (ast.List, ast.Tuple)):
+            values = [await self._eval(item) for item in node.elts]
+            return self._built(values if isinstance(node, ast.List) else tuple(values))
+        if isinstance(node, ast.Dict):
+            return self._built(
+                {await self._eval(key): await self._eval(value) for key, value in zip(node.keys, node.values)}
+            )
+        if isinstance(node, ast.BinOp):
+            return self._binary(type(node.op), await self._eval(node.left), await self._eval(node.right))
+        if isinstance(node, ast.UnaryOp):
+            return UNARY[type(node.op)](await self._eval(node.operand))
+        if isinstance(node, ast.BoolOp):
+            value = None
+            for operand in node.values:
+                value = await self._eval(operand)
+                if bool(value) == isinstance(node.op, ast.Or):
+                    break
+            return value
+        if isinstance(node, ast.Compare):
+            left = await self._eval(node.left)
+            for op, comparator in zip(node.ops, node.comparators):
+                right = await self._eval(comparator)
+                if not COMPARE[type(op)](left, right):
+                    return False
+                left = right
+            return True
+        if isinstance(node, ast.IfExp):
+            return await self._eval(node.body if await self._eval(node.test) else node.orelse)
+        if isinstance(node, ast.Subscript):
+            return (await self._eval(node.value))[await self._eval(node.slice)]
+        if isinstance(node, ast.Slice):
+            return slice(
+                await self._eval(node.lower) if node.lower else None,
+                await self._eval(node.upper) if node.upper else None,
+                await self._eval(node.step) if node.step else None,
+            )
+        if isinstance(node, ast.JoinedStr):
+            parts = [await self._eval(value) for value in node.values]
+            _check_length(sum(len(part) for part in parts))
+            return self._built("".join(parts))
+        if isinstance(node, ast.FormattedValue):
+            return _format(await self._eval(node.value), quote=node.conversion == ord("r"))
+        if isinstance(node, ast.Call):
+            return await self._call(node)
+        raise ScriptError(getattr(node, "lineno", None), f"{type(node).__name__} is not allowed in scripts")
+
+    async def _call(self, node: ast.Call) -> Any:
+        args = [await self._eval(arg) for arg in node.args]
+        kwargs = {keyword.arg: await self._eval(keyword.value) for keyword in node.keywords}
+        if isinstance(node.func, ast.Attribute):
+            target = await self._eval(node.func.value)
+            methods = next((names for kind, names in METHODS.items() if isinstance(target, kind)), set())
+            if node.func.attr not in methods:
+                raise AttributeError(f"{type(target).__name__} has no method {node.func.attr!r}")
+            self._check_method(target, node.func.attr, args)
+            if node.func.attr in ("append", "extend", "update") and args:
+                self._account(args[0])
+            value = getattr(target, node.func.attr)(*args, **kwargs)
+            if node.func.attr in ("keys", "values", "items"):
+                return list(value)
+            # Only string methods build new values; list and dict methods return existing ones
+            return self._built(value) if isinstance(target, str) else value
+
+        value = self.functions[node.func.id](*args, **kwargs)
+        if inspect.isawaitable(value):
+            value = await value
+        return self._built(value)
+
+    @staticmethod
+    def _check_method(target: Any, method: str, args: list) -> None:
+        """Refuse method calls whose results would be too large to build."""
+        if method == "replace" and len(args) >= 2 and isinstance(args[0], str) and isinstance(args[1], str):
+            matches = target.count(args[0]) if args[0] else len(target) + 1
+            _check_length(len(target) + matches * len(args[1]))
+        elif method == "join" and args:
+            items = list(args[0])
+            _check_length(sum(_length(item) for item in items) + len(target) * max(0, len(items) - 1))
+        elif method in ("extend", "update") and args:
+            _check_length(len(target) + _length(args[0]))
+        elif method == "append":
+            _check_length(len(target) + 1)
+
+    def _locator(self, selector: str, frame: Optional[str]) -> Any:
+        return resolve_frame(self.page, frame).locator(selector).first
+
+    @staticmethod
+    def _milliseconds(timeout: float) -> float:
+        if not 0 < timeout <= 300:
+            raise ValueError("timeout must be between 0 and 300 seconds")
+        return timeout * 1000
+
+    async def _goto(self, url: str, wait_until: str = "load", timeout: float = 30.0) -> Optional[int]:
+        """Load a page, relative to the current one; returns its status."""
+        base = self.page.url if self.page.url.startswith(("http://", "https://")) else ""
+        url = urljoin(base, url)
+        if not url.startswith(("http://", "https://")):
+            raise ValueError(f"URL must start with http:// or https://: {url}")
+        response = await self.page.goto(url, wait_until=wait_until, timeout=self._milliseconds(timeout))
+        self.result.status = response.status if response else None
+        return self.result.status
+
+    async def _click(self, selector: str, frame: Optional[str] = None, timeout: float = 30.0) -> None:
+        await self._locator(selector, frame).click(timeout=self._milliseconds(timeout))
+
+    async def _fill(self, selector: str, value: str, frame: Optional[str] = None, timeout: float = 30.0) -> None:
+        await self._locator(selector, frame).fill(_format(value), timeout=self._milliseconds(timeout))
+
+    async def _press(self, selector: str, key: str, frame: Optional[str] = None, timeout: float = 30.0) -> None:
+        await self._locator(selector, frame).press(key, timeout=self._milliseconds(timeout))
+
+    async def _wait_for(self, selector: str, frame: Optional[str] = None, timeout: float = 30.0) -> None:
+        await self._locator(selector, frame).wait_for(timeout=self._milliseconds(timeout))
+
+    async def _exists(self, selector: str, frame: Optional[str] = None) -> bool:
+        return await self._locator(selector, frame).count() > 0
+
+    async def _text(self, selector: Optional[str] = None, frame: Optional[str] = None) -> Optional[str]:
+        """An element's text, or the page's without a selector; None if nothing matches."""
+        if selector is None:
+            return await resolve_frame(self.page, frame).inner_text("body")
+        locator = self._locator(selector, frame)
+        return await locator.inner_text() if await locator.count() else None
+
+    async def _attr(self, selector: str, name: str, frame: Optional[str] = None) -> Optional[str]:
+        locator = self._locator(selector, frame)
+        return await locator.get_attribute(name) if await locator.count() else None
+
+    async def _extract(self, rules: dict) -> dict:
+        """Extract fields like a task's ``extract``; fields that fail are logged and None."""
+        try:
+            parsed = {name: ExtractRule.model_validate(rule) for name, rule in rules.items()}
+        except ValidationError as e:
+            raise ValueError(f"invalid extraction rules: {e.errors(include_url=False, include_context=False)}") from e
+        data, errors = await extract(self.page, parsed)
+        for name, error in errors.items():
+            self._log(f"extract {name}: {error}")
+            data.setdefault(name, None)
+        return data
+
+    def _url(self) -> str:
+        return self.page.url
+
+    async def _html(self) -> str:
+        return await self.page.content()
+
+    async def _screenshot(self) -> str:
+        """A base64-encoded PNG screenshot of the page."""
+        return base64.b64encode(await self.page.screenshot()).decode()
+
+    async def _sleep(self, seconds: float) -> None:
+        if not 0 <= seconds <= 30:
+            raise ValueError("sleep takes 0 to 30 seconds")
+        await asyncio.sleep(seconds)
+
+    def _log(self, *values: Any) -> None:
+        if len(self.result.logs) < MAX_LOGS:
+            line = " ".join(value if isinstance(value, str) else _format(value, quote=True) for value in values)
+            self.result.logs.append(_format(line, MAX_LOG_LENGTH, cut=True))
+
+    def _fail(self, message: str) -> None:
+        raise ScriptFailed(_format(message, MAX_LOG_LENGTH, cut=True))
+
+
+def _plain(value: Any) -> Any:
+    """A script value as JSON: tuples become lists and keys strings."""
+    items = 0
+
+    def convert(item: Any, parents: tuple[int, ...]) -> Any:
+        nonlocal items
+        if not isinstance(item, (list, tuple, dict)):
+            return item
+        if id(item) in parents:
+            raise ValueError("the result contains itself")
+        if len(parents) >= MAX_RESULT_DEPTH:
+            raise ValueError(f"the result is nested more than {MAX_RESULT_DEPTH} levels deep")
+        # Shared lists are copied each time they appear, so the total is bounded
+        items += len(item)
+        if items > MAX_VALUE_LENGTH:
+            raise ValueError(f"the result holds more than {MAX_VALUE_LENGTH} items")
+        parents = (*parents, id(item))
+        if isinstance(item, dict):
+            return {_format(key): convert(entry, parents) for key, entry in item.items()}
+        return [convert(entry, parents) for entry in item]
+
+    return convert(value, ())
+
+
+async def run_script(runner: TaskRunner, script: Script, tenant: Optional[str] = None) -> Optional[ScriptResult]:
+    """
+    Wait for the first page's rate limit, then run a script on a leased browser.
+
+    Returns:
+        The script result, or None if no browser was available.
+
+    Raises:
+        The same errors as :meth:`TaskRunner.fetch`.
+    """
+    tree = parse_script(script.source)
+
+    async with runner.limiter.slot(script.url):
+        session = await runner.sessions.acquire(script.lease, tenant=tenant)
+        if session is None:
+            return None
+
+        result = ScriptResult(url=script.url, instance=session.instance.index)
+        variables = {**script.vars, "result": {}}
+        try:
+            browser = await runner.connect(session)
+            try:
+                context = await browser.new_context()
+                runner.handle_dialogs(context, script.dialogs, result.dialogs)
+                page = await context.new_page()
+                interpreter = Interpreter(page, variables, result, script.max_operations)
+
+                async def run() -> None:
+                    response = await page.goto(script.url, wait_until=script.wait_until, timeout=script.timeout * 1000)
+                    result.status = response.status if response else None
+                    result.protocol = await navigation_protocol(page)
+                    await interpreter.run(tree)
+
+                try:
+                    await asyncio.wait_for(run(), timeout=script.timeout)
+                except asyncio.TimeoutError:
+                    raise ScriptError(None, f"Timed out after {script.timeout:g} seconds")
+                finally:
+                    result.final_url = page.url
+            finally:
+                await browser.close()
+        except ScriptError as e:
+            logger.warning(f"Script on {script.url} failed: {e}")
+            result.error = str(e)
+            result.error_line = e.line
+        except Exception as e:
+            logger.warning(f"Script on {script.url} failed: {e}")
+            result.error = str(e)
+        finally:
+            result.duration = time.time() - result.started_at
+            await runner.sessions.release(session.id)
+
+    try:
+        result.result = _plain(variables["result"])
+    except ValueError as e:
+        logger.warning(f"Script on {script.url} returned an invalid result: {e}")
+        if result.error is None:
+            result.error = f"Invalid result: {e}"
+
+    if runner.signer is not None:
+        result.signature = runner.signer.sign(result.to_dict())
+    return result
+
+
+def create_script_routes(runner: TaskRunner) -> list[Route]:
+    """
+    Create routes running scripts.
+
+    Args:
+        runner: Task runner whose browsers the scripts run on
+
+    Returns:
+        List of Starlette routes
+    """
+    async def submit_script(request: Request) -> Response:
+        """
+        Run a script on a pool browser and return its result.
+
+        POST /tasks/script
+        """
+        try:
+            script = Script.model_validate_json(await request.body())
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid script", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+
+        try:
+            result = await run_script(runner, script, tenant=getattr(request.state, "api_key_name", None))
+        except LeaseLimitError as e:
+            return JSONResponse({"error": str(e)}, status_code=429)
+        except RateLimited as e:
+            return JSONResponse(
+                {"error": str(e), "domain": e.host},
+                status_code=429,
+                headers={"Retry-After": str(max(1, round(e.retry_after)))},
+            )
+        except (
+            UnknownDeviceError,
+            UnknownVersionError,
+            UnknownLabelError,
+            UnknownExtensionError,
+            LeaseScopeError,
+            EvidenceNotConfigured,
+        ) as e:
+            return JSONResponse({"error": str(e)}, status_code=400)
+        except RuntimeError as e:
+            return JSONResponse({"error": str(e)}, status_code=502)
+
+        if result is None:
+            return JSONResponse(
+                {"error": "No browser instances available for the script"},
+                status_code=503,
+            )
+
+        return JSONResponse(result.to_dict(), status_code=502 if result.error else 200)
+
+    return [
+        Route("/tasks/script", submit_script, methods=["POST"]),
+    ]
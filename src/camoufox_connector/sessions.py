@@ -0,0 +1,679 @@
+"""
+Browser leases for Camoufox Connector.
+
+A session is an exclusive lease on one pool instance. Unlike ``/next``, which
+shares browsers round-robin, a leased browser is handed to a single client
+until it is released, and can be relaunched with per-lease launch options.
+Clients connect to a session through the relay, so connector-side features
+can follow the session's browser contexts.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+import secrets
+import time
+import uuid
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Awaitable, Callable, Literal, Optional
+
+from pydantic import BaseModel, ConfigDict, Field, ValidationError, field_validator, model_validator
+from starlette.requests import HTTPConnection, Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .auth import may_access
+from .config import cache_prefs, protocol_prefs
+from .devices import DeviceRegistry, UnknownDeviceError
+from .extensions import UnknownExtensionError
+from .geo import GeoInfo, resolve_proxy_geo
+from .geooverride import GeoOverride
+from .initscripts import MAX_INIT_SCRIPTS, InitScript, InitScriptSpec
+from .interception import InterceptionRules
+from .popups import PopupPolicy
+from .proxies import lookup_proxy_url, validate_proxy_url
+from .relay import websocket_url
+
+if TYPE_CHECKING:
+    from .pool import BrowserInstance, BrowserPool
+
+logger = logging.getLogger(__name__)
+
+
+class LeaseLimitError(Exception):
+    """Raised when a client already holds as many leases as it may."""
+
+
+class UnknownVersionError(LookupError):
+    """Raised when a lease asks for a browser version no instance runs."""
+
+
+class UnknownLabelError(LookupError):
+    """Raised when a lease asks for labels no instance has."""
+
+
+class LeaseScopeError(ValueError):
+    """Raised when a context lease asks for options that need a browser of its own."""
+
+
+class VideoSize(BaseModel):
+    """Frame size of recorded videos."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    width: int = Field(gt=0, le=3840)
+    height: int = Field(gt=0, le=2160)
+
+
+class LeaseOptions(BaseModel):
+    """Options accepted when acquiring a lease."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    proxy: Optional[str] = Field(
+        default=None,
+        description="Proxy URL for this lease, overriding the configured proxy",
+    )
+
+    geo_align: Optional[bool] = Field(
+        default=None,
+        description="Align timezone, locale and geolocation with the proxy exit IP",
+    )
+
+    holder: Optional[str] = Field(
+        default=None,
+        max_length=100,
+        description="Free-form name of the client holding the lease",
+    )
+
+    ttl: Optional[float] = Field(
+        default=None,
+        gt=0,
+        description="Seconds after which the lease expires and is released automatically",
+    )
+
+    disable_javascript: bool = Field(
+        default=False,
+        description="Disable JavaScript in the leased browser",
+    )
+
+    block_images: Optional[bool] = Field(
+        default=None,
+        description="Block image loading, overriding the configured default",
+    )
+
+    block_css: bool = Field(
+        default=False,
+        description="Block stylesheets in the leased browser",
+    )
+
+    lightweight: bool = Field(
+        default=False,
+        description="Lightweight fetch mode: disable JavaScript and block images and CSS",
+    )
+
+    http2: Optional[bool] = Field(
+        default=None,
+        description="Enable or disable HTTP/2 towards targets, overriding the configured default",
+    )
+
+    http3: Optional[bool] = Field(
+        default=None,
+        description="Enable or disable HTTP/3 towards targets, overriding the configured default",
+    )
+
+    block_service_workers: Optional[bool] = Field(
+        default=None,
+        description="Block service worker registration, overriding the configured default",
+    )
+
+    disable_cache: Optional[bool] = Field(
+        default=None,
+        description="Disable the HTTP cache, overriding the configured default",
+    )
+
+    fresh_profile: bool = Field(
+        default=False,
+        description="Start from a freshly launched browser with an empty cache and no service workers",
+    )
+
+    popups: Optional[PopupPolicy] = Field(
+        default=None,
+        description="Popup handling: allow, block, follow or capture (default: configured policy)",
+    )
+
+    har: bool = Field(
+        default=False,
+        description="Record the lease's network traffic as a HAR",
+    )
+
+    max_transfer_mb: Optional[float] = Field(
+        default=None,
+        gt=0,
+        description="Network MB the browser may transfer before the lease is released (default: configured cap)",
+    )
+
+    video: bool = Field(
+        default=False,
+        description="Record a video of every page opened during the lease",
+    )
+
+    video_size: Optional[VideoSize] = Field(
+        default=None,
+        description="Frame size of recorded videos (default: the page viewport, scaled to fit 800x800)",
+    )
+
+    interception: Optional[InterceptionRules] = Field(
+        default=None,
+        description="Network rules applied to the lease's browser contexts",
+    )
+
+    geo_override: Optional[GeoOverride] = Field(
+        default=None,
+        description="Position, timezone and Accept-Language of the lease's contexts; changeable with PATCH /sessions/{id}/geo",
+    )
+
+    device: Optional[str] = Field(
+        default=None,
+        description="Device preset to emulate, e.g. 'Pixel 8' or 'iPhone 15' (see GET /devices)",
+    )
+
+    version: Optional[str] = Field(
+        default=None,
+        description="Browser version to lease, e.g. 132 (see browser_builds)",
+    )
+
+    labels: dict[str, str] = Field(
+        default_factory=dict,
+        description="Labels the leased instance must have, e.g. {'profile': 'amazon-account-3'}",
+    )
+
+    group: Optional[str] = Field(
+        default=None,
+        description="Pool group to lease from, e.g. auth (see pool_groups)",
+    )
+
+    extensions: list[str] = Field(
+        default_factory=list,
+        description="IDs of uploaded extensions to load (see POST /extensions)",
+    )
+
+    patches: bool = Field(
+        default=True,
+        description="Run the connector's per-domain JavaScript patches (see /patches)",
+    )
+
+    init_scripts: list[InitScriptSpec] = Field(
+        default_factory=list,
+        max_length=MAX_INIT_SCRIPTS,
+        description="Scripts run in every page of the lease before the page's own; more can be added with POST /sessions/{id}/init-script",
+    )
+
+    scope: Optional[Literal["browser", "context"]] = Field(
+        default=None,
+        description=(
+            "Lease a whole browser or one context in a shared browser "
+            "(default: a context if contexts_per_browser > 1 and the lease needs no launch options)"
+        ),
+    )
+
+    @field_validator("proxy")
+    @classmethod
+    def validate_proxy(cls, v: Optional[str]) -> Optional[str]:
+        """Validate proxy URL format."""
+        if v is None or v == "":
+            return None
+        return validate_proxy_url(v)
+
+    @model_validator(mode="after")
+    def select_group(self) -> LeaseOptions:
+        """A group is selected by its instances' group label."""
+        if self.group is not None:
+            if self.labels.get("group", self.group) != self.group:
+                raise ValueError("group and the group label select different groups")
+            self.labels = {**self.labels, "group": self.group}
+        return self
+
+
+@dataclass
+class Session:
+    """An exclusive lease on a browser instance, or on a context in a shared one."""
+
+    id: str
+    instance: BrowserInstance
+    options: LeaseOptions
+    created_at: float = field(default_factory=time.time)
+    ttl: Optional[float] = None
+    geo: Optional[GeoInfo] = None
+    # Current geolocation and locale overrides; starts as the lease option's
+    geo_override: Optional[GeoOverride] = None
+    # Current init scripts; starts with the lease option's
+    init_scripts: list[InitScript] = field(default_factory=list)
+    tenant: Optional[str] = None
+    summary: Optional[dict] = None
+    shared: bool = False
+    # Lets the lease's client reconnect to its dropped relayed connection
+    reconnect_token: str = field(default_factory=lambda: secrets.token_urlsafe(24))
+
+    @property
+    def duration(self) -> float:
+        """Get lease duration in seconds."""
+        return time.time() - self.created_at
+
+    @property
+    def expires_at(self) -> Optional[float]:
+        """Get the time at which the lease expires, if it has a TTL."""
+        return self.created_at + self.ttl if self.ttl else None
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "id": self.id,
+            "instance": self.instance.index,
+            "scope": "context" if self.shared else "browser",
+            "created_at": self.created_at,
+            "duration": round(self.duration, 2),
+            "expires_at": self.expires_at,
+            "options": self.options.model_dump(exclude_none=True, exclude={"init_scripts"}),
+            "geo": self.geo.to_dict() if self.geo else None,
+            "geo_override": self.geo_override.model_dump(exclude_none=True) if self.geo_override else None,
+            "init_scripts": [script.to_dict() for script in self.init_scripts],
+            "tenant": self.tenant,
+        }
+
+
+@dataclass
+class SessionManager:
+    """
+    Hands out exclusive leases on pool instances.
+
+    Instances whose current launch options already match a lease are
+    preferred; otherwise an idle instance is relaunched with the lease's
+    options before it is handed out.
+    """
+
+    pool: BrowserPool
+    sessions: dict[str, Session] = field(default_factory=dict)
+    release_hooks: list[Callable[[Session], Awaitable[None]]] = field(default_factory=list)
+    devices: DeviceRegistry = field(init=False)
+    _lock: asyncio.Lock = field(default_factory=asyncio.Lock)
+    _reaper_task: Optional[asyncio.Task] = None
+
+    def __post_init__(self) -> None:
+        self.devices = DeviceRegistry(pool=self.pool)
+
+    def start(self) -> None:
+        """Start expiring leases whose TTL has passed."""
+        if self._reaper_task is None:
+            self._reaper_task = asyncio.create_task(self._reap_expired())
+
+    async def stop(self) -> None:
+        """Stop the expiry task and release every active session."""
+        if self._reaper_task is not None:
+            self._reaper_task.cancel()
+            self._reaper_task = None
+        await self.release_all()
+
+    async def _reap_expired(self) -> None:
+        """Release leases once their TTL has passed."""
+        while True:
+            await asyncio.sleep(1.0)
+            now = time.time()
+            for session in list(self.sessions.values()):
+                if session.expires_at is not None and session.expires_at <= now:
+                    logger.info(f"Session {session.id} expired after {session.ttl}s")
+                    if await self.release(session.id) is not None:
+                        self.pool.events.publish(
+                            "lease-expired",
+                            session_id=session.id,
+                            index=session.instance.index,
+                            holder=session.options.holder,
+                        )
+
+    async def _build_launch_overrides(self, options: LeaseOptions) -> tuple[dict, Optional[GeoInfo]]:
+        """Translate lease options into Camoufox launch overrides."""
+        settings = self.pool.settings
+        overrides: dict = {}
+        geo: Optional[GeoInfo] = None
+
+        proxy = options.proxy or settings.proxy
+        if options.proxy:
+            overrides["proxy"] = options.proxy
+
+        geo_align = settings.geo_align if options.geo_align is None else options.geo_align
+        if geo_align:
+            group = settings.get_group(options.group) if options.group else None
+            rotation = group.proxies if group is not None and group.proxies else settings.proxies
+            if not options.proxy and rotation:
+                # Pin one proxy from the rotation so the resolved geo matches it
+                proxy = rotation[len(self.sessions) % len(rotation)]
+                overrides["proxy"] = proxy
+            geo = await resolve_proxy_geo(lookup_proxy_url(proxy, settings.proxy_remote_dns))
+            # Passing the exit IP lets Camoufox derive a consistent timezone,
+            # locale, Accept-Language and geolocation from its GeoIP database.
+            overrides["geoip"] = geo.ip
+
+        block_images = True if options.lightweight else options.block_images
+        if block_images is not None and block_images != settings.block_images:
+            overrides["block_images"] = block_images
+
+        prefs = {}
+        if options.lightweight or options.disable_javascript:
+            prefs["javascript.enabled"] = False
+        if options.lightweight or options.block_css:
+            prefs["permissions.default.stylesheet"] = 2
+        prefs.update(protocol_prefs(options.http2, options.http3))
+        prefs.update(cache_prefs(options.block_service_workers, options.disable_cache))
+        if prefs:
+            overrides["firefox_user_prefs"] = prefs
+
+        if options.device is not None:
+            overrides["config"] = self.devices.get(options.device).fingerprint()
+            # A mobile fingerprint on a desktop browser is deliberate here
+            overrides["i_know_what_im_doing"] = True
+
+        if options.extensions:
+            overrides["addons"] = [str(self.pool.extensions.get(ext_id).path) for ext_id in options.extensions]
+
+        return overrides, geo
+
+    def _pick_instance(
+        self,
+        overrides: dict,
+        fresh: bool = False,
+        version: Optional[str] = None,
+        labels: Optional[dict[str, str]] = None,
+        index: Optional[int] = None,
+    ) -> Optional[BrowserInstance]:
+        """
+        Pick an idle instance of the requested browser version and labels,
+        preferring one already launched with the overrides and, for fresh
+        leases, one unused since its launch.
+        """
+        idle = self.pool.get_idle_instances(version, labels)
+        if index is not None:
+            idle = [inst for inst in idle if inst.index == index]
+        if not idle:
+            return None
+        return min(idle, key=lambda inst: (
+            inst.launch_overrides != overrides,
+            fresh and inst.uses_since_launch > 0,
+        ))
+
+    def _pick_context_instance(
+        self,
+        version: Optional[str] = None,
+        labels: Optional[dict[str, str]] = None,
+        index: Optional[int] = None,
+    ) -> Optional[BrowserInstance]:
+        """
+        Pick a browser for a context lease: the fullest shared browser with
+        room left, so whole browsers stay free for other leases, else an
+        idle one, preferably launched without overrides.
+        """
+        candidates = [
+            inst for inst in self.pool.get_context_instances(version, labels)
+            if index is None or inst.index == index
+        ]
+        # Only browsers launched with the plain settings may be shared
+        shared = [
+            inst for inst in candidates
+            if inst.context_sessions and not inst.launch_overrides and not self.pool.is_stale(inst)
+        ]
+        if shared:
+            return max(shared, key=lambda inst: len(inst.context_sessions))
+        idle = [inst for inst in candidates if not inst.context_sessions]
+        if not idle:
+            return None
+        return min(idle, key=lambda inst: inst.launch_overrides != {})
+
+    def count_for(self, tenant: str) -> int:
+        """Count the active leases held by a client."""
+        return sum(1 for s in self.sessions.values() if s.tenant == tenant)
+
+    async def acquire(
+        self,
+        options: LeaseOptions,
+        tenant: Optional[str] = None,
+        launch_options: Optional[dict] = None,
+        index: Optional[int] = None,
+    ) -> Optional[Session]:
+        """
+        Lease an idle browser instance.
+
+        Args:
+            options: Lease options
+            tenant: Name of the API key the lease is acquired with, if any
+            launch_options: Extra Camoufox launch options for the connector's
+                own leases, which clients cannot set
+            index: Only lease this instance, for the connector's own leases
+
+        Returns:
+            The new session, or None if every instance is already leased.
+
+        Raises:
+            LeaseLimitError: If the client already holds its maximum of leases.
+            UnknownDeviceError: If the lease asks for an unknown device preset.
+            UnknownVersionError: If the lease asks for a browser version no instance runs.
+            UnknownLabelError: If the lease asks for labels no instance has.
+            UnknownExtensionError: If the lease asks for an extension that was not uploaded.
+            RuntimeError: If the lease's launch options could not be applied.
+        """
+        if options.version is not None and not self.pool.has_version(options.version):
+            raise UnknownVersionError(f"No browser instances run version {options.version}")
+        if options.labels and not self.pool.has_labels(options.labels):
+            raise UnknownLabelError(f"No browser instances have the labels {options.labels}")
+
+        overrides, geo = await self._build_launch_overrides(options)
+        if launch_options:
+            overrides = {**launch_options, **overrides}
+
+        own_launch = bool(overrides) or options.fresh_profile
+        if options.scope == "context" and own_launch:
+            raise LeaseScopeError("A context lease shares its browser's launch options; lease a whole browser instead")
+        shared = options.scope == "context" or (
+            options.scope is None and self.pool.settings.contexts_per_browser > 1 and not own_launch
+        )
+
+        async with self._lock:
+            limit = self.pool.settings.max_sessions_per_key
+            if tenant is not None and limit is not None and self.count_for(tenant) >= limit:
+                raise LeaseLimitError(f"API key '{tenant}' already holds {limit} lease(s)")
+
+            if shared:
+                instance = self._pick_context_instance(options.version, options.labels, index)
+            else:
+                instance = self._pick_instance(
+                    overrides,
+                    fresh=options.fresh_profile,
+                    version=options.version,
+                    labels=options.labels,
+                    index=index,
+                )
+            if instance is None:
+                self.pool.events.publish(
+                    "pool-exhausted",
+                    total_instances=len(self.pool.instances),
+                    leased=len(self.sessions),
+                )
+                return None
+            session = Session(
+                id=uuid.uuid4().hex,
+                instance=instance,
+                options=options,
+                ttl=options.ttl or self.pool.settings.lease_ttl,
+                geo=geo,
+                geo_override=options.geo_override,
+                init_scripts=[InitScript(spec=spec) for spec in options.init_scripts],
+                tenant=tenant,
+                shared=shared,
+            )
+            if shared:
+                instance.context_sessions.add(session.id)
+            else:
+                instance.session_id = session.id
+            self.sessions[session.id] = session
+
+        if (
+            instance.launch_overrides != overrides
+            or self.pool.is_stale(instance)
+            or (options.fresh_profile and instance.uses_since_launch > 0)
+        ):
+            logger.info(f"Relaunching browser instance {instance.index} for session {session.id}")
+            if not await self.pool.relaunch_instance(instance, overrides):
+                await self.release(session.id)
+                raise RuntimeError(f"Failed to relaunch browser instance {instance.index}")
+        instance.uses_since_launch += 1
+
+        session.created_at = time.time()
+        logger.info(f"Session {session.id} leased browser instance {instance.index}")
+        self.pool.events.publish(
+            "lease-acquired",
+            session_id=session.id,
+            index=instance.index,
+            holder=options.holder,
+        )
+        return session
+
+    async def release(self, session_id: str) -> Optional[Session]:
+        """Release a lease, returning its instance to the pool."""
+        async with self._lock:
+            session = self.sessions.pop(session_id, None)
+            if session is None:
+                return None
+            if session.shared:
+                session.instance.context_sessions.discard(session_id)
+            elif session.instance.session_id == session_id:
+                session.instance.session_id = None
+
+        for hook in self.release_hooks:
+            try:
+                await hook(session)
+            except Exception as e:
+                logger.warning(f"Release hook failed for session {session_id}: {e}")
+
+        logger.info(f"Session {session_id} released browser instance {session.instance.index}")
+        self.pool.events.publish(
+            "lease-released",
+            session_id=session_id,
+            index=session.instance.index,
+            holder=session.options.holder,
+            duration=round(session.duration, 2),
+            summary=session.summary,
+        )
+        return session
+
+    def get(self, session_id: str) -> Optional[Session]:
+        """Get an active session by ID."""
+        return self.sessions.get(session_id)
+
+    def get_for(self, conn: HTTPConnection, session_id: str) -> Optional[Session]:
+        """Get an active session by ID, if the client's API key may use it."""
+        session = self.sessions.get(session_id)
+        return session if session is not None and may_access(conn, session.tenant) else None
+
+    async def release_all(self) -> None:
+        """Release every active session."""
+        for session_id in list(self.sessions):
+            await self.release(session_id)
+
+
+def create_session_routes(manager: SessionManager) -> list[Route]:
+    """
+    Create HTTP routes for acquiring and releasing leases.
+
+    Args:
+        manager: Session manager handing out leases
+
+    Returns:
+        List of Starlette routes
+    """
+
+    def render(request: Request, session: Session) -> dict:
+        """Serialize a session with its relayed endpoint."""
+        data = session.to_dict()
+        data["endpoint"] = websocket_url(request, f"/sessions/{session.id}/ws")
+        return data
+
+    async def acquire(request: Request) -> Response:
+        """
+        Acquire an exclusive browser lease.
+
+        POST /sessions
+        """
+        try:
+            body = await request.body()
+            options = LeaseOptions.model_validate_json(body) if body else LeaseOptions()
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid lease options", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+
+        try:
+            session = await manager.acquire(options, tenant=getattr(request.state, "api_key_name", None))
+        except LeaseLimitError as e:
+            return JSONResponse({"error": str(e)}, status_code=429)
+        except (
+            UnknownDeviceError,
+            UnknownVersionError,
+            UnknownLabelError,
+            UnknownExtensionError,
+            LeaseScopeError,
+        ) as e:
+            return JSONResponse({"error": str(e)}, status_code=400)
+        except RuntimeError as e:
+            return JSONResponse({"error": str(e)}, status_code=502)
+
+        if session is None:
+            return JSONResponse(
+                {"error": "No browser instances available for lease"},
+                status_code=503,
+            )
+
+        data = render(request, session)
+        # Only the client acquiring the lease learns its token
+        data["reconnect_token"] = session.reconnect_token
+        data["reconnect_endpoint"] = f"{data['endpoint']}?reconnect_token={session.reconnect_token}"
+        return JSONResponse(data, status_code=201)
+
+    async def list_sessions(request: Request) -> Response:
+        """
+        List the client's active leases, or every client's with an admin key.
+
+        GET /sessions
+        """
+        sessions = [render(request, s) for s in manager.sessions.values() if may_access(request, s.tenant)]
+        return JSONResponse({"sessions": sessions, "count": len(sessions)})
+
+    async def get_session(request: Request) -> Response:
+        """
+        Get a single lease.
+
+        GET /sessions/{id}
+        """
+        session = manager.get_for(request, request.path_params["session_id"])
+        if session is None:
+            return JSONResponse({"error": "Session not found"}, status_code=404)
+        return JSONResponse(render(request, session))
+
+    async def release(request: Request) -> Response:
+        """
+        Release a lease.
+
+        DELETE /sessions/{id}
+        """
+        session = manager.get_for(request, request.path_params["session_id"])
+        if session is not None:
+            session = await manager.release(session.id)
+        if session is None:
+            return JSONResponse({"error": "Session not found"}, status_code=404)
+        return JSONResponse({"status": "released", "id": session.id, "summary": session.summary})
+
+    return [
+        Route("/sessions", acquire, methods=["POST"]),
+        Route("/sessions", list_sessions, methods=["GET"]),
+        Route("/sessions/{session_id}", get_session, methods=["GET"]),
+        Route("/sessions/{session_id}", release, methods=["DELETE"]),
+    ]
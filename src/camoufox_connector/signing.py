@@ -0,0 +1,272 @@
+"""
+Artifact signing for Camoufox Connector.
+
+With ``signing_key`` set, the connector signs what it captures with an
+Ed25519 key, so downstream consumers can prove artifacts weren't modified
+after capture:
+
+- When a lease is released, its stored artifacts (HARs, videos, audit log,
+  kept downloads) are sealed: a manifest listing each file's SHA-256 digest
+  and size is signed and stored with them. Each file can be downloaded as
+  stored and checked against the manifest.
+- Task and flow results carry a ``signature`` over the rest of the result,
+  which covers their HTML, screenshots and extracted data.
+
+Signatures cover the canonical JSON of the signed document without its
+``signature`` field: keys sorted, no whitespace, UTF-8. The public key is
+served on ``GET /signing/key``; the key file is created on first start and
+must be kept to keep signatures verifiable.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import base64
+import hashlib
+import json
+import logging
+import os
+import time
+from dataclasses import dataclass
+from pathlib import Path
+from typing import TYPE_CHECKING, Any, Optional
+
+from starlette.requests import Request
+from starlette.responses import FileResponse, JSONResponse, Response
+from starlette.routing import Route
+
+if TYPE_CHECKING:
+    from .artifacts import ArtifactStore
+    from .sessions import Session
+
+logger = logging.getLogger(__name__)
+
+ALGORITHM = "Ed25519"
+
+MANIFEST = "manifest.json"
+
+
+def canonical(document: dict) -> bytes:
+    """Serialize a document for signing, leaving out its signature."""
+    unsigned = {key: value for key, value in document.items() if key != "signature"}
+    return json.dumps(unsigned, sort_keys=True, separators=(",", ":"), ensure_ascii=False).encode()
+
+
+def file_digest(path: Path) -> str:
+    """SHA-256 hex digest of a file."""
+    digest = hashlib.sha256()
+    with open(path, "rb") as f:
+        for chunk in iter(lambda: f.read(1024 * 1024), b""):
+            digest.update(chunk)
+    return digest.hexdigest()
+
+
+class Signer:
+    """Signs documents with the connector's Ed25519 key."""
+
+    def __init__(self, path: str):
+        try:
+            from cryptography.hazmat.primitives import serialization
+            from cryptography.hazmat.primitives.asymmetric.ed25519 import Ed25519PrivateKey
+        except ImportError as e:
+            raise RuntimeError(
+                "Signing needs the cryptography package: pip install 'camoufox-connector[signing]'"
+            ) from e
+
+        key_path = Path(path)
+        if key_path.exists():
+            key = serialization.load_pem_private_key(key_path.read_bytes(), password=None)
+            if not isinstance(key, Ed25519PrivateKey):
+                raise RuntimeError(f"Signing key {path} is not an Ed25519 key")
+        else:
+            key = Ed25519PrivateKey.generate()
+            key_path.parent.mkdir(parents=True, exist_ok=True)
+            pem = key.private_bytes(
+                serialization.Encoding.PEM,
+                serialization.PrivateFormat.PKCS8,
+                serialization.NoEncryption(),
+            )
+            fd = os.open(key_path, os.O_WRONLY | os.O_CREAT | os.O_EXCL, 0o600)
+            with os.fdopen(fd, "wb") as f:
+                f.write(pem)
+            logger.info(f"Created signing key {path}")
+
+        self._key: Any = key
+        public = key.public_key()
+        raw = public.public_bytes(serialization.Encoding.Raw, serialization.PublicFormat.Raw)
+        self.key_id = hashlib.sha256(raw).hexdigest()[:16]
+        self.public_key_pem = public.public_bytes(
+            serialization.Encoding.PEM,
+            serialization.PublicFormat.SubjectPublicKeyInfo,
+        ).decode()
+
+    def sign(self, document: dict) -> dict:
+        """Sign a document; returns the signature to store in its ``signature`` field."""
+        value = self._key.sign(canonical(document))
+        return {"algorithm": ALGORITHM, "key_id": self.key_id, "value": base64.b64encode(value).decode()}
+
+    def verify(self, document: dict) -> bool:
+        """Check a signed document against its ``signature`` field."""
+        signature = document.get("signature") or {}
+        if signature.get("key_id") != self.key_id:
+            return False
+        try:
+            self._key.public_key().verify(base64.b64decode(signature.get("value", "")), canonical(document))
+        except Exception:
+            return False
+        return True
+
+    def to_dict(self) -> dict:
+        """Describe the public key for verifiers."""
+        return {"algorithm": ALGORITHM, "key_id": self.key_id, "public_key": self.public_key_pem}
+
+
+@dataclass
+class ArtifactSealer:
+    """Seals the artifacts of released sessions in a signed manifest."""
+
+    store: ArtifactStore
+    signer: Signer
+
+    def _artifacts(self, directory: Path) -> list[dict]:
+        """List the files under a session's artifact directory with their digests."""
+        return [
+            {
+                "path": path.relative_to(directory).as_posix(),
+                "size": path.stat().st_size,
+                "sha256": file_digest(path),
+            }
+            for path in sorted(directory.rglob("*"))
+            if path.is_file() and path.parent != directory
+        ]
+
+    def seal(self, session: Session) -> Optional[dict]:
+        """Write the signed manifest of a session's artifacts, if it has any."""
+        directory = self.store.session_directory(session.id)
+        if directory is None or not directory.is_dir():
+            return None
+        artifacts = self._artifacts(directory)
+        if not artifacts:
+            return None
+        manifest = {
+            "session": session.id,
+            "tenant": session.tenant,
+            "instance": session.instance.index,
+            "leased_at": session.created_at,
+            "sealed_at": time.time(),
+            "artifacts": artifacts,
+        }
+        manifest["signature"] = self.signer.sign(manifest)
+        (directory / MANIFEST).write_text(json.dumps(manifest, indent=2))
+        return manifest
+
+    async def release_session(self, session: Session) -> None:
+        """Seal a session's artifacts once the lease is released and they are complete."""
+        try:
+            manifest = await asyncio.to_thread(self.seal, session)
+        except Exception as e:
+            logger.warning(f"Failed to seal artifacts of session {session.id}: {e}")
+            return
+        if manifest is not None:
+            logger.debug(f"Sealed {len(manifest['artifacts'])} artifact(s) of session {session.id}")
+
+    def check(self, session_id: str) -> Optional[dict]:
+        """
+        Load a session's manifest and check it against the stored files.
+
+        Returns:
+            The manifest with the check's outcome, or None if the session isn't sealed
+        """
+        directory = self.store.session_directory(session_id)
+        if directory is None or not (directory / MANIFEST).is_file():
+            return None
+        manifest = json.loads((directory / MANIFEST).read_text())
+        current = {entry["path"]: entry for entry in self._artifacts(directory)}
+        modified, missing = [], []
+        for entry in manifest.get("artifacts", []):
+            found = current.get(entry["path"])
+            if found is None:
+                missing.append(entry["path"])
+            elif found["sha256"] != entry["sha256"]:
+                modified.append(entry["path"])
+        signed = self.signer.verify(manifest)
+        return {
+            "manifest": manifest,
+            "verification": {
+                "signature_valid": signed,
+                "modified": modified,
+                "missing": missing,
+                "intact": signed and not modified and not missing,
+            },
+        }
+
+    def file(self, session_id: str, path: str) -> Optional[Path]:
+        """Resolve a stored artifact by its manifest path, refusing paths outside the session."""
+        directory = self.store.session_directory(session_id)
+        if directory is None:
+            return None
+        target = (directory / path).resolve()
+        if target.parent == directory.resolve() or not target.is_relative_to(directory.resolve()):
+            return None
+        return target if target.is_file() else None
+
+
+def create_signing_routes(sealer: Optional[ArtifactSealer]) -> list[Route]:
+    """
+    Create routes exposing the signing key and sealed artifacts.
+
+    Args:
+        sealer: Artifact sealer, or None when signing is not configured
+
+    Returns:
+        List of Starlette routes
+    """
+    not_configured = {"error": "Signing is not configured"}
+
+    async def get_key(request: Request) -> Response:
+        """
+        Public key verifying the connector's signatures.
+
+        GET /signing/key
+        """
+        if sealer is None:
+            return JSONResponse(not_configured, status_code=404)
+        return JSONResponse(sealer.signer.to_dict())
+
+    async def get_manifest(request: Request) -> Response:
+        """
+        Signed manifest of a released session's artifacts, checked against the stored files.
+
+        GET /sessions/{id}/manifest
+        """
+        if sealer is None:
+            return JSONResponse(not_configured, status_code=404)
+        session_id = request.path_params["session_id"]
+        result = None
+        if await sealer.store.accessible(request, session_id):
+            result = await asyncio.to_thread(sealer.check, session_id)
+        if result is None:
+            return JSONResponse({"error": "No sealed artifacts for this session"}, status_code=404)
+        return JSONResponse(result)
+
+    async def get_artifact(request: Request) -> Response:
+        """
+        Download an artifact file as stored, by its path in the manifest.
+
+        GET /sessions/{id}/artifacts/{path}
+        """
+        if sealer is None:
+            return JSONResponse(not_configured, status_code=404)
+        session_id = request.path_params["session_id"]
+        path = None
+        if await sealer.store.accessible(request, session_id):
+            path = sealer.file(session_id, request.path_params["path"])
+        if path is None:
+            return JSONResponse({"error": "Artifact not found"}, status_code=404)
+        return FileResponse(path, filename=path.name)
+
+    return [
+        Route("/signing/key", get_key, methods=["GET"]),
+        Route("/sessions/{session_id}/manifest", get_manifest, methods=["GET"]),
+        Route("/sessions/{session_id}/artifacts/{path:path}", get_artifact, methods=["GET"]),
+    ]
@@ -0,0 +1,290 @@
+"""
+Latency SLOs for Camoufox Connector.
+
+Operators define objectives in ``slos``: a percentile of API responses
+(``match: POST /sessions``) or of fetch tasks on some domains that must stay
+within a threshold, such as 95% of lease requests within 50 ms. Every
+matching response is timed, and each objective's error budget, the share of
+responses allowed to be slower, is compared with how fast slow responses use
+it up: the burn rate, 1 when the budget lasts exactly the window. An
+objective is at risk while the burn rate exceeds ``alert_burn_rate`` over
+both its window and the last twelfth of it, so alerts fire quickly on a
+sharp slowdown and clear soon after it ends. ``slo-at-risk`` and
+``slo-recovered`` events reach webhooks; ``GET /slo`` and ``/metrics``
+report the objectives continuously.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+import math
+import time
+from collections import deque
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Optional
+from urllib.parse import urlsplit
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .transfer import metric_labels
+
+if TYPE_CHECKING:
+    from .config import SloObjective
+    from .pool import BrowserPool
+    from .tasks import FetchResult, FetchTask, TaskRunner
+
+logger = logging.getLogger(__name__)
+
+# Responses kept per objective; the oldest are dropped first
+MAX_SAMPLES = 100_000
+
+# Seconds between evaluations of the objectives
+CHECK_INTERVAL = 15.0
+
+# Share of the window the short alert window covers
+SHORT_WINDOW = 1 / 12
+
+
+@dataclass
+class SloState:
+    """Timed responses of one objective and whether it is at risk."""
+
+    objective: SloObjective
+    # (time, milliseconds) of each timed response, oldest first
+    samples: deque = field(default_factory=deque)
+    at_risk: bool = False
+    changed_at: float = field(default_factory=time.time)
+
+    def record(self, ms: float, now: float) -> None:
+        """Add a timed response."""
+        self.samples.append((now, ms))
+        if len(self.samples) > MAX_SAMPLES:
+            self.samples.popleft()
+
+    def prune(self, now: float) -> None:
+        """Drop responses older than the window."""
+        cutoff = now - self.objective.window
+        while self.samples and self.samples[0][0] < cutoff:
+            self.samples.popleft()
+
+    def _since(self, start: float) -> list[float]:
+        """Response times since a point in time."""
+        return [ms for at, ms in self.samples if at >= start]
+
+    def burn_rate(self, times: list[float]) -> Optional[float]:
+        """How fast responses use up the error budget; 1 uses it up exactly over the window."""
+        if not times:
+            return None
+        slow = sum(1 for ms in times if ms > self.objective.threshold_ms)
+        budget = 1 - self.objective.percentile / 100
+        return slow / len(times) / budget
+
+    def observed(self, times: list[float]) -> Optional[float]:
+        """The objective's percentile of the response times, in milliseconds."""
+        if not times:
+            return None
+        ordered = sorted(times)
+        rank = math.ceil(self.objective.percentile / 100 * len(ordered)) - 1
+        return ordered[max(0, rank)]
+
+    def evaluate(self, now: float) -> dict:
+        """Measure the objective over its windows."""
+        self.prune(now)
+        times = [ms for _, ms in self.samples]
+        recent = self._since(now - self.objective.window * SHORT_WINDOW)
+        burn = self.burn_rate(times)
+        short_burn = self.burn_rate(recent)
+        alert = self.objective.alert_burn_rate
+        at_risk = (
+            len(times) >= self.objective.min_samples
+            and burn is not None and burn >= alert
+            and short_burn is not None and short_burn >= alert
+        )
+        observed = self.observed(times)
+        return {
+            "name": self.objective.name,
+            "kind": self.objective.kind,
+            "match": self.objective.match,
+            "domains": self.objective.domains if self.objective.kind == "fetch" else None,
+            "percentile": self.objective.percentile,
+            "threshold_ms": self.objective.threshold_ms,
+            "window": self.objective.window,
+            "samples": len(times),
+            "observed_ms": round(observed, 1) if observed is not None else None,
+            "burn_rate": round(burn, 3) if burn is not None else None,
+            "short_burn_rate": round(short_burn, 3) if short_burn is not None else None,
+            "at_risk": at_risk,
+        }
+
+
+@dataclass
+class SloTracker:
+    """Times API responses and fetch tasks against the configured objectives."""
+
+    pool: BrowserPool
+    runner: TaskRunner
+    states: dict[str, SloState] = field(default_factory=dict)
+    _task: Optional[asyncio.Task] = None
+
+    def __post_init__(self) -> None:
+        self.runner.completion_hooks.append(self._on_result)
+
+    def _states(self) -> list[SloState]:
+        """States of the configured objectives; changed objectives start from scratch."""
+        objectives = {slo.name: slo for slo in self.pool.settings.slos}
+        for name in list(self.states):
+            if name not in objectives or self.states[name].objective != objectives[name]:
+                del self.states[name]
+        for name, objective in objectives.items():
+            if name not in self.states:
+                self.states[name] = SloState(objective=objective)
+        return list(self.states.values())
+
+    def record_request(self, method: str, path: str, ms: float) -> None:
+        """Time an API response against the request objectives."""
+        now = time.time()
+        for state in self._states():
+            if state.objective.kind == "request" and state.objective.matches_request(method, path):
+                state.record(ms, now)
+
+    def _on_result(self, task: FetchTask, result: FetchResult) -> None:
+        """Time a finished fetch task against the fetch objectives."""
+        host = urlsplit(task.url).hostname or ""
+        now = time.time()
+        for state in self._states():
+            if state.objective.kind == "fetch" and state.objective.matches_host(host):
+                state.record(result.duration * 1000, now)
+
+    def start(self) -> None:
+        """Start evaluating the objectives."""
+        if self._task is None:
+            self._task = asyncio.create_task(self._loop())
+
+    async def _loop(self) -> None:
+        """Evaluate periodically, so alerts fire without anyone asking."""
+        while True:
+            await asyncio.sleep(CHECK_INTERVAL)
+            try:
+                self.evaluate()
+            except Exception as e:
+                logger.error(f"Failed to evaluate SLOs: {e}")
+
+    def evaluate(self) -> list[dict]:
+        """Measure every objective, publishing events for those that went at risk or recovered."""
+        now = time.time()
+        reports = []
+        for state in self._states():
+            report = state.evaluate(now)
+            if report["at_risk"] != state.at_risk:
+                state.at_risk = report["at_risk"]
+                state.changed_at = now
+                if state.at_risk:
+                    logger.warning(
+                        f"SLO {report['name']} at risk: p{report['percentile']:g} {report['observed_ms']} ms "
+                        f"(threshold {report['threshold_ms']:g} ms), burn rate {report['burn_rate']}"
+                    )
+                self.pool.events.publish(
+                    "slo-at-risk" if state.at_risk else "slo-recovered",
+                    name=report["name"],
+                    observed_ms=report["observed_ms"],
+                    threshold_ms=report["threshold_ms"],
+                    percentile=report["percentile"],
+                    burn_rate=report["burn_rate"],
+                    short_burn_rate=report["short_burn_rate"],
+                )
+            report["since"] = state.changed_at
+            reports.append(report)
+        return reports
+
+    def metrics(self) -> str:
+        """Render the objectives' measurements in the Prometheus text format."""
+        reports = self.evaluate()
+        lines = [
+            "# HELP camoufox_slo_burn_rate Rate at which an SLO's error budget is used up, 1 lasting the window",
+            "# TYPE camoufox_slo_burn_rate gauge",
+        ]
+        for report in reports:
+            for window, key in (("long", "burn_rate"), ("short", "short_burn_rate")):
+                if report[key] is not None:
+                    lines.append(f"camoufox_slo_burn_rate{metric_labels(slo=report['name'], window=window)} {report[key]}")
+        lines += [
+            "# HELP camoufox_slo_latency_ms Observed percentile of an SLO's response times",
+            "# TYPE camoufox_slo_latency_ms gauge",
+        ]
+        for report in reports:
+            if report["observed_ms"] is not None:
+                labels = metric_labels(slo=report["name"], percentile=f"{report['percentile']:g}")
+                lines.append(f"camoufox_slo_latency_ms{labels} {report['observed_ms']}")
+        lines += [
+            "# HELP camoufox_slo_threshold_ms Response time an SLO's percentile must stay within",
+            "# TYPE camoufox_slo_threshold_ms gauge",
+        ]
+        for report in reports:
+            lines.append(f"camoufox_slo_threshold_ms{metric_labels(slo=report['name'])} {report['threshold_ms']:g}")
+        lines += [
+            "# HELP camoufox_slo_at_risk Whether an SLO is at risk",
+            "# TYPE camoufox_slo_at_risk gauge",
+        ]
+        for report in reports:
+            lines.append(f"camoufox_slo_at_risk{metric_labels(slo=report['name'])} {int(report['at_risk'])}")
+        return "\n".join(lines) + "\n"
+
+    async def close(self) -> None:
+        """Stop evaluating the objectives."""
+        if self._task is not None:
+            self._task.cancel()
+            self._task = None
+
+
+class SloMiddleware:
+    """ASGI middleware timing API responses for the request objectives."""
+
+    def __init__(self, app, tracker: SloTracker):
+        self.app = app
+        self.tracker = tracker
+
+    async def __call__(self, scope, receive, send) -> None:
+        if scope["type"] != "http" or not self.tracker.pool.settings.slos:
+            await self.app(scope, receive, send)
+            return
+
+        started = time.perf_counter()
+        timed = False
+
+        async def timed_send(message) -> None:
+            nonlocal timed
+            # Timed to the start of the response, so streams such as /events count too
+            if message["type"] == "http.response.start" and not timed:
+                timed = True
+                ms = (time.perf_counter() - started) * 1000
+                self.tracker.record_request(scope["method"], scope["path"], ms)
+            await send(message)
+
+        await self.app(scope, receive, timed_send)
+
+
+def create_slo_routes(tracker: SloTracker) -> list[Route]:
+    """
+    Create routes reporting the SLOs.
+
+    Args:
+        tracker: Tracker timing responses against the objectives
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_slos(request: Request) -> Response:
+        """
+        The configured SLOs, their observed percentile and burn rates.
+
+        GET /slo
+        """
+        return JSONResponse({"slos": tracker.evaluate()})
+
+    return [
+        Route("/slo", get_slos, methods=["GET"]),
+    ]
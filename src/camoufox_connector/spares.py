@@ -0,0 +1,120 @@
+"""
+Warm spare browsers for Camoufox Connector.
+
+Cold-launching Camoufox takes several seconds, which dominates the latency
+of short tasks whenever every browser is leased. With ``warm_spares`` set
+(``--warm-spares N``), the pool keeps at least N launched, unleased browsers
+ready: as leases are issued, spares are launched in the background past
+``pool_size``, so the next lease gets a browser that is already up, and
+they are removed again as leases are released. Browsers that are starting,
+or waiting to be restarted, count as spares, so failing launches don't make
+the pool grow without bound. Growth stops at the host's estimated capacity.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Optional
+
+from .events import Event
+
+if TYPE_CHECKING:
+    from .pool import BrowserInstance, BrowserPool
+
+logger = logging.getLogger(__name__)
+
+# Events that may change how many spares there are
+WAKE_EVENTS = {
+    "lease-acquired",
+    "lease-released",
+    "config-reloaded",
+    "pool-scaled",
+    "browser-removed",
+}
+
+# Checked between events, e.g. for browsers drained or resumed
+CHECK_INTERVAL = 10.0
+
+
+@dataclass
+class SpareKeeper:
+    """Grows and shrinks the pool to keep warm spares ready."""
+
+    pool: BrowserPool
+    _wake: asyncio.Event = field(default_factory=asyncio.Event)
+    # Whether the host's capacity held spares back, to warn once
+    _capped: bool = False
+    _task: Optional[asyncio.Task] = None
+
+    def __post_init__(self) -> None:
+        self.pool.events.listeners.append(self.handle)
+
+    async def handle(self, event: Event) -> None:
+        """Check the spares as soon as leases come and go."""
+        if event.type in WAKE_EVENTS:
+            self._wake.set()
+
+    def start(self) -> None:
+        """Start keeping spares."""
+        if self._task is None:
+            self._task = asyncio.create_task(self._loop())
+
+    async def _loop(self) -> None:
+        """Replenish now, after leases change and periodically."""
+        while True:
+            self._wake.clear()
+            try:
+                await self.replenish()
+            except Exception as e:
+                logger.error(f"Failed to replenish warm spares: {e}")
+            try:
+                await asyncio.wait_for(self._wake.wait(), timeout=CHECK_INTERVAL)
+            except asyncio.TimeoutError:
+                pass
+
+    @property
+    def wanted(self) -> int:
+        """Spares the settings ask for; only pools have any."""
+        settings = self.pool.settings
+        return settings.warm_spares if settings.mode.value == "pool" else 0
+
+    @staticmethod
+    def is_spare(instance: BrowserInstance) -> bool:
+        """Whether an instance is, or is about to be, ready for a lease."""
+        return not instance.is_leased and not instance.draining and not instance.retiring
+
+    async def replenish(self) -> None:
+        """Add spares launched in the background, or remove surplus ones."""
+        pool = self.pool
+        spares = sum(1 for inst in pool.instances if self.is_spare(inst))
+        previous = pool.spare_instances
+        count = previous
+
+        if spares < self.wanted:
+            count = previous + self.wanted - spares
+            limit = pool.get_capacity()["max_browsers"]
+            capped = limit is not None and len(pool.instances) + count - previous > limit
+            if capped:
+                count = max(previous, limit - len(pool.instances) + previous)
+                if not self._capped:
+                    logger.warning(
+                        f"Keeping fewer than {self.wanted} warm spare(s): "
+                        f"the host has capacity for {limit} browser(s)"
+                    )
+            self._capped = capped
+        elif spares > self.wanted:
+            count = max(0, previous - (spares - self.wanted))
+
+        if count == previous:
+            return
+        logger.info(f"Keeping {count} browser(s) past the configured size as warm spares ({spares} idle)")
+        pool.events.publish("warm-spares-resized", previous=previous, spare_instances=count, idle=spares)
+        await pool.resize_spares(count)
+
+    async def close(self) -> None:
+        """Stop keeping spares."""
+        if self._task is not None:
+            self._task.cancel()
+            self._task = None
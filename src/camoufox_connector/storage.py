@@ -0,0 +1,342 @@
+"""
+Storage drivers for Camoufox Connector.
+
+The connector works on local files: browsers write HARs, videos and
+downloads to disk, and artifacts of released sessions are deleted after
+``artifact_ttl``. With ``storage`` set, session artifacts (including audit
+logs, screenshots and evidence archives) and profile templates are also
+kept by a storage driver, so they outlive the connector's disk. Expired
+local copies are downloaded again when they are asked for. ``storage_kinds``
+chooses another driver, or none, for one kind of artifact, e.g. videos in a
+cheaper bucket.
+
+Drivers are chosen by the URL's scheme. ``file:///path`` and
+``s3://bucket/prefix`` are built in; other backends, such as GCS or Azure,
+are added without forking by calling ``register_driver`` or by installing a
+package with a ``camoufox_connector.storage`` entry point naming a factory
+that takes the URL.
+"""
+
+from __future__ import annotations
+
+import json
+import logging
+from dataclasses import dataclass, field
+from importlib.metadata import entry_points
+from pathlib import Path
+from typing import Any, Callable, Optional
+from urllib.parse import parse_qs, urlsplit
+
+logger = logging.getLogger(__name__)
+
+ENTRY_POINT_GROUP = "camoufox_connector.storage"
+
+# Directory of the local driver keeping objects' metadata
+META_DIRECTORY = ".meta"
+
+
+@dataclass
+class ObjectInfo:
+    """A stored object's key, size and metadata."""
+
+    key: str
+    size: int
+    modified: float
+    metadata: dict[str, str] = field(default_factory=dict)
+
+
+@dataclass
+class StoredObject:
+    """A stored object's contents with its description."""
+
+    data: bytes
+    info: ObjectInfo
+
+
+class StorageDriver:
+    """
+    Base class for storage drivers.
+
+    Keys are ``/``-separated paths such as ``artifacts/<session>/har/<name>``.
+    Methods block, and are called from worker threads.
+    """
+
+    def put(self, key: str, data: bytes, metadata: Optional[dict[str, str]] = None) -> None:
+        """Store an object, replacing any with the same key."""
+        raise NotImplementedError
+
+    def get(self, key: str) -> Optional[StoredObject]:
+        """Get an object, or None if there is none."""
+        raise NotImplementedError
+
+    def list(self, prefix: str) -> list[ObjectInfo]:
+        """List the objects whose keys start with a prefix."""
+        raise NotImplementedError
+
+    def delete(self, key: str) -> None:
+        """Delete an object; deleting a missing one is not an error."""
+        raise NotImplementedError
+
+    def signed_url(self, key: str, expires: int) -> Optional[str]:
+        """A URL downloading an object without credentials for some seconds, or None if the driver has none."""
+        return None
+
+    def close(self) -> None:
+        """Release the driver's connections."""
+
+
+class LocalDriver(StorageDriver):
+    """Keeps objects as files in a directory, with their metadata alongside."""
+
+    def __init__(self, root: str):
+        self.root = Path(root).expanduser()
+        self.root.mkdir(parents=True, exist_ok=True)
+
+    def _path(self, key: str, meta: bool = False) -> Path:
+        """File of an object or of its metadata."""
+        parts = [part for part in key.split("/") if part]
+        if not parts or any(part in (".", "..") for part in parts) or parts[0] == META_DIRECTORY:
+            raise ValueError(f"Invalid storage key: {key}")
+        if meta:
+            return self.root / META_DIRECTORY / Path(*parts).with_name(f"{parts[-1]}.json")
+        return self.root.joinpath(*parts)
+
+    def _info(self, key: str, path: Path) -> ObjectInfo:
+        """Describe a stored file."""
+        stat = path.stat()
+        try:
+            metadata = json.loads(self._path(key, meta=True).read_text())
+        except (OSError, ValueError):
+            metadata = {}
+        return ObjectInfo(key=key, size=stat.st_size, modified=stat.st_mtime, metadata=metadata)
+
+    def put(self, key: str, data: bytes, metadata: Optional[dict[str, str]] = None) -> None:
+        path = self._path(key)
+        path.parent.mkdir(parents=True, exist_ok=True)
+        temp = path.with_name(f".{path.name}.tmp")
+        temp.write_bytes(data)
+        temp.replace(path)
+        meta = self._path(key, meta=True)
+        meta.parent.mkdir(parents=True, exist_ok=True)
+        meta.write_text(json.dumps(metadata or {}))
+
+    def get(self, key: str) -> Optional[StoredObject]:
+        path = self._path(key)
+        try:
+            data = path.read_bytes()
+        except OSError:
+            return None
+        return StoredObject(data=data, info=self._info(key, path))
+
+    def list(self, prefix: str) -> list[ObjectInfo]:
+        objects = []
+        for path in sorted(self.root.rglob("*")):
+            relative = path.relative_to(self.root)
+            if not path.is_file() or relative.parts[0] == META_DIRECTORY or path.name.startswith("."):
+                continue
+            key = relative.as_posix()
+            if key.startswith(prefix):
+                objects.append(self._info(key, path))
+        return objects
+
+    def delete(self, key: str) -> None:
+        self._path(key).unlink(missing_ok=True)
+        self._path(key, meta=True).unlink(missing_ok=True)
+
+
+class S3Driver(StorageDriver):
+    """
+    Keeps objects in an S3 bucket, or any S3-compatible service.
+
+    ``s3://bucket/prefix?region=eu-west-1&endpoint=https://minio:9000`` takes
+    credentials from the usual AWS environment variables or config files.
+    """
+
+    def __init__(self, url: str):
+        try:
+            import boto3
+        except ImportError as e:
+            raise RuntimeError(
+                "The S3 storage driver needs the boto3 package: pip install 'camoufox-connector[s3]'"
+            ) from e
+        parts = urlsplit(url)
+        if not parts.netloc:
+            raise ValueError(f"S3 storage URL needs a bucket: {url}")
+        query = {key: values[-1] for key, values in parse_qs(parts.query).items()}
+        self.bucket = parts.netloc
+        self.prefix = parts.path.strip("/")
+        self._client: Any = boto3.client(
+            "s3",
+            region_name=query.get("region"),
+            endpoint_url=query.get("endpoint"),
+        )
+
+    def _key(self, key: str) -> str:
+        """Object key in the bucket."""
+        return f"{self.prefix}/{key}" if self.prefix else key
+
+    def _unkey(self, key: str) -> str:
+        """Driver key of an object key in the bucket."""
+        return key[len(self.prefix) + 1:] if self.prefix else key
+
+    def put(self, key: str, data: bytes, metadata: Optional[dict[str, str]] = None) -> None:
+        self._client.put_object(Bucket=self.bucket, Key=self._key(key), Body=data, Metadata=metadata or {})
+
+    def get(self, key: str) -> Optional[StoredObject]:
+        try:
+            response = self._client.get_object(Bucket=self.bucket, Key=self._key(key))
+        except self._client.exceptions.NoSuchKey:
+            return None
+        data = response["Body"].read()
+        info = ObjectInfo(
+            key=key,
+            size=len(data),
+            modified=response["LastModified"].timestamp(),
+            metadata=response.get("Metadata") or {},
+        )
+        return StoredObject(data=data, info=info)
+
+    def list(self, prefix: str) -> list[ObjectInfo]:
+        objects = []
+        paginator = self._client.get_paginator("list_objects_v2")
+        for page in paginator.paginate(Bucket=self.bucket, Prefix=self._key(prefix)):
+            for item in page.get("Contents", []):
+                # Listing doesn't return metadata; get() does
+                objects.append(ObjectInfo(
+                    key=self._unkey(item["Key"]),
+                    size=item["Size"],
+                    modified=item["LastModified"].timestamp(),
+                ))
+        return objects
+
+    def delete(self, key: str) -> None:
+        self._client.delete_object(Bucket=self.bucket, Key=self._key(key))
+
+    def signed_url(self, key: str, expires: int) -> Optional[str]:
+        return self._client.generate_presigned_url(
+            "get_object",
+            Params={"Bucket": self.bucket, "Key": self._key(key)},
+            ExpiresIn=expires,
+        )
+
+
+DriverFactory = Callable[[str], StorageDriver]
+
+DRIVERS: dict[str, DriverFactory] = {
+    "file": lambda url: LocalDriver(urlsplit(url).path),
+    "s3": S3Driver,
+}
+
+
+def register_driver(scheme: str, factory: DriverFactory) -> None:
+    """
+    Make a storage driver available for URLs with a scheme.
+
+    Args:
+        scheme: URL scheme, e.g. gs or azure
+        factory: Creates the driver from the configured URL
+    """
+    DRIVERS[scheme] = factory
+
+
+def open_storage(url: Optional[str]) -> Optional[StorageDriver]:
+    """
+    Open the configured storage driver.
+
+    Args:
+        url: file:///path, s3://bucket/prefix, a URL of a registered driver, or None for none
+
+    Returns:
+        The storage driver, or None when everything stays on local disk only
+
+    Raises:
+        ValueError: If no driver handles the URL's scheme
+    """
+    if not url:
+        return None
+    scheme = urlsplit(url).scheme
+    factory = DRIVERS.get(scheme)
+    if factory is None:
+        for entry_point in entry_points(group=ENTRY_POINT_GROUP):
+            if entry_point.name == scheme:
+                factory = entry_point.load()
+                register_driver(scheme, factory)
+                break
+    if factory is None:
+        raise ValueError(f"No storage driver for {scheme}:// URLs")
+    driver = factory(url)
+    logger.info(f"Keeping artifacts with the {scheme} storage driver")
+    return driver
+
+
+def open_kind_storage(
+    urls: dict[str, Optional[str]],
+    opened: dict[str, StorageDriver],
+) -> dict[str, Optional[StorageDriver]]:
+    """
+    Open the storage drivers configured for kinds of artifacts.
+
+    Args:
+        urls: Storage URL by artifact kind, None keeping the kind on local disk only
+        opened: Drivers already open by URL, reused and added to
+
+    Returns:
+        The driver of each kind, None for local disk only
+    """
+    drivers: dict[str, Optional[StorageDriver]] = {}
+    for kind, url in urls.items():
+        if url and url not in opened:
+            opened[url] = open_storage(url)
+        drivers[kind] = opened[url] if url else None
+    return drivers
+
+
+def upload_directory(
+    driver: StorageDriver,
+    directory: Path,
+    prefix: str,
+    metadata: dict[str, str],
+    only: Optional[set[str]] = None,
+) -> int:
+    """
+    Store every file under a directory that is not stored yet; returns the number stored.
+
+    ``only`` limits the upload to the directory's entries of those names.
+    """
+    if not directory.is_dir():
+        return 0
+    stored = {info.key for info in driver.list(f"{prefix}/")}
+    count = 0
+    for path in sorted(directory.rglob("*")):
+        relative = path.relative_to(directory)
+        if only is not None and relative.parts[0] not in only:
+            continue
+        key = f"{prefix}/{relative.as_posix()}"
+        if path.is_file() and key not in stored:
+            driver.put(key, path.read_bytes(), metadata)
+            count += 1
+    return count
+
+
+def download_directory(driver: StorageDriver, prefix: str, directory: Path) -> int:
+    """Restore the objects under a prefix as files of a directory; returns the number restored."""
+    count = 0
+    for info in driver.list(f"{prefix}/"):
+        stored = driver.get(info.key)
+        if stored is None:
+            continue
+        path = directory.joinpath(*info.key[len(prefix) + 1:].split("/"))
+        if ".." in path.relative_to(directory).parts:
+            continue
+        path.parent.mkdir(parents=True, exist_ok=True)
+        path.write_bytes(stored.data)
+        count += 1
+    return count
+
+
+def delete_prefix(driver: StorageDriver, prefix: str) -> int:
+    """Delete the objects under a prefix; returns the number deleted."""
+    objects = driver.list(f"{prefix}/")
+    for info in objects:
+        driver.delete(info.key)
+    return len(objects)
@@ -0,0 +1,379 @@
+"""
+Streaming scrapes for Camoufox Connector.
+
+Live scores, auctions and tickers change by the second; polling them with
+fetch tasks reloads the page every time and still misses changes between
+polls. A stream keeps one page open on a leased browser for a bounded
+duration and pushes what changes to the client as it happens: the fields of
+its ``watch`` rules whenever their values change, and the XHR/fetch
+responses and WebSocket messages matching its ``capture`` options as they
+arrive. ``POST /tasks/stream`` sends the messages as Server-Sent Events;
+``/tasks/stream/ws`` takes the stream as its first WebSocket message and
+sends them back as JSON messages. The browser is released when the stream
+ends, or as soon as the client goes away.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import json
+import logging
+import time
+from typing import TYPE_CHECKING, AsyncIterator, Literal, Optional
+
+from pydantic import BaseModel, ConfigDict, Field, ValidationError, field_validator, model_validator
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response, StreamingResponse
+from starlette.routing import Route, WebSocketRoute
+from starlette.websockets import WebSocket, WebSocketDisconnect
+
+from .capture import CaptureOptions, ResponseCapture
+from .devices import UnknownDeviceError
+from .dialogs import DialogRule
+from .events import KEEPALIVE_INTERVAL
+from .evidence import EvidenceNotConfigured
+from .extensions import UnknownExtensionError
+from .extract import ExtractRule, extract
+from .ratelimit import RateLimited
+from .sessions import LeaseLimitError, LeaseOptions, LeaseScopeError, UnknownLabelError, UnknownVersionError
+from .tasks import navigation_protocol
+
+if TYPE_CHECKING:
+    from .tasks import TaskRunner
+
+logger = logging.getLogger(__name__)
+
+# Errors of a stream's lease options, answered with 400
+LEASE_ERRORS = (
+    UnknownDeviceError,
+    UnknownVersionError,
+    UnknownLabelError,
+    UnknownExtensionError,
+    LeaseScopeError,
+    EvidenceNotConfigured,
+)
+
+
+class StreamUnavailable(Exception):
+    """Raised when no browser is available for a stream."""
+
+
+# Errors a stream may fail with before it starts
+START_ERRORS = (RateLimited, LeaseLimitError, StreamUnavailable, RuntimeError, *LEASE_ERRORS)
+
+# Close code of WebSocket streams that were invalid or rejected
+WS_REJECTED = 4400
+
+
+class StreamTask(BaseModel):
+    """A page kept open while its changes are pushed to the client."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    url: str = Field(description="Page to open")
+
+    watch: dict[str, ExtractRule] = Field(
+        default_factory=dict,
+        description="Fields to extract repeatedly; their values are pushed whenever they change",
+    )
+
+    capture: Optional[CaptureOptions] = Field(
+        default=None,
+        description="XHR/fetch responses and WebSocket messages to push as they arrive",
+    )
+
+    duration: float = Field(
+        default=300.0,
+        gt=0,
+        le=3600,
+        description="Seconds the page is kept open",
+    )
+
+    interval: float = Field(
+        default=1.0,
+        ge=0.25,
+        le=60,
+        description="Seconds between extractions of the watched fields",
+    )
+
+    max_messages: int = Field(
+        default=10000,
+        ge=1,
+        le=100000,
+        description="Messages pushed before the stream ends",
+    )
+
+    wait_until: Literal["commit", "domcontentloaded", "load", "networkidle"] = Field(
+        default="load",
+        description="Navigation event to wait for before watching",
+    )
+
+    timeout: float = Field(
+        default=30.0,
+        gt=0,
+        le=300,
+        description="Navigation timeout in seconds",
+    )
+
+    dialogs: list[DialogRule] = Field(
+        default_factory=list,
+        description="Dialog rules for this stream, tried before the configured ones",
+    )
+
+    lease: LeaseOptions = Field(
+        default_factory=LeaseOptions,
+        description="Options for the browser lease the stream runs on",
+    )
+
+    @field_validator("url")
+    @classmethod
+    def validate_url(cls, v: str) -> str:
+        """Streams open http(s) pages."""
+        if not v.startswith(("http://", "https://")):
+            raise ValueError("URL must start with http:// or https://")
+        return v
+
+    @model_validator(mode="after")
+    def check_watching(self) -> StreamTask:
+        """A stream watches fields, captures traffic, or both."""
+        if not self.watch and self.capture is None:
+            raise ValueError("A stream needs watch rules, capture options or both")
+        return self
+
+
+async def run_stream(
+    runner: TaskRunner, task: StreamTask, tenant: Optional[str] = None
+) -> AsyncIterator[Optional[dict]]:
+    """
+    Open a page on a leased browser and yield its changes until the stream ends.
+
+    Messages are dicts with a ``type``: ``started``, then ``data`` with the
+    watched fields' changed values and ``capture`` with captured traffic, and
+    ``ended`` with the reason. None is yielded when nothing happened for a
+    while, for the transport to keep the connection alive.
+
+    Raises:
+        StreamUnavailable: If no browser was available.
+        The same errors as :meth:`TaskRunner.fetch`, before the first message.
+    """
+    async with runner.limiter.slot(task.url):
+        session = await runner.sessions.acquire(task.lease, tenant=tenant)
+        if session is None:
+            raise StreamUnavailable("No browser instances available for the stream")
+
+        started = time.time()
+        messages = 0
+        reason = "duration"
+        error = None
+        queue: asyncio.Queue = asyncio.Queue()
+        capture = None
+        if task.capture is not None:
+            capture = ResponseCapture(options=task.capture, listener=queue.put_nowait)
+        try:
+            browser = await runner.connect(session)
+            try:
+                context = await browser.new_context()
+                dialogs: list[dict] = []
+                runner.handle_dialogs(context, task.dialogs, dialogs)
+                if capture is not None:
+                    capture.attach(context)
+                page = await context.new_page()
+                page.on("close", lambda _: queue.put_nowait(None))
+                page.on("crash", lambda _: queue.put_nowait(None))
+
+                response = await page.goto(task.url, wait_until=task.wait_until, timeout=task.timeout * 1000)
+                yield {
+                    "type": "started",
+                    "url": task.url,
+                    "final_url": page.url,
+                    "status": response.status if response else None,
+                    "protocol": await navigation_protocol(page),
+                    "instance": session.instance.index,
+                    "time": time.time(),
+                }
+
+                loop = asyncio.get_running_loop()
+                deadline = loop.time() + task.duration
+                next_poll = loop.time()
+                last_message = loop.time()
+                values: dict = {}
+                while True:
+                    now = loop.time()
+                    if now >= deadline:
+                        break
+                    if messages >= task.max_messages:
+                        reason = "max_messages"
+                        break
+
+                    if task.watch and now >= next_poll:
+                        data, errors = await extract(page, task.watch)
+                        changed = {
+                            name: value for name, value in data.items() if name not in values or values[name] != value
+                        }
+                        values.update(data)
+                        next_poll = loop.time() + task.interval
+                        if changed:
+                            messages += 1
+                            last_message = loop.time()
+                            yield {"type": "data", "data": changed, "errors": errors or None, "time": time.time()}
+                        continue
+
+                    wake = min(deadline, next_poll if task.watch else deadline, last_message + KEEPALIVE_INTERVAL)
+                    try:
+                        entry = await asyncio.wait_for(queue.get(), timeout=max(0.0, wake - now))
+                    except asyncio.TimeoutError:
+                        if loop.time() >= last_message + KEEPALIVE_INTERVAL:
+                            last_message = loop.time()
+                            yield None
+                        continue
+                    if entry is None:
+                        reason = "page-closed"
+                        break
+                    messages += 1
+                    last_message = loop.time()
+                    yield {"type": "capture", "entry": entry, "time": time.time()}
+            finally:
+                await browser.close()
+        except Exception as e:
+            logger.warning(f"Stream of {task.url} failed: {e}")
+            reason = "error"
+            error = str(e)
+        finally:
+            await runner.sessions.release(session.id)
+
+        yield {
+            "type": "ended",
+            "reason": reason,
+            "error": error,
+            "messages": messages,
+            "duration": round(time.time() - started, 2),
+        }
+
+
+def _rejection(e: Exception) -> tuple[int, dict, dict]:
+    """Status, body and headers answering a stream that could not start."""
+    if isinstance(e, RateLimited):
+        return 429, {"error": str(e), "domain": e.host}, {"Retry-After": str(max(1, round(e.retry_after)))}
+    if isinstance(e, LeaseLimitError):
+        return 429, {"error": str(e)}, {}
+    if isinstance(e, LEASE_ERRORS):
+        return 400, {"error": str(e)}, {}
+    if isinstance(e, StreamUnavailable):
+        return 503, {"error": str(e)}, {}
+    return 502, {"error": str(e)}, {}
+
+
+def create_stream_routes(runner: TaskRunner) -> list:
+    """
+    Create routes streaming page changes.
+
+    Args:
+        runner: Task runner whose browsers the streams run on
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def stream_sse(request: Request) -> Response:
+        """
+        Keep a page open and stream its changes as Server-Sent Events.
+
+        POST /tasks/stream
+        """
+        try:
+            task = StreamTask.model_validate_json(await request.body())
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid stream", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+
+        messages = run_stream(runner, task, tenant=getattr(request.state, "api_key_name", None))
+        # Streams that can't start are answered with a status code; the first message is sent once the page is open
+        try:
+            first = await messages.__anext__()
+        except START_ERRORS as e:
+            status, body, headers = _rejection(e)
+            return JSONResponse(body, status_code=status, headers=headers)
+        if first["type"] == "ended":
+            await messages.aclose()
+            return JSONResponse(first, status_code=502)
+
+        async def body() -> AsyncIterator[str]:
+            try:
+                message = first
+                while True:
+                    if message is None:
+                        yield ": keep-alive\n\n"
+                    else:
+                        yield f"event: {message['type']}\ndata: {json.dumps(message)}\n\n"
+                        if message["type"] == "ended":
+                            return
+                    if await request.is_disconnected():
+                        return
+                    message = await messages.__anext__()
+            finally:
+                await messages.aclose()
+
+        return StreamingResponse(
+            body(),
+            media_type="text/event-stream",
+            headers={"Cache-Control": "no-cache", "X-Accel-Buffering": "no"},
+        )
+
+    async def stream_ws(websocket: WebSocket) -> None:
+        """
+        Keep a page open and send its changes as WebSocket messages.
+
+        WS /tasks/stream/ws
+        """
+        await websocket.accept()
+        try:
+            task = StreamTask.model_validate_json(await websocket.receive_text())
+        except ValidationError as e:
+            details = e.errors(include_url=False, include_context=False)
+            await websocket.send_json({"type": "error", "error": "Invalid stream", "details": details})
+            await websocket.close(code=WS_REJECTED)
+            return
+        except WebSocketDisconnect:
+            return
+
+        messages = run_stream(runner, task, tenant=websocket.scope.get("state", {}).get("api_key_name"))
+        try:
+            try:
+                message = await messages.__anext__()
+            except START_ERRORS as e:
+                status, body, _ = _rejection(e)
+                await websocket.send_json({"type": "error", "status": status, **body})
+                await websocket.close(code=1013 if status in (429, 503) else WS_REJECTED)
+                return
+
+            # The client only listens; anything it sends, or its going away, ends the stream early
+            client = asyncio.ensure_future(websocket.receive())
+            try:
+                while True:
+                    if message is not None:
+                        await websocket.send_json(message)
+                        if message["type"] == "ended":
+                            break
+                    pending = asyncio.ensure_future(messages.__anext__())
+                    done, _ = await asyncio.wait({pending, client}, return_when=asyncio.FIRST_COMPLETED)
+                    if pending not in done:
+                        pending.cancel()
+                        await asyncio.gather(pending, return_exceptions=True)
+                        if client.result()["type"] == "websocket.disconnect":
+                            return
+                        break
+                    message = pending.result()
+                await websocket.close()
+            finally:
+                client.cancel()
+        except WebSocketDisconnect:
+            pass
+        finally:
+            await messages.aclose()
+
+    return [
+        Route("/tasks/stream", stream_sse, methods=["POST"]),
+        WebSocketRoute("/tasks/stream/ws", stream_ws),
+    ]
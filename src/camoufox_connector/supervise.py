@@ -0,0 +1,223 @@
+"""
+Cross-platform supervision of browser processes.
+
+A browser is a tree of processes: the Python launcher, Playwright's Node.js
+browser server, and Firefox, which Playwright starts in a process group of
+its own on Linux and macOS. Ending only the launcher leaves the rest running,
+so browsers are held together and stopped as a whole:
+
+- On Linux and macOS, launchers lead a session and process group of their
+  own. Stopping a browser sends SIGTERM to the launcher's group and every
+  process of its tree, which lets the Node.js server and Firefox shut down
+  cleanly, waits for the whole tree to exit, and kills what is left of it
+  after a grace period. Launchers also watch the connector and take their
+  browser down when it goes away. Descendants orphaned onto the connector,
+  as happens when it runs as PID 1 in a container without an init, are
+  reaped.
+- On Windows, each launcher is put in a job object that kills every process
+  in it when the job is closed, so nothing outlives the launcher or the
+  connector, even after a crash. Windowless processes can't be asked to
+  exit, so stopping a browser ends its job at once.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+import os
+import signal
+import sys
+from typing import Any
+
+from .procutil import process_alive, process_tree
+
+logger = logging.getLogger(__name__)
+
+# Seconds a browser gets to exit after being asked to, before it is killed
+GRACE_PERIOD = 5.0
+
+POLL_INTERVAL = 0.1
+
+CREATE_NO_WINDOW = 0x08000000
+
+# Windows job object constants
+JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE = 0x2000
+JOB_OBJECT_EXTENDED_LIMIT_INFORMATION = 9
+PROCESS_SET_QUOTA = 0x0100
+PROCESS_TERMINATE = 0x0001
+
+# Job object handles by launcher PID, on Windows
+_jobs: dict[int, Any] = {}
+
+
+def spawn_options() -> dict:
+    """Keyword arguments starting a launcher apart from the connector's own process group or console."""
+    if sys.platform == "win32":
+        return {"creationflags": CREATE_NO_WINDOW}
+    # Its own process group, so the whole browser can be signalled at once and
+    # terminal signals meant for the connector don't reach it directly
+    return {"start_new_session": True}
+
+
+def _kernel32() -> Any:
+    import ctypes
+    from ctypes import wintypes
+
+    kernel32 = ctypes.WinDLL("kernel32", use_last_error=True)
+    kernel32.CreateJobObjectW.restype = wintypes.HANDLE
+    kernel32.OpenProcess.restype = wintypes.HANDLE
+    return kernel32
+
+
+def _create_job(pid: int) -> Any:
+    """Put a process in a new job object that kills its processes when closed."""
+    import ctypes
+    from ctypes import wintypes
+
+    class BasicLimits(ctypes.Structure):
+        _fields_ = [
+            ("PerProcessUserTimeLimit", ctypes.c_int64),
+            ("PerJobUserTimeLimit", ctypes.c_int64),
+            ("LimitFlags", wintypes.DWORD),
+            ("MinimumWorkingSetSize", ctypes.c_size_t),
+            ("MaximumWorkingSetSize", ctypes.c_size_t),
+            ("ActiveProcessLimit", wintypes.DWORD),
+            ("Affinity", ctypes.c_size_t),
+            ("PriorityClass", wintypes.DWORD),
+            ("SchedulingClass", wintypes.DWORD),
+        ]
+
+    class IoCounters(ctypes.Structure):
+        _fields_ = [
+            (name, ctypes.c_uint64)
+            for name in (
+                "ReadOperationCount", "WriteOperationCount", "OtherOperationCount",
+                "ReadTransferCount", "WriteTransferCount", "OtherTransferCount",
+            )
+        ]
+
+    class ExtendedLimits(ctypes.Structure):
+        _fields_ = [
+            ("BasicLimitInformation", BasicLimits),
+            ("IoInfo", IoCounters),
+            ("ProcessMemoryLimit", ctypes.c_size_t),
+            ("JobMemoryLimit", ctypes.c_size_t),
+            ("PeakProcessMemoryUsed", ctypes.c_size_t),
+            ("PeakJobMemoryUsed", ctypes.c_size_t),
+        ]
+
+    kernel32 = _kernel32()
+    job = kernel32.CreateJobObjectW(None, None)
+    if not job:
+        raise OSError(ctypes.get_last_error(), "CreateJobObjectW failed")
+    try:
+        limits = ExtendedLimits()
+        limits.BasicLimitInformation.LimitFlags = JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+        if not kernel32.SetInformationJobObject(
+            job, JOB_OBJECT_EXTENDED_LIMIT_INFORMATION, ctypes.byref(limits), ctypes.sizeof(limits)
+        ):
+            raise OSError(ctypes.get_last_error(), "SetInformationJobObject failed")
+        process = kernel32.OpenProcess(PROCESS_SET_QUOTA | PROCESS_TERMINATE, False, pid)
+        if not process:
+            raise OSError(ctypes.get_last_error(), "OpenProcess failed")
+        try:
+            if not kernel32.AssignProcessToJobObject(job, process):
+                raise OSError(ctypes.get_last_error(), "AssignProcessToJobObject failed")
+        finally:
+            kernel32.CloseHandle(process)
+    except OSError:
+        kernel32.CloseHandle(job)
+        raise
+    return job
+
+
+def adopt(process: asyncio.subprocess.Process) -> None:
+    """
+    Hold together a launcher and every process it starts.
+
+    Launchers are adopted before they are given their launch kwargs, so the
+    browser processes they start belong to their job from the start.
+    """
+    if sys.platform != "win32":
+        return
+    try:
+        _jobs[process.pid] = _create_job(process.pid)
+    except OSError as e:
+        logger.warning(f"Browser processes of launcher {process.pid} won't be stopped with it: {e}")
+
+
+def release(process: asyncio.subprocess.Process) -> None:
+    """Close a launcher's job object, ending whatever still runs in it."""
+    job = _jobs.pop(process.pid, None)
+    if job is not None:
+        _kernel32().CloseHandle(job)
+
+
+def _signal_group(pgid: int, sig: int) -> None:
+    """Signal a process group, if it still exists."""
+    try:
+        os.killpg(pgid, sig)
+    except (ProcessLookupError, PermissionError):
+        pass
+
+
+def _signal_all(pids: list[int], sig: int) -> None:
+    """Signal processes, skipping those already gone."""
+    for pid in pids:
+        try:
+            os.kill(pid, sig)
+        except (ProcessLookupError, PermissionError):
+            pass
+
+
+def _reap(pids: list[int]) -> None:
+    """Reap descendants orphaned onto the connector, which only happens when it is their new parent."""
+    for pid in pids:
+        try:
+            os.waitpid(pid, os.WNOHANG)
+        except ChildProcessError:
+            pass
+
+
+async def stop_process_tree(process: asyncio.subprocess.Process, grace: float = GRACE_PERIOD) -> bool:
+    """
+    Stop a launcher and the browser it started, politely first.
+
+    Returns:
+        Whether the browser exited within the grace period, rather than being killed.
+    """
+    if sys.platform == "win32":
+        if process.returncode is None:
+            process.terminate()
+        release(process)
+        try:
+            await asyncio.wait_for(process.wait(), timeout=grace)
+        except asyncio.TimeoutError:
+            process.kill()
+            await process.wait()
+            return False
+        return True
+
+    # Firefox runs in a process group of Playwright's, so the tree is collected before it comes apart.
+    # Off the event loop, as macOS has to ask ps
+    descendants = (await asyncio.to_thread(process_tree, process.pid))[1:] if process.returncode is None else []
+    _signal_group(process.pid, signal.SIGTERM)
+    _signal_all(descendants, signal.SIGTERM)
+
+    loop = asyncio.get_running_loop()
+    deadline = loop.time() + grace
+    exited = False
+    while loop.time() < deadline:
+        _reap(descendants)
+        if process.returncode is not None and not any(process_alive(pid) for pid in descendants):
+            exited = True
+            break
+        await asyncio.sleep(POLL_INTERVAL)
+
+    if not exited:
+        _signal_group(process.pid, signal.SIGKILL)
+        _signal_all([pid for pid in descendants if process_alive(pid)], signal.SIGKILL)
+    await process.wait()
+    _reap(descendants)
+    return exited
+
@@ -0,0 +1,451 @@
+"""
+Server-side tasks for Camoufox Connector.
+
+Tasks let clients that cannot speak the Playwright protocol use the pool:
+the connector leases a browser, drives it itself and returns the result.
+Task browsers are reached through the relay, so every connector-side lease
+feature applies to them just as it does to remote clients.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import base64
+import logging
+import time
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Any, Awaitable, Callable, Literal, Optional
+
+from pydantic import BaseModel, ConfigDict, Field, ValidationError, field_validator
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .auth import INTERNAL_KEY
+from .capture import CaptureOptions, ResponseCapture
+from .devices import UnknownDeviceError
+from .dialogs import DialogRule, answer_dialog
+from .evidence import EvidenceNotConfigured
+from .extensions import UnknownExtensionError
+from .extract import ExtractRule, extract
+from .popups import PopupPolicy, collect_popups, pick_followed, wait_loaded
+from .ratelimit import RateLimited
+from .relay import local_websocket_url
+from .sessions import (
+    LeaseLimitError,
+    LeaseOptions,
+    LeaseScopeError,
+    UnknownLabelError,
+    UnknownVersionError,
+)
+
+if TYPE_CHECKING:
+    from .artifacts import ArtifactStore
+    from .evidence import EvidenceRecorder, PageEvidence
+    from .fetchcache import FetchCache
+    from .ratelimit import DomainRateLimiter
+    from .sessions import Session, SessionManager
+    from .signing import Signer
+    from .usage import UsageMeter
+
+logger = logging.getLogger(__name__)
+
+# Reads the protocol the main document was actually fetched over ("h2", "h3", "http/1.1")
+NAVIGATION_PROTOCOL_JS = """() => {
+  const [entry] = performance.getEntriesByType("navigation");
+  return entry ? entry.nextHopProtocol || null : null;
+}"""
+
+
+class FetchTask(BaseModel):
+    """A request to load a single page server-side."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    url: str = Field(description="URL to load")
+
+    wait_until: Literal["commit", "domcontentloaded", "load", "networkidle"] = Field(
+        default="load",
+        description="Navigation event to wait for",
+    )
+
+    timeout: float = Field(
+        default=30.0,
+        gt=0,
+        le=300,
+        description="Navigation timeout in seconds",
+    )
+
+    screenshot: bool = Field(
+        default=False,
+        description="Include a base64-encoded PNG screenshot in the result",
+    )
+
+    popups: Optional[PopupPolicy] = Field(
+        default=None,
+        description="Popup handling for this task (default: the lease's policy)",
+    )
+
+    dialogs: list[DialogRule] = Field(
+        default_factory=list,
+        description="Dialog rules for this task, tried before the configured ones",
+    )
+
+    extract: dict[str, ExtractRule] = Field(
+        default_factory=dict,
+        description="Fields to extract from the loaded page, by name",
+    )
+
+    capture: Optional[CaptureOptions] = Field(
+        default=None,
+        description="XHR/fetch responses and WebSocket messages to return with the result",
+    )
+
+    captcha: Optional[Literal["solve", "detect", "off"]] = Field(
+        default=None,
+        description="What to do about CAPTCHAs on the page (default: solve if a solver is configured, else detect)",
+    )
+
+    evidence: bool = Field(
+        default=False,
+        description="Bundle the page, its HAR, timestamps, IPs and TLS certificate into a signed archive",
+    )
+
+    cache: Optional[Literal["use", "refresh", "off"]] = Field(
+        default=None,
+        description="Answer from the fetch cache, refresh its entry or bypass it (default: use it if configured)",
+    )
+
+    lease: LeaseOptions = Field(
+        default_factory=LeaseOptions,
+        description="Options for the browser lease the task runs on",
+    )
+
+    @field_validator("url")
+    @classmethod
+    def validate_url(cls, v: str) -> str:
+        """Validate the target URL."""
+        if not v.startswith(("http://", "https://")):
+            raise ValueError("URL must start with http:// or https://")
+        return v
+
+
+@dataclass
+class FetchResult:
+    """Outcome of a fetch task."""
+
+    url: str
+    instance: Optional[int] = None
+    session_id: Optional[str] = None
+    final_url: Optional[str] = None
+    status: Optional[int] = None
+    protocol: Optional[str] = None
+    html: Optional[str] = None
+    screenshot: Optional[str] = None
+    popups: list[dict] = field(default_factory=list)
+    dialogs: list[dict] = field(default_factory=list)
+    data: Optional[dict] = None
+    extract_errors: dict = field(default_factory=dict)
+    captured: Optional[list[dict]] = None
+    captured_dropped: int = 0
+    captcha: Optional[dict] = None
+    evidence: Optional[dict] = None
+    error: Optional[str] = None
+    signature: Optional[dict] = None
+    cached_at: Optional[float] = None
+    started_at: float = field(default_factory=time.time)
+    duration: float = 0.0
+    # Cache-Control of the main response, for the fetch cache
+    cache_control: Optional[str] = field(default=None, repr=False)
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "url": self.url,
+            "instance": self.instance,
+            "session_id": self.session_id,
+            "final_url": self.final_url,
+            "status": self.status,
+            "protocol": self.protocol,
+            "html": self.html,
+            "screenshot": self.screenshot,
+            "popups": self.popups,
+            "dialogs": self.dialogs,
+            "data": self.data,
+            "extract_errors": self.extract_errors,
+            "captured": self.captured,
+            "captured_dropped": self.captured_dropped,
+            "captcha": self.captcha,
+            "evidence": self.evidence,
+            "error": self.error,
+            "started_at": self.started_at,
+            "duration": round(self.duration, 2),
+            "cached_at": self.cached_at,
+            "signature": self.signature,
+        }
+
+
+async def navigation_protocol(page: Any) -> Optional[str]:
+    """Get the network protocol the page's main document was loaded over."""
+    try:
+        return await page.evaluate(NAVIGATION_PROTOCOL_JS)
+    except Exception as e:
+        # Pages with JavaScript disabled cannot be asked
+        logger.debug(f"Could not read navigation protocol: {e}")
+        return None
+
+
+@dataclass
+class TaskRunner:
+    """Runs server-side tasks on leased pool browsers."""
+
+    sessions: SessionManager
+    limiter: DomainRateLimiter
+    completion_hooks: list[Callable[[FetchTask, FetchResult], None]] = field(default_factory=list)
+    page_hooks: list[Callable[[FetchTask, Any, FetchResult], Awaitable[None]]] = field(default_factory=list)
+    signer: Optional[Signer] = None
+    evidence: Optional[EvidenceRecorder] = None
+    cache: Optional[FetchCache] = None
+    # Keeps screenshots as artifacts of the task's session, for storage drivers and signed URLs
+    store: Optional[ArtifactStore] = None
+    usage: Optional[UsageMeter] = None
+    _playwright: Any = None
+    _lock: asyncio.Lock = field(default_factory=asyncio.Lock)
+
+    async def _get_playwright(self) -> Any:
+        """Start the Playwright driver on first use."""
+        async with self._lock:
+            if self._playwright is None:
+                from playwright.async_api import async_playwright
+
+                self._playwright = await async_playwright().start()
+            return self._playwright
+
+    async def connect(self, session: Session) -> Any:
+        """Connect Playwright to a session's browser through the relay."""
+        playwright = await self._get_playwright()
+        settings = self.sessions.pool.settings
+        return await playwright.firefox.connect(
+            local_websocket_url(settings, f"/sessions/{session.id}/ws"),
+            headers={"Authorization": f"Bearer {INTERNAL_KEY}"},
+        )
+
+    def handle_dialogs(self, context: Any, rules: list[DialogRule], answered: list[dict]) -> None:
+        """
+        Answer every dialog of a context's pages and popups by a task's dialog
+        rules, then the configured ones, recording each in ``answered``.
+        """
+        rules = [*rules, *self.sessions.pool.settings.dialog_rules]
+
+        async def on_dialog(dialog: Any) -> None:
+            page = dialog.page
+            answered.append(await answer_dialog(dialog, page.url if page else "", rules))
+
+        context.on("dialog", on_dialog)
+
+    async def fetch(
+        self,
+        task: FetchTask,
+        tenant: Optional[str] = None,
+        launch_options: Optional[dict] = None,
+    ) -> Optional[FetchResult]:
+        """
+        Answer a fetch from the cache, or wait for the target domain's rate
+        limit and run it.
+
+        Completion hooks see every result run, including failed fetches, but
+        not cached ones. Results are signed after them when signing is
+        configured.
+
+        Returns:
+            The fetch result, or None if no browser was available.
+
+        Raises:
+            RateLimited: If the target domain's limits rejected the task.
+            LeaseLimitError: If the client already holds its maximum of leases.
+            UnknownDeviceError: If the lease asks for an unknown device preset.
+            UnknownVersionError: If the lease asks for a browser version no instance runs.
+            UnknownLabelError: If the lease asks for labels no instance has.
+            LeaseScopeError: If a context lease asks for options that need a browser of its own.
+            EvidenceNotConfigured: If the task asks for evidence but signing is not configured.
+            UnknownExtensionError: If the lease asks for an extension that was not uploaded.
+            RuntimeError: If the lease's launch options could not be applied.
+        """
+        if task.evidence and self.evidence is None:
+            raise EvidenceNotConfigured("Evidence capture needs signing_key to be configured")
+
+        use_cache = self.cache is not None and self.cache.applies(task, launch_options)
+        result = await self.cache.get(task, tenant) if use_cache else None
+        if result is None:
+            async with self.limiter.slot(task.url):
+                result = await self._fetch(task, tenant, launch_options)
+            if result is not None:
+                for hook in self.completion_hooks:
+                    try:
+                        hook(task, result)
+                    except Exception as e:
+                        logger.warning(f"Task completion hook failed for {task.url}: {e}")
+                if use_cache:
+                    await self.cache.put(task, tenant, result)
+        if self.usage is not None:
+            failed = result is None or result.error is not None
+            self.usage.record_task(tenant, cached=result is not None and result.cached_at is not None, failed=failed)
+        if result is not None:
+            if self.signer is not None:
+                result.signature = self.signer.sign(result.to_dict())
+        return result
+
+    async def _fetch(
+        self,
+        task: FetchTask,
+        tenant: Optional[str],
+        launch_options: Optional[dict],
+    ) -> Optional[FetchResult]:
+        """Lease a browser, load a page and release the browser again."""
+        # Evidence includes the HAR, which the relay records for the lease
+        lease = task.lease.model_copy(update={"har": True}) if task.evidence else task.lease
+        session = await self.sessions.acquire(lease, tenant=tenant, launch_options=launch_options)
+        if session is None:
+            return None
+
+        result = FetchResult(url=task.url, instance=session.instance.index, session_id=session.id)
+        evidence: Optional[PageEvidence] = None
+        try:
+            browser = await self.connect(session)
+            try:
+                context = await browser.new_context()
+                self.handle_dialogs(context, task.dialogs, result.dialogs)
+                capture = None
+                if task.capture is not None:
+                    capture = ResponseCapture(task.capture)
+                    capture.attach(context)
+                page = await context.new_page()
+
+                policy = task.popups or task.lease.popups or self.sessions.pool.settings.popup_policy
+                popups: list = []
+                if policy in ("follow", "capture"):
+                    context.on("page", popups.append)
+                elif policy == "block":
+                    # Also covers a task-level policy the relay doesn't know about
+                    context.on("page", lambda popup: asyncio.ensure_future(popup.close()))
+
+                response = await page.goto(
+                    task.url,
+                    wait_until=task.wait_until,
+                    timeout=task.timeout * 1000,
+                )
+                result.status = response.status if response else None
+                result.cache_control = response.headers.get("cache-control") if response else None
+
+                if policy == "capture":
+                    result.popups = await collect_popups(popups, task.wait_until, task.timeout)
+                elif policy == "follow":
+                    popup = pick_followed(popups)
+                    if popup is not None:
+                        await wait_loaded(popup, task.wait_until, task.timeout)
+                        # The popup's own status is unknown, so don't report the opener's
+                        page, result.status, response = popup, None, None
+
+                for hook in self.page_hooks:
+                    try:
+                        await hook(task, page, result)
+                    except Exception as e:
+                        logger.warning(f"Page hook failed for {task.url}: {e}")
+
+                result.final_url = page.url
+                result.protocol = await navigation_protocol(page)
+                result.html = await page.content()
+                if task.extract:
+                    result.data, result.extract_errors = await extract(page, task.extract)
+                if capture is not None:
+                    result.captured = await capture.finish()
+                    result.captured_dropped = capture.dropped
+                if task.screenshot:
+                    image = await page.screenshot()
+                    result.screenshot = base64.b64encode(image).decode()
+                    if self.store is not None:
+                        await asyncio.to_thread(self.store.new_path(session.id, "screenshots", ".png").write_bytes, image)
+                if task.evidence:
+                    evidence = await self.evidence.collect(page, response, result)
+            finally:
+                await browser.close()
+        except Exception as e:
+            logger.warning(f"Fetch of {task.url} failed: {e}")
+            result.error = str(e)
+        finally:
+            result.duration = time.time() - result.started_at
+            await self.sessions.release(session.id)
+
+        if evidence is not None:
+            try:
+                result.evidence = await self.evidence.seal(session, evidence, result)
+            except Exception as e:
+                logger.warning(f"Sealing evidence of {task.url} failed: {e}")
+                result.error = f"Sealing evidence failed: {e}"
+        return result
+
+    async def close(self) -> None:
+        """Stop the Playwright driver."""
+        if self._playwright is not None:
+            await self._playwright.stop()
+            self._playwright = None
+
+
+def create_task_routes(runner: TaskRunner) -> list[Route]:
+    """
+    Create HTTP routes for server-side tasks.
+
+    Args:
+        runner: Task runner executing the tasks
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def fetch(request: Request) -> Response:
+        """
+        Load a page on a pool browser and return its content.
+
+        POST /tasks/fetch
+        """
+        try:
+            task = FetchTask.model_validate_json(await request.body())
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid task", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+
+        try:
+            result = await runner.fetch(task, tenant=getattr(request.state, "api_key_name", None))
+        except LeaseLimitError as e:
+            return JSONResponse({"error": str(e)}, status_code=429)
+        except RateLimited as e:
+            return JSONResponse(
+                {"error": str(e), "domain": e.host},
+                status_code=429,
+                headers={"Retry-After": str(max(1, round(e.retry_after)))},
+            )
+        except (
+            UnknownDeviceError,
+            UnknownVersionError,
+            UnknownLabelError,
+            UnknownExtensionError,
+            LeaseScopeError,
+            EvidenceNotConfigured,
+        ) as e:
+            return JSONResponse({"error": str(e)}, status_code=400)
+        except RuntimeError as e:
+            return JSONResponse({"error": str(e)}, status_code=502)
+
+        if result is None:
+            return JSONResponse(
+                {"error": "No browser instances available for the task"},
+                status_code=503,
+            )
+
+        return JSONResponse(result.to_dict(), status_code=502 if result.error else 200)
+
+    return [
+        Route("/tasks/fetch", fetch, methods=["POST"]),
+    ]
@@ -0,0 +1,406 @@
+"""
+Profile templates for Camoufox Connector.
+
+Heavy single-page apps cost every new browser a slow first visit: megabytes
+of scripts and assets to download, consent cookies to collect. A profile
+template captures that once. ``POST /templates`` leases a browser, visits
+the given pages and stores the browser's HTTP cache and site data under a
+name. With a template active (``profile_template``, or
+``PUT /templates/active``), browsers launch with a copy of its cache, and
+contexts clients open on them start with its cookies and local storage.
+
+Firefox keeps cached responses apart per browser context, so the template's
+cache is reused by the first context opened after a launch, which is where
+most leases browse; later contexts on the same launch get the site data
+only. Leases asking for a ``fresh_profile`` launch without the template.
+With a storage driver, templates are stored by it too, and restored from it
+by connectors that don't have them on disk.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import json
+import logging
+import re
+import shutil
+import time
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import TYPE_CHECKING, Optional
+
+from pydantic import BaseModel, ConfigDict, Field, ValidationError, field_validator
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .janitor import scratch_directory
+from .sessions import LeaseOptions
+from .storage import StorageDriver, delete_prefix, download_directory, upload_directory
+
+if TYPE_CHECKING:
+    from .pool import BrowserInstance, BrowserPool
+    from .relay import Relay, RelayConnection
+    from .tasks import TaskRunner
+
+logger = logging.getLogger(__name__)
+
+HOLDER = "template"
+
+TEMPLATE_NAME = re.compile(r"^[A-Za-z0-9_-]{1,64}$")
+
+
+class TemplateNotFound(KeyError):
+    """Raised when a template name is not known."""
+
+
+class CaptureRequest(BaseModel):
+    """Pages to visit for a new profile template."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    name: str = Field(pattern=TEMPLATE_NAME.pattern, description="Template name")
+
+    urls: list[str] = Field(min_length=1, max_length=20, description="Pages to visit, in order")
+
+    index: Optional[int] = Field(
+        default=None,
+        ge=0,
+        description="Browser instance to capture on (default: any idle one)",
+    )
+
+    timeout: float = Field(default=30.0, gt=0, le=300, description="Navigation timeout in seconds")
+
+    @field_validator("urls")
+    @classmethod
+    def validate_urls(cls, v: list[str]) -> list[str]:
+        """Validate the page URLs."""
+        for url in v:
+            if not url.startswith(("http://", "https://")):
+                raise ValueError(f"Template page must start with http:// or https://: {url}")
+        return v
+
+
+class ActiveTemplate(BaseModel):
+    """Template new browsers launch from."""
+
+    model_config = ConfigDict(extra="forbid")
+
+    name: Optional[str] = Field(description="Template name, or null to launch browsers empty")
+
+
+@dataclass
+class ProfileTemplate:
+    """A captured HTTP cache and site data."""
+
+    name: str
+    urls: list[str]
+    captured_at: float
+    source: int
+    cache_bytes: int
+    storage: dict
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "name": self.name,
+            "urls": self.urls,
+            "captured_at": self.captured_at,
+            "source": self.source,
+            "cache_bytes": self.cache_bytes,
+            "cookies": len(self.storage.get("cookies") or []),
+            "origins": len(self.storage.get("origins") or []),
+        }
+
+
+def _directory_size(path: Path) -> int:
+    """Total size of the files under a directory."""
+    return sum(p.stat().st_size for p in path.rglob("*") if p.is_file())
+
+
+def _replace_tree(source: Optional[Path], target: Path) -> None:
+    """Replace a directory with a copy of another, or with an empty one if there is none."""
+    shutil.rmtree(target, ignore_errors=True)
+    if source is not None and source.is_dir():
+        shutil.copytree(source, target)
+    else:
+        target.mkdir(parents=True, exist_ok=True)
+
+
+@dataclass
+class TemplateManager:
+    """Captures profile templates and seeds launching browsers from the active one."""
+
+    runner: TaskRunner
+    relay: Relay
+    templates: dict[str, ProfileTemplate] = field(default_factory=dict)
+    active: Optional[str] = None
+    # Template each browser's current launch was seeded from, by instance index
+    seeded: dict[int, str] = field(default_factory=dict)
+    root: Optional[Path] = None
+    driver: Optional[StorageDriver] = None
+    _configured: Optional[str] = None
+
+    def __post_init__(self) -> None:
+        configured = self.pool.settings.templates_dir
+        if self.root is None:
+            self.root = Path(configured) if configured else scratch_directory("templates")
+        self.root.mkdir(parents=True, exist_ok=True)
+        self.pool.cache_root = scratch_directory("cache")
+        self.pool.launch_hooks.append(self._seed)
+        self.relay.context_params_providers.append(self._context_params)
+        self._load()
+
+    @property
+    def pool(self) -> BrowserPool:
+        """Browser pool launching from the templates."""
+        return self.runner.sessions.pool
+
+    def _load(self) -> None:
+        """Load the templates stored by earlier runs."""
+        for path in sorted(self.root.glob("*/template.json")):
+            try:
+                meta = json.loads(path.read_text())
+                storage = json.loads((path.parent / "storage.json").read_text())
+                self.templates[path.parent.name] = ProfileTemplate(**meta, storage=storage)
+            except (OSError, ValueError, TypeError) as e:
+                logger.warning(f"Skipping profile template {path.parent.name}: {e}")
+
+    async def restore(self) -> None:
+        """Download the templates the storage driver has and the disk doesn't."""
+        if self.driver is None:
+            return
+        try:
+            infos = await asyncio.to_thread(self.driver.list, "templates/")
+            names = {info.key.split("/")[1] for info in infos if info.key.count("/") >= 2}
+            for name in sorted(names - set(self.templates)):
+                if TEMPLATE_NAME.match(name):
+                    await asyncio.to_thread(download_directory, self.driver, f"templates/{name}", self.root / name)
+        except Exception as e:
+            logger.warning(f"Failed to restore profile templates from storage: {e}")
+        self._load()
+
+    def _upload(self, name: str) -> None:
+        """Store a template with the storage driver, replacing an earlier one."""
+        delete_prefix(self.driver, f"templates/{name}")
+        upload_directory(self.driver, self.root / name, f"templates/{name}", {"template": name})
+
+    def sync_config(self, name: Optional[str]) -> None:
+        """Adopt the configured template when the configuration names a different one."""
+        if name == self._configured:
+            return
+        self._configured = name
+        try:
+            self.activate(name)
+        except TemplateNotFound:
+            logger.warning(f"Configured profile template {name} has not been captured; launching browsers empty")
+            self.activate(None)
+
+    def activate(self, name: Optional[str]) -> None:
+        """Launch browsers from a template from now on, or empty with None."""
+        if name is not None and name not in self.templates:
+            raise TemplateNotFound(name)
+        if name == self.active:
+            return
+        self.active = name
+        logger.info(f"Browsers now launch from profile template {name}" if name else "Browsers now launch empty")
+        self.pool.events.publish("template-activated", name=name)
+
+    async def _seed(self, instance: BrowserInstance) -> None:
+        """Give a launching browser a copy of the active template's cache, or an empty one."""
+        self.seeded.pop(instance.index, None)
+        target = self.pool.cache_directory(instance)
+        session = self.runner.sessions.get(instance.session_id) if instance.session_id else None
+        name = self.active
+        if session is not None and session.options.fresh_profile:
+            name = None
+        source = self.root / name / "cache" if name else None
+        await asyncio.to_thread(_replace_tree, source, target)
+        if name:
+            self.seeded[instance.index] = name
+
+    def _context_params(self, connection: RelayConnection) -> dict:
+        """Inject the seeding template's site data into new contexts."""
+        if connection.session is not None and connection.session.options.fresh_profile:
+            return {}
+        template = self.templates.get(self.seeded.get(connection.instance.index, ""))
+        if template is None:
+            return {}
+        return {"storageState": template.storage}
+
+    def _store(self, template: ProfileTemplate, cache: Path) -> None:
+        """Write a template to its directory, replacing an earlier one of the same name."""
+        directory = self.root / template.name
+        staging = self.root / f".{template.name}.tmp"
+        shutil.rmtree(staging, ignore_errors=True)
+        _replace_tree(cache, staging / "cache")
+        template.cache_bytes = _directory_size(staging / "cache")
+        (staging / "storage.json").write_text(json.dumps(template.storage))
+        meta = template.to_dict()
+        for key in ("cookies", "origins"):
+            del meta[key]
+        (staging / "template.json").write_text(json.dumps(meta, indent=2))
+        shutil.rmtree(directory, ignore_errors=True)
+        staging.rename(directory)
+
+    async def capture(self, request: CaptureRequest) -> ProfileTemplate:
+        """
+        Visit pages on a freshly launched browser and keep its cache and site data as a template.
+
+        Raises:
+            RuntimeError: If no browser is free or the capture failed
+        """
+        session = await self.runner.sessions.acquire(
+            # A fresh launch, so the template holds only what these pages left
+            LeaseOptions(holder=HOLDER, fresh_profile=True),
+            index=request.index,
+        )
+        if session is None:
+            raise RuntimeError("No browser instance available to capture on")
+
+        instance = session.instance
+        try:
+            browser = await self.runner.connect(session)
+            try:
+                context = await browser.new_context()
+                page = await context.new_page()
+                for url in request.urls:
+                    await page.goto(url, wait_until="load", timeout=request.timeout * 1000)
+                storage = await context.storage_state()
+            finally:
+                # Closing the context flushes its cache entries to disk
+                await browser.close()
+            template = ProfileTemplate(
+                name=request.name,
+                urls=request.urls,
+                captured_at=time.time(),
+                source=instance.index,
+                cache_bytes=0,
+                storage=storage,
+            )
+            await asyncio.to_thread(self._store, template, self.pool.cache_directory(instance))
+        except Exception as e:
+            raise RuntimeError(f"Capture on browser instance {instance.index} failed: {e}") from e
+        finally:
+            await self.runner.sessions.release(session.id)
+
+        self.templates[template.name] = template
+        if self.driver is not None:
+            try:
+                await asyncio.to_thread(self._upload, template.name)
+            except Exception as e:
+                logger.warning(f"Failed to store profile template {template.name}: {e}")
+        logger.info(f"Captured profile template {template.name} on browser instance {instance.index}")
+        self.pool.events.publish(
+            "template-captured",
+            name=template.name,
+            index=instance.index,
+            cache_bytes=template.cache_bytes,
+        )
+        return template
+
+    async def delete(self, name: str) -> None:
+        """
+        Delete a template; browsers launched from it keep their copies.
+
+        Raises:
+            TemplateNotFound: If there is no such template
+        """
+        if self.templates.pop(name, None) is None:
+            raise TemplateNotFound(name)
+        if self.active == name:
+            self.activate(None)
+        await asyncio.to_thread(shutil.rmtree, self.root / name, True)
+        if self.driver is not None:
+            await asyncio.to_thread(delete_prefix, self.driver, f"templates/{name}")
+
+    def report(self) -> dict:
+        """Describe the templates and which browsers were seeded from them."""
+        return {
+            "active": self.active,
+            "templates": [template.to_dict() for template in self.templates.values()],
+            "seeded": {str(index): name for index, name in sorted(self.seeded.items())},
+        }
+
+    async def close(self) -> None:
+        """Remove the browsers' cache directories."""
+        if self.pool.cache_root is not None:
+            await asyncio.to_thread(shutil.rmtree, self.pool.cache_root, True)
+
+
+def create_template_routes(manager: TemplateManager) -> list[Route]:
+    """
+    Create routes capturing and activating profile templates.
+
+    Args:
+        manager: Template manager seeding launching browsers
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def list_templates(request: Request) -> Response:
+        """
+        Captured templates, the active one and the browsers seeded from them.
+
+        GET /templates
+        """
+        return JSONResponse(manager.report())
+
+    async def capture(request: Request) -> Response:
+        """
+        Capture a template by visiting pages on a fresh browser.
+
+        POST /templates
+        """
+        try:
+            body = CaptureRequest.model_validate_json(await request.body())
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid template", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+        try:
+            template = await manager.capture(body)
+        except RuntimeError as e:
+            return JSONResponse({"error": str(e)}, status_code=503)
+        return JSONResponse(template.to_dict(), status_code=201)
+
+    async def set_active(request: Request) -> Response:
+        """
+        Choose the template browsers launch from.
+
+        PUT /templates/active
+        """
+        try:
+            body = ActiveTemplate.model_validate_json(await request.body())
+        except ValidationError as e:
+            return JSONResponse(
+                {"error": "Invalid template", "details": e.errors(include_url=False, include_context=False)},
+                status_code=400,
+            )
+        try:
+            manager.activate(body.name)
+        except TemplateNotFound:
+            return JSONResponse({"error": "Template not found"}, status_code=404)
+        return JSONResponse({"active": manager.active})
+
+    async def delete_template(request: Request) -> Response:
+        """
+        Delete a template.
+
+        DELETE /templates/{name}
+        """
+        name = request.path_params["name"]
+        try:
+            await manager.delete(name)
+        except TemplateNotFound:
+            return JSONResponse({"error": "Template not found"}, status_code=404)
+        return JSONResponse({"status": "deleted", "name": name})
+
+    return [
+        Route("/templates", list_templates, methods=["GET"]),
+        Route("/templates", capture, methods=["POST"]),
+        Route("/templates/active", set_active, methods=["PUT"]),
+        Route("/templates/{name}", delete_template, methods=["DELETE"]),
+    ]
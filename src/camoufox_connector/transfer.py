@@ -0,0 +1,284 @@
+"""
+Network transfer accounting for Camoufox Connector.
+
+Residential proxies are billed per gigabyte, so the connector counts the
+bytes each lease's browser sends and receives over the network: when a
+request of a relayed context finishes, its header and body sizes are asked
+from the browser. Bodies count as transferred, so compressed responses count
+compressed and responses served from the browser's cache count nothing.
+Protocol traffic between clients and the connector is not included; lease
+summaries report it separately as ``bytes_sent`` and ``bytes_received``.
+
+Transfer is added up per lease, per API key and per proxy on
+``GET /transfer`` and ``GET /metrics`` (Prometheus), and per tenant and
+period in usage exports. With ``max_transfer_mb`` configured or given as a
+lease option, a lease whose browser goes beyond it is released.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Callable, Optional, Sequence
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .bans import proxy_id
+from .relay import RelayCallError
+
+if TYPE_CHECKING:
+    from .relay import Relay, RelayConnection
+    from .sessions import Session, SessionManager
+
+logger = logging.getLogger(__name__)
+
+MB = 1024 * 1024
+
+FINISHED_EVENT = "requestFinished"
+
+
+@dataclass
+class Transfer:
+    """Bytes sent and received over the network."""
+
+    sent: int = 0
+    received: int = 0
+    requests: int = 0
+
+    @property
+    def total(self) -> int:
+        """Bytes in both directions."""
+        return self.sent + self.received
+
+    def add(self, sent: int, received: int) -> None:
+        """Count one finished request."""
+        self.sent += sent
+        self.received += received
+        self.requests += 1
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "requests": self.requests,
+            "bytes_sent": self.sent,
+            "bytes_received": self.received,
+            "mb": round(self.total / MB, 3),
+        }
+
+
+@dataclass
+class LeaseTransfer(Transfer):
+    """Transfer of one active lease."""
+
+    tenant: Optional[str] = None
+    proxy: str = "direct"
+    cap: Optional[int] = None
+    capped: bool = False
+
+
+def _escape(value: str) -> str:
+    """Escape a Prometheus label value."""
+    return value.replace("\\", "\\\\").replace('"', '\\"').replace("\n", "\\n")
+
+
+def metric_labels(**labels: str) -> str:
+    """Render Prometheus labels."""
+    return "{" + ",".join(f'{name}="{_escape(value)}"' for name, value in labels.items()) + "}"
+
+
+@dataclass
+class TransferMeter:
+    """Counts the network transfer of leased browsers and enforces caps."""
+
+    relay: Relay
+    sessions: SessionManager
+    leases: dict[str, LeaseTransfer] = field(default_factory=dict)
+    tenants: dict[str, Transfer] = field(default_factory=dict)
+    proxies: dict[str, Transfer] = field(default_factory=dict)
+    caps_exceeded: int = 0
+    _tasks: set[asyncio.Task] = field(default_factory=set)
+
+    def __post_init__(self) -> None:
+        self.relay.context_hooks.append(self._on_context)
+        self.relay.event_filters.append(self._on_event)
+        self.relay.call_rewriters.append(self._rewrite_call)
+
+    def _lease(self, session: Session) -> LeaseTransfer:
+        """Get an active lease's transfer, starting it on first use."""
+        lease = self.leases.get(session.id)
+        if lease is None:
+            caps = [
+                limit for limit in (session.options.max_transfer_mb, self.sessions.pool.settings.max_transfer_mb)
+                if limit is not None
+            ]
+            lease = LeaseTransfer(
+                tenant=session.tenant,
+                proxy=proxy_id(session.instance),
+                cap=int(min(caps) * MB) if caps else None,
+            )
+            self.leases[session.id] = lease
+        return lease
+
+    @staticmethod
+    def _subscribed(connection: RelayConnection) -> set[str]:
+        """Contexts of a connection the meter has subscribed to."""
+        return connection.state.setdefault("transfer", set())
+
+    async def _on_context(self, connection: RelayConnection, guid: str) -> None:
+        """Have a lease's new context report finished requests."""
+        if connection.session is None:
+            return
+        self._lease(connection.session)
+        await connection.call(guid, "updateSubscription", {"event": FINISHED_EVENT, "enabled": True})
+        self._subscribed(connection).add(guid)
+
+    def _rewrite_call(self, connection: RelayConnection, message: dict) -> bool:
+        """Keep the subscription when the client no longer listens for finished requests."""
+        params = message.get("params") or {}
+        if (
+            message.get("method") == "updateSubscription"
+            and params.get("event") == FINISHED_EVENT
+            and not params.get("enabled")
+            and message.get("guid") in self._subscribed(connection)
+        ):
+            params["enabled"] = True
+            return True
+        return False
+
+    def _on_event(self, connection: RelayConnection, message: dict) -> bool:
+        """Measure a finished request; never consumes the event."""
+        if message.get("method") != FINISHED_EVENT or message.get("guid") not in self._subscribed(connection):
+            return False
+        request = ((message.get("params") or {}).get("request") or {}).get("guid")
+        if request and connection.session is not None:
+            task = asyncio.create_task(self._measure(connection, connection.session, request))
+            self._tasks.add(task)
+            task.add_done_callback(self._tasks.discard)
+        return False
+
+    async def _measure(self, connection: RelayConnection, session: Session, request: str) -> None:
+        """Count a finished request's size and release the lease beyond its cap."""
+        try:
+            result = await connection.call(request, "sizes")
+        except RelayCallError as e:
+            logger.debug(f"Could not measure request of session {session.id}: {e}")
+            return
+        sizes = result.get("sizes") or {}
+        sent = max(0, sizes.get("requestHeadersSize", 0)) + max(0, sizes.get("requestBodySize", 0))
+        received = max(0, sizes.get("responseHeadersSize", 0)) + max(0, sizes.get("responseBodySize", 0))
+
+        lease = self.leases.get(session.id)
+        if lease is None:
+            # Released in the meantime
+            return
+        lease.add(sent, received)
+        self.tenants.setdefault(lease.tenant or "", Transfer()).add(sent, received)
+        self.proxies.setdefault(lease.proxy, Transfer()).add(sent, received)
+
+        if lease.cap is not None and lease.total > lease.cap and not lease.capped:
+            lease.capped = True
+            self.caps_exceeded += 1
+            logger.warning(
+                f"Session {session.id} transferred {lease.total / MB:.1f} MB, "
+                f"beyond its cap of {lease.cap / MB:g} MB; releasing it"
+            )
+            self.sessions.pool.events.publish(
+                "transfer-cap-exceeded",
+                session_id=session.id,
+                tenant=lease.tenant,
+                proxy=lease.proxy,
+                bytes=lease.total,
+                cap=lease.cap,
+            )
+            await self.sessions.release(session.id)
+
+    async def release_session(self, session: Session) -> None:
+        """Add a released lease's transfer to its summary."""
+        lease = self.leases.pop(session.id, None) or LeaseTransfer()
+        if session.summary is not None:
+            session.summary["transfer"] = {**lease.to_dict(), "capped": lease.capped}
+
+    def report(self) -> dict:
+        """Transfer per active lease, API key and proxy."""
+        return {
+            "leases": {
+                session_id: {
+                    **lease.to_dict(),
+                    "tenant": lease.tenant,
+                    "proxy": lease.proxy,
+                    "cap_mb": round(lease.cap / MB, 3) if lease.cap is not None else None,
+                }
+                for session_id, lease in self.leases.items()
+            },
+            "tenants": {tenant or "anonymous": stats.to_dict() for tenant, stats in self.tenants.items()},
+            "proxies": {proxy: stats.to_dict() for proxy, stats in self.proxies.items()},
+            "caps_exceeded": self.caps_exceeded,
+        }
+
+    def metrics(self) -> str:
+        """Render the transfer counters in the Prometheus text format."""
+        lines = [
+            "# HELP camoufox_transfer_bytes_total Network bytes transferred by leased browsers, per API key",
+            "# TYPE camoufox_transfer_bytes_total counter",
+        ]
+        for tenant, stats in sorted(self.tenants.items()):
+            for direction, value in (("sent", stats.sent), ("received", stats.received)):
+                lines.append(f"camoufox_transfer_bytes_total{metric_labels(tenant=tenant, direction=direction)} {value}")
+        lines += [
+            "# HELP camoufox_proxy_transfer_bytes_total Network bytes transferred by leased browsers, per proxy",
+            "# TYPE camoufox_proxy_transfer_bytes_total counter",
+        ]
+        for proxy, stats in sorted(self.proxies.items()):
+            for direction, value in (("sent", stats.sent), ("received", stats.received)):
+                lines.append(f"camoufox_proxy_transfer_bytes_total{metric_labels(proxy=proxy, direction=direction)} {value}")
+        lines += [
+            "# HELP camoufox_lease_transfer_bytes Network bytes transferred by each active lease",
+            "# TYPE camoufox_lease_transfer_bytes gauge",
+        ]
+        for session_id, lease in sorted(self.leases.items()):
+            labels = metric_labels(session=session_id, tenant=lease.tenant or "", proxy=lease.proxy)
+            lines.append(f"camoufox_lease_transfer_bytes{labels} {lease.total}")
+        lines += [
+            "# HELP camoufox_transfer_caps_exceeded_total Leases released for going beyond their transfer cap",
+            "# TYPE camoufox_transfer_caps_exceeded_total counter",
+            f"camoufox_transfer_caps_exceeded_total {self.caps_exceeded}",
+        ]
+        return "\n".join(lines) + "\n"
+
+
+def create_transfer_routes(meter: TransferMeter, extra_metrics: Sequence[Callable[[], str]] = ()) -> list[Route]:
+    """
+    Create routes reporting network transfer.
+
+    Args:
+        meter: Transfer meter counting leased browsers' traffic
+        extra_metrics: Renderers of other subsystems' metrics, served on /metrics too
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_transfer(request: Request) -> Response:
+        """
+        Network transfer per active lease, API key and proxy.
+
+        GET /transfer
+        """
+        return JSONResponse(meter.report())
+
+    async def get_metrics(request: Request) -> Response:
+        """
+        Transfer counters for Prometheus.
+
+        GET /metrics
+        """
+        text = meter.metrics() + "".join(render() for render in extra_metrics)
+        return Response(text, media_type="text/plain; version=0.0.4")
+
+    return [
+        Route("/transfer", get_transfer, methods=["GET"]),
+        Route("/metrics", get_metrics, methods=["GET"]),
+    ]
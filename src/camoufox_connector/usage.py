@@ -0,0 +1,442 @@
+"""
+Usage metering for Camoufox Connector.
+
+Every released lease, including the leases behind tasks, leaves a usage
+record with the API key it was acquired with, how long it held its browser,
+how much artifact storage (HAR, video, downloads, logs) it produced and how
+much its browser transferred over the network. Every fetch task, including
+those answered from the cache, leaves a task record with its API key.
+``GET /admin/usage`` adds the records up per tenant and period and exports
+them as CSV, JSON Lines or CloudEvents, so browser time can be charged back
+to the teams using the pool; ``GET /usage`` does the same for the caller's
+own API key only. Records are kept in memory and, when ``usage_file`` is
+set, appended to a JSON Lines file they are reloaded from on startup.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import csv
+import io
+import json
+import logging
+import time
+import uuid
+from collections import deque
+from dataclasses import asdict, dataclass, field
+from datetime import datetime, timedelta, timezone
+from pathlib import Path
+from typing import TYPE_CHECKING, Literal, Optional
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .auth import INTERNAL_KEY_NAME
+
+if TYPE_CHECKING:
+    from .artifacts import ArtifactStore
+    from .sessions import Session
+
+logger = logging.getLogger(__name__)
+
+Period = Literal["hour", "day", "month"]
+PERIODS = ("hour", "day", "month")
+FORMATS = ("json", "csv", "jsonl", "cloudevents")
+
+CLOUDEVENT_TYPE = "com.camoufox-connector.usage"
+CSV_COLUMNS = [
+    "tenant", "period_start", "period_end", "sessions", "browser_minutes",
+    "artifact_mb", "transfer_mb", "tasks", "cached_tasks", "failed_tasks",
+]
+
+# Units of ?window=, e.g. 24h or 7d
+WINDOW_UNITS = {"h": 3600, "d": 86400, "w": 7 * 86400}
+
+# Keep the records of a little over a year
+RECORD_RETENTION = 400 * 86400
+
+
+@dataclass
+class UsageRecord:
+    """What one lease used."""
+
+    session_id: str
+    tenant: Optional[str]
+    started_at: float
+    ended_at: float
+    browser_seconds: float
+    artifact_bytes: int
+    instance: Optional[int] = None
+    version: Optional[str] = None
+    transfer_bytes: int = 0
+
+
+@dataclass
+class TaskRecord:
+    """One fetch task run for a client."""
+
+    tenant: Optional[str]
+    at: float
+    cached: bool = False
+    failed: bool = False
+
+
+def period_start(moment: datetime, period: Period) -> datetime:
+    """Get the UTC start of the period a moment falls into."""
+    moment = moment.astimezone(timezone.utc)
+    if period == "hour":
+        return moment.replace(minute=0, second=0, microsecond=0)
+    if period == "day":
+        return moment.replace(hour=0, minute=0, second=0, microsecond=0)
+    return moment.replace(day=1, hour=0, minute=0, second=0, microsecond=0)
+
+
+def next_period(start: datetime, period: Period) -> datetime:
+    """Get the start of the period following the one starting at ``start``."""
+    if period == "hour":
+        return start + timedelta(hours=1)
+    if period == "day":
+        return start + timedelta(days=1)
+    if start.month == 12:
+        return start.replace(year=start.year + 1, month=1)
+    return start.replace(month=start.month + 1)
+
+
+def parse_time(value: str) -> float:
+    """
+    Parse an ISO 8601 date or time, taken as UTC without a zone, or a Unix timestamp.
+
+    Raises:
+        ValueError: If the value is neither.
+    """
+    try:
+        return float(value)
+    except ValueError:
+        pass
+    moment = datetime.fromisoformat(value)
+    if moment.tzinfo is None:
+        moment = moment.replace(tzinfo=timezone.utc)
+    return moment.timestamp()
+
+
+def parse_window(value: str) -> float:
+    """
+    Parse a window such as 24h, 7d or 2w into seconds.
+
+    Raises:
+        ValueError: If the value is not a number followed by h, d or w.
+    """
+    unit = WINDOW_UNITS.get(value[-1:])
+    if unit is None or not value[:-1].isdigit() or int(value[:-1]) < 1:
+        raise ValueError(f"window must be a number followed by h, d or w, e.g. 24h: {value}")
+    return int(value[:-1]) * unit
+
+
+def aggregate(
+    records: list[UsageRecord],
+    period: Period,
+    start: float,
+    end: float,
+    tasks: list[TaskRecord] = (),
+) -> list[dict]:
+    """
+    Add usage up per tenant and period within a time range.
+
+    Browser time is split across the periods a lease spans. A lease counts as
+    a session in the period it started in, and its artifact storage and
+    network transfer in the period it ended in. Tasks count in the period
+    they finished in.
+    """
+    rows: dict[tuple[str, datetime], dict] = {}
+
+    def row(tenant: Optional[str], moment: float) -> dict:
+        bucket = period_start(datetime.fromtimestamp(moment, timezone.utc), period)
+        key = (tenant or "", bucket)
+        if key not in rows:
+            rows[key] = {
+                "tenant": tenant,
+                "period_start": bucket,
+                "sessions": 0,
+                "browser_seconds": 0.0,
+                "artifact_bytes": 0,
+                "transfer_bytes": 0,
+                "tasks": 0,
+                "cached_tasks": 0,
+                "failed_tasks": 0,
+            }
+        return rows[key]
+
+    for task in tasks:
+        if start <= task.at < end:
+            counts = row(task.tenant, task.at)
+            counts["tasks"] += 1
+            counts["cached_tasks"] += task.cached
+            counts["failed_tasks"] += task.failed
+
+    for record in records:
+        if start <= record.started_at < end:
+            row(record.tenant, record.started_at)["sessions"] += 1
+        if start <= record.ended_at < end:
+            ended = row(record.tenant, record.ended_at)
+            ended["artifact_bytes"] += record.artifact_bytes
+            ended["transfer_bytes"] += record.transfer_bytes
+
+        cursor = max(record.started_at, start)
+        stop = min(record.ended_at, end)
+        while cursor < stop:
+            bucket = period_start(datetime.fromtimestamp(cursor, timezone.utc), period)
+            boundary = min(next_period(bucket, period).timestamp(), stop)
+            row(record.tenant, cursor)["browser_seconds"] += boundary - cursor
+            cursor = boundary
+
+    return [
+        {
+            "tenant": data["tenant"],
+            "period_start": data["period_start"].isoformat(),
+            "period_end": next_period(data["period_start"], period).isoformat(),
+            "sessions": data["sessions"],
+            "browser_minutes": round(data["browser_seconds"] / 60, 3),
+            "artifact_mb": round(data["artifact_bytes"] / (1024 * 1024), 3),
+            "transfer_mb": round(data["transfer_bytes"] / (1024 * 1024), 3),
+            "tasks": data["tasks"],
+            "cached_tasks": data["cached_tasks"],
+            "failed_tasks": data["failed_tasks"],
+        }
+        for _, data in sorted(rows.items(), key=lambda item: (item[0][1], item[0][0]))
+    ]
+
+
+def totals(rows: list[dict]) -> dict[str, dict]:
+    """Add aggregated rows up per tenant, over the whole time range."""
+    summed: dict[str, dict] = {}
+    for row in rows:
+        tenant = row["tenant"] or "anonymous"
+        total = summed.setdefault(tenant, {column: 0 for column in CSV_COLUMNS[3:]})
+        for column in total:
+            total[column] += row[column]
+    for total in summed.values():
+        for column in ("browser_minutes", "artifact_mb", "transfer_mb"):
+            total[column] = round(total[column], 3)
+    return summed
+
+
+def to_cloudevents(rows: list[dict], source: str) -> list[dict]:
+    """Wrap usage rows as CloudEvents 1.0, one event per tenant and period."""
+    return [
+        {
+            "specversion": "1.0",
+            "type": CLOUDEVENT_TYPE,
+            "source": source,
+            "id": uuid.uuid5(uuid.NAMESPACE_URL, f"{source}/{row['tenant']}/{row['period_start']}").hex,
+            "time": row["period_end"],
+            "subject": row["tenant"] or "anonymous",
+            "datacontenttype": "application/json",
+            "data": row,
+        }
+        for row in rows
+    ]
+
+
+@dataclass
+class UsageMeter:
+    """Records the usage of released leases."""
+
+    store: ArtifactStore
+    records: deque[UsageRecord] = field(default_factory=deque)
+    tasks: deque[TaskRecord] = field(default_factory=deque)
+    _loaded: bool = False
+
+    @property
+    def path(self) -> Optional[Path]:
+        """File usage records are persisted to, if any."""
+        configured = self.store.sessions.pool.settings.usage_file
+        return Path(configured).expanduser() if configured else None
+
+    def load(self) -> None:
+        """Load the records persisted by earlier runs."""
+        path = self.path
+        if self._loaded or path is None or not path.is_file():
+            return
+        self._loaded = True
+        cutoff = time.time() - RECORD_RETENTION
+        with open(path) as f:
+            for line in f:
+                try:
+                    data = json.loads(line)
+                    if data.pop("type", "lease") == "task":
+                        task = TaskRecord(**data)
+                        if task.at >= cutoff:
+                            self.tasks.append(task)
+                        continue
+                    record = UsageRecord(**data)
+                except (AttributeError, TypeError, ValueError):
+                    logger.warning(f"Skipping malformed usage record in {path}")
+                    continue
+                if record.ended_at >= cutoff:
+                    self.records.append(record)
+        logger.info(f"Loaded {len(self.records)} usage record(s) and {len(self.tasks)} task record(s) from {path}")
+
+    def _append(self, data: dict) -> None:
+        """Append a record to the usage file, if there is one."""
+        path = self.path
+        if path is None:
+            return
+        try:
+            with open(path, "a") as f:
+                f.write(json.dumps(data) + "\n")
+        except OSError as e:
+            logger.warning(f"Failed to persist usage record: {e}")
+
+    def _artifact_bytes(self, session_id: str) -> int:
+        """Size of everything stored for a session."""
+        directory = self.store.root / session_id if self.store.root is not None else None
+        if directory is None or not directory.is_dir():
+            return 0
+        return sum(p.stat().st_size for p in directory.rglob("*") if p.is_file())
+
+    async def record(self, session: Session) -> None:
+        """Record the usage of a lease as it is released."""
+        now = time.time()
+        record = UsageRecord(
+            session_id=session.id,
+            tenant=session.tenant,
+            started_at=session.created_at,
+            ended_at=now,
+            browser_seconds=round(now - session.created_at, 3),
+            artifact_bytes=await asyncio.to_thread(self._artifact_bytes, session.id),
+            instance=session.instance.index,
+            version=session.instance.version,
+        )
+        transfer = (session.summary or {}).get("transfer")
+        if transfer:
+            record.transfer_bytes = transfer["bytes_sent"] + transfer["bytes_received"]
+        self.records.append(record)
+        while self.records and self.records[0].ended_at < now - RECORD_RETENTION:
+            self.records.popleft()
+        self._append(asdict(record))
+
+        self.store.sessions.pool.events.publish("usage-recorded", **asdict(record))
+
+    def record_task(self, tenant: Optional[str], cached: bool, failed: bool) -> None:
+        """Count a fetch task run for a client."""
+        now = time.time()
+        task = TaskRecord(tenant=tenant, at=now, cached=cached, failed=failed)
+        self.tasks.append(task)
+        while self.tasks and self.tasks[0].at < now - RECORD_RETENTION:
+            self.tasks.popleft()
+        self._append({"type": "task", **asdict(task)})
+
+    def current(self) -> list[UsageRecord]:
+        """Records of released leases plus active leases' usage so far."""
+        now = time.time()
+        active = [
+            UsageRecord(
+                session_id=session.id,
+                tenant=session.tenant,
+                started_at=session.created_at,
+                ended_at=now,
+                browser_seconds=round(now - session.created_at, 3),
+                artifact_bytes=0,
+                instance=session.instance.index,
+                version=session.instance.version,
+            )
+            for session in self.store.sessions.sessions.values()
+        ]
+        return [*self.records, *active]
+
+
+def create_usage_routes(meter: UsageMeter) -> list[Route]:
+    """
+    Create the routes exporting usage.
+
+    Args:
+        meter: Usage meter to export from
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def export(request: Request, tenant: Optional[str], scoped: bool) -> Response:
+        """Export the usage of every tenant, or of one."""
+        params = request.query_params
+        period = params.get("period", "day")
+        output = params.get("format", "json")
+        if period not in PERIODS:
+            return JSONResponse({"error": f"period must be one of {', '.join(PERIODS)}"}, status_code=400)
+        if output not in FORMATS:
+            return JSONResponse({"error": f"format must be one of {', '.join(FORMATS)}"}, status_code=400)
+        try:
+            end = parse_time(params["to"]) if "to" in params else time.time()
+            if "window" in params:
+                start = end - parse_window(params["window"])
+            else:
+                start = parse_time(params["from"]) if "from" in params else 0.0
+        except ValueError as e:
+            return JSONResponse({"error": f"Invalid time: {e}"}, status_code=400)
+
+        records = meter.current()
+        tasks = list(meter.tasks)
+        if scoped:
+            records = [r for r in records if (r.tenant or "") == (tenant or "")]
+            tasks = [t for t in tasks if (t.tenant or "") == (tenant or "")]
+        rows = aggregate(records, period, start, end, tasks)
+
+        filename = f"usage-{period}"
+        if output == "csv":
+            buffer = io.StringIO()
+            writer = csv.DictWriter(buffer, fieldnames=CSV_COLUMNS)
+            writer.writeheader()
+            writer.writerows({**row, "tenant": row["tenant"] or ""} for row in rows)
+            return Response(
+                buffer.getvalue(),
+                media_type="text/csv",
+                headers={"Content-Disposition": f'attachment; filename="{filename}.csv"'},
+            )
+        if output == "jsonl":
+            return Response(
+                "".join(json.dumps(row) + "\n" for row in rows),
+                media_type="application/jsonl",
+                headers={"Content-Disposition": f'attachment; filename="{filename}.jsonl"'},
+            )
+        if output == "cloudevents":
+            region = meter.store.sessions.pool.settings.region
+            source = f"camoufox-connector/{region}" if region else "camoufox-connector"
+            return JSONResponse(
+                to_cloudevents(rows, source),
+                media_type="application/cloudevents-batch+json",
+            )
+        return JSONResponse({
+            "period": period,
+            "from": start,
+            "to": end,
+            "usage": rows,
+            "totals": totals(rows),
+            "count": len(rows),
+        })
+
+    async def admin_usage(request: Request) -> Response:
+        """
+        Export browser time, storage, transfer and tasks of every API key per period.
+
+        GET /admin/usage
+        """
+        tenant = request.query_params.get("tenant")
+        return await export(request, tenant, scoped=tenant is not None)
+
+    async def own_usage(request: Request) -> Response:
+        """
+        Export the caller's own usage per period; without API keys, everyone's.
+
+        GET /usage
+        """
+        name = getattr(request.state, "api_key_name", None)
+        if name is None or name == INTERNAL_KEY_NAME:
+            tenant = request.query_params.get("tenant")
+            return await export(request, tenant, scoped=tenant is not None)
+        return await export(request, name, scoped=True)
+
+    return [
+        Route("/admin/usage", admin_usage, methods=["GET"]),
+        Route("/usage", own_usage, methods=["GET"]),
+    ]
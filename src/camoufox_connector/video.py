@@ -0,0 +1,94 @@
+"""
+Session video recording for Camoufox Connector.
+
+Leases acquired with ``"video": true`` have every page of their browser
+contexts recorded by the browser as WebM files written straight into the
+session's artifact directory. Videos are kept like other artifacts and can be
+downloaded from ``GET /sessions/{id}/video``; the configured size limit caps
+how much video a single session may keep.
+"""
+
+from __future__ import annotations
+
+import logging
+from dataclasses import dataclass
+from typing import TYPE_CHECKING
+
+from starlette.requests import Request
+from starlette.responses import FileResponse, JSONResponse, Response
+from starlette.routing import Route
+
+if TYPE_CHECKING:
+    from .artifacts import ArtifactStore
+    from .relay import Relay, RelayConnection
+
+logger = logging.getLogger(__name__)
+
+
+@dataclass
+class VideoRecorder:
+    """Makes the browser record the pages of leases that ask for video."""
+
+    relay: Relay
+    store: ArtifactStore
+
+    def __post_init__(self) -> None:
+        self.relay.context_params_providers.append(self._context_params)
+
+    def _context_params(self, connection: RelayConnection) -> dict:
+        """Point new contexts' video recording at the session's artifacts."""
+        session = connection.session
+        if session is None or not session.options.video:
+            return {}
+        directory = self.store.directory(session.id, "video", create=True)
+        params: dict = {"dir": str(directory.resolve())}
+        if session.options.video_size:
+            params["size"] = session.options.video_size.model_dump()
+        return {"recordVideo": params}
+
+
+def create_video_routes(store: ArtifactStore) -> list[Route]:
+    """
+    Create the route serving recorded videos.
+
+    Args:
+        store: Artifact store the videos are recorded to
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_video(request: Request) -> Response:
+        """
+        Download a session's video; ``?index=N`` selects one of several pages.
+
+        GET /sessions/{id}/video
+        """
+        session_id = request.path_params["session_id"]
+        if not await store.accessible(request, session_id):
+            return JSONResponse({"error": "No video recorded for this session"}, status_code=404)
+        store.enforce_limit(session_id, "video", store.sessions.pool.settings.max_video_mb)
+        videos = [p for p in store.files(session_id, "video") if p.suffix == ".webm"]
+        if not videos:
+            return JSONResponse({"error": "No video recorded for this session"}, status_code=404)
+
+        try:
+            index = int(request.query_params.get("index", "0"))
+        except ValueError:
+            return JSONResponse({"error": "index must be an integer"}, status_code=400)
+        if index < 0 or index >= len(videos):
+            return JSONResponse(
+                {"error": f"Video {index} not found, session has {len(videos)}"},
+                status_code=404,
+            )
+
+        return FileResponse(
+            videos[index],
+            media_type="video/webm",
+            filename=f"{session_id}-{index}.webm",
+            headers={"X-Video-Count": str(len(videos))},
+        )
+
+    return [
+        Route("/sessions/{session_id}/video", get_video, methods=["GET"]),
+    ]
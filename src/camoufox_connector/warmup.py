@@ -0,0 +1,223 @@
+"""
+Warm-up browsing for Camoufox Connector.
+
+A browser that shows up with no cookies or site data at all looks fresh to
+some anti-bot systems. With ``warmup`` configured, idle pool browsers now
+and then lease themselves to the connector and visit a few pages of the
+configured sites. The cookies and local storage they collect are added to
+every context clients later open on the same browser through the relay,
+and carried into its next warm-up, so they build up over time. Playwright
+contexts never share history, so only site data carries over.
+
+Warm-up data belongs to one launch: a browser relaunched with a new
+fingerprint starts over. Leases asking for a ``fresh_profile`` don't get it.
+"""
+
+from __future__ import annotations
+
+import asyncio
+import logging
+import random
+import time
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING, Optional
+
+from starlette.requests import Request
+from starlette.responses import JSONResponse, Response
+from starlette.routing import Route
+
+from .sessions import LeaseOptions
+
+if TYPE_CHECKING:
+    from .config import Warmup
+    from .pool import BrowserInstance, BrowserPool
+    from .relay import Relay, RelayConnection
+    from .tasks import TaskRunner
+
+logger = logging.getLogger(__name__)
+
+# How often idle browsers are checked for a due warm-up
+CHECK_INTERVAL = 30.0
+
+HOLDER = "warm-up"
+
+
+@dataclass
+class WarmState:
+    """Site data a browser collected while warming up."""
+
+    storage: dict
+    launched_at: Optional[float]
+    warmed_at: float
+    runs: int = 1
+
+    def to_dict(self) -> dict:
+        """Convert to dictionary for JSON serialization."""
+        return {
+            "warmed_at": self.warmed_at,
+            "runs": self.runs,
+            "cookies": len(self.storage.get("cookies") or []),
+            "origins": len(self.storage.get("origins") or []),
+        }
+
+
+@dataclass
+class Warmer:
+    """Warms up idle browsers and hands their site data to later contexts."""
+
+    runner: TaskRunner
+    relay: Relay
+    states: dict[int, WarmState] = field(default_factory=dict)
+    _task: Optional[asyncio.Task] = None
+
+    def __post_init__(self) -> None:
+        self.relay.context_params_providers.append(self._context_params)
+
+    @property
+    def pool(self) -> BrowserPool:
+        """Browser pool being warmed up."""
+        return self.runner.sessions.pool
+
+    def _state(self, instance: BrowserInstance) -> Optional[WarmState]:
+        """Get an instance's warm-up data, if it belongs to the current launch."""
+        state = self.states.get(instance.index)
+        if state is None or state.launched_at != instance.started_at:
+            return None
+        return state
+
+    def _context_params(self, connection: RelayConnection) -> dict:
+        """Inject the browser's warm-up site data into new contexts."""
+        if connection.session is not None and connection.session.options.fresh_profile:
+            return {}
+        state = self._state(connection.instance)
+        if state is None:
+            return {}
+        return {"storageState": state.storage}
+
+    def start(self) -> None:
+        """Start warming up idle browsers in the background."""
+        if self._task is None:
+            self._task = asyncio.create_task(self._loop())
+
+    async def _loop(self) -> None:
+        """Periodically warm up the browsers that are due."""
+        while True:
+            await asyncio.sleep(CHECK_INTERVAL)
+            config = self.pool.settings.warmup
+            if config is None:
+                continue
+            try:
+                await self.run_due(config)
+            except Exception as e:
+                logger.error(f"Warm-up failed: {e}")
+
+    def due(self, config: Warmup) -> list[BrowserInstance]:
+        """Idle browsers due for a warm-up, least recently warmed first, sparing the reserve."""
+        def warmed_at(instance: BrowserInstance) -> float:
+            state = self._state(instance)
+            return state.warmed_at if state is not None else 0.0
+
+        idle = self.pool.get_available_instances()
+        cutoff = time.time() - config.interval
+        due = sorted((instance for instance in idle if warmed_at(instance) <= cutoff), key=warmed_at)
+        return due[:max(0, len(idle) - config.reserve)]
+
+    async def run_due(self, config: Warmup) -> None:
+        """Warm up the due browsers one after the other."""
+        for instance in self.due(config):
+            # Clients may have taken browsers in the meantime
+            if len(self.pool.get_available_instances()) <= config.reserve:
+                return
+            if instance.is_available:
+                await self.warm(instance, config)
+
+    async def warm(self, instance: BrowserInstance, config: Warmup) -> None:
+        """Browse a few of the configured sites on a browser."""
+        session = await self.runner.sessions.acquire(
+            LeaseOptions(holder=HOLDER),
+            # Relaunching would throw away what the browser is being warmed up for
+            launch_options=dict(instance.launch_overrides),
+            index=instance.index,
+        )
+        if session is None:
+            return
+
+        visited = 0
+        try:
+            browser = await self.runner.connect(session)
+            try:
+                context = await browser.new_context()
+                page = await context.new_page()
+                for url in random.sample(config.sites, min(config.pages, len(config.sites))):
+                    try:
+                        await page.goto(url, wait_until="load", timeout=config.timeout * 1000)
+                        await page.mouse.wheel(0, random.randint(300, 1500))
+                        await asyncio.sleep(config.dwell * random.uniform(0.5, 1.5))
+                        visited += 1
+                    except Exception as e:
+                        logger.debug(f"Warm-up of browser instance {instance.index} could not load {url}: {e}")
+                storage = await context.storage_state()
+                # Read before releasing, which may relaunch the browser
+                launched_at = instance.started_at
+            finally:
+                await browser.close()
+        except Exception as e:
+            logger.warning(f"Warm-up of browser instance {instance.index} failed: {e}")
+            return
+        finally:
+            await self.runner.sessions.release(session.id)
+
+        previous = self._state(instance)
+        self.states[instance.index] = WarmState(
+            storage=storage,
+            launched_at=launched_at,
+            warmed_at=time.time(),
+            runs=previous.runs + 1 if previous is not None else 1,
+        )
+        logger.info(f"Warmed up browser instance {instance.index} on {visited} page(s)")
+        self.pool.events.publish(
+            "browser-warmed",
+            index=instance.index,
+            pages=visited,
+            cookies=len(storage.get("cookies") or []),
+        )
+
+    def report(self) -> list[dict]:
+        """Describe each browser's warm-up state."""
+        report = []
+        for instance in self.pool.instances:
+            state = self._state(instance)
+            report.append({"index": instance.index, **(state.to_dict() if state is not None else {"warmed_at": None})})
+        return report
+
+    async def close(self) -> None:
+        """Stop warming up browsers."""
+        if self._task is not None:
+            self._task.cancel()
+            await asyncio.gather(self._task, return_exceptions=True)
+            self._task = None
+
+
+def create_warmup_routes(warmer: Warmer) -> list[Route]:
+    """
+    Create routes reporting the browsers' warm-up state.
+
+    Args:
+        warmer: Warmer browsing on idle browsers
+
+    Returns:
+        List of Starlette routes
+    """
+
+    async def get_warmup(request: Request) -> Response:
+        """
+        When each browser was last warmed up and the site data it collected.
+
+        GET /warmup
+        """
+        config = warmer.pool.settings.warmup
+        return JSONResponse({"enabled": config is not None, "browsers": warmer.report()})
+
+    return [
+        Route("/warmup", get_warmup, methods=["GET"]),
+    ]
@@ -0,0 +1,125 @@
+"""
+Webhook notifications for Camoufox Connector.
+
+Delivers connector events to configured HTTP endpoints as signed JSON
+payloads, retrying failed deliveries with exponential backoff.
+
+Each request carries these headers:
+
+- ``X-Camoufox-Event``: event type
+- ``X-Camoufox-Delivery``: event ID, stable across retries
+- ``X-Camoufox-Timestamp``: Unix time the delivery attempt was signed
+- ``X-Camoufox-Signature``: ``sha256=<hex>`` HMAC of ``"<timestamp>.<body>"``
+  with the webhook secret (only when a secret is configured)
+"""
+
+from __future__ import annotations
+
+import asyncio
+import hashlib
+import hmac
+import json
+import logging
+import time
+from dataclasses import dataclass, field
+from typing import Optional
+
+import httpx
+
+from .config import WebhookConfig
+from .events import Event, EventBus
+
+logger = logging.getLogger(__name__)
+
+# Backoff before retry N is BASE * 2**N seconds, capped at MAX
+RETRY_BACKOFF_BASE = 1.0
+RETRY_BACKOFF_MAX = 60.0
+
+
+def sign_payload(secret: str, timestamp: str, body: bytes) -> str:
+    """Compute the signature header value for a payload."""
+    message = timestamp.encode() + b"." + body
+    digest = hmac.new(secret.encode(), message, hashlib.sha256).hexdigest()
+    return f"sha256={digest}"
+
+
+def verify_signature(secret: str, timestamp: str, body: bytes, signature: str) -> bool:
+    """Check a received signature header; useful for webhook receivers."""
+    return hmac.compare_digest(sign_payload(secret, timestamp, body).encode(), signature.encode())
+
+
+@dataclass
+class WebhookDispatcher:
+    """
+    Forwards events from the event bus to configured webhooks.
+
+    Deliveries run in the background so slow receivers never hold up the
+    connector.
+    """
+
+    webhooks: list[WebhookConfig]
+    timeout: float = 10.0
+    _client: Optional[httpx.AsyncClient] = None
+    _tasks: set[asyncio.Task] = field(default_factory=set)
+
+    def attach(self, bus: EventBus) -> None:
+        """Start receiving events from a bus."""
+        bus.listeners.append(self.handle)
+
+    async def handle(self, event: Event) -> None:
+        """Schedule delivery of an event to every interested webhook."""
+        for webhook in self.webhooks:
+            if webhook.events and event.type not in webhook.events:
+                continue
+            task = asyncio.create_task(self._deliver(webhook, event))
+            self._tasks.add(task)
+            task.add_done_callback(self._tasks.discard)
+
+    async def _deliver(self, webhook: WebhookConfig, event: Event) -> bool:
+        """Deliver an event to one webhook, retrying on failure."""
+        if self._client is None:
+            self._client = httpx.AsyncClient(timeout=self.timeout)
+
+        body = json.dumps(event.to_dict()).encode()
+
+        for attempt in range(webhook.max_retries + 1):
+            timestamp = str(int(time.time()))
+            headers = {
+                "Content-Type": "application/json",
+                "User-Agent": "camoufox-connector",
+                "X-Camoufox-Event": event.type,
+                "X-Camoufox-Delivery": event.id,
+                "X-Camoufox-Timestamp": timestamp,
+            }
+            if webhook.secret:
+                headers["X-Camoufox-Signature"] = sign_payload(webhook.secret, timestamp, body)
+
+            try:
+                response = await self._client.post(webhook.url, content=body, headers=headers)
+                if response.is_success:
+                    return True
+                error = f"HTTP {response.status_code}"
+            except httpx.HTTPError as e:
+                error = str(e) or type(e).__name__
+
+            if attempt < webhook.max_retries:
+                delay = min(RETRY_BACKOFF_BASE * 2 ** attempt, RETRY_BACKOFF_MAX)
+                logger.debug(
+                    f"Webhook {webhook.url} failed for {event.type} ({error}), "
+                    f"retrying in {delay:g}s"
+                )
+                await asyncio.sleep(delay)
+            else:
+                logger.warning(
+                    f"Giving up delivering {event.type} to {webhook.url} "
+                    f"after {attempt + 1} attempt(s): {error}"
+                )
+        return False
+
+    async def close(self) -> None:
+        """Cancel pending deliveries and close the HTTP client."""
+        for task in list(self._tasks):
+            task.cancel()
+        if self._client is not None:
+            await self._client.aclose()
+            self._client = None
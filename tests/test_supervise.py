@@ -0,0 +1,84 @@
+"""Stopping and restarting a browser-like process tree on every platform."""
+
+import asyncio
+import subprocess
+import sys
+
+from camoufox_connector.procutil import process_alive
+from camoufox_connector.supervise import adopt, spawn_options, stop_process_tree
+
+# A launcher stand-in: waits to be adopted like a launcher waits for its
+# kwargs, then starts a chain of children, and each prints its PID
+TREE = """
+import os, signal, subprocess, sys, time
+depth, stubborn = int(sys.argv[1]), sys.argv[2] == "stubborn"
+if stubborn:
+    signal.signal(signal.SIGTERM, signal.SIG_IGN)
+sys.stdin.readline()
+if depth:
+    subprocess.Popen([sys.executable, __file__, str(depth - 1), sys.argv[2]], stdin=subprocess.DEVNULL)
+print(os.getpid(), flush=True)
+time.sleep(60)
+"""
+
+DEPTH = 2
+
+
+async def start_tree(tmp_path, stubborn=False):
+    script = tmp_path / "tree.py"
+    script.write_text(TREE)
+    process = await asyncio.create_subprocess_exec(
+        sys.executable, str(script), str(DEPTH), "stubborn" if stubborn else "polite",
+        stdin=subprocess.PIPE, stdout=subprocess.PIPE, **spawn_options(),
+    )
+    adopt(process)
+    process.stdin.write(b"\n")
+    await process.stdin.drain()
+    pids = []
+    for _ in range(DEPTH + 1):
+        line = await asyncio.wait_for(process.stdout.readline(), timeout=30)
+        pids.append(int(line))
+    return process, pids
+
+
+async def wait_gone(pids, timeout=10.0):
+    """Whether all processes exit within a timeout."""
+    loop = asyncio.get_running_loop()
+    deadline = loop.time() + timeout
+    while loop.time() < deadline:
+        if not any(process_alive(pid) for pid in pids):
+            return True
+        await asyncio.sleep(0.1)
+    return False
+
+
+async def test_stop_tree(tmp_path):
+    process, pids = await start_tree(tmp_path)
+    assert all(process_alive(pid) for pid in pids)
+
+    assert await stop_process_tree(process)
+    assert process.returncode is not None
+    assert await wait_gone(pids)
+
+
+async def test_kill_stubborn_tree(tmp_path):
+    process, pids = await start_tree(tmp_path, stubborn=True)
+
+    exited = await stop_process_tree(process, grace=0.5)
+    # Windows ends the job at once, so only POSIX gets to wait and kill
+    assert exited == (sys.platform == "win32")
+    assert await wait_gone(pids)
+
+
+async def test_restart_tree(tmp_path):
+    process, old = await start_tree(tmp_path)
+    await stop_process_tree(process)
+
+    process, new = await start_tree(tmp_path)
+    try:
+        assert not set(old) & set(new)
+        assert all(process_alive(pid) for pid in new)
+        assert await wait_gone(old)
+    finally:
+        await stop_process_tree(process)
+    assert await wait_gone(new)